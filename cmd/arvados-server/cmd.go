@@ -25,17 +25,18 @@ var (
 		"-version":  cmd.Version,
 		"--version": cmd.Version,
 
-		"boot":               boot.Command,
-		"cloudtest":          cloudtest.Command,
-		"config-check":       config.CheckCommand,
-		"config-defaults":    config.DumpDefaultsCommand,
-		"config-dump":        config.DumpCommand,
-		"controller":         controller.Command,
-		"crunch-run":         crunchrun.Command,
-		"dispatch-cloud":     dispatchcloud.Command,
-		"install":            install.Command,
-		"recover-collection": recovercollection.Command,
-		"ws":                 ws.Command,
+		"boot":                boot.Command,
+		"cloudtest":           cloudtest.Command,
+		"config-check":        config.CheckCommand,
+		"config-defaults":     config.DumpDefaultsCommand,
+		"config-dump":         config.DumpCommand,
+		"controller":          controller.Command,
+		"crunch-run":          crunchrun.Command,
+		"dispatch-cloud":      dispatchcloud.Command,
+		"install":             install.Command,
+		"recover-collection":  recovercollection.Command,
+		"recover-lost-blocks": recovercollection.LostBlocksCommand,
+		"ws":                  ws.Command,
 	})
 )
 
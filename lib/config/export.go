@@ -63,10 +63,13 @@ var whitelist = map[string]bool{
 	"API.AsyncPermissionsUpdateInterval":           false,
 	"API.DisabledAPIs":                             false,
 	"API.KeepServiceRequestTimeout":                false,
+	"API.KeepWriteRateLimitBurst":                  false,
 	"API.MaxConcurrentRequests":                    false,
 	"API.MaxIndexDatabaseRead":                     false,
 	"API.MaxItemsPerResponse":                      true,
 	"API.MaxKeepBlobBuffers":                       false,
+	"API.MaxKeepWriteBandwidth":                    false,
+	"API.MaxKeepWriteRequestRate":                  false,
 	"API.MaxRequestAmplification":                  false,
 	"API.MaxRequestSize":                           true,
 	"API.RailsSessionSecretToken":                  false,
@@ -82,11 +85,20 @@ var whitelist = map[string]bool{
 	"Collections":                                  true,
 	"Collections.BalanceCollectionBatch":           false,
 	"Collections.BalanceCollectionBuffers":         false,
+	"Collections.BalanceFullSweepPeriod":           false,
 	"Collections.BalancePeriod":                    false,
+	"Collections.BalanceStateFile":                 false,
 	"Collections.BalanceTimeout":                   false,
+	"Collections.BalanceUpdateLimit":               false,
+	"Collections.BlobAuditLog":                     false,
 	"Collections.BlobDeleteConcurrency":            false,
+	"Collections.BlobEncryptionKeys":               false,
 	"Collections.BlobMissingReport":                false,
 	"Collections.BlobReplicateConcurrency":         false,
+	"Collections.BlobScrubBandwidth":               false,
+	"Collections.BlobScrubInterval":                false,
+	"Collections.BlobWriteFillThreshold":           false,
+	"Collections.BlobWriteStrategy":                false,
 	"Collections.BlobSigning":                      true,
 	"Collections.BlobSigningKey":                   false,
 	"Collections.BlobSigningTTL":                   true,
@@ -98,15 +110,20 @@ var whitelist = map[string]bool{
 	"Collections.DefaultReplication":               true,
 	"Collections.DefaultTrashLifetime":             true,
 	"Collections.ForwardSlashNameSubstitution":     true,
+	"Collections.KeepproxyDiskCache":               false,
+	"Collections.KeepproxyWriteBehind":             false,
 	"Collections.ManagedProperties":                true,
 	"Collections.ManagedProperties.*":              true,
 	"Collections.ManagedProperties.*.*":            true,
 	"Collections.PreserveVersionIfIdle":            true,
 	"Collections.S3FolderObjects":                  true,
+	"Collections.S3MultipartUploadTTL":             false,
 	"Collections.TrashSweepInterval":               false,
 	"Collections.TrustAllContent":                  false,
 	"Collections.WebDAVCache":                      false,
 	"Containers":                                   true,
+	"Containers.BlockCacheDirectory":               false,
+	"Containers.BlockCacheGroupShared":             false,
 	"Containers.CloudVMs":                          false,
 	"Containers.CrunchRunArgumentsList":            false,
 	"Containers.CrunchRunCommand":                  false,
@@ -117,6 +134,7 @@ var whitelist = map[string]bool{
 	"Containers.JobsAPI.GitInternalDir":            false,
 	"Containers.Logging":                           false,
 	"Containers.LogReuseDecisions":                 false,
+	"Containers.MaxBlockCacheBytes":                false,
 	"Containers.MaxComputeVMs":                     false,
 	"Containers.MaxDispatchAttempts":               false,
 	"Containers.MaxRetryAttempts":                  true,
@@ -197,6 +197,27 @@ Clusters:
       # Any HTTP requests beyond MaxConcurrentRequests will receive an
       # immediate 503 response.
       #
+      # Requests for small blocks use smaller buffers, and count
+      # against the limit only in proportion to their size. Requests
+      # that have to wait are served in the order they arrive, so a
+      # request for a large block is not starved by a steady stream
+      # of requests for small blocks. Currently
+      # only Directory volumes that are not serialized, encrypted,
+      # compressed, tiered, or erasure coded stream requests directly
+      # to and from disk; these need little buffer space, but still
+      # use a full buffer when a streamed PUT has to be retried on a
+      # different volume. Requests for all other volumes are
+      # buffered.
+      #
+      # Encrypted, compressed, tiered, and erasure coded volumes
+      # also take scratch space from the same buffers (one more
+      # buffer for each of these layers, sized to fit the block; an
+      # erasure coded volume takes one buffer per shard).
+      # Scratch space needed by a request that already holds a
+      # buffer is allocated right away, even if that exceeds the
+      # limit, so memory use can temporarily exceed
+      # MaxKeepBlobBuffers * 64MiB by that amount.
+      #
       # MaxKeepBlobBuffers should be set such that (MaxKeepBlobBuffers * 64MiB
       # * 1.1) fits comfortably in memory. On a host dedicated to running
       # Keepstore, divide total memory by 88MiB to suggest a suitable value.
@@ -204,6 +225,31 @@ Clusters:
       # kB, compute 7125440 / (88 * 1024)=79 and configure MaxBuffers: 79
       MaxKeepBlobBuffers: 128
 
+      # Maximum rate of block writes (PUT requests per second)
+      # accepted by each Keepstore server process on behalf of a
+      # single user, or 0 for no limit. Requests beyond the limit
+      # receive a 429 response with a Retry-After header.
+      #
+      # Users are identified by looking up the API token provided
+      # with each request. Requests using the same token or
+      # different tokens belonging to the same user share a limit.
+      #
+      # Keepstore reports each user's remaining allowance at
+      # /write-limits, which requires the ManagementToken.
+      MaxKeepWriteRequestRate: 0
+
+      # Maximum rate of data written (bytes per second) by each
+      # Keepstore server process on behalf of a single user, or 0 for
+      # no limit.
+      MaxKeepWriteBandwidth: 0
+
+      # Amount of time a user can exceed MaxKeepWriteRequestRate and
+      # MaxKeepWriteBandwidth after being idle. For example, with
+      # MaxKeepWriteRequestRate: 2 and KeepWriteRateLimitBurst: 10s, a
+      # user who has not written anything recently can send 20
+      # requests at once before being limited.
+      KeepWriteRateLimitBurst: 10s
+
       # API methods to disable. Disabled methods are not listed in the
       # discovery document, and respond 404 to all requests.
       # Example: {"jobs.create":{}, "pipeline_instances.create": {}}
@@ -367,6 +413,24 @@ Clusters:
       # when no such processes are running.
       BlobSigningKey: ""
 
+      # Keys used by keepstore to encrypt block data on volumes that
+      # have an EncryptionKey (see Volumes section below). Each entry
+      # maps a key name to a secret string of at least 32
+      # characters. IMPORTANT: These are site secrets. Data encrypted
+      # with a key cannot be read without it.
+      #
+      # To rotate keys, add a new entry here, change each volume's
+      # EncryptionKey to the new name, and enable the scrubber (see
+      # BlobScrubInterval). Each time the scrubber verifies a block
+      # that is stored unencrypted or with an old key, it rewrites
+      # the block using the volume's current key. After a full
+      # scrubber pass, the old key can be removed. Blocks that are
+      # still encrypted with a removed key are reported as errors
+      # when they are read, but the scrubber does not trash them, so
+      # they can be read again if the key is restored.
+      BlobEncryptionKeys:
+        SAMPLE: ""
+
       # Enable garbage collection of unreferenced blobs in Keep.
       BlobTrash: true
 
@@ -396,6 +460,64 @@ Clusters:
       # process.
       BlobReplicateConcurrency: 4
 
+      # How often each keepstore process should start a new pass of
+      # its background scrubber, which reads every block on every
+      # volume and verifies its checksum. Corrupt blocks are moved to
+      # the trash, so keep-balance will replicate a good copy from
+      # another volume. Zero disables the scrubber.
+      BlobScrubInterval: 0s
+
+      # Maximum rate at which the scrubber reads data from each
+      # volume. Zero means no limit.
+      BlobScrubBandwidth: 10MiB
+
+      # How keepstore chooses a volume when writing a new block.
+      #
+      # "roundrobin" cycles through all writable volumes.
+      #
+      # "weighted" chooses a volume at random, with probability
+      # proportional to its free space, reduced for volumes that
+      # have recently returned errors or written data more slowly
+      # (per byte) than the others. Volumes that don't report their
+      # free space, such as cloud storage volumes, are treated as
+      # having the average free space of the others.
+      BlobWriteStrategy: roundrobin
+
+      # With BlobWriteStrategy "weighted", avoid writing new blocks
+      # to volumes that are more than this fraction full, unless
+      # all writable volumes are. Zero means no limit.
+      BlobWriteFillThreshold: 0.95
+
+      # Optional audit log of block-level requests handled by
+      # keepstore (GET, HEAD, PUT, TOUCH, and DELETE). Each record
+      # includes the time, operation, block locator (without
+      # permission signature), user and token UUIDs, client IP
+      # address, number of bytes transferred, and response status.
+      # This is separate from the request log.
+      BlobAuditLog:
+        # Where to send audit records, one JSON object per record:
+        #
+        # "" disables audit logging.
+        #
+        # An absolute path, like "/var/log/arvados/keepstore-audit.log",
+        # writes to a local file, rotated according to MaxFileSize
+        # and MaxFiles.
+        #
+        # "syslog:" sends records to the local syslog daemon, and
+        # "syslog://host:514" sends them to a remote syslog server
+        # via UDP.
+        #
+        # An http:// or https:// URL sends batches of records, as a
+        # JSON array, in POST requests to the given URL.
+        Destination: ""
+
+        # When the local audit log file reaches this size, rename it
+        # (adding a ".1" suffix) and start a new one.
+        MaxFileSize: 100MiB
+
+        # Number of rotated audit log files to keep.
+        MaxFiles: 10
+
       # Default replication level for collections. This is used when a
       # collection's replication_desired attribute is nil.
       DefaultReplication: 2
@@ -429,7 +551,15 @@ Clusters:
 
       # When running keep-balance, this is the destination filename for
       # the list of lost block hashes if there are any, one per line.
-      # Updated automically during each successful run.
+      # Each block hash is followed by the portable data hashes of
+      # the collections that reference the block, separated by
+      # spaces, then a tab and the UUIDs of those collections,
+      # separated by spaces. Updated automically during each
+      # successful run.
+      #
+      # Use "arvados-server recover-lost-blocks" to recover the
+      # listed blocks from trash where possible, and list the
+      # affected collections and their owners.
       BlobMissingReport: ""
 
       # keep-balance operates periodically, i.e.: do a
@@ -464,6 +594,46 @@ Clusters:
       # long-running balancing operation.
       BalanceTimeout: 6h
 
+      # Maximum number of collections whose storage_classes_confirmed
+      # and storage_classes_confirmed_at fields keep-balance will
+      # update after a rebalancing run. Collections whose confirmed
+      # storage classes have not changed since the previous run are
+      # not updated, and do not count toward this limit. If this is
+      # zero, the fields are not updated at all.
+      BalanceUpdateLimit: 100000
+
+      # If non-zero, keep-balance runs incrementally between full
+      # sweeps: each run only retrieves the collections that have
+      # been modified since the previous run and the parts of the
+      # keepstore indexes that cover their blocks, and only
+      # re-evaluates the affected blocks. A full sweep is done when
+      # the last one started longer ago than
+      # BalanceFullSweepPeriod, and whenever the set of keep
+      # services or mounts changes.
+      #
+      # Between full sweeps, keep-balance keeps the block list of
+      # every collection (including old versions and trashed
+      # collections) in memory, using about 20 bytes per block
+      # reference.
+      #
+      # Blocks of collections that are deleted between full sweeps
+      # are not trashed until the next full sweep.
+      #
+      # If this is zero, every run is a full sweep.
+      BalanceFullSweepPeriod: 0s
+
+      # Local file where keep-balance saves its state when
+      # BalanceFullSweepPeriod is non-zero, so incremental runs can
+      # continue after keep-balance restarts. The file is rewritten
+      # after each full sweep, and is roughly as large as the
+      # keepstore indexes and collection block lists combined; the
+      # changes made by each incremental run are appended to a
+      # journal file (the same name with ".journal" added), which is
+      # merged into the state file when it grows too large. If this
+      # is empty, the state is only kept in memory, and the first
+      # run after a restart is a full sweep.
+      BalanceStateFile: ""
+
       # Default lifetime for ephemeral collections: 2 weeks. This must not
       # be less than BlobSigningTTL.
       DefaultTrashLifetime: 336h
@@ -506,6 +676,17 @@ Clusters:
       # Include "folder objects" in S3 ListObjects responses.
       S3FolderObjects: true
 
+      # Multipart uploads initiated by S3 clients are stored in
+      # temporary collections, in each user's "S3 multipart uploads"
+      # project, until they are completed. If no parts are uploaded
+      # for this long, the upload's temporary collection is trashed
+      # and the upload can no longer be completed. Each
+      # part's temporary collection is trashed this long after the
+      # part was uploaded, but can still be used to complete the
+      # upload until it is deleted. Zero means temporary collections
+      # are never trashed automatically.
+      S3MultipartUploadTTL: 24h
+
       # Managed collection properties. At creation time, if the client didn't
       # provide the listed keys, they will be automatically populated following
       # one of the following behaviors:
@@ -541,14 +722,79 @@ Clusters:
       # * MaxCollectionBytes: Approximate memory limit for collection cache.
       # * MaxPermissionEntries: Maximum number of permission cache entries.
       # * MaxUUIDEntries: Maximum number of UUID cache entries.
+      # * BlockCacheDirectory: If not empty, blocks retrieved from
+      #   Keep are also cached in files in this directory, which can
+      #   be shared with other processes on the same host (see the
+      #   -block-cache-dir option of crunch-run and arvados-client
+      #   mount). Note any process that can read this directory can
+      #   read the cached data.
+      # * MaxBlockCacheBytes: Approximate size limit for
+      #   BlockCacheDirectory.
+      # * BlockCacheGroupShared: Make files and directories created
+      #   in BlockCacheDirectory readable and writable by their group
+      #   (see Containers.BlockCacheGroupShared).
       WebDAVCache:
         TTL: 300s
         UUIDTTL: 5s
-        MaxBlockEntries:      4
-        MaxCollectionEntries: 1000
-        MaxCollectionBytes:   100000000
-        MaxPermissionEntries: 1000
-        MaxUUIDEntries:       1000
+        MaxBlockEntries:       4
+        MaxCollectionEntries:  1000
+        MaxCollectionBytes:    100000000
+        MaxPermissionEntries:  1000
+        MaxUUIDEntries:        1000
+        BlockCacheDirectory:   ""
+        MaxBlockCacheBytes:    10GiB
+        BlockCacheGroupShared: false
+
+      # Local disk cache for keepproxy. Blocks retrieved from
+      # keepstore servers are saved in Directory, and subsequent
+      # requests for the same blocks are served from there without
+      # contacting the keepstore servers. This is useful where
+      # keepproxy reaches the keepstore servers over a slow network
+      # connection.
+      #
+      # The least recently used blocks are deleted as needed to keep
+      # the total size of the cached blocks under MaxSize.
+      #
+      # Blocks are only served from the cache to clients that provide
+      # a valid permission signature (see BlobSigning).
+      #
+      # If Directory is empty, the disk cache is disabled.
+      KeepproxyDiskCache:
+        Directory: ""
+        MaxSize: 10GiB
+
+      # Write-behind mode for keepproxy. Blocks uploaded through
+      # keepproxy are saved in Directory, and the upload is
+      # acknowledged immediately, with a signed locator and an
+      # X-Keep-Replicas-Pending response header. Keepproxy then
+      # writes the blocks to keepstore servers in the background,
+      # retrying failed writes every RetryInterval, and deletes them
+      # from Directory when the desired replication is achieved.
+      # Blocks still in Directory when keepproxy restarts are written
+      # after restarting.
+      #
+      # This is useful where keepproxy reaches the keepstore servers
+      # over a slow network connection. Note that until a block is
+      # written to keepstore servers, it is only stored on the
+      # keepproxy host, and can only be retrieved through keepproxy.
+      #
+      # The X-Keep-Replicas-Stored response header also reports the
+      # pending replicas, because clients that don't know about
+      # X-Keep-Replicas-Pending would otherwise treat the upload as
+      # failed. Clients that need to know how many replicas are
+      # actually stored should subtract X-Keep-Replicas-Pending.
+      # Keepproxy's own log reports 0 replicas written for these
+      # uploads.
+      #
+      # When the blocks waiting in Directory reach MaxSize, new
+      # uploads are written to keepstore servers before being
+      # acknowledged, as usual.
+      #
+      # If Directory is empty, write-behind mode is disabled.
+      KeepproxyWriteBehind:
+        Directory: ""
+        MaxSize: 10GiB
+        RetryInterval: 1m
 
     Login:
       # One of the following mechanisms (SSO, Google, PAM, LDAP, or
@@ -830,6 +1076,26 @@ Clusters:
       # Example: ["--cgroup-parent-subsystem=memory"]
       CrunchRunArgumentsList: []
 
+      # If not empty, crunch-run caches blocks retrieved from Keep
+      # in files in this directory on the compute node (the
+      # dispatcher passes it to crunch-run as -block-cache-dir). The
+      # same directory can be used by arvados-client mount and
+      # keep-web (Collections.WebDAVCache.BlockCacheDirectory) on
+      # the same host.
+      BlockCacheDirectory: ""
+
+      # Approximate size limit for BlockCacheDirectory.
+      MaxBlockCacheBytes: 10GiB
+
+      # If true, files and directories created in BlockCacheDirectory
+      # are readable and writable by their group (mode 0660 and
+      # 0770) so processes running as different users can share the
+      # cache. In that case, BlockCacheDirectory should be created
+      # with the setgid bit set and a group that all of those users
+      # belong to. If false, cached files are only accessible by the
+      # user that wrote them.
+      BlockCacheGroupShared: false
+
       # Extra RAM to reserve on the node, in addition to
       # the amount specified in the container's RuntimeConstraints
       ReserveExtraRAM: 256MiB
@@ -1144,6 +1410,35 @@ Clusters:
         StorageClasses:
           default: true
           SAMPLE: true
+
+        # If non-empty, keepstore encrypts block data before writing
+        # it to this volume, using the named key from
+        # Collections.BlobEncryptionKeys. Block locators and sizes
+        # are not affected, so clients and keep-balance work the same
+        # way with encrypted and unencrypted volumes.
+        #
+        # Data is encrypted and authenticated with AES-256-GCM, so a
+        # block that has been modified on the backing storage is
+        # reported as corrupt. Each stored block is 40 bytes larger
+        # than the original.
+        EncryptionKey: ""
+
+        # Cost of storing data on this volume, per GiB per month, in
+        # any currency unit (use the same unit for all volumes). If
+        # any volume has a non-zero StorageCost, keep-balance keeps
+        # the first replica of each block in the usual rendezvous
+        # position (so clients find it quickly), but stores
+        # additional replicas on the cheapest suitable volumes. It
+        # also reports the projected monthly storage cost before and
+        # after each balancing run.
+        StorageCost: 0
+
+        # Cost of reading data from this volume, per GiB, in the same
+        # currency unit as StorageCost. When keep-balance makes a new
+        # replica of a block, it copies the existing replica with the
+        # lowest EgressCost.
+        EgressCost: 0
+
         Driver: s3
         DriverParameters:
           # for s3 driver -- see
@@ -1186,6 +1481,68 @@ Clusters:
           WriteRaceInterval: 15s
           WriteRacePollTime: 1s
 
+          # for GCS driver: Bucket, Endpoint, IndexPageSize, and
+          # RequestTimeout (above) also apply. ServiceAccountKey is
+          # the content of a JSON key file; if empty, keepstore uses
+          # the instance's default service account.
+          ServiceAccountKey: ""
+
+          # for ErasureCoded driver: each block is split into
+          # DataShards pieces, and ParityShards Reed-Solomon parity
+          # pieces are added. Each piece is stored on one of the
+          # backing volumes listed in Shards (which must have
+          # DataShards+ParityShards entries, each with its own
+          # Driver and DriverParameters). Blocks remain readable
+          # when up to ParityShards backing volumes are unavailable,
+          # and missing or corrupt pieces are rewritten when a block
+          # is read. If Replication is not set for the ErasureCoded
+          # volume, it is reported as ParityShards+1 times the lowest
+          # Replication of the backing volumes. Set it lower if the
+          # backing volumes are not independent enough that losing
+          # more than ParityShards of them at once is as unlikely as
+          # losing that many separate replicas. EncryptionKey and
+          # Compression can be set on the ErasureCoded volume, but
+          # not on its backing volumes.
+          DataShards: 4
+          ParityShards: 2
+          Shards: []
+
+          # for Tiered driver: new blocks are written to the Fast
+          # volume. Every DemoteInterval, blocks on the Fast volume
+          # whose timestamps are older than DemoteAge (which must
+          # not be less than Collections.BlobSigningTTL) are moved
+          # to the Slow volume. Blocks that are read from the Slow
+          # volume PromoteReads times by clients (reads by the
+          # scrubber and other internal reads are not counted) are
+          # copied back to the Fast volume, and are not demoted
+          # again until DemoteAge after promotion. If the Fast
+          # volume uses the Directory driver, demoted blocks are
+          # deleted from it right away; with other drivers, demotion
+          # requires Collections.BlobTrash, and demoted blocks stay
+          # in the Fast volume's trash until BlobTrashLifetime
+          # expires. Demoted blocks keep their
+          # timestamps if the Slow volume uses the Directory driver;
+          # with other drivers, demotion counts as a write, so
+          # unreferenced blocks are kept for another BlobSigningTTL.
+          # Likewise, promoted blocks keep their timestamps if the
+          # Fast volume uses the Directory driver.
+          # Fast and Slow are volume configs with their own Driver
+          # and DriverParameters. EncryptionKey and Compression can
+          # be set on the Tiered volume, but not on Fast or Slow.
+          Fast:
+            Driver: Directory
+            DriverParameters:
+              SAMPLE: ""
+            Replication: 1
+          Slow:
+            Driver: S3
+            DriverParameters:
+              SAMPLE: ""
+            Replication: 2
+          DemoteAge: 720h
+          DemoteInterval: 1h
+          PromoteReads: 1
+
           # for local directory driver -- see
           # https://doc.arvados.org/install/configure-fs-storage.html
           Root: /var/lib/arvados/keep-data
@@ -1206,6 +1563,20 @@ Clusters:
           # should leave this alone.
           Serialize: false
 
+          # For all drivers: compress block data before writing it
+          # to the volume. Supported values are "gzip" and "zstd".
+          # Blocks that don't get smaller are stored uncompressed
+          # (with a small header, like compressed blocks), and
+          # blocks written before compression was enabled are
+          # still readable. Index responses report the uncompressed
+          # block size. To get the size of a block that hasn't been
+          # accessed since keepstore started, the first index
+          # request reads the beginning of the block (using a ranged
+          # request on S3, Azure, and GCS volumes; ErasureCoded
+          # volumes read the whole block), so it can be slow on a
+          # large volume.
+          Compression: ""
+
     Mail:
       MailchimpAPIKey: ""
       MailchimpListID: ""
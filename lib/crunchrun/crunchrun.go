@@ -1782,6 +1782,9 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 		`Set networking mode for container.  Corresponds to Docker network mode (--net).
     	`)
 	memprofile := flags.String("memprofile", "", "write memory profile to `file` after running container")
+	blockCacheDir := flags.String("block-cache-dir", "", "cache blocks read from Keep in files in `dir`, which can be shared with other processes")
+	blockCacheSize := flags.Int64("block-cache-size", 0, "size limit (in bytes) for -block-cache-dir (default 10 GiB)")
+	blockCacheGroupShared := flags.Bool("block-cache-group-shared", false, "make files in -block-cache-dir readable and writable by their group")
 	flags.Duration("check-containerd", 0, "Ignored. Exists for compatibility with older versions.")
 
 	ignoreDetachFlag := false
@@ -1849,7 +1852,12 @@ func (command) RunCommand(prog string, args []string, stdin io.Reader, stdout, s
 		log.Printf("%s: %v", containerId, kcerr)
 		return 1
 	}
-	kc.BlockCache = &keepclient.BlockCache{MaxBlocks: 2}
+	kc.BlockCache = &keepclient.BlockCache{
+		MaxBlocks:    2,
+		Dir:          *blockCacheDir,
+		MaxDiskBytes: *blockCacheSize,
+		GroupShared:  *blockCacheGroupShared,
+	}
 	kc.Retries = 4
 
 	// API version 1.21 corresponds to Docker 1.9, which is currently the
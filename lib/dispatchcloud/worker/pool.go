@@ -103,6 +103,7 @@ func NewPool(logger logrus.FieldLogger, arvClient *arvados.Client, reg *promethe
 		newExecutor:                    newExecutor,
 		bootProbeCommand:               cluster.Containers.CloudVMs.BootProbeCommand,
 		runnerSource:                   cluster.Containers.CloudVMs.DeployRunnerBinary,
+		runnerArgs:                     BlockCacheArgs(cluster.Containers),
 		imageID:                        cloud.ImageID(cluster.Containers.CloudVMs.ImageID),
 		instanceTypes:                  cluster.InstanceTypes,
 		maxProbesPerSecond:             cluster.Containers.CloudVMs.MaxProbesPerSecond,
@@ -141,6 +142,7 @@ type Pool struct {
 	newExecutor                    func(cloud.Instance) Executor
 	bootProbeCommand               string
 	runnerSource                   string
+	runnerArgs                     []string
 	imageID                        cloud.ImageID
 	instanceTypes                  map[string]arvados.InstanceType
 	syncInterval                   time.Duration
@@ -8,9 +8,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"syscall"
 	"time"
 
+	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"github.com/sirupsen/logrus"
 )
 
@@ -21,6 +23,7 @@ type remoteRunner struct {
 	executor      Executor
 	envJSON       json.RawMessage
 	runnerCmd     string
+	runnerArgs    []string
 	remoteUser    string
 	timeoutTERM   time.Duration
 	timeoutSignal time.Duration
@@ -61,6 +64,7 @@ func newRemoteRunner(uuid string, wkr *worker) *remoteRunner {
 		executor:      wkr.executor,
 		envJSON:       envJSON,
 		runnerCmd:     wkr.wp.runnerCmd,
+		runnerArgs:    wkr.wp.runnerArgs,
 		remoteUser:    wkr.instance.RemoteUser(),
 		timeoutTERM:   wkr.wp.timeoutTERM,
 		timeoutSignal: wkr.wp.timeoutSignal,
@@ -72,13 +76,33 @@ func newRemoteRunner(uuid string, wkr *worker) *remoteRunner {
 	return rr
 }
 
+// BlockCacheArgs returns the crunch-run command line arguments
+// that enable the block cache configured in cc, if any.
+func BlockCacheArgs(cc arvados.ContainersConfig) []string {
+	if cc.BlockCacheDirectory == "" {
+		return nil
+	}
+	args := []string{
+		"-block-cache-dir=" + cc.BlockCacheDirectory,
+		fmt.Sprintf("-block-cache-size=%d", int64(cc.MaxBlockCacheBytes)),
+	}
+	if cc.BlockCacheGroupShared {
+		args = append(args, "-block-cache-group-shared")
+	}
+	return args
+}
+
 // Start a crunch-run process on the remote host.
 //
 // Start does not return any error encountered. The caller should
 // assume the remote process _might_ have started, at least until it
 // probes the worker and finds otherwise.
 func (rr *remoteRunner) Start() {
-	cmd := rr.runnerCmd + " --detach --stdin-env '" + rr.uuid + "'"
+	cmd := rr.runnerCmd + " --detach --stdin-env"
+	for _, arg := range rr.runnerArgs {
+		cmd += " '" + strings.Replace(arg, "'", "'\\''", -1) + "'"
+	}
+	cmd += " '" + rr.uuid + "'"
 	if rr.remoteUser != "root" {
 		cmd = "sudo " + cmd
 	}
@@ -282,14 +282,38 @@ type stubResp struct {
 	err    error
 }
 
+func (suite *WorkerSuite) TestStartWithBlockCache(c *check.C) {
+	c.Check(BlockCacheArgs(arvados.ContainersConfig{}), check.HasLen, 0)
+
+	exr := &stubExecutor{}
+	rr := &remoteRunner{
+		uuid:       "zzzzz-dz642-aaaaaaaaaaaaaaa",
+		executor:   exr,
+		runnerCmd:  "crunch-run",
+		remoteUser: "root",
+		runnerArgs: BlockCacheArgs(arvados.ContainersConfig{
+			BlockCacheDirectory:   "/var/cache/it's here",
+			MaxBlockCacheBytes:    1 << 30,
+			BlockCacheGroupShared: true,
+		}),
+		logger: ctxlog.TestLogger(c),
+	}
+	rr.Start()
+	c.Check(exr.commands, check.DeepEquals, []string{
+		`crunch-run --detach --stdin-env '-block-cache-dir=/var/cache/it'\''s here' '-block-cache-size=1073741824' '-block-cache-group-shared' 'zzzzz-dz642-aaaaaaaaaaaaaaa'`,
+	})
+}
+
 type stubExecutor struct {
 	response map[string]stubResp
 	stdin    bytes.Buffer
+	commands []string
 }
 
 func (se *stubExecutor) SetTarget(cloud.ExecutorTarget) {}
 func (se *stubExecutor) Close()                         {}
 func (se *stubExecutor) Execute(env map[string]string, cmd string, stdin io.Reader) (stdout, stderr []byte, err error) {
+	se.commands = append(se.commands, cmd)
 	if stdin != nil {
 		_, err = io.Copy(&se.stdin, stdin)
 		if err != nil {
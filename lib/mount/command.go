@@ -42,6 +42,9 @@ func (c *cmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, st
 	ro := flags.Bool("ro", false, "read-only")
 	experimental := flags.Bool("experimental", false, "acknowledge this is an experimental command, and should not be used in production (required)")
 	blockCache := flags.Int("block-cache", 4, "read cache size (number of 64MiB blocks)")
+	blockCacheDir := flags.String("block-cache-dir", "", "also cache blocks in files in `dir`, which can be shared with other processes")
+	blockCacheSize := flags.Int64("block-cache-size", 0, "size limit (in bytes) for -block-cache-dir (default 10 GiB)")
+	blockCacheGroupShared := flags.Bool("block-cache-group-shared", false, "make files in -block-cache-dir readable and writable by their group")
 	pprof := flags.String("pprof", "", "serve Go profile data at `[addr]:port`")
 	err := flags.Parse(args)
 	if err != nil {
@@ -69,7 +72,12 @@ func (c *cmd) RunCommand(prog string, args []string, stdin io.Reader, stdout, st
 		logger.Print(err)
 		return 1
 	}
-	kc.BlockCache = &keepclient.BlockCache{MaxBlocks: *blockCache}
+	kc.BlockCache = &keepclient.BlockCache{
+		MaxBlocks:    *blockCache,
+		Dir:          *blockCacheDir,
+		MaxDiskBytes: *blockCacheSize,
+		GroupShared:  *blockCacheGroupShared,
+	}
 	host := fuse.NewFileSystemHost(&keepFS{
 		Client:     client,
 		KeepClient: kc,
@@ -256,6 +256,55 @@ func (rcvr recoverer) ensureSafe(ctx context.Context, logger logrus.FieldLogger,
 	}
 }
 
+// keepServices returns the keepstore services, i.e., all keep
+// services other than proxies.
+func (rcvr recoverer) keepServices() ([]arvados.KeepService, error) {
+	var services []arvados.KeepService
+	err := rcvr.client.EachKeepService(func(svc arvados.KeepService) error {
+		if svc.ServiceType == "proxy" {
+			rcvr.logger.WithField("service", svc).Debug("ignore proxy service")
+		} else {
+			services = append(services, svc)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting list of keep services: %s", err)
+	}
+	rcvr.logger.WithField("services", services).Debug("got list of services")
+	return services, nil
+}
+
+// Finds the given block on one of the given services, untrashing it
+// if necessary, and ensures it won't be eligible for trashing before
+// blobsigexp (see ensureSafe). Returns false if the block cannot be
+// found or untrashed on any service.
+func (rcvr recoverer) recoverBlock(ctx context.Context, blk string, services []arvados.KeepService, blobsigttl time.Duration, blobsigexp time.Time) bool {
+	logger := rcvr.logger.WithField("block", blk)
+	for _, untrashing := range []bool{false, true} {
+		for _, svc := range services {
+			logger := logger.WithField("service", fmt.Sprintf("%s:%d", svc.ServiceHost, svc.ServicePort))
+			if untrashing {
+				if err := svc.Untrash(ctx, rcvr.client, blk); err != nil {
+					logger.WithError(err).Debug("untrash failed")
+					continue
+				}
+				logger.Info("untrashed")
+			}
+			err := rcvr.ensureSafe(ctx, logger, blk, svc, blobsigttl, blobsigexp)
+			if err == errNotFound {
+				logger.Debug(err)
+			} else if err != nil {
+				logger.Error(err)
+			} else {
+				return true
+			}
+		}
+	}
+	logger.Debug("unrecoverable")
+	return false
+}
+
 // Untrash and update GC timestamps (as needed) on blocks referenced
 // by the given manifest, save a new collection and return the new
 // collection's UUID.
@@ -274,19 +323,10 @@ func (rcvr recoverer) RecoverManifest(mtxt string) (string, error) {
 	}
 	go close(todo)
 
-	var services []arvados.KeepService
-	err = rcvr.client.EachKeepService(func(svc arvados.KeepService) error {
-		if svc.ServiceType == "proxy" {
-			rcvr.logger.WithField("service", svc).Debug("ignore proxy service")
-		} else {
-			services = append(services, svc)
-		}
-		return nil
-	})
+	services, err := rcvr.keepServices()
 	if err != nil {
-		return "", fmt.Errorf("error getting list of keep services: %s", err)
+		return "", err
 	}
-	rcvr.logger.WithField("services", services).Debug("got list of services")
 
 	// blobsigexp is our deadline for saving the rescued
 	// collection. This must be less than BlobSigningTTL
@@ -317,32 +357,9 @@ func (rcvr recoverer) RecoverManifest(mtxt string) (string, error) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-		nextblk:
 			for idx := range todo {
 				blk := strings.SplitN(string(blks[idx]), "+", 2)[0]
-				logger := rcvr.logger.WithField("block", blk)
-				for _, untrashing := range []bool{false, true} {
-					for _, svc := range services {
-						logger := logger.WithField("service", fmt.Sprintf("%s:%d", svc.ServiceHost, svc.ServicePort))
-						if untrashing {
-							if err := svc.Untrash(ctx, rcvr.client, blk); err != nil {
-								logger.WithError(err).Debug("untrash failed")
-								continue
-							}
-							logger.Info("untrashed")
-						}
-						err := rcvr.ensureSafe(ctx, logger, blk, svc, blobsigttl, blobsigexp)
-						if err == errNotFound {
-							logger.Debug(err)
-						} else if err != nil {
-							logger.Error(err)
-						} else {
-							blkFound[idx] = true
-							continue nextblk
-						}
-					}
-				}
-				logger.Debug("unrecoverable")
+				blkFound[idx] = rcvr.recoverBlock(ctx, blk, services, blobsigttl, blobsigexp)
 			}
 		}()
 	}
@@ -46,11 +46,53 @@ func (*Suite) TestUnrecoverableBlock(c *check.C) {
 	c.Check(stderr.String(), check.Matches, `(?ms).*msg="recovery failed".*`)
 }
 
+func (*Suite) TestUnrecoverableLostBlock(c *check.C) {
+	tmp := c.MkDir()
+	report := tmp + "/lost-blocks.txt"
+	ioutil.WriteFile(report, []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa "+arvadostest.FooCollectionPDH+"\t"+arvadostest.FooCollection+"\n"), 0777)
+	var stdout, stderr bytes.Buffer
+	exitcode := LostBlocksCommand.RunCommand("recovercollection.test", []string{"-log-level=debug", report}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 1)
+	c.Log(stderr.String())
+	c.Check(stderr.String(), check.Matches, `(?ms).*msg="untrash failed" block=aaaaa.*`)
+	c.Check(stderr.String(), check.Matches, `(?ms).*msg=unrecoverable block=aaaaa.*`)
+	c.Check(stdout.String(), check.Matches, `aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa\t`+arvadostest.FooCollection+`\t`+arvadostest.FooCollectionPDH+`\t`+arvadostest.ActiveUserUUID+`\t[^\t]+\t[^\t]+\n`)
+}
+
 func (*Suite) TestUntrashAndTouchBlock(c *check.C) {
 	tmp := c.MkDir()
 	mfile := tmp + "/manifest"
 	ioutil.WriteFile(mfile, []byte(". dcd0348cb2532ee90c99f1b846efaee7+13 0:13:test.txt\n"), 0777)
+	datadirs := placeTrashedBlock(c, "dcd0348cb2532ee90c99f1b846efaee7", []byte("undelete test"))
+
+	var stdout, stderr bytes.Buffer
+	exitcode := Command.RunCommand("recovercollection.test", []string{"-log-level=debug", mfile}, &bytes.Buffer{}, &stdout, &stderr)
+	c.Check(exitcode, check.Equals, 0)
+	c.Check(stdout.String(), check.Matches, `zzzzz-4zz18-.{15}\n`)
+	c.Log(stderr.String())
+	c.Check(stderr.String(), check.Matches, `(?ms).*msg=untrashed block=dcd0348.*`)
+	c.Check(stderr.String(), check.Matches, `(?ms).*msg="updated timestamp" block=dcd0348.*`)
 
+	found := false
+	for _, datadir := range datadirs {
+		buf, err := ioutil.ReadFile(datadir + "/dcd/dcd0348cb2532ee90c99f1b846efaee7")
+		if err == nil {
+			found = true
+			c.Check(buf, check.DeepEquals, []byte("undelete test"))
+			fi, err := os.Stat(datadir + "/dcd/dcd0348cb2532ee90c99f1b846efaee7")
+			if c.Check(err, check.IsNil) {
+				c.Logf("recovered block's modtime is %s", fi.ModTime())
+				c.Check(time.Now().Sub(fi.ModTime()) < time.Hour, check.Equals, true)
+			}
+		}
+	}
+	c.Check(found, check.Equals, true)
+}
+
+// placeTrashedBlock deletes the given block from the keepstore
+// volumes, and puts a backdated trashed copy in each of them. It
+// returns the keepstore data directories.
+func placeTrashedBlock(c *check.C, hash string, data []byte) []string {
 	logger := ctxlog.TestLogger(c)
 	loader := config.NewLoader(&bytes.Buffer{}, logger)
 	cfg, err := loader.Load()
@@ -66,7 +108,7 @@ func (*Suite) TestUntrashAndTouchBlock(c *check.C) {
 		c.Assert(err, check.IsNil)
 		if params.Root != "" {
 			datadirs = append(datadirs, params.Root)
-			err := os.Remove(params.Root + "/dcd/dcd0348cb2532ee90c99f1b846efaee7")
+			err := os.Remove(params.Root + "/" + hash[:3] + "/" + hash)
 			if err != nil && !os.IsNotExist(err) {
 				c.Error(err)
 			}
@@ -84,34 +126,37 @@ func (*Suite) TestUntrashAndTouchBlock(c *check.C) {
 			continue
 		}
 		c.Logf("placing backdated trashed block in datadir %q", datadir)
-		trashfile := datadir + "/dcd/dcd0348cb2532ee90c99f1b846efaee7.trash.999999999"
-		os.Mkdir(datadir+"/dcd", 0777)
-		err = ioutil.WriteFile(trashfile, []byte("undelete test"), 0777)
+		trashfile := datadir + "/" + hash[:3] + "/" + hash + ".trash.999999999"
+		os.Mkdir(datadir+"/"+hash[:3], 0777)
+		err = ioutil.WriteFile(trashfile, data, 0777)
 		c.Assert(err, check.IsNil)
 		t := time.Now().Add(-time.Hour * 24 * 365)
 		err = os.Chtimes(trashfile, t, t)
 		c.Assert(err, check.IsNil)
 	}
+	return datadirs
+}
+
+func (*Suite) TestUntrashLostBlock(c *check.C) {
+	tmp := c.MkDir()
+	report := tmp + "/lost-blocks.txt"
+	ioutil.WriteFile(report, []byte("f27a016312b6024a9f53f308ee5dfb5d "+arvadostest.FooCollectionPDH+"\t"+arvadostest.FooCollection+"\n"), 0777)
+	datadirs := placeTrashedBlock(c, "f27a016312b6024a9f53f308ee5dfb5d", []byte("lost block test"))
 
 	var stdout, stderr bytes.Buffer
-	exitcode := Command.RunCommand("recovercollection.test", []string{"-log-level=debug", mfile}, &bytes.Buffer{}, &stdout, &stderr)
+	exitcode := LostBlocksCommand.RunCommand("recovercollection.test", []string{"-log-level=debug", report}, &bytes.Buffer{}, &stdout, &stderr)
 	c.Check(exitcode, check.Equals, 0)
-	c.Check(stdout.String(), check.Matches, `zzzzz-4zz18-.{15}\n`)
+	c.Check(stdout.String(), check.Equals, "")
 	c.Log(stderr.String())
-	c.Check(stderr.String(), check.Matches, `(?ms).*msg=untrashed block=dcd0348.*`)
-	c.Check(stderr.String(), check.Matches, `(?ms).*msg="updated timestamp" block=dcd0348.*`)
+	c.Check(stderr.String(), check.Matches, `(?ms).*msg=untrashed block=f27a016.*`)
+	c.Check(stderr.String(), check.Matches, `(?ms).*msg="finished recovery attempt" recovered=1 unrecovered=0.*`)
 
 	found := false
 	for _, datadir := range datadirs {
-		buf, err := ioutil.ReadFile(datadir + "/dcd/dcd0348cb2532ee90c99f1b846efaee7")
+		buf, err := ioutil.ReadFile(datadir + "/f27/f27a016312b6024a9f53f308ee5dfb5d")
 		if err == nil {
 			found = true
-			c.Check(buf, check.DeepEquals, []byte("undelete test"))
-			fi, err := os.Stat(datadir + "/dcd/dcd0348cb2532ee90c99f1b846efaee7")
-			if c.Check(err, check.IsNil) {
-				c.Logf("recovered block's modtime is %s", fi.ModTime())
-				c.Check(time.Now().Sub(fi.ModTime()) < time.Hour, check.Equals, true)
-			}
+			c.Check(buf, check.DeepEquals, []byte("lost block test"))
 		}
 	}
 	c.Check(found, check.Equals, true)
@@ -0,0 +1,357 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package recovercollection
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/config"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/sirupsen/logrus"
+)
+
+var LostBlocksCommand lostBlocksCommand
+
+type lostBlocksCommand struct{}
+
+var (
+	blockHashRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	pdhRegexp       = regexp.MustCompile(`^[0-9a-f]{32}\+\d+$`)
+	collUUIDRegexp  = regexp.MustCompile(`^[0-9a-z]{5}-4zz18-[0-9a-z]{15}$`)
+)
+
+func (lostBlocksCommand) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	logger := ctxlog.New(stderr, "text", "info")
+	defer func() {
+		if err != nil {
+			logger.WithError(err).Error("fatal")
+		}
+		logger.Info("exiting")
+	}()
+
+	loader := config.NewLoader(stdin, logger)
+	loader.SkipLegacy = true
+
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), `Usage:
+	%s [options ...] [/path/to/lost-blocks.txt]
+
+	This program attempts to recover the blocks listed in a
+	keep-balance lost blocks report (by default, the file named by
+	Collections.BlobMissingReport in the cluster config).
+
+	Each block is searched for on all keepstore volumes, including
+	their trash, and untrashed if necessary. Recovered blocks are
+	protected from garbage collection in the same way as
+	recover-collection.
+
+	For each block that cannot be recovered, one line is printed
+	on stdout for each collection that references it, with the
+	following tab-separated fields:
+
+	* block hash
+	* collection UUID (empty if only the portable data hash is known)
+	* collection portable data hash
+	* owner UUID
+	* owner name (user's email address or project name)
+	* collection name
+
+	Exit status will be zero if all listed blocks are recovered.
+Options:
+`, prog)
+		flags.PrintDefaults()
+	}
+	loader.SetupFlags(flags)
+	loglevel := flags.String("log-level", "info", "logging level (debug, info, ...)")
+	err = flags.Parse(args)
+	if err == flag.ErrHelp {
+		err = nil
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	if len(flags.Args()) > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	lvl, err := logrus.ParseLevel(*loglevel)
+	if err != nil {
+		return 2
+	}
+	logger.SetLevel(lvl)
+
+	cfg, err := loader.Load()
+	if err != nil {
+		return 1
+	}
+	cluster, err := cfg.GetCluster("")
+	if err != nil {
+		return 1
+	}
+	client, err := arvados.NewClientFromConfig(cluster)
+	if err != nil {
+		return 1
+	}
+	client.AuthToken = cluster.SystemRootToken
+	rcvr := recoverer{
+		client:  client,
+		cluster: cluster,
+		logger:  logger,
+	}
+
+	reportPath := cluster.Collections.BlobMissingReport
+	if len(flags.Args()) > 0 {
+		reportPath = flags.Arg(0)
+	}
+	if reportPath == "" {
+		err = fmt.Errorf("no report file specified, and Collections.BlobMissingReport is not configured")
+		return 2
+	}
+	f, err := os.Open(reportPath)
+	if err != nil {
+		return 1
+	}
+	defer f.Close()
+	lost, err := parseLostBlocks(f)
+	if err != nil {
+		err = fmt.Errorf("error reading %s: %s", reportPath, err)
+		return 1
+	}
+	logger.WithField("blocks", len(lost)).Info("read lost blocks report")
+
+	unrecovered, err := rcvr.RecoverLostBlocks(lost)
+	if err != nil {
+		return 1
+	}
+	logger.WithField("recovered", len(lost)-len(unrecovered)).WithField("unrecovered", len(unrecovered)).Info("finished recovery attempt")
+	if len(unrecovered) == 0 {
+		return 0
+	}
+	err = rcvr.reportUnrecovered(context.Background(), stdout, unrecovered)
+	return 1
+}
+
+// A lostBlock is an entry in a keep-balance lost blocks report.
+type lostBlock struct {
+	Hash  string
+	PDHs  []string
+	UUIDs []string
+}
+
+// parseLostBlocks parses a keep-balance lost blocks report. Each
+// line has a block hash followed by the portable data hashes of the
+// collections that reference it, separated by spaces, and
+// optionally a tab followed by the UUIDs of those collections,
+// separated by spaces. Reports written by older versions of
+// keep-balance have no UUIDs.
+func parseLostBlocks(r io.Reader) ([]lostBlock, error) {
+	var lost []lostBlock
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<26)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.SplitN(scanner.Text(), "\t", 2)
+		fields := strings.Fields(line[0])
+		if len(fields) == 0 {
+			continue
+		}
+		if !blockHashRegexp.MatchString(fields[0]) {
+			return nil, fmt.Errorf("line %d: invalid block hash %q", lineno, fields[0])
+		}
+		blk := lostBlock{Hash: fields[0]}
+		for _, pdh := range fields[1:] {
+			if !pdhRegexp.MatchString(pdh) {
+				return nil, fmt.Errorf("line %d: invalid portable data hash %q", lineno, pdh)
+			}
+			blk.PDHs = append(blk.PDHs, pdh)
+		}
+		if len(line) > 1 {
+			for _, uuid := range strings.Fields(line[1]) {
+				if !collUUIDRegexp.MatchString(uuid) {
+					return nil, fmt.Errorf("line %d: invalid collection UUID %q", lineno, uuid)
+				}
+				blk.UUIDs = append(blk.UUIDs, uuid)
+			}
+		}
+		lost = append(lost, blk)
+	}
+	return lost, scanner.Err()
+}
+
+// RecoverLostBlocks finds and untrashes (as needed) the given
+// blocks, and protects them from garbage collection. It returns the
+// blocks that could not be recovered.
+func (rcvr recoverer) RecoverLostBlocks(lost []lostBlock) ([]lostBlock, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	services, err := rcvr.keepServices()
+	if err != nil {
+		return nil, err
+	}
+
+	// Unlike RecoverManifest, we don't need to save a collection
+	// before a deadline, so this only needs to be long enough to
+	// give keep-balance a chance to see the recovered blocks in
+	// its next run.
+	blobsigttl := rcvr.cluster.Collections.BlobSigningTTL.Duration()
+	blobsigexp := time.Now().Add(blobsigttl / 2)
+
+	todo := make(chan int, len(lost))
+	for idx := range lost {
+		todo <- idx
+	}
+	close(todo)
+
+	// As in RecoverManifest, limit concurrency to 2 per keepstore
+	// node.
+	workerThreads := 2 * len(services)
+
+	blkFound := make([]bool, len(lost))
+	var wg sync.WaitGroup
+	for i := 0; i < workerThreads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range todo {
+				blkFound[idx] = rcvr.recoverBlock(ctx, lost[idx].Hash, services, blobsigttl, blobsigexp)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var unrecovered []lostBlock
+	for idx, ok := range blkFound {
+		if !ok {
+			unrecovered = append(unrecovered, lost[idx])
+		}
+	}
+	return unrecovered, nil
+}
+
+// reportUnrecovered writes one line for each collection that
+// references each of the given blocks, identifying the collection
+// and its owner. See usage message for format.
+func (rcvr recoverer) reportUnrecovered(ctx context.Context, w io.Writer, unrecovered []lostBlock) error {
+	colls := map[string]arvados.Collection{}
+	owners := map[string]string{}
+	var errs []string
+
+	for _, blk := range unrecovered {
+		var rows []arvados.Collection
+		seenPDH := map[string]bool{}
+		for _, uuid := range blk.UUIDs {
+			coll, ok := colls[uuid]
+			if !ok {
+				err := rcvr.client.RequestAndDecodeContext(ctx, &coll, "GET", "arvados/v1/collections/"+uuid, nil, arvados.GetOptions{
+					Select:       []string{"uuid", "portable_data_hash", "name", "owner_uuid"},
+					IncludeTrash: true,
+				})
+				if err != nil {
+					rcvr.logger.WithError(err).WithField("uuid", uuid).Warn("error looking up collection")
+					errs = append(errs, err.Error())
+					coll = arvados.Collection{UUID: uuid}
+				}
+				colls[uuid] = coll
+			}
+			rows = append(rows, coll)
+			seenPDH[coll.PortableDataHash] = true
+		}
+		for _, pdh := range blk.PDHs {
+			if seenPDH[pdh] {
+				continue
+			}
+			var resp arvados.CollectionList
+			err := rcvr.client.RequestAndDecodeContext(ctx, &resp, "GET", "arvados/v1/collections", nil, arvados.ListOptions{
+				Select:             []string{"uuid", "portable_data_hash", "name", "owner_uuid"},
+				Filters:            []arvados.Filter{{Attr: "portable_data_hash", Operator: "=", Operand: pdh}},
+				IncludeTrash:       true,
+				IncludeOldVersions: true,
+			})
+			if err != nil {
+				rcvr.logger.WithError(err).WithField("pdh", pdh).Warn("error looking up collections")
+				errs = append(errs, err.Error())
+			}
+			if len(resp.Items) == 0 {
+				rows = append(rows, arvados.Collection{PortableDataHash: pdh})
+			}
+			rows = append(rows, resp.Items...)
+		}
+		sort.Slice(rows, func(i, j int) bool {
+			if rows[i].PortableDataHash != rows[j].PortableDataHash {
+				return rows[i].PortableDataHash < rows[j].PortableDataHash
+			}
+			return rows[i].UUID < rows[j].UUID
+		})
+		if len(rows) == 0 {
+			// Report format doesn't tell us any
+			// collections, but the block is still lost.
+			rows = []arvados.Collection{{}}
+		}
+		for _, coll := range rows {
+			owner, err := rcvr.ownerName(ctx, owners, coll.OwnerUUID)
+			if err != nil {
+				rcvr.logger.WithError(err).WithField("uuid", coll.OwnerUUID).Warn("error looking up owner")
+				errs = append(errs, err.Error())
+			}
+			_, err = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", blk.Hash, coll.UUID, coll.PortableDataHash, coll.OwnerUUID, owner, coll.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d errors looking up collections and owners", len(errs))
+	}
+	return nil
+}
+
+// ownerName returns a human-readable name for the given user or
+// group, i.e., the user's email address or the group's name.
+// Results are cached in the given map.
+func (rcvr recoverer) ownerName(ctx context.Context, cache map[string]string, uuid string) (string, error) {
+	if uuid == "" {
+		return "", nil
+	} else if name, ok := cache[uuid]; ok {
+		return name, nil
+	}
+	var name string
+	var err error
+	switch {
+	case strings.Contains(uuid, "-tpzed-"):
+		var user arvados.User
+		err = rcvr.client.RequestAndDecodeContext(ctx, &user, "GET", "arvados/v1/users/"+uuid, nil, arvados.GetOptions{
+			Select: []string{"uuid", "email", "full_name"},
+		})
+		name = user.Email
+		if name == "" {
+			name = user.FullName
+		}
+	case strings.Contains(uuid, "-j7d0g-"):
+		var group arvados.Group
+		err = rcvr.client.RequestAndDecodeContext(ctx, &group, "GET", "arvados/v1/groups/"+uuid, nil, arvados.GetOptions{
+			Select:       []string{"uuid", "name"},
+			IncludeTrash: true,
+		})
+		name = group.Name
+	}
+	cache[uuid] = name
+	return name, err
+}
@@ -0,0 +1,51 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package recovercollection
+
+import (
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&LostBlocksSuite{})
+
+type LostBlocksSuite struct{}
+
+func (*LostBlocksSuite) TestParseLostBlocks(c *check.C) {
+	lost, err := parseLostBlocks(strings.NewReader(`37b51d194a7513e45b56f6524f2d51f2 fa7aeb5140e2848d39b416daeef4ffc5+45 1f4b0bc7583c2a7f9102c395f4ffc5e3+45	zzzzz-4zz18-aaaaaaaaaaaaaaa zzzzz-4zz18-ehbhgtheo8909or
+acbd18db4cc2f85cedef654fccc4a4d8 fa7aeb5140e2848d39b416daeef4ffc5+45
+
+73feffa4b7f6bb68e44cf984c85f6e88
+`))
+	c.Assert(err, check.IsNil)
+	c.Check(lost, check.DeepEquals, []lostBlock{
+		{
+			Hash:  "37b51d194a7513e45b56f6524f2d51f2",
+			PDHs:  []string{"fa7aeb5140e2848d39b416daeef4ffc5+45", "1f4b0bc7583c2a7f9102c395f4ffc5e3+45"},
+			UUIDs: []string{"zzzzz-4zz18-aaaaaaaaaaaaaaa", "zzzzz-4zz18-ehbhgtheo8909or"},
+		},
+		{
+			// Written by an older version of keep-balance
+			Hash: "acbd18db4cc2f85cedef654fccc4a4d8",
+			PDHs: []string{"fa7aeb5140e2848d39b416daeef4ffc5+45"},
+		},
+		{
+			Hash: "73feffa4b7f6bb68e44cf984c85f6e88",
+		},
+	})
+
+	for _, trial := range []struct {
+		line string
+		err  string
+	}{
+		{"37b51d194a7513e45b56f6524f2d51f2 zzzzz-4zz18-aaaaaaaaaaaaaaa", `line 1: invalid portable data hash "zzzzz-4zz18-aaaaaaaaaaaaaaa"`},
+		{"37b51d194a7513e45b56f6524f2d51f2\tfa7aeb5140e2848d39b416daeef4ffc5+45", `line 1: invalid collection UUID "fa7aeb5140e2848d39b416daeef4ffc5\+45"`},
+		{"37b51d194a7513e45b56f6524f2d51f2+3", `line 1: invalid block hash .*`},
+	} {
+		_, err := parseLostBlocks(strings.NewReader(trial.line + "\n"))
+		c.Check(err, check.ErrorMatches, trial.err)
+	}
+}
@@ -7,6 +7,7 @@ package arvados
 // APIClientAuthorization is an arvados#apiClientAuthorization resource.
 type APIClientAuthorization struct {
 	UUID      string   `json:"uuid"`
+	OwnerUUID string   `json:"owner_uuid"`
 	APIToken  string   `json:"api_token"`
 	ExpiresAt string   `json:"expires_at"`
 	Scopes    []string `json:"scopes"`
@@ -57,14 +57,34 @@ func (sc *Config) GetCluster(clusterID string) (*Cluster, error) {
 	return &cc, nil
 }
 
+type BlobAuditLogConfig struct {
+	Destination string
+	MaxFileSize ByteSize
+	MaxFiles    int
+}
+
 type WebDAVCacheConfig struct {
-	TTL                  Duration
-	UUIDTTL              Duration
-	MaxBlockEntries      int
-	MaxCollectionEntries int
-	MaxCollectionBytes   int64
-	MaxPermissionEntries int
-	MaxUUIDEntries       int
+	TTL                   Duration
+	UUIDTTL               Duration
+	MaxBlockEntries       int
+	MaxCollectionEntries  int
+	MaxCollectionBytes    int64
+	MaxPermissionEntries  int
+	MaxUUIDEntries        int
+	BlockCacheDirectory   string
+	MaxBlockCacheBytes    ByteSize
+	BlockCacheGroupShared bool
+}
+
+type KeepproxyDiskCacheConfig struct {
+	Directory string
+	MaxSize   ByteSize
+}
+
+type KeepproxyWriteBehindConfig struct {
+	Directory     string
+	MaxSize       ByteSize
+	RetryInterval Duration
 }
 
 type Cluster struct {
@@ -84,6 +104,9 @@ type Cluster struct {
 		MaxItemsPerResponse            int
 		MaxConcurrentRequests          int
 		MaxKeepBlobBuffers             int
+		MaxKeepWriteRequestRate        float64
+		MaxKeepWriteBandwidth          ByteSize
+		KeepWriteRateLimitBurst        Duration
 		MaxRequestAmplification        int
 		MaxRequestSize                 int
 		RailsSessionSecretToken        string
@@ -101,6 +124,7 @@ type Cluster struct {
 	Collections struct {
 		BlobSigning              bool
 		BlobSigningKey           string
+		BlobEncryptionKeys       map[string]string
 		BlobSigningTTL           Duration
 		BlobTrash                bool
 		BlobTrashLifetime        Duration
@@ -108,6 +132,11 @@ type Cluster struct {
 		BlobTrashConcurrency     int
 		BlobDeleteConcurrency    int
 		BlobReplicateConcurrency int
+		BlobScrubInterval        Duration
+		BlobScrubBandwidth       ByteSize
+		BlobWriteStrategy        string
+		BlobWriteFillThreshold   float64
+		BlobAuditLog             BlobAuditLogConfig
 		CollectionVersioning     bool
 		DefaultTrashLifetime     Duration
 		DefaultReplication       int
@@ -121,14 +150,21 @@ type Cluster struct {
 		TrustAllContent              bool
 		ForwardSlashNameSubstitution string
 		S3FolderObjects              bool
+		S3MultipartUploadTTL         Duration
 
 		BlobMissingReport        string
 		BalancePeriod            Duration
 		BalanceCollectionBatch   int
 		BalanceCollectionBuffers int
 		BalanceTimeout           Duration
+		BalanceUpdateLimit       int
+		BalanceFullSweepPeriod   Duration
+		BalanceStateFile         string
 
 		WebDAVCache WebDAVCacheConfig
+
+		KeepproxyDiskCache   KeepproxyDiskCacheConfig
+		KeepproxyWriteBehind KeepproxyWriteBehindConfig
 	}
 	Git struct {
 		GitCommand   string
@@ -272,6 +308,9 @@ type Volume struct {
 	ReadOnly         bool
 	Replication      int
 	StorageClasses   map[string]bool
+	EncryptionKey    string
+	StorageCost      float64
+	EgressCost       float64
 	Driver           string
 	DriverParameters json.RawMessage
 }
@@ -399,12 +438,15 @@ type InstanceType struct {
 }
 
 type ContainersConfig struct {
+	BlockCacheDirectory         string
+	BlockCacheGroupShared       bool
 	CloudVMs                    CloudVMsConfig
 	CrunchRunCommand            string
 	CrunchRunArgumentsList      []string
 	DefaultKeepCacheRAM         ByteSize
 	DispatchPrivateKey          string
 	LogReuseDecisions           bool
+	MaxBlockCacheBytes          ByteSize
 	MaxComputeVMs               int
 	MaxDispatchAttempts         int
 	MaxRetryAttempts            int
@@ -163,6 +163,7 @@ type fileinfo struct {
 	mode    os.FileMode
 	size    int64
 	modTime time.Time
+	sys     func() interface{}
 }
 
 // Name implements os.FileInfo.
@@ -190,9 +191,15 @@ func (fi fileinfo) Size() int64 {
 	return fi.size
 }
 
-// Sys implements os.FileInfo.
+// Sys implements os.FileInfo. If fi is the top-level directory of a
+// collection in a site filesystem, Sys returns a *Collection with
+// (at least) the collection's UUID, owner UUID, and properties, as
+// they were when the collection was loaded.
 func (fi fileinfo) Sys() interface{} {
-	return nil
+	if fi.sys == nil {
+		return nil
+	}
+	return fi.sys()
 }
 
 type nullnode struct{}
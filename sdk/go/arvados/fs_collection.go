@@ -45,7 +45,9 @@ type CollectionFileSystem interface {
 
 type collectionFileSystem struct {
 	fileSystem
-	uuid string
+	uuid       string
+	ownerUUID  string
+	properties map[string]interface{}
 }
 
 // FileSystem returns a CollectionFileSystem for the collection.
@@ -55,7 +57,9 @@ func (c *Collection) FileSystem(client apiClient, kc keepClient) (CollectionFile
 		modTime = time.Now()
 	}
 	fs := &collectionFileSystem{
-		uuid: c.UUID,
+		uuid:       c.UUID,
+		ownerUUID:  c.OwnerUUID,
+		properties: c.Properties,
 		fileSystem: fileSystem{
 			fsBackend: keepBackend{apiClient: client, keepClient: kc},
 			thr:       newThrottle(concurrentWriters),
@@ -129,7 +133,11 @@ func (fs *collectionFileSystem) FS() FileSystem {
 }
 
 func (fs *collectionFileSystem) FileInfo() os.FileInfo {
-	return fs.rootnode().FileInfo()
+	fi := fs.rootnode().FileInfo().(fileinfo)
+	fi.sys = func() interface{} {
+		return &Collection{UUID: fs.uuid, OwnerUUID: fs.ownerUUID, Properties: fs.properties}
+	}
+	return fi
 }
 
 func (fs *collectionFileSystem) IsDir() bool {
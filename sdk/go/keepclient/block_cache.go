@@ -5,7 +5,13 @@
 package keepclient
 
 import (
+	"crypto/md5"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -20,11 +26,43 @@ type BlockCache struct {
 	// default size (currently 4) is used instead.
 	MaxBlocks int
 
+	// If Dir is not empty, blocks retrieved from Keep are also
+	// saved in files in Dir, and blocks found there are used
+	// instead of retrieving them from Keep again. Dir can be
+	// shared by multiple processes, including processes acting
+	// on behalf of different users: a process that can read Dir
+	// can read any block stored there, without a permission
+	// signature.
+	Dir string
+
+	// Maximum total size of the files in Dir. If 0, a default
+	// size (currently 10 GiB) is used instead.
+	MaxDiskBytes int64
+
+	// If GroupShared is true, files and directories created in
+	// Dir are readable and writable by their group (mode 0660
+	// and 0770), regardless of umask, so processes running as
+	// different users can share Dir. Otherwise they are only
+	// accessible by their owner (mode 0600 and 0700).
+	//
+	// To share Dir between users, create it with the setgid bit
+	// set and a group that all of the users belong to, so new
+	// files and directories inherit that group.
+	GroupShared bool
+
 	cache map[string]*cacheBlock
 	mtx   sync.Mutex
+
+	// bytes written to Dir since the last disk sweep
+	diskWritten int64
+	diskMtx     sync.Mutex
 }
 
-const defaultMaxBlocks = 4
+const (
+	defaultMaxBlocks    = 4
+	defaultMaxDiskBytes = 10 << 30
+	diskCacheTmpPrefix  = ".tmp-"
+)
 
 // Sweep deletes the least recently used blocks from the cache until
 // there are no more than MaxBlocks left.
@@ -87,14 +125,24 @@ func (c *BlockCache) Get(kc *KeepClient, locator string) ([]byte, error) {
 		}
 		c.cache[cacheKey] = b
 		go func() {
-			rdr, size, _, err := kc.Get(locator)
-			var data []byte
-			if err == nil {
-				data = make([]byte, size, bufsize)
-				_, err = io.ReadFull(rdr, data)
-				err2 := rdr.Close()
+			data, err := c.getDisk(cacheKey)
+			if err != nil && !os.IsNotExist(err) {
+				log.Print(err)
+			}
+			if err != nil {
+				var rdr io.ReadCloser
+				var size int64
+				rdr, size, _, err = kc.Get(locator)
+				if err == nil {
+					data = make([]byte, size, bufsize)
+					_, err = io.ReadFull(rdr, data)
+					err2 := rdr.Close()
+					if err == nil {
+						err = err2
+					}
+				}
 				if err == nil {
-					err = err2
+					go c.putDisk(cacheKey, data)
 				}
 			}
 			c.mtx.Lock()
@@ -116,12 +164,166 @@ func (c *BlockCache) Get(kc *KeepClient, locator string) ([]byte, error) {
 	return b.data, b.err
 }
 
+// Clear deletes all blocks from the in-memory cache. Blocks stored
+// in Dir are not affected.
 func (c *BlockCache) Clear() {
 	c.mtx.Lock()
 	c.cache = nil
 	c.mtx.Unlock()
 }
 
+func (c *BlockCache) diskPath(hash string) string {
+	return filepath.Join(c.Dir, hash[:3], hash)
+}
+
+// getDisk returns the content of a block stored in Dir. If the
+// stored data does not match the hash, it is deleted and an error is
+// returned.
+func (c *BlockCache) getDisk(hash string) ([]byte, error) {
+	if c.Dir == "" {
+		return nil, os.ErrNotExist
+	}
+	path := c.diskPath(hash)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if fmt.Sprintf("%x", md5.Sum(data)) != hash {
+		os.Remove(path)
+		return nil, fmt.Errorf("block cache: %s: data does not match hash", path)
+	}
+	// Update mtime so the disk sweep (in this and other
+	// processes) sees this block as recently used.
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, nil
+}
+
+// putDisk saves a block in Dir, and deletes the least recently used
+// blocks if needed to stay within MaxDiskBytes. Errors are logged
+// and otherwise ignored.
+func (c *BlockCache) putDisk(hash string, data []byte) {
+	if c.Dir == "" {
+		return
+	}
+	path := c.diskPath(hash)
+	err := c.mkdir(filepath.Dir(path))
+	if err != nil {
+		log.Printf("block cache: %s", err)
+		return
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), diskCacheTmpPrefix)
+	if err != nil {
+		log.Printf("block cache: %s", err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if c.GroupShared {
+		// TempFile always uses mode 0600.
+		err = f.Chmod(0660)
+	}
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		// Rename is atomic, so other processes never see a
+		// partially written block.
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		log.Printf("block cache: %s", err)
+		return
+	}
+
+	max := c.MaxDiskBytes
+	if max == 0 {
+		max = defaultMaxDiskBytes
+	}
+	c.diskMtx.Lock()
+	defer c.diskMtx.Unlock()
+	c.diskWritten += int64(len(data))
+	if c.diskWritten < max/16 && c.diskWritten > int64(len(data)) {
+		// Avoid scanning the whole directory after every
+		// write. The first write in this process always
+		// triggers a sweep.
+		return
+	}
+	c.diskWritten = 0
+	c.sweepDisk(max)
+}
+
+// mkdir creates dir (and its parent, if needed) with the mode
+// indicated by GroupShared. Directories that already exist are left
+// alone: they may belong to a different user.
+func (c *BlockCache) mkdir(dir string) error {
+	mode := os.FileMode(0700)
+	if c.GroupShared {
+		mode = 0770
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if _, err := os.Stat(parent); os.IsNotExist(err) {
+			if err := c.mkdir(parent); err != nil {
+				return err
+			}
+		}
+	}
+	err := os.Mkdir(dir, mode)
+	if os.IsExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// Mkdir applies umask, so set the mode explicitly.
+	return os.Chmod(dir, mode)
+}
+
+// sweepDisk deletes the least recently used blocks from Dir until
+// the total size is no more than max. It also deletes temporary
+// files left behind by processes that were interrupted while
+// writing. Caller must have diskMtx.
+func (c *BlockCache) sweepDisk(max int64) {
+	type diskBlock struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var blocks []diskBlock
+	var total int64
+	staleTmp := time.Now().Add(-time.Hour)
+	filepath.Walk(c.Dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), diskCacheTmpPrefix) {
+			if fi.ModTime().Before(staleTmp) {
+				os.Remove(path)
+			}
+			return nil
+		}
+		blocks = append(blocks, diskBlock{path: path, size: fi.Size(), mtime: fi.ModTime()})
+		total += fi.Size()
+		return nil
+	})
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].mtime.Before(blocks[j].mtime)
+	})
+	for _, b := range blocks {
+		if total <= max {
+			break
+		}
+		err := os.Remove(b.path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("block cache: %s", err)
+			continue
+		}
+		total -= b.size
+	}
+}
+
 type timeSlice []time.Time
 
 func (ts timeSlice) Len() int { return len(ts) }
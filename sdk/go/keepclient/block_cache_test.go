@@ -0,0 +1,158 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package keepclient
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&BlockCacheSuite{})
+
+type BlockCacheSuite struct{}
+
+// countingGetHandler serves the given blocks and counts requests.
+type countingGetHandler struct {
+	mtx    sync.Mutex
+	blocks map[string][]byte
+	gets   int
+}
+
+func (h *countingGetHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.gets++
+	data, ok := h.blocks[req.URL.Path[1:33]]
+	if !ok {
+		http.Error(resp, "not found", http.StatusNotFound)
+		return
+	}
+	resp.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	resp.Write(data)
+}
+
+func (h *countingGetHandler) count() int {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.gets
+}
+
+func (s *BlockCacheSuite) setup(c *C, blocks ...string) (*KeepClient, *countingGetHandler, []string) {
+	h := &countingGetHandler{blocks: map[string][]byte{}}
+	var locators []string
+	for _, data := range blocks {
+		hash := fmt.Sprintf("%x", md5.Sum([]byte(data)))
+		h.blocks[hash] = []byte(data)
+		locators = append(locators, fmt.Sprintf("%s+%d", hash, len(data)))
+	}
+	ks := RunFakeKeepServer(h)
+	kc := &KeepClient{Arvados: &arvadosclient.ArvadosClient{ApiToken: "abc123"}}
+	kc.SetServiceRoots(map[string]string{"zzzzz-bi6l4-000000000000000": ks.url}, nil, nil)
+	return kc, h, locators
+}
+
+func (s *BlockCacheSuite) TestDiskCacheSharedBetweenProcesses(c *C) {
+	kc, h, locators := s.setup(c, "foo")
+	dir := c.MkDir()
+
+	// Two BlockCaches using the same Dir, as if they were in
+	// different processes.
+	cache1 := &BlockCache{Dir: dir}
+	cache2 := &BlockCache{Dir: dir}
+	data, err := cache1.Get(kc, locators[0])
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "foo")
+	c.Check(h.count(), Equals, 1)
+
+	// Wait for the background write to Dir.
+	path := cache1.diskPath(locators[0][:32])
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+	}
+	data, err = cache2.Get(kc, locators[0])
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "foo")
+	c.Check(h.count(), Equals, 1)
+
+	// Corrupt data in Dir is ignored and deleted.
+	c.Assert(ioutil.WriteFile(path, []byte("bar"), 0600), IsNil)
+	data, err = (&BlockCache{Dir: dir}).Get(kc, locators[0])
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "foo")
+	c.Check(h.count(), Equals, 2)
+}
+
+func (s *BlockCacheSuite) TestDiskCacheSweep(c *C) {
+	dir := c.MkDir()
+	cache := &BlockCache{Dir: dir, MaxDiskBytes: 6}
+	var locators []string
+	for i, data := range []string{"foo", "bar", "baz"} {
+		hash := fmt.Sprintf("%x", md5.Sum([]byte(data)))
+		locators = append(locators, hash)
+		cache.putDisk(hash, []byte(data))
+		// Ensure distinct mtimes.
+		t := time.Now().Add(time.Duration(i-3) * time.Minute)
+		os.Chtimes(cache.diskPath(hash), t, t)
+	}
+	cache.sweepDisk(cache.MaxDiskBytes)
+
+	// The least recently used block ("foo") is gone.
+	for i, expect := range []bool{false, true, true} {
+		_, err := os.Stat(cache.diskPath(locators[i][:32]))
+		c.Check(err == nil, Equals, expect, Commentf("block %d", i))
+	}
+
+	// Stale temp files are deleted.
+	tmp := dir + "/" + locators[1][:3] + "/" + diskCacheTmpPrefix + "123"
+	c.Assert(ioutil.WriteFile(tmp, []byte("foo"), 0600), IsNil)
+	t := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(tmp, t, t)
+	cache.sweepDisk(cache.MaxDiskBytes)
+	_, err := os.Stat(tmp)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *BlockCacheSuite) TestDiskCacheGroupShared(c *C) {
+	defer syscall.Umask(syscall.Umask(0077))
+	for _, trial := range []struct {
+		shared  bool
+		dirMode os.FileMode
+		mode    os.FileMode
+	}{
+		{false, 0700, 0600},
+		{true, 0770, 0660},
+	} {
+		dir := c.MkDir() + "/cache"
+		cache := &BlockCache{Dir: dir, GroupShared: trial.shared}
+		hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+		cache.putDisk(hash, []byte("foo"))
+		path := cache.diskPath(hash)
+		for _, check := range []struct {
+			path string
+			mode os.FileMode
+		}{
+			{dir, os.ModeDir | trial.dirMode},
+			{filepath.Dir(path), os.ModeDir | trial.dirMode},
+			{path, trial.mode},
+		} {
+			fi, err := os.Stat(check.path)
+			if c.Check(err, IsNil) {
+				c.Check(fi.Mode(), Equals, check.mode, Commentf("shared=%v %s", trial.shared, check.path))
+			}
+		}
+	}
+}
@@ -86,6 +86,11 @@ var ErrIncompleteIndex = errors.New("Got incomplete index")
 const XKeepDesiredReplicas = "X-Keep-Desired-Replicas"
 const XKeepReplicasStored = "X-Keep-Replicas-Stored"
 
+// XKeepReplicasPending is set by keepproxy in write-behind mode to
+// indicate that the replicas reported in X-Keep-Replicas-Stored
+// have not been written to keepstore servers yet.
+const XKeepReplicasPending = "X-Keep-Replicas-Pending"
+
 type HTTPClient interface {
 	Do(*http.Request) (*http.Response, error)
 }
@@ -140,6 +145,29 @@ func New(arv *arvadosclient.ArvadosClient) *KeepClient {
 	}
 }
 
+// Clone returns a copy of kc that can be modified (e.g., to change
+// Want_replicas or StorageClasses) without affecting kc. The copy
+// shares kc's service roots, HTTP client, and block cache.
+func (kc *KeepClient) Clone() *KeepClient {
+	kc.lock.RLock()
+	defer kc.lock.RUnlock()
+	return &KeepClient{
+		Arvados:            kc.Arvados,
+		Want_replicas:      kc.Want_replicas,
+		localRoots:         kc.localRoots,
+		writableLocalRoots: kc.writableLocalRoots,
+		gatewayRoots:       kc.gatewayRoots,
+		HTTPClient:         kc.HTTPClient,
+		Retries:            kc.Retries,
+		BlockCache:         kc.BlockCache,
+		RequestID:          kc.RequestID,
+		StorageClasses:     kc.StorageClasses,
+		replicasPerService: kc.replicasPerService,
+		foundNonDiskSvc:    kc.foundNonDiskSvc,
+		disableDiscovery:   kc.disableDiscovery,
+	}
+}
+
 // PutHR puts a block given the block hash, a reader, and the number of bytes
 // to read from the reader (which must be between 0 and BLOCKSIZE).
 //
@@ -147,7 +175,9 @@ func New(arv *arvadosclient.ArvadosClient) *KeepClient {
 // written, and an error.
 //
 // Returns an InsufficientReplicasError if 0 <= replicas <
-// kc.Wants_replicas.
+// kc.Wants_replicas. The error also implements Error: Temporary()
+// returns false if every server that failed rejected the block itself
+// (e.g., 413 or 422, but not 401 or 403), so retrying would not help.
 func (kc *KeepClient) PutHR(hash string, r io.Reader, dataBytes int64) (string, int, error) {
 	// Buffer for reads from 'r'
 	var bufsize int
@@ -159,6 +159,7 @@ func (kc *KeepClient) putReplicas(
 	var retryServers []string
 
 	lastError := make(map[string]string)
+	lastStatus := make(map[string]int)
 
 	for retriesRemaining > 0 {
 		retriesRemaining--
@@ -179,7 +180,10 @@ func (kc *KeepClient) putReplicas(
 							msg += resp + "; "
 						}
 						msg = msg[:len(msg)-2]
-						return locator, replicasDone, InsufficientReplicasError(errors.New(msg))
+						return locator, replicasDone, InsufficientReplicasError(&multipleResponseError{
+							error:  errors.New(msg),
+							isTemp: temporaryPutFailure(lastStatus),
+						})
 					}
 					break
 				}
@@ -198,12 +202,14 @@ func (kc *KeepClient) putReplicas(
 					replicasTodo -= status.replicasStored
 					locator = status.response
 					delete(lastError, status.url)
+					delete(lastStatus, status.url)
 				} else {
 					msg := fmt.Sprintf("[%d] %s", status.statusCode, status.response)
 					if len(msg) > 100 {
 						msg = msg[:100]
 					}
 					lastError[status.url] = msg
+					lastStatus[status.url] = status.statusCode
 				}
 
 				if status.statusCode == 0 || status.statusCode == 408 || status.statusCode == 429 ||
@@ -222,3 +228,22 @@ func (kc *KeepClient) putReplicas(
 
 	return locator, replicasDone, nil
 }
+
+// temporaryPutFailure returns true if any of the given HTTP status
+// codes (0 for a network error) indicates a failure that might not
+// happen again, or if there were no failed servers at all.
+//
+// 401 and 403 are considered temporary: they are more likely to
+// indicate a token or server configuration problem that will be
+// fixed than a problem with the block itself.
+func temporaryPutFailure(statuses map[string]int) bool {
+	if len(statuses) == 0 {
+		return true
+	}
+	for _, code := range statuses {
+		if code == 0 || code == 401 || code == 403 || code == 408 || code == 429 || code >= 500 {
+			return true
+		}
+	}
+	return false
+}
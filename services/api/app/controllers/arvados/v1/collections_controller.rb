@@ -8,6 +8,7 @@ require "trashable"
 class Arvados::V1::CollectionsController < ApplicationController
   include DbCurrentTime
   include TrashableController
+  include ArvadosModelUpdates
 
   def self._index_requires_parameters
     (super rescue {}).
@@ -43,6 +44,22 @@ class Arvados::V1::CollectionsController < ApplicationController
     super
   end
 
+  def update
+    if !resource_attrs.empty? &&
+       (resource_attrs.keys.map(&:to_s) - ['storage_classes_confirmed', 'storage_classes_confirmed_at']).empty?
+      # Recording which storage classes are confirmed (see
+      # keep-balance) doesn't modify the collection, so it
+      # shouldn't change modified_at or modified_by_user_uuid.
+      leave_modified_by_user_alone do
+        leave_modified_at_alone do
+          super
+        end
+      end
+    else
+      super
+    end
+  end
+
   def find_objects_for_index
     opts = {
       include_trash: params[:include_trash] || ['destroy', 'trash', 'untrash'].include?(action_name),
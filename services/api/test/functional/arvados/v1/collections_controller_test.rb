@@ -1455,4 +1455,29 @@ EOS
     assert_response :success
     assert_equal col.version, json_response['version'], 'Trashing a collection should not create a new version'
   end
+
+  [
+    [{storage_classes_confirmed: ["default"], storage_classes_confirmed_at: "2021-01-01T00:00:00Z"}, false],
+    [{storage_classes_confirmed: ["default"], name: "new name"}, true],
+  ].each do |attrs, modified|
+    test "update #{attrs.keys.join(', ')} #{modified ? 'changes' : 'does not change'} modified_at" do
+      col = collections(:storage_classes_desired_default_unconfirmed)
+      authorize_with :admin
+      put :update, params: {
+            id: col.uuid,
+            collection: attrs,
+          }
+      assert_response :success
+      assert_equal ["default"], json_response['storage_classes_confirmed']
+      col.reload
+      assert_equal ["default"], col.storage_classes_confirmed
+      if modified
+        assert_operator col.modified_at, :>, Time.now - 1.minute
+        assert_equal users(:admin).uuid, col.modified_by_user_uuid
+      else
+        assert_equal collections(:storage_classes_desired_default_unconfirmed).modified_at.to_f, col.modified_at.to_f
+        assert_equal users(:active).uuid, col.modified_by_user_uuid
+      end
+    end
+  end
 end
@@ -20,6 +20,7 @@ import (
 
 	"git.arvados.org/arvados.git/lib/config"
 	"git.arvados.org/arvados.git/lib/dispatchcloud"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/worker"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
 	"git.arvados.org/arvados.git/sdk/go/dispatch"
@@ -278,6 +279,7 @@ func (disp *Dispatcher) runContainer(_ *dispatch.Dispatcher, ctr arvados.Contain
 		log.Printf("Submitting container %s to slurm", ctr.UUID)
 		cmd := []string{disp.cluster.Containers.CrunchRunCommand}
 		cmd = append(cmd, disp.cluster.Containers.CrunchRunArgumentsList...)
+		cmd = append(cmd, worker.BlockCacheArgs(disp.cluster.Containers)...)
 		if err := disp.submit(ctr, cmd); err != nil {
 			var text string
 			switch err := err.(type) {
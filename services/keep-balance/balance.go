@@ -47,6 +47,31 @@ type Balancer struct {
 	DefaultReplication int
 	MinMtime           int64
 
+	// Time when GetCurrentState (or GetChangedState) started
+	// retrieving the current state.
+	stateTime time.Time
+
+	// State carried between runs when incremental balancing is
+	// enabled (otherwise nil).
+	inc *incrementalState
+	// Collections seen during a full sweep, kept only so
+	// updateCollections doesn't have to retrieve them again when
+	// incremental balancing is disabled (otherwise nil).
+	collections map[string]*collectionRecord
+	// True if this run is incremental, i.e., only the blocks
+	// whose hash prefixes are in affectedPrefixes are
+	// re-evaluated.
+	incrementalRun    bool
+	affectedPrefixes  map[string]bool
+	affectedPrefixLen int
+
+	// Desired replication of the blocks trashed by a loaded plan
+	// (see LoadPlan).
+	planDesired map[arvados.SizedDigest]map[string]int
+
+	// True if any volume has a non-zero StorageCost.
+	costAware bool
+
 	classes       []string
 	mounts        int
 	mountsByClass map[string]map[*KeepMount]bool
@@ -69,6 +94,11 @@ type Balancer struct {
 //   runOptions, err = (&Balancer{}).Run(config, runOptions)
 func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOptions RunOptions) (nextRunOptions RunOptions, err error) {
 	nextRunOptions = runOptions
+	// If this run fails, the next run will need to start over
+	// with a full sweep (or the state saved by the last
+	// successful run), because this run might have modified the
+	// state from the previous run.
+	nextRunOptions.incremental = nil
 
 	defer bal.time("sweep", "wall clock time to run one full sweep")()
 
@@ -111,6 +141,7 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 		}
 	}
 	bal.cleanupMounts()
+	bal.setMountCosts(cluster)
 
 	if err = bal.CheckSanityEarly(client); err != nil {
 		return
@@ -139,7 +170,22 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 		nextRunOptions.SafeRendezvousState = rs
 	}
 
-	if err = bal.GetCurrentState(ctx, client, cluster.Collections.BalanceCollectionBatch, cluster.Collections.BalanceCollectionBuffers); err != nil {
+	if runOptions.ApplyPlan != "" {
+		err = bal.applyPlan(ctx, client, cluster, runOptions)
+		return
+	}
+
+	if inc := bal.getIncrementalState(cluster, runOptions); inc != nil {
+		err = bal.GetChangedState(ctx, client, inc, cluster.Collections.BalanceCollectionBatch)
+	} else {
+		if cluster.Collections.BalanceFullSweepPeriod > 0 {
+			bal.inc = newIncrementalState()
+		} else if runOptions.CommitConfirmedFields && cluster.Collections.BalanceUpdateLimit > 0 {
+			bal.collections = map[string]*collectionRecord{}
+		}
+		err = bal.GetCurrentState(ctx, client, cluster.Collections.BalanceCollectionBatch, cluster.Collections.BalanceCollectionBuffers)
+	}
+	if err != nil {
 		return
 	}
 	bal.ComputeChangeSets()
@@ -148,6 +194,15 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 		return
 	}
 	if lbFile != nil {
+		if bal.incrementalRun {
+			// An incremental run only finds lost blocks
+			// among the affected blocks, so the rest of
+			// the previous report still applies.
+			err = bal.copyUnaffectedLostBlocks(lbFile, bal.LostBlocksFile)
+			if err != nil {
+				return
+			}
+		}
 		err = lbFile.Sync()
 		if err != nil {
 			return
@@ -158,6 +213,12 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 		}
 		lbFile = nil
 	}
+	if runOptions.SavePlan != "" {
+		err = bal.SavePlan(runOptions.SavePlan, cluster.ClusterID)
+		if err != nil {
+			return
+		}
+	}
 	if runOptions.CommitPulls {
 		err = bal.CommitPulls(ctx, client)
 		if err != nil {
@@ -167,6 +228,23 @@ func (bal *Balancer) Run(client *arvados.Client, cluster *arvados.Cluster, runOp
 	}
 	if runOptions.CommitTrash {
 		err = bal.CommitTrash(ctx, client)
+		if err != nil {
+			return
+		}
+	}
+	if runOptions.CommitConfirmedFields {
+		err = bal.updateCollections(ctx, client, cluster)
+		if err != nil {
+			return
+		}
+	}
+	if bal.inc != nil {
+		err = bal.saveIncrementalState(cluster.Collections.BalanceStateFile)
+		if err != nil {
+			err = fmt.Errorf("error saving state: %s", err)
+			return
+		}
+		nextRunOptions.incremental = bal.inc
 	}
 	return
 }
@@ -274,6 +352,22 @@ func (bal *Balancer) CheckSanityEarly(c *arvados.Client) error {
 	return nil
 }
 
+// setMountCosts copies the StorageCost and EgressCost of each
+// mounted volume from the cluster config.
+func (bal *Balancer) setMountCosts(cluster *arvados.Cluster) {
+	bal.costAware = false
+	for _, srv := range bal.KeepServices {
+		for _, mnt := range srv.mounts {
+			vol := cluster.Volumes[mnt.UUID]
+			mnt.storageCost = vol.StorageCost
+			mnt.egressCost = vol.EgressCost
+			if vol.StorageCost != 0 {
+				bal.costAware = true
+			}
+		}
+	}
+}
+
 // rendezvousState returns a fingerprint (e.g., a sorted list of
 // UUID+host+port) of the current set of keep services.
 func (bal *Balancer) rendezvousState() string {
@@ -323,6 +417,7 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 
 	defer bal.time("get_state", "wall clock time to get current state")()
 	bal.BlockStateMap = NewBlockStateMap()
+	bal.stateTime = time.Now()
 
 	dd, err := c.DiscoveryDocument()
 	if err != nil {
@@ -334,32 +429,10 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 	errs := make(chan error, 1)
 	wg := sync.WaitGroup{}
 
-	// When a device is mounted more than once, we will get its
-	// index only once, and call AddReplicas on all of the mounts.
-	// equivMount keys are the mounts that will be indexed, and
-	// each value is a list of mounts to apply the received index
-	// to.
-	equivMount := map[*KeepMount][]*KeepMount{}
-	// deviceMount maps each device ID to the one mount that will
-	// be indexed for that device.
-	deviceMount := map[string]*KeepMount{}
-	for _, srv := range bal.KeepServices {
-		for _, mnt := range srv.mounts {
-			equiv := deviceMount[mnt.DeviceID]
-			if equiv == nil {
-				equiv = mnt
-				if mnt.DeviceID != "" {
-					deviceMount[mnt.DeviceID] = equiv
-				}
-			}
-			equivMount[equiv] = append(equivMount[equiv], mnt)
-		}
-	}
-
 	// Start one goroutine for each (non-redundant) mount:
 	// retrieve the index, and add the returned blocks to
 	// BlockStateMap.
-	for _, mounts := range equivMount {
+	for _, mounts := range bal.equivMounts() {
 		wg.Add(1)
 		go func(mounts []*KeepMount) {
 			defer wg.Done()
@@ -451,6 +524,32 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 	return nil
 }
 
+// equivMounts returns groups of mounts that have the same backend
+// device. When a device is mounted more than once, we retrieve its
+// index only once, and call AddReplicas on all of the mounts.
+//
+// The keys of the returned map are the mounts that will be indexed,
+// and each value is a list of mounts to apply the received index to.
+func (bal *Balancer) equivMounts() map[*KeepMount][]*KeepMount {
+	equivMount := map[*KeepMount][]*KeepMount{}
+	// deviceMount maps each device ID to the one mount that will
+	// be indexed for that device.
+	deviceMount := map[string]*KeepMount{}
+	for _, srv := range bal.KeepServices {
+		for _, mnt := range srv.mounts {
+			equiv := deviceMount[mnt.DeviceID]
+			if equiv == nil {
+				equiv = mnt
+				if mnt.DeviceID != "" {
+					deviceMount[mnt.DeviceID] = equiv
+				}
+			}
+			equivMount[equiv] = append(equivMount[equiv], mnt)
+		}
+	}
+	return equivMount
+}
+
 func (bal *Balancer) addCollection(coll arvados.Collection) error {
 	blkids, err := coll.SizedDigests()
 	if err != nil {
@@ -461,13 +560,23 @@ func (bal *Balancer) addCollection(coll arvados.Collection) error {
 		repl = *coll.ReplicationDesired
 	}
 	bal.Logger.Debugf("%v: %d block x%d", coll.UUID, len(blkids), repl)
-	// Pass pdh to IncreaseDesired only if LostBlocksFile is being
-	// written -- otherwise it's just a waste of memory.
-	pdh := ""
+	// Pass pdh and uuid to IncreaseDesired only if LostBlocksFile
+	// is being written -- otherwise it's just a waste of memory.
+	pdh, uuid := "", ""
 	if bal.LostBlocksFile != "" {
-		pdh = coll.PortableDataHash
+		pdh, uuid = coll.PortableDataHash, coll.UUID
+	}
+	bal.BlockStateMap.IncreaseDesired(pdh, uuid, coll.StorageClassesDesired, repl, blkids)
+	if bal.inc != nil {
+		return bal.inc.recordCollection(coll, blkids, bal.LostBlocksFile != "")
+	}
+	if bal.collections != nil {
+		rec, err := newCollectionRecord(coll, blkids, false)
+		if err != nil {
+			return err
+		}
+		bal.collections[coll.UUID] = rec
 	}
-	bal.BlockStateMap.IncreaseDesired(pdh, coll.StorageClassesDesired, repl, blkids)
 	return nil
 }
 
@@ -491,6 +600,9 @@ func (bal *Balancer) ComputeChangeSets() {
 	todo := make(chan balanceTask, workers)
 	go func() {
 		bal.BlockStateMap.Apply(func(blkid arvados.SizedDigest, blk *BlockState) {
+			if bal.incrementalRun && !bal.affected(blkid) {
+				return
+			}
 			todo <- balanceTask{
 				blkid: blkid,
 				blk:   blk,
@@ -579,6 +691,9 @@ type balanceResult struct {
 	lost       bool
 	blockState balancedBlockState
 	classState map[string]balancedBlockState
+	// monthly storage cost of the current and planned replicas
+	cost      float64
+	costAfter float64
 }
 
 type slot struct {
@@ -635,8 +750,7 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		}
 
 		// Sort the slots by desirability.
-		sort.Slice(slots, func(i, j int) bool {
-			si, sj := slots[i], slots[j]
+		less := func(si, sj slot, byCost bool) bool {
 			if classi, classj := bal.mountsByClass[class][si.mnt], bal.mountsByClass[class][sj.mnt]; classi != classj {
 				// Prefer a mount that satisfies the
 				// desired class.
@@ -649,6 +763,9 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 				// already need it to satisfy a
 				// different storage class.
 				return si.want
+			} else if byCost && si.mnt.storageCost != sj.mnt.storageCost {
+				// Prefer a cheaper mount.
+				return si.mnt.storageCost < sj.mnt.storageCost
 			} else if orderi, orderj := srvRendezvous[si.mnt.KeepService], srvRendezvous[sj.mnt.KeepService]; orderi != orderj {
 				// Prefer a better rendezvous
 				// position.
@@ -665,7 +782,20 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 				// server.
 				return rendezvousLess(si.mnt.DeviceID, sj.mnt.DeviceID, blkid)
 			}
+		}
+		sort.Slice(slots, func(i, j int) bool {
+			return less(slots[i], slots[j], false)
 		})
+		if bal.costAware && len(slots) > 1 {
+			// Keep the first replica in the best
+			// rendezvous position, where clients look
+			// first, but store the rest on the cheapest
+			// mounts.
+			rest := slots[1:]
+			sort.Slice(rest, func(i, j int) bool {
+				return less(rest[i], rest[j], true)
+			})
+		}
 
 		// Servers/mounts/devices (with or without existing
 		// replicas) that are part of the best achievable
@@ -776,6 +906,9 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 
 	var lost bool
 	var changes []string
+	var cost, costAfter float64
+	costDev := map[string]bool{}
+	costAfterDev := map[string]bool{}
 	for _, slot := range slots {
 		// TODO: request a Touch if Mtime is duplicated.
 		var change int
@@ -793,7 +926,7 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		case slot.repl == nil && slot.want && !slot.mnt.ReadOnly:
 			slot.mnt.KeepService.AddPull(Pull{
 				SizedDigest: blkid,
-				From:        blk.Replicas[0].KeepMount.KeepService,
+				From:        pullSource(blk).KeepService,
 				To:          slot.mnt,
 			})
 			change = changePull
@@ -802,6 +935,20 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		default:
 			change = changeNone
 		}
+		if bal.costAware {
+			// Storage cost per month, counting each
+			// device once.
+			monthly := slot.mnt.storageCost * float64(blkid.Size()) / (1 << 30)
+			dev := slot.mnt.DeviceID
+			if slot.repl != nil && (dev == "" || !costDev[dev]) {
+				cost += monthly
+				costDev[dev] = true
+			}
+			if (change == changeStay || change == changePull) && (dev == "" || !costAfterDev[dev]) {
+				costAfter += monthly
+				costAfterDev[dev] = true
+			}
+		}
 		if bal.Dumper != nil {
 			var mtime int64
 			if slot.repl != nil {
@@ -820,9 +967,23 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		lost:       lost,
 		blockState: blockState,
 		classState: classState,
+		cost:       cost,
+		costAfter:  costAfter,
 	}
 }
 
+// pullSource returns the mount with the lowest EgressCost among the
+// mounts that have a replica of the given block.
+func pullSource(blk *BlockState) *KeepMount {
+	src := blk.Replicas[0].KeepMount
+	for _, r := range blk.Replicas[1:] {
+		if r.KeepMount.egressCost < src.egressCost {
+			src = r.KeepMount
+		}
+	}
+	return src
+}
+
 func computeBlockState(slots []slot, onlyCount map[*KeepMount]bool, have, needRepl int) (bbs balancedBlockState) {
 	repl := 0
 	countedDev := map[string]bool{}
@@ -891,6 +1052,10 @@ type balancerStats struct {
 	collectionBlockBytes int64 // sum(block size) across all blocks referenced by collections
 	collectionBlockRefs  int64 // sum(number of blocks referenced) across all collections
 	collectionBlocks     int64 // number of blocks referenced by any collection
+
+	// monthly storage cost, if any volumes have a StorageCost
+	storageCost      float64 // current replicas
+	storageCostAfter float64 // replicas after pulls and trashes
 }
 
 func (s *balancerStats) dedupByteRatio() float64 {
@@ -913,6 +1078,8 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 	s.classStats = make(map[string]replicationStats, len(bal.classes))
 	for result := range results {
 		bytes := result.blkid.Size()
+		s.storageCost += result.cost
+		s.storageCostAfter += result.costAfter
 
 		if rc := int64(result.blk.RefCount); rc > 0 {
 			s.collectionBytes += rc * bytes
@@ -952,10 +1119,17 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 			s.lost.replicas++
 			s.lost.blocks++
 			s.lost.bytes += bytes
+			// The block hash and PDHs are separated by
+			// spaces, as in earlier versions. The
+			// collection UUIDs, if any, are added after a
+			// tab.
 			fmt.Fprintf(bal.lostBlocks, "%s", strings.SplitN(string(result.blkid), "+", 2)[0])
-			for pdh := range result.blk.Refs {
+			for _, pdh := range sortedKeys(result.blk.Refs) {
 				fmt.Fprintf(bal.lostBlocks, " %s", pdh)
 			}
+			if len(result.blk.RefUUIDs) > 0 {
+				fmt.Fprintf(bal.lostBlocks, "\t%s", strings.Join(sortedKeys(result.blk.RefUUIDs), " "))
+			}
 			fmt.Fprint(bal.lostBlocks, "\n")
 		case bs.pulling > 0:
 			s.underrep.replicas += bs.pulling
@@ -1010,7 +1184,12 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 		s.trashes += len(srv.ChangeSet.Trashes)
 	}
 	bal.stats = s
-	bal.Metrics.UpdateStats(s)
+	if !bal.incrementalRun {
+		// Statistics from an incremental run only cover the
+		// affected blocks, so we leave the metrics from the
+		// last full sweep in place.
+		bal.Metrics.UpdateStats(s)
+	}
 }
 
 // PrintStatistics writes statistics about the computed changes to
@@ -1018,6 +1197,9 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 // finished.
 func (bal *Balancer) PrintStatistics() {
 	bal.logf("===")
+	if bal.incrementalRun {
+		bal.logf("incremental run: statistics only include blocks affected by %d modified collections", bal.collScanned)
+	}
 	bal.logf("%s lost (0=have<want)", bal.stats.lost)
 	bal.logf("%s underreplicated (0<have<want)", bal.stats.underrep)
 	bal.logf("%s just right (have=want)", bal.stats.justright)
@@ -1035,6 +1217,9 @@ func (bal *Balancer) PrintStatistics() {
 	bal.logf("===")
 	bal.logf("%s total commitment (excluding unreferenced)", bal.stats.desired)
 	bal.logf("%s total usage", bal.stats.current)
+	if bal.costAware {
+		bal.logf("projected monthly storage cost: %.2f now, %.2f after changes", bal.stats.storageCost, bal.stats.storageCostAfter)
+	}
 	bal.logf("===")
 	for _, srv := range bal.KeepServices {
 		bal.logf("%s: %v\n", srv, srv.ChangeSet)
@@ -1073,7 +1258,7 @@ func (bal *Balancer) CheckSanityLate() error {
 		return fmt.Errorf("cannot proceed safely after deferred errors")
 	}
 
-	if bal.collScanned == 0 {
+	if bal.collScanned == 0 && !bal.incrementalRun {
 		return fmt.Errorf("received zero collections")
 	}
 
@@ -1170,3 +1355,13 @@ func rendezvousLess(i, j string, blkid arvados.SizedDigest) bool {
 	b := md5.Sum([]byte(string(blkid[:32]) + j))
 	return bytes.Compare(a[:], b[:]) < 0
 }
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -7,6 +7,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -220,6 +221,28 @@ func (s *stubServer) serveCollectionsButSkipOne() *reqTracker {
 	return rt
 }
 
+// serveCollectionUpdates handles PUT requests for individual
+// collections, and records the updated attributes in the returned
+// map, keyed by collection UUID.
+func (s *stubServer) serveCollectionUpdates() (*reqTracker, map[string]map[string]interface{}) {
+	rt := &reqTracker{}
+	updates := map[string]map[string]interface{}{}
+	s.mux.HandleFunc("/arvados/v1/collections/", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		rt.Add(r)
+		var attrs map[string]interface{}
+		if r.Method != "PUT" || json.Unmarshal([]byte(r.Form.Get("collection")), &attrs) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rt.Lock()
+		updates[strings.TrimPrefix(r.URL.Path, "/arvados/v1/collections/")] = attrs
+		rt.Unlock()
+		io.WriteString(w, `{}`)
+	})
+	return rt, updates
+}
+
 func (s *stubServer) serveZeroKeepServices() *reqTracker {
 	return s.serveJSON("/arvados/v1/keep_services", arvados.KeepServiceList{})
 }
@@ -428,7 +451,7 @@ func (s *runSuite) TestWriteLostBlocks(c *check.C) {
 	c.Check(err, check.IsNil)
 	lost, err := ioutil.ReadFile(lostf.Name())
 	c.Assert(err, check.IsNil)
-	c.Check(string(lost), check.Equals, "37b51d194a7513e45b56f6524f2d51f2 fa7aeb5140e2848d39b416daeef4ffc5+45\n")
+	c.Check(string(lost), check.Equals, "37b51d194a7513e45b56f6524f2d51f2 fa7aeb5140e2848d39b416daeef4ffc5+45\tzzzzz-4zz18-aaaaaaaaaaaaaaa zzzzz-4zz18-ehbhgtheo8909or\n")
 }
 
 func (s *runSuite) TestDryRun(c *check.C) {
@@ -502,6 +525,652 @@ func (s *runSuite) TestCommit(c *check.C) {
 	c.Check(buf, check.Matches, `(?ms).*\narvados_keep_dedup_block_ratio 1\.5\n.*`)
 }
 
+func (s *runSuite) TestCommitConfirmedFields(c *check.C) {
+	opts := RunOptions{
+		CommitConfirmedFields: true,
+		Logger:                ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	collReqs := s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	updateReqs, updates := s.stub.serveCollectionUpdates()
+
+	// Count the requests needed to list the collections once.
+	_, err := s.newServer(&RunOptions{Logger: ctxlog.TestLogger(c)}).runOnce()
+	c.Assert(err, check.IsNil)
+	listReqs := collReqs.Count()
+	c.Check(updateReqs.Count(), check.Equals, 0)
+
+	srv := s.newServer(&opts)
+	bal, err := srv.runOnce()
+	c.Check(err, check.IsNil)
+
+	// The collections retrieved by GetCurrentState are reused
+	// rather than listed again.
+	c.Check(collReqs.Count(), check.Equals, listReqs*2)
+
+	// "foo" is stored on 4 mounts, but "bar" is only stored on
+	// one, and the default replication level is 2.
+	c.Check(updateReqs.Count(), check.Equals, 1)
+	c.Check(updateReqs.reqs[0].Form.Get("select"), check.Equals, `["uuid"]`)
+	c.Assert(updates["zzzzz-4zz18-znfnqtbbv4spc3w"], check.NotNil)
+	c.Check(updates["zzzzz-4zz18-znfnqtbbv4spc3w"]["storage_classes_confirmed"], check.DeepEquals, []interface{}{"default"})
+	confirmedAt, err := time.Parse(time.RFC3339Nano, updates["zzzzz-4zz18-znfnqtbbv4spc3w"]["storage_classes_confirmed_at"].(string))
+	c.Check(err, check.IsNil)
+	c.Check(confirmedAt.Equal(bal.stateTime), check.Equals, true)
+}
+
+func (s *runSuite) TestCommitConfirmedFieldsLimit(c *check.C) {
+	s.config.Collections.BalanceUpdateLimit = 2
+	opts := RunOptions{
+		CommitConfirmedFields: true,
+		Logger:                ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.mux.HandleFunc("/arvados/v1/collections", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.Contains(r.Form.Get("filters"), `modified_at`) {
+			io.WriteString(w, `{"items_available":0,"items":[]}`)
+			return
+		}
+		io.WriteString(w, `{"items_available":4,"items":[
+			{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa","manifest_text":". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n","modified_at":"2014-02-03T17:22:54Z","storage_classes_confirmed":[]},
+			{"uuid":"zzzzz-4zz18-bbbbbbbbbbbbbbb","manifest_text":". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n","modified_at":"2014-02-03T17:22:54Z","storage_classes_confirmed":["default"]},
+			{"uuid":"zzzzz-4zz18-ccccccccccccccc","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z","storage_classes_confirmed":["default"]},
+			{"uuid":"zzzzz-4zz18-ddddddddddddddd","manifest_text":". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n","modified_at":"2014-02-03T17:22:54Z"}]}`)
+	})
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	updateReqs, updates := s.stub.serveCollectionUpdates()
+	srv := s.newServer(&opts)
+	_, err := srv.runOnce()
+	c.Check(err, check.IsNil)
+
+	// Collection "b" is already up to date, and only two of the
+	// other three are updated because of BalanceUpdateLimit.
+	c.Check(updateReqs.Count(), check.Equals, 2)
+	c.Check(updates, check.HasLen, 2)
+	c.Check(updates["zzzzz-4zz18-bbbbbbbbbbbbbbb"], check.IsNil)
+	for uuid, attrs := range updates {
+		switch uuid {
+		case "zzzzz-4zz18-aaaaaaaaaaaaaaa", "zzzzz-4zz18-ddddddddddddddd":
+			c.Check(attrs["storage_classes_confirmed"], check.DeepEquals, []interface{}{"default"})
+		case "zzzzz-4zz18-ccccccccccccccc":
+			c.Check(attrs["storage_classes_confirmed"], check.DeepEquals, []interface{}{})
+			c.Check(attrs["storage_classes_confirmed_at"], check.IsNil)
+		default:
+			c.Errorf("unexpected update %s", uuid)
+		}
+	}
+}
+
+func (s *runSuite) TestIncremental(c *check.C) {
+	statef, err := ioutil.TempFile("", "keep-balance-state-test-")
+	c.Assert(err, check.IsNil)
+	statef.Close()
+	os.Remove(statef.Name())
+	defer os.Remove(statef.Name())
+	defer os.Remove(statef.Name() + ".journal")
+	s.config.Collections.BalanceStateFile = statef.Name()
+	s.config.Collections.BalanceFullSweepPeriod = arvados.Duration(time.Hour)
+
+	opts := RunOptions{
+		Logger: ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	collReqs := s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	indexReqs := s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	srv := s.newServer(&opts)
+
+	// First run is a full sweep.
+	bal, err := srv.runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(bal.incrementalRun, check.Equals, false)
+	c.Check(bal.stats.trashes, check.Equals, 2)
+	c.Check(bal.stats.pulls, check.Equals, 2)
+	_, err = os.Stat(statef.Name())
+	c.Check(err, check.IsNil)
+
+	// Second run only retrieves modified collections (none) and
+	// the index entries for blocks with pending changes, and
+	// arrives at the same pulls and trashes.
+	checkIncremental := func(bal *Balancer, collReqs0, indexReqs0 int) {
+		c.Check(bal.incrementalRun, check.Equals, true)
+		c.Check(bal.stats.trashes, check.Equals, 2)
+		c.Check(bal.stats.pulls, check.Equals, 2)
+		collReqs.Lock()
+		for _, req := range collReqs.reqs[collReqs0:] {
+			if filters := req.Form.Get("filters"); filters != `[["modified_at","=",null]]` {
+				// Other than the sanity check, all
+				// queries are limited to modified
+				// collections.
+				c.Check(filters, check.Matches, `.*"modified_at","\\u003e=".*`)
+			}
+		}
+		collReqs.Unlock()
+		indexReqs.Lock()
+		c.Check(len(indexReqs.reqs) > indexReqs0, check.Equals, true)
+		for _, req := range indexReqs.reqs[indexReqs0:] {
+			c.Check(req.URL.Query().Get("prefix"), check.Matches, `37b|acb`)
+		}
+		indexReqs.Unlock()
+	}
+	collReqs0, indexReqs0 := collReqs.Count(), indexReqs.Count()
+	bal, err = srv.runOnce()
+	c.Assert(err, check.IsNil)
+	checkIncremental(bal, collReqs0, indexReqs0)
+
+	// A new process picks up the saved state.
+	collReqs0, indexReqs0 = collReqs.Count(), indexReqs.Count()
+	srv = s.newServer(&opts)
+	bal, err = srv.runOnce()
+	c.Assert(err, check.IsNil)
+	checkIncremental(bal, collReqs0, indexReqs0)
+
+	// After BalanceFullSweepPeriod, the next run is a full sweep
+	// again.
+	s.config.Collections.BalanceFullSweepPeriod = arvados.Duration(time.Nanosecond)
+	bal, err = srv.runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(bal.incrementalRun, check.Equals, false)
+}
+
+func (s *runSuite) TestIncrementalNewCollection(c *check.C) {
+	statef, err := ioutil.TempFile("", "keep-balance-state-test-")
+	c.Assert(err, check.IsNil)
+	statef.Close()
+	os.Remove(statef.Name())
+	defer os.Remove(statef.Name())
+	defer os.Remove(statef.Name() + ".journal")
+	s.config.Collections.BalanceStateFile = statef.Name()
+	s.config.Collections.BalanceFullSweepPeriod = arvados.Duration(time.Hour)
+
+	var mtx sync.Mutex
+	created := false
+	s.stub.serveCurrentUserAdmin()
+	s.stub.mux.HandleFunc("/arvados/v1/collections", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		filters := r.Form.Get("filters")
+		mtx.Lock()
+		defer mtx.Unlock()
+		switch {
+		case !strings.Contains(filters, `modified_at`):
+			io.WriteString(w, `{"items_available":1,"items":[
+				{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z"}]}`)
+		case created && strings.Contains(filters, `"modified_at","\u003e="`) && !strings.Contains(filters, `"uuid"`):
+			io.WriteString(w, `{"items_available":1,"items":[
+				{"uuid":"zzzzz-4zz18-bbbbbbbbbbbbbbb","portable_data_hash":"1f4b0bc7583c2a7f9102c395f4ffc5e3+45","manifest_text":". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n","modified_at":"2038-01-01T00:00:00Z","replication_desired":4}]}`)
+		default:
+			io.WriteString(w, `{"items_available":0,"items":[]}`)
+		}
+	})
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	srv := s.newServer(&RunOptions{Logger: ctxlog.TestLogger(c)})
+
+	// The "foo" block is not referenced by any collection, so
+	// all 4 replicas are trashed.
+	bal, err := srv.runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(bal.incrementalRun, check.Equals, false)
+	c.Check(bal.stats.trashes, check.Equals, 4)
+
+	// After a collection referencing "foo" is created, an
+	// incremental run (even in a new process) sends no trash
+	// requests.
+	mtx.Lock()
+	created = true
+	mtx.Unlock()
+	srv = s.newServer(&RunOptions{Logger: ctxlog.TestLogger(c)})
+	bal, err = srv.runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(bal.incrementalRun, check.Equals, true)
+	c.Check(bal.stats.trashes, check.Equals, 0)
+	for _, srv := range bal.KeepServices {
+		c.Check(srv.ChangeSet.Trashes, check.HasLen, 0)
+	}
+
+	// The incremental run's changes were appended to a journal,
+	// which is replayed by the next process.
+	_, err = os.Stat(statef.Name() + ".journal")
+	c.Check(err, check.IsNil)
+	srv = s.newServer(&RunOptions{Logger: ctxlog.TestLogger(c)})
+	bal, err = srv.runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(bal.incrementalRun, check.Equals, true)
+	c.Check(bal.stats.trashes, check.Equals, 0)
+	c.Check(bal.inc.Collections["zzzzz-4zz18-bbbbbbbbbbbbbbb"], check.NotNil)
+}
+
+func (s *runSuite) TestIncrementalLateCommit(c *check.C) {
+	s.config.Collections.BalanceFullSweepPeriod = arvados.Duration(time.Hour)
+
+	// modified_at of a collection that is committed after the
+	// first run, in a transaction that started before it.
+	var mtx sync.Mutex
+	var lateModifiedAt time.Time
+	s.stub.serveCurrentUserAdmin()
+	s.stub.mux.HandleFunc("/arvados/v1/collections", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		var filters [][]interface{}
+		json.Unmarshal([]byte(r.Form.Get("filters")), &filters)
+		var since time.Time
+		for _, f := range filters {
+			if len(f) == 3 && f[0] == "modified_at" && f[1] == ">=" {
+				since, _ = time.Parse(time.RFC3339Nano, f[2].(string))
+			}
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		switch {
+		case !strings.Contains(r.Form.Get("filters"), `modified_at`):
+			io.WriteString(w, `{"items_available":1,"items":[
+				{"uuid":"zzzzz-4zz18-aaaaaaaaaaaaaaa","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z"}]}`)
+		case !lateModifiedAt.IsZero() && !since.IsZero() && !since.After(lateModifiedAt) && !strings.Contains(r.Form.Get("filters"), `"uuid"`):
+			fmt.Fprintf(w, `{"items_available":1,"items":[
+				{"uuid":"zzzzz-4zz18-bbbbbbbbbbbbbbb","manifest_text":". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:foo\n","modified_at":%q,"replication_desired":4}]}`, lateModifiedAt.Format(time.RFC3339Nano))
+		default:
+			io.WriteString(w, `{"items_available":0,"items":[]}`)
+		}
+	})
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	srv := s.newServer(&RunOptions{Logger: ctxlog.TestLogger(c)})
+
+	bal, err := srv.runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(bal.incrementalRun, check.Equals, false)
+	c.Check(bal.stats.trashes, check.Equals, 4)
+
+	// The new collection's modified_at is before the first
+	// run's StateTime, but it was not visible to the first run.
+	mtx.Lock()
+	lateModifiedAt = srv.RunOptions.incremental.StateTime.Add(-time.Second)
+	mtx.Unlock()
+	bal, err = srv.runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(bal.incrementalRun, check.Equals, true)
+	c.Check(bal.inc.Collections["zzzzz-4zz18-bbbbbbbbbbbbbbb"], check.NotNil)
+	c.Check(bal.stats.trashes, check.Equals, 0)
+}
+
+func (s *runSuite) TestIncrementalLostBlocks(c *check.C) {
+	statef, err := ioutil.TempFile("", "keep-balance-state-test-")
+	c.Assert(err, check.IsNil)
+	statef.Close()
+	os.Remove(statef.Name())
+	defer os.Remove(statef.Name())
+	defer os.Remove(statef.Name() + ".journal")
+	s.config.Collections.BalanceStateFile = statef.Name()
+	s.config.Collections.BalanceFullSweepPeriod = arvados.Duration(time.Hour)
+	lostf, err := ioutil.TempFile("", "keep-balance-lost-blocks-test-")
+	c.Assert(err, check.IsNil)
+	s.config.Collections.BlobMissingReport = lostf.Name()
+	defer os.Remove(lostf.Name())
+
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	expect := "37b51d194a7513e45b56f6524f2d51f2 fa7aeb5140e2848d39b416daeef4ffc5+45\tzzzzz-4zz18-aaaaaaaaaaaaaaa zzzzz-4zz18-ehbhgtheo8909or\n"
+	var srv *Server
+	for i := 0; i < 3; i++ {
+		// The first run is a full sweep. The others only
+		// re-evaluate the blocks with pending pulls ("foo"),
+		// but keep reporting the lost "bar" block.
+		srv = s.newServer(&RunOptions{Logger: ctxlog.TestLogger(c)})
+		bal, err := srv.runOnce()
+		c.Assert(err, check.IsNil)
+		c.Check(bal.incrementalRun, check.Equals, i > 0)
+		lost, err := ioutil.ReadFile(lostf.Name())
+		c.Assert(err, check.IsNil)
+		c.Check(string(lost), check.Equals, expect)
+	}
+
+	// If the "bar" block is re-evaluated, it is reported along
+	// with the collections remembered from previous runs.
+	srv.RunOptions.incremental.Pending["37b51d194a7513e45b56f6524f2d51f2+3"] = true
+	bal, err := srv.runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(bal.incrementalRun, check.Equals, true)
+	c.Check(bal.affected("37b51d194a7513e45b56f6524f2d51f2+3"), check.Equals, true)
+	lost, err := ioutil.ReadFile(lostf.Name())
+	c.Assert(err, check.IsNil)
+	c.Check(string(lost), check.Equals, expect)
+}
+
+func (s *runSuite) TestStatusAPI(c *check.C) {
+	s.config.ManagementToken = "xyzzy"
+	opts := RunOptions{
+		Logger: ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.mux.HandleFunc("/arvados/v1/collections/", func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/arvados/v1/collections/") {
+		case "zzzzz-4zz18-ehbhgtheo8909or":
+			io.WriteString(w, `{"uuid":"zzzzz-4zz18-ehbhgtheo8909or","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3+Afe01 0:3:bar\n"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"errors":["not found"]}`)
+		}
+	})
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	srv := s.newServer(&opts)
+	srv.setupHandler()
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := httptest.NewRecorder()
+		srv.ServeHTTP(resp, req)
+		return resp
+	}
+	fooPath := "/arvados/v1/balance/blocks/acbd18db4cc2f85cedef654fccc4a4d8+3+Afe01"
+	c.Check(get(fooPath, "").Code, check.Equals, http.StatusUnauthorized)
+	c.Check(get(fooPath, "badtoken").Code, check.Equals, http.StatusForbidden)
+	c.Check(get(fooPath, "xyzzy").Code, check.Equals, http.StatusServiceUnavailable)
+
+	bal, err := srv.runOnce()
+	c.Assert(err, check.IsNil)
+
+	resp := get(fooPath, "xyzzy")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	var blkStatus blockStatus
+	c.Check(json.NewDecoder(resp.Body).Decode(&blkStatus), check.IsNil)
+	c.Check(blkStatus.Locator, check.Equals, arvados.SizedDigest("acbd18db4cc2f85cedef654fccc4a4d8+3"))
+	c.Check(blkStatus.StateTime.Equal(bal.stateTime), check.Equals, true)
+	c.Check(blkStatus.Desired, check.DeepEquals, map[string]int{"default": 2})
+	c.Check(blkStatus.Actual, check.DeepEquals, map[string]int{"default": 4})
+	c.Check(blkStatus.Replicas, check.HasLen, 4)
+	for _, repl := range blkStatus.Replicas {
+		c.Check(repl.StorageClasses, check.DeepEquals, []string{"default"})
+		c.Check(repl.MountUUID, check.Matches, `zzzzz-ivpuk-[0-3]00000000000000`)
+	}
+
+	c.Check(get("/arvados/v1/balance/blocks/37b51d194a7513e45b56f6524f2d51f3+3", "xyzzy").Code, check.Equals, http.StatusNotFound)
+	c.Check(get("/arvados/v1/balance/blocks/foo", "xyzzy").Code, check.Equals, http.StatusBadRequest)
+
+	resp = get("/arvados/v1/balance/collections/zzzzz-4zz18-ehbhgtheo8909or", "xyzzy")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	var collStatus collectionStatus
+	c.Check(json.NewDecoder(resp.Body).Decode(&collStatus), check.IsNil)
+	c.Check(collStatus.UUID, check.Equals, "zzzzz-4zz18-ehbhgtheo8909or")
+	c.Check(collStatus.Desired, check.DeepEquals, map[string]int{"default": 2})
+	c.Check(collStatus.Actual, check.DeepEquals, map[string]int{"default": 1})
+	c.Check(collStatus.Blocks, check.Equals, 1)
+	c.Check(collStatus.Underreplicated, check.DeepEquals, []arvados.SizedDigest{"37b51d194a7513e45b56f6524f2d51f2+3"})
+
+	c.Check(get("/arvados/v1/balance/collections/zzzzz-4zz18-000000000000000", "xyzzy").Code, check.Equals, http.StatusNotFound)
+}
+
+// In incremental mode, the status API does not report the state of
+// the next run while it is in progress.
+func (s *runSuite) TestStatusAPIIncremental(c *check.C) {
+	s.config.ManagementToken = "xyzzy"
+	s.config.Collections.BalanceFullSweepPeriod = arvados.Duration(time.Hour)
+	opts := RunOptions{
+		Logger: ctxlog.TestLogger(c),
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+	srv := s.newServer(&opts)
+	srv.setupHandler()
+
+	bal, err := srv.runOnce()
+	c.Assert(err, check.IsNil)
+	c.Assert(bal.inc, check.NotNil)
+
+	req := httptest.NewRequest("GET", "/arvados/v1/balance/blocks/acbd18db4cc2f85cedef654fccc4a4d8+3", nil)
+	req.Header.Set("Authorization", "Bearer xyzzy")
+	resp := httptest.NewRecorder()
+	srv.ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	var blkStatus blockStatus
+	c.Check(json.NewDecoder(resp.Body).Decode(&blkStatus), check.IsNil)
+	c.Check(blkStatus.Actual, check.DeepEquals, map[string]int{"default": 4})
+	c.Check(blkStatus.Replicas, check.HasLen, 4)
+
+	// While the next run is updating the map in place, the
+	// status API is unavailable.
+	srv.startRun()
+	clearReplicas(bal.BlockStateMap, nil)
+	resp = httptest.NewRecorder()
+	srv.ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusServiceUnavailable)
+	c.Check(resp.Header().Get("Retry-After"), check.Not(check.Equals), "")
+
+	// If that run fails, the partially updated map is discarded.
+	srv.finishRun(bal, errors.New("test"))
+	resp = httptest.NewRecorder()
+	srv.ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusServiceUnavailable)
+
+	_, err = srv.runOnce()
+	c.Assert(err, check.IsNil)
+	resp = httptest.NewRecorder()
+	srv.ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+}
+
+func (s *runSuite) TestSaveAndApplyPlan(c *check.C) {
+	s.config.Collections.BalancePeriod = arvados.Duration(time.Hour)
+	planf, err := ioutil.TempFile("", "keep-balance-plan-test-")
+	c.Assert(err, check.IsNil)
+	planf.Close()
+	defer os.Remove(planf.Name())
+
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	indexReqs := s.stub.serveKeepstoreIndexFoo4Bar1()
+	trashReqs := s.stub.serveKeepstoreTrash()
+	pullReqs := s.stub.serveKeepstorePull()
+
+	// Dry run: save the plan without committing anything.
+	srv := s.newServer(&RunOptions{
+		SavePlan: planf.Name(),
+		Logger:   ctxlog.TestLogger(c),
+	})
+	_, err = srv.runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(trashReqs.Count(), check.Equals, 0)
+	c.Check(pullReqs.Count(), check.Equals, 0)
+
+	buf, err := ioutil.ReadFile(planf.Name())
+	c.Assert(err, check.IsNil)
+	var p plan
+	c.Assert(json.Unmarshal(buf, &p), check.IsNil)
+	c.Check(p.KeepServices, check.HasLen, 4)
+	pulls, trashes := 0, 0
+	for _, pc := range p.KeepServices {
+		pulls += len(pc.Pulls)
+		trashes += len(pc.Trashes)
+	}
+	c.Check(pulls, check.Equals, 2)
+	c.Check(trashes, check.Equals, 2)
+
+	// Remove the trash requests from the plan, then apply it.
+	for _, pc := range p.KeepServices {
+		pc.Trashes = nil
+	}
+	buf, err = json.Marshal(p)
+	c.Assert(err, check.IsNil)
+	c.Assert(ioutil.WriteFile(planf.Name(), buf, 0600), check.IsNil)
+
+	indexReqs0 := indexReqs.Count()
+	srv = s.newServer(&RunOptions{
+		ApplyPlan:   planf.Name(),
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      ctxlog.TestLogger(c),
+	})
+	bal, err := srv.runOnce()
+	c.Assert(err, check.IsNil)
+	c.Check(indexReqs.Count(), check.Equals, indexReqs0)
+	c.Check(pullReqs.Count(), check.Equals, 4)
+	// Empty trash lists are sent when clearing existing trash
+	// lists, and again when committing the plan.
+	c.Check(trashReqs.Count(), check.Equals, 8)
+	pulls, trashes = 0, 0
+	for _, srv := range bal.KeepServices {
+		pulls += len(srv.ChangeSet.Pulls)
+		trashes += len(srv.ChangeSet.Trashes)
+	}
+	c.Check(pulls, check.Equals, 2)
+	c.Check(trashes, check.Equals, 0)
+
+	// A plan cannot be applied after the keep services or mounts
+	// have changed.
+	p.MountState = "x"
+	buf, err = json.Marshal(p)
+	c.Assert(err, check.IsNil)
+	c.Assert(ioutil.WriteFile(planf.Name(), buf, 0600), check.IsNil)
+	_, err = srv.runOnce()
+	c.Check(err, check.ErrorMatches, `plan .* is out of date: .*`)
+	c.Check(pullReqs.Count(), check.Equals, 4)
+}
+
+func (s *runSuite) TestApplyStalePlan(c *check.C) {
+	s.config.Collections.BalancePeriod = arvados.Duration(time.Hour)
+	planf, err := ioutil.TempFile("", "keep-balance-plan-test-")
+	c.Assert(err, check.IsNil)
+	planf.Close()
+	defer os.Remove(planf.Name())
+
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveKeepServices(stubServices)
+	s.stub.serveKeepstoreMounts()
+	s.stub.serveKeepstoreTrash()
+	s.stub.serveKeepstorePull()
+
+	// Same as serveKeepstoreIndexFoo4Bar1, except that foo can
+	// be removed from a mount after the plan is saved.
+	var mtx sync.Mutex
+	lost := map[string]bool{}
+	s.stub.mux.HandleFunc("/index/", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	})
+	mtime := 12345678
+	for host, mounts := range stubMounts {
+		host, uuid := host, mounts[0].UUID
+		mtime++
+		mtime := mtime
+		s.stub.mux.HandleFunc(fmt.Sprintf("/mounts/%s/blocks", uuid), func(w http.ResponseWriter, r *http.Request) {
+			if host == "keep0.zzzzz.arvadosapi.com:25107" {
+				io.WriteString(w, "37b51d194a7513e45b56f6524f2d51f2+3 12345678\n")
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			if !lost[uuid] {
+				fmt.Fprintf(w, "acbd18db4cc2f85cedef654fccc4a4d8+3 %d\n", mtime)
+			}
+			io.WriteString(w, "\n")
+		})
+	}
+
+	srv := s.newServer(&RunOptions{
+		SavePlan: planf.Name(),
+		Logger:   ctxlog.TestLogger(c),
+	})
+	_, err = srv.runOnce()
+	c.Assert(err, check.IsNil)
+	buf, err := ioutil.ReadFile(planf.Name())
+	c.Assert(err, check.IsNil)
+	var p plan
+	c.Assert(json.Unmarshal(buf, &p), check.IsNil)
+	trashing := map[string]bool{}
+	for _, pc := range p.KeepServices {
+		for _, t := range pc.Trashes {
+			trashing[t.From] = true
+		}
+	}
+	c.Assert(trashing, check.HasLen, 2)
+
+	apply := func() (*Balancer, error) {
+		srv := s.newServer(&RunOptions{
+			ApplyPlan:   planf.Name(),
+			CommitTrash: true,
+			Logger:      ctxlog.TestLogger(c),
+		})
+		return srv.runOnce()
+	}
+	countTrash := func(bal *Balancer) (n int) {
+		for _, srv := range bal.KeepServices {
+			n += len(srv.ChangeSet.Trashes)
+		}
+		return
+	}
+
+	// Nothing has changed since the plan was saved, so the
+	// trash requests are sent.
+	bal, err := apply()
+	c.Assert(err, check.IsNil)
+	c.Check(countTrash(bal), check.Equals, 2)
+
+	// One of the replicas that the plan keeps has been lost, so
+	// trashing the other two would leave foo with one replica.
+	mtx.Lock()
+	for _, mounts := range stubMounts {
+		if !trashing[mounts[0].UUID] {
+			lost[mounts[0].UUID] = true
+			break
+		}
+	}
+	mtx.Unlock()
+	bal, err = apply()
+	c.Assert(err, check.IsNil)
+	c.Check(countTrash(bal), check.Equals, 0)
+
+	// A plan older than BalancePeriod is refused.
+	p.CreatedAt = time.Now().Add(-2 * time.Hour)
+	buf, err = json.Marshal(p)
+	c.Assert(err, check.IsNil)
+	c.Assert(ioutil.WriteFile(planf.Name(), buf, 0600), check.IsNil)
+	_, err = apply()
+	c.Check(err, check.ErrorMatches, `plan .* is too old: .*`)
+
+	// ...and so is a plan older than BlobSigningTTL, even if
+	// BalancePeriod is longer.
+	s.config.Collections.BalancePeriod = arvados.Duration(24 * time.Hour)
+	s.config.Collections.BlobSigningTTL = arvados.Duration(time.Hour)
+	_, err = apply()
+	c.Check(err, check.ErrorMatches, `plan .* is too old: .*`)
+}
+
 func (s *runSuite) TestRunForever(c *check.C) {
 	s.config.ManagementToken = "xyzzy"
 	opts := RunOptions{
@@ -660,6 +660,94 @@ func (bal *balancerSuite) TestChangeStorageClasses(c *check.C) {
 // Clear all servers' changesets, balance a single block, and verify
 // the appropriate changes for that block have been added to the
 // changesets.
+func (bal *balancerSuite) TestCostAware(c *check.C) {
+	for _, srv := range bal.srvs {
+		srv.mounts[0].storageCost = 1
+	}
+	for _, srv := range bal.srvList(0, slots{1, 2}) {
+		srv.mounts[0].storageCost = 10
+	}
+	bal.costAware = true
+
+	// Surplus replicas move to cheaper mounts.
+	bal.try(c, tester{
+		desired:    map[string]int{"default": 3},
+		current:    slots{0, 1, 2},
+		shouldPull: slots{3, 4}})
+	bal.try(c, tester{
+		desired:     map[string]int{"default": 3},
+		current:     slots{0, 1, 2, 3, 4},
+		shouldTrash: slots{1, 2}})
+
+	// Projected cost before and after the pulls/trashes.
+	blk := &BlockState{
+		Replicas: bal.replList(0, slots{0, 1, 2, 3, 4}),
+		Desired:  map[string]int{"default": 3},
+	}
+	result := bal.balanceBlock(knownBlkid(0), blk)
+	gib := float64(knownBlkid(0).Size()) / (1 << 30)
+	c.Check(result.cost/gib, check.Equals, 23.0)
+	c.Check(result.costAfter/gib, check.Equals, 3.0)
+
+	// The first replica stays in the best rendezvous position,
+	// even if a cheaper mount is available.
+	bal.srvList(0, slots{0})[0].mounts[0].storageCost = 10
+	bal.try(c, tester{
+		desired:    map[string]int{"default": 2},
+		current:    slots{5},
+		shouldPull: slots{0, 3}})
+}
+
+func (bal *balancerSuite) TestPullFromLowestEgressCost(c *check.C) {
+	bal.srvList(0, slots{0})[0].mounts[0].egressCost = 5
+	bal.srvList(0, slots{1})[0].mounts[0].egressCost = 1
+	bal.try(c, tester{
+		desired:    map[string]int{"default": 3},
+		current:    slots{0, 1},
+		shouldPull: slots{2}})
+	for _, srv := range bal.srvs {
+		for _, pull := range srv.Pulls {
+			c.Check(pull.From, check.Equals, bal.srvList(0, slots{1})[0])
+		}
+	}
+}
+
+func (bal *balancerSuite) TestPackDigests(c *check.C) {
+	blkids := []arvados.SizedDigest{knownBlkid(0), knownBlkid(1), "d41d8cd98f00b204e9800998ecf8427e+0", "acbd18db4cc2f85cedef654fccc4a4d8+67108864"}
+	packed, err := packDigests(blkids)
+	c.Assert(err, check.IsNil)
+	c.Check(packed.Len(), check.Equals, 4)
+	c.Check(packed.Digests(), check.DeepEquals, blkids)
+	var buf [4]byte
+	c.Check(string(packed.prefix(3, 3, &buf)), check.Equals, "acb")
+
+	_, err = packDigests([]arvados.SizedDigest{"acbd18db4cc2f85cedef654fccc4a4d8"})
+	c.Check(err, check.NotNil)
+}
+
+func (bal *balancerSuite) TestCoarsenPrefixes(c *check.C) {
+	prefixes := map[string]bool{}
+	for i := 0; i < incrementalMaxPrefixes; i++ {
+		prefixes[fmt.Sprintf("%03x", i*2)] = true
+	}
+	c.Check(coarsenPrefixes(prefixes), check.HasLen, incrementalMaxPrefixes)
+
+	// Too many 3-digit prefixes, so 2-digit prefixes are used.
+	prefixes["f01"] = true
+	coarse := coarsenPrefixes(prefixes)
+	c.Check(coarse, check.HasLen, 33)
+	c.Check(coarse["1f"], check.Equals, true)
+	c.Check(coarse["f0"], check.Equals, true)
+	c.Check(prefixLen(coarse), check.Equals, 2)
+
+	// More than half of all blocks are affected, so complete
+	// indexes are used.
+	for i := 0; i < 128; i++ {
+		prefixes[fmt.Sprintf("%02x0", i*2+1)] = true
+	}
+	c.Check(coarsenPrefixes(prefixes), check.IsNil)
+}
+
 func (bal *balancerSuite) try(c *check.C, t tester) {
 	bal.setupLookupTables()
 	blk := &BlockState{
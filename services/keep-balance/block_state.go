@@ -24,6 +24,7 @@ type Replica struct {
 // know about).
 type BlockState struct {
 	Refs     map[string]bool // pdh => true (only tracked when len(Replicas)==0)
+	RefUUIDs map[string]bool // collection uuid => true (likewise)
 	RefCount int
 	Replicas []Replica
 	Desired  map[string]int
@@ -44,17 +45,25 @@ func (bs *BlockState) addReplica(r Replica) {
 	// Free up memory wasted by tracking PDHs that will never be
 	// reported (see comment in increaseDesired)
 	bs.Refs = nil
+	bs.RefUUIDs = nil
 }
 
-func (bs *BlockState) increaseDesired(pdh string, classes []string, n int) {
+func (bs *BlockState) increaseDesired(pdh, uuid string, classes []string, n int) {
 	if pdh != "" && len(bs.Replicas) == 0 {
-		// Note we only track PDHs if there's a possibility
-		// that we will report the list of referring PDHs,
-		// i.e., if we haven't yet seen a replica.
+		// Note we only track PDHs and UUIDs if there's a
+		// possibility that we will report the list of
+		// referring collections, i.e., if we haven't yet seen
+		// a replica.
 		if bs.Refs == nil {
 			bs.Refs = map[string]bool{}
 		}
 		bs.Refs[pdh] = true
+		if uuid != "" {
+			if bs.RefUUIDs == nil {
+				bs.RefUUIDs = map[string]bool{}
+			}
+			bs.RefUUIDs[uuid] = true
+		}
 	}
 	bs.RefCount++
 	if len(classes) == 0 {
@@ -69,6 +78,30 @@ func (bs *BlockState) increaseDesired(pdh string, classes []string, n int) {
 	}
 }
 
+// classReplication returns the number of replicas stored on mounts
+// that offer each storage class. A device that is mounted on more
+// than one server is only counted once.
+func (bs *BlockState) classReplication() map[string]int {
+	repl := map[string]int{}
+	countedDev := map[string]bool{}
+	for _, r := range bs.Replicas {
+		if r.KeepMount.DeviceID != "" {
+			if countedDev[r.KeepMount.DeviceID] {
+				continue
+			}
+			countedDev[r.KeepMount.DeviceID] = true
+		}
+		if len(r.KeepMount.StorageClasses) == 0 {
+			repl["default"] += r.KeepMount.Replication
+			continue
+		}
+		for class := range r.KeepMount.StorageClasses {
+			repl[class] += r.KeepMount.Replication
+		}
+	}
+	return repl
+}
+
 // BlockStateMap is a goroutine-safe wrapper around a
 // map[arvados.SizedDigest]*BlockState.
 type BlockStateMap struct {
@@ -106,6 +139,27 @@ func (bsm *BlockStateMap) Apply(f func(arvados.SizedDigest, *BlockState)) {
 	}
 }
 
+// Get returns a copy of the entry for the given block, or false if
+// there is no such entry.
+func (bsm *BlockStateMap) Get(blkid arvados.SizedDigest) (BlockState, bool) {
+	bsm.mutex.Lock()
+	defer bsm.mutex.Unlock()
+
+	blk := bsm.entries[blkid]
+	if blk == nil {
+		return BlockState{}, false
+	}
+	cp := BlockState{
+		RefCount: blk.RefCount,
+		Replicas: append([]Replica(nil), blk.Replicas...),
+		Desired:  make(map[string]int, len(blk.Desired)),
+	}
+	for class, n := range blk.Desired {
+		cp.Desired[class] = n
+	}
+	return cp, true
+}
+
 // AddReplicas updates the map to indicate that mnt has a replica of
 // each block in idx.
 func (bsm *BlockStateMap) AddReplicas(mnt *KeepMount, idx []arvados.KeepServiceIndexEntry) {
@@ -123,13 +177,38 @@ func (bsm *BlockStateMap) AddReplicas(mnt *KeepMount, idx []arvados.KeepServiceI
 // IncreaseDesired updates the map to indicate the desired replication
 // for the given blocks in the given storage class is at least n.
 //
-// If pdh is non-empty, it will be tracked and reported in the "lost
-// blocks" report.
-func (bsm *BlockStateMap) IncreaseDesired(pdh string, classes []string, n int, blocks []arvados.SizedDigest) {
+// If pdh is non-empty, it (and the collection uuid, if non-empty)
+// will be tracked and reported in the "lost blocks" report.
+func (bsm *BlockStateMap) IncreaseDesired(pdh, uuid string, classes []string, n int, blocks []arvados.SizedDigest) {
 	bsm.mutex.Lock()
 	defer bsm.mutex.Unlock()
 
 	for _, blkid := range blocks {
-		bsm.get(blkid).increaseDesired(pdh, classes, n)
+		bsm.get(blkid).increaseDesired(pdh, uuid, classes, n)
+	}
+}
+
+// GetConfirmedReplication returns, for each of the given storage
+// classes, the minimum replication level of the given blocks on
+// mounts that offer that class. A device that is mounted on more
+// than one server is only counted once.
+//
+// If blkids is empty, the returned map is empty.
+func (bsm *BlockStateMap) GetConfirmedReplication(blkids []arvados.SizedDigest, classes []string) map[string]int {
+	bsm.mutex.Lock()
+	defer bsm.mutex.Unlock()
+
+	confirmed := make(map[string]int, len(classes))
+	for i, blkid := range blkids {
+		var repl map[string]int
+		if blk := bsm.entries[blkid]; blk != nil {
+			repl = blk.classReplication()
+		}
+		for _, class := range classes {
+			if i == 0 || repl[class] < confirmed[class] {
+				confirmed[class] = repl[class]
+			}
+		}
 	}
+	return confirmed
 }
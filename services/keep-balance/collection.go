@@ -6,7 +6,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -32,11 +35,27 @@ func countCollections(c *arvados.Client, params arvados.ResourceListParams) (int
 // If pageSize > 0 it is used as the maximum page size in each API
 // call; otherwise the maximum allowed page size is requested.
 func EachCollection(ctx context.Context, c *arvados.Client, pageSize int, f func(arvados.Collection) error, progress func(done, total int)) error {
+	return eachCollectionSince(ctx, c, pageSize, time.Time{}, f, progress)
+}
+
+// eachCollectionSince is like EachCollection, but if since is
+// non-zero, it skips collections whose modified_at is before since.
+func eachCollectionSince(ctx context.Context, c *arvados.Client, pageSize int, since time.Time, f func(arvados.Collection) error, progress func(done, total int)) error {
 	if progress == nil {
 		progress = func(_, _ int) {}
 	}
 
+	var sinceFilters []arvados.Filter
+	if !since.IsZero() {
+		sinceFilters = []arvados.Filter{{
+			Attr:     "modified_at",
+			Operator: ">=",
+			Operand:  since,
+		}}
+	}
+
 	expectCount, err := countCollections(c, arvados.ResourceListParams{
+		Filters:            sinceFilters,
 		IncludeTrash:       true,
 		IncludeOldVersions: true,
 	})
@@ -65,7 +84,8 @@ func EachCollection(ctx context.Context, c *arvados.Client, pageSize int, f func
 		Limit:              &limit,
 		Order:              "modified_at, uuid",
 		Count:              "none",
-		Select:             []string{"uuid", "unsigned_manifest_text", "modified_at", "portable_data_hash", "replication_desired"},
+		Filters:            sinceFilters,
+		Select:             []string{"uuid", "unsigned_manifest_text", "modified_at", "portable_data_hash", "replication_desired", "storage_classes_desired", "storage_classes_confirmed", "storage_classes_confirmed_at", "is_trashed", "current_version_uuid"},
 		IncludeTrash:       true,
 		IncludeOldVersions: true,
 	}
@@ -151,10 +171,10 @@ func EachCollection(ctx context.Context, c *arvados.Client, pageSize int, f func
 	progress(callCount, expectCount)
 
 	if checkCount, err := countCollections(c, arvados.ResourceListParams{
-		Filters: []arvados.Filter{{
+		Filters: append([]arvados.Filter{{
 			Attr:     "modified_at",
 			Operator: "<=",
-			Operand:  filterTime}},
+			Operand:  filterTime}}, sinceFilters...),
 		IncludeTrash:       true,
 		IncludeOldVersions: true,
 	}); err != nil {
@@ -165,3 +185,161 @@ func EachCollection(ctx context.Context, c *arvados.Client, pageSize int, f func
 
 	return nil
 }
+
+// Number of concurrent API calls used by updateCollections.
+const updateCollectionsWorkers = 8
+
+var errUpdateCollectionsDone = errors.New("done")
+
+// updateCollections updates the storage_classes_confirmed and
+// storage_classes_confirmed_at fields of each collection whose
+// confirmed storage classes (i.e., the desired classes in which all
+// of its blocks are stored at the desired replication level,
+// according to bal.BlockStateMap) differ from the stored values.
+//
+// Collections that were modified after the current state was
+// retrieved are skipped, because they might reference blocks that
+// were written after the keepstore indexes were retrieved. Old
+// versions and trashed collections are also skipped.
+//
+// The collections are not retrieved again: they were remembered
+// when the current state was retrieved. The API server does not
+// change modified_at when only these fields are updated, so the
+// updated collections do not count as modified in the next
+// incremental run.
+//
+// At most cluster.Collections.BalanceUpdateLimit collections are
+// updated.
+func (bal *Balancer) updateCollections(ctx context.Context, c *arvados.Client, cluster *arvados.Cluster) error {
+	limit := cluster.Collections.BalanceUpdateLimit
+	if limit <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	defer bal.time("update_collections", "wall clock time to update collections")()
+	threshold := bal.stateTime
+
+	type update struct {
+		uuid      string
+		confirmed []string
+		rec       *collectionRecord
+	}
+	todo := make(chan update, updateCollectionsWorkers)
+	var updated, failed int
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < updateCollectionsWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for upd := range todo {
+				var confirmedAt interface{}
+				if len(upd.confirmed) > 0 {
+					confirmedAt = threshold
+				}
+				err := c.RequestAndDecodeContext(ctx, nil, "PUT", "arvados/v1/collections/"+upd.uuid, nil, map[string]interface{}{
+					"collection": map[string]interface{}{
+						"storage_classes_confirmed":    upd.confirmed,
+						"storage_classes_confirmed_at": confirmedAt,
+					},
+					"select": []string{"uuid"},
+				})
+				mtx.Lock()
+				if err != nil {
+					bal.logf("%s: error updating storage_classes_confirmed: %s", upd.uuid, err)
+					failed++
+				} else {
+					updated++
+					upd.rec.Confirmed = upd.confirmed
+					if bal.inc != nil {
+						// Save the new value in the
+						// next journal entry.
+						bal.inc.modified[upd.uuid] = true
+					}
+				}
+				mtx.Unlock()
+			}
+		}()
+	}
+
+	queued := 0
+	enqueue := func(upd update, current []string) error {
+		if sameClasses(upd.confirmed, current) {
+			return nil
+		}
+		todo <- upd
+		if queued++; queued >= limit {
+			bal.logf("reached BalanceUpdateLimit (%d), not updating any more collections", limit)
+			return errUpdateCollectionsDone
+		}
+		return nil
+	}
+	// Use the collections remembered during GetCurrentState (or
+	// the previous runs) instead of retrieving them all again. In
+	// an incremental run, only collections with affected blocks
+	// can have changed.
+	recs := bal.collections
+	if bal.inc != nil {
+		recs = bal.inc.Collections
+	}
+	var err error
+	for uuid, rec := range recs {
+		if !rec.Updatable || rec.ModifiedAt.After(threshold) {
+			continue
+		}
+		if bal.incrementalRun && !bal.anyAffected(rec.Blocks) {
+			continue
+		}
+		confirmed := bal.confirmedClasses(rec.Blocks.Digests(), rec.Classes, rec.Replication)
+		if err = enqueue(update{uuid: uuid, confirmed: confirmed, rec: rec}, rec.Confirmed); err != nil {
+			break
+		}
+	}
+	close(todo)
+	wg.Wait()
+	bal.logf("updated storage_classes_confirmed on %d collections (%d failed)", updated, failed)
+	if err == errUpdateCollectionsDone {
+		err = nil
+	}
+	return err
+}
+
+// confirmedClasses returns the desired storage classes of a
+// collection with the given blocks that are currently satisfied, in
+// sorted order.
+func (bal *Balancer) confirmedClasses(blkids []arvados.SizedDigest, classes []string, replDesired *int) []string {
+	repl := bal.DefaultReplication
+	if replDesired != nil {
+		repl = *replDesired
+	}
+	if len(classes) == 0 {
+		classes = defaultClasses
+	}
+	have := bal.BlockStateMap.GetConfirmedReplication(blkids, classes)
+	confirmed := []string{}
+	for _, class := range classes {
+		if len(blkids) == 0 || have[class] >= repl {
+			confirmed = append(confirmed, class)
+		}
+	}
+	sort.Strings(confirmed)
+	return confirmed
+}
+
+// sameClasses returns true if a and b contain the same storage
+// classes, disregarding order.
+func sameClasses(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sorted := append([]string(nil), b...)
+	sort.Strings(sorted)
+	for i := range a {
+		if a[i] != sorted[i] {
+			return false
+		}
+	}
+	return true
+}
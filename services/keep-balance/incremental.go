@@ -0,0 +1,937 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+const (
+	// Maximum length of the block hash prefixes used to retrieve
+	// partial keepstore indexes during an incremental run.
+	incrementalPrefixLen = 3
+
+	// Maximum number of distinct prefixes whose indexes are
+	// retrieved individually during an incremental run. If more
+	// prefixes are affected, shorter prefixes are used instead,
+	// and if even that would cover more than half of the
+	// possible block hashes, complete indexes are retrieved.
+	incrementalMaxPrefixes = 256
+
+	// When retrieving the collections modified since the previous
+	// run, also retrieve the ones whose modified_at is up to this
+	// much earlier than the previous run's StateTime. The API
+	// server sets modified_at to the start time of the
+	// transaction, which may commit after we have listed the
+	// collections, and our clock may be ahead of the API
+	// server's. Re-processing a collection is harmless.
+	incrementalOverlap = 15 * time.Minute
+
+	// The state file is rewritten in full when its journal grows
+	// larger than this fraction of the state file itself.
+	incrementalMaxJournalRatio = 0.5
+)
+
+// packedDigests is a compact representation of a list of block
+// digests: the 16-byte MD5 hash and 4-byte size of each block. It
+// uses about a third of the memory of the equivalent
+// []arvados.SizedDigest, which matters because every version of
+// every collection is remembered between runs.
+type packedDigests []byte
+
+const (
+	md5Size          = 16
+	packedDigestSize = md5Size + 4
+)
+
+func packDigests(blkids []arvados.SizedDigest) (packedDigests, error) {
+	p := make(packedDigests, len(blkids)*packedDigestSize)
+	for i, blkid := range blkids {
+		s := string(blkid)
+		plus := strings.IndexByte(s, '+')
+		if plus != md5Size*2 {
+			return nil, fmt.Errorf("invalid block locator %q", s)
+		}
+		ent := p[i*packedDigestSize:]
+		if _, err := hex.Decode(ent[:md5Size], []byte(s[:plus])); err != nil {
+			return nil, fmt.Errorf("invalid block locator %q: %s", s, err)
+		}
+		size, err := strconv.ParseUint(s[plus+1:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block locator %q: %s", s, err)
+		}
+		binary.BigEndian.PutUint32(ent[md5Size:], uint32(size))
+	}
+	return p, nil
+}
+
+// Len returns the number of digests in p.
+func (p packedDigests) Len() int {
+	return len(p) / packedDigestSize
+}
+
+// Digest returns the i'th digest in p.
+func (p packedDigests) Digest(i int) arvados.SizedDigest {
+	ent := p[i*packedDigestSize : (i+1)*packedDigestSize]
+	return arvados.SizedDigest(fmt.Sprintf("%x+%d", ent[:md5Size], binary.BigEndian.Uint32(ent[md5Size:])))
+}
+
+// Digests returns all of the digests in p.
+func (p packedDigests) Digests() []arvados.SizedDigest {
+	blkids := make([]arvados.SizedDigest, p.Len())
+	for i := range blkids {
+		blkids[i] = p.Digest(i)
+	}
+	return blkids
+}
+
+// prefix returns the first n (at most 4) hex digits of the i'th
+// digest in p, using buf to avoid allocating a new string.
+func (p packedDigests) prefix(i, n int, buf *[4]byte) []byte {
+	off := i * packedDigestSize
+	hex.Encode(buf[:], p[off:off+2])
+	return buf[:n]
+}
+
+// A collectionRecord is what an incremental balancer remembers about
+// a collection: enough to recompute the desired replication of its
+// blocks, and to update its confirmed storage classes, without
+// retrieving it again.
+type collectionRecord struct {
+	ModifiedAt  time.Time
+	Blocks      packedDigests
+	Classes     []string
+	Replication *int
+	Confirmed   []string
+
+	// PortableDataHash is only remembered if a lost blocks
+	// report is being written.
+	PortableDataHash string
+
+	// Updatable is false for old versions and trashed
+	// collections, whose confirmed storage classes are not
+	// updated (and are not remembered).
+	Updatable bool
+}
+
+// incrementalState is the state carried from one balancing run to the
+// next when incremental balancing is enabled (see
+// Collections.BalanceFullSweepPeriod).
+//
+// Between full sweeps, a run only retrieves the collections that
+// have been modified since the previous run, and the parts of the
+// keepstore indexes that cover their blocks, and only re-evaluates
+// the affected blocks.
+//
+// Collections that are deleted (rather than trashed) between full
+// sweeps are not noticed until the next full sweep, so their blocks
+// remain protected until then.
+//
+// When saved to a state file, the complete state is written after
+// each full sweep, and the changes made by each incremental run are
+// appended to a journal (see saveIncrementalState).
+type incrementalState struct {
+	// Time when the state was retrieved, according to our
+	// clock. Collections modified after this time (or slightly
+	// before, see incrementalOverlap) might not have been seen.
+	StateTime time.Time
+
+	// Time when the most recent full sweep started.
+	FullSweepAt time.Time
+
+	// Fingerprint of the keep services and mounts, as returned by
+	// (*Balancer)mountState. If this changes, a full sweep is
+	// needed.
+	MountState string
+
+	// Collections, keyed by UUID.
+	Collections map[string]*collectionRecord
+
+	// Blocks that had pull or trash requests in the previous
+	// run. These are re-evaluated in the next run, whether or
+	// not they are referenced by modified collections, so the
+	// requests are resent until they are done.
+	Pending map[arvados.SizedDigest]bool
+
+	blocks   *BlockStateMap
+	services map[string]*KeepService
+
+	// loaded is true if blocks were loaded from a state file, in
+	// which case their desired replication has not been computed
+	// yet.
+	loaded bool
+
+	// UUIDs of collections recorded since the state was last
+	// saved.
+	modified map[string]bool
+}
+
+func newIncrementalState() *incrementalState {
+	return &incrementalState{
+		Collections: map[string]*collectionRecord{},
+		Pending:     map[arvados.SizedDigest]bool{},
+		modified:    map[string]bool{},
+	}
+}
+
+// newCollectionRecord returns a record of the given collection. The
+// portable data hash is only remembered if keepPDH is true.
+func newCollectionRecord(coll arvados.Collection, blkids []arvados.SizedDigest, keepPDH bool) (*collectionRecord, error) {
+	packed, err := packDigests(blkids)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", coll.UUID, err)
+	}
+	rec := &collectionRecord{
+		ModifiedAt:  coll.ModifiedAt,
+		Blocks:      packed,
+		Classes:     coll.StorageClassesDesired,
+		Replication: coll.ReplicationDesired,
+		Updatable:   !coll.IsTrashed && (coll.CurrentVersionUUID == "" || coll.CurrentVersionUUID == coll.UUID),
+	}
+	if rec.Updatable {
+		rec.Confirmed = coll.StorageClassesConfirmed
+	}
+	if keepPDH {
+		rec.PortableDataHash = coll.PortableDataHash
+	}
+	return rec, nil
+}
+
+// recordCollection remembers the given collection. The portable data
+// hash is only remembered if keepPDH is true.
+func (inc *incrementalState) recordCollection(coll arvados.Collection, blkids []arvados.SizedDigest, keepPDH bool) error {
+	rec, err := newCollectionRecord(coll, blkids, keepPDH)
+	if err != nil {
+		return err
+	}
+	inc.Collections[coll.UUID] = rec
+	if inc.modified == nil {
+		inc.modified = map[string]bool{}
+	}
+	inc.modified[coll.UUID] = true
+	return nil
+}
+
+// mountState returns a fingerprint of the current set of keep
+// services and mounts, including the mount attributes that affect
+// balancing decisions.
+func (bal *Balancer) mountState() string {
+	var mnts []string
+	for _, srv := range bal.KeepServices {
+		for _, mnt := range srv.mounts {
+			var classes []string
+			for class := range mnt.StorageClasses {
+				classes = append(classes, class)
+			}
+			sort.Strings(classes)
+			mnts = append(mnts, fmt.Sprintf("%s %s/%s %v %d %s %g %g", srv, mnt.UUID, mnt.DeviceID, mnt.ReadOnly || srv.ReadOnly, mnt.Replication, strings.Join(classes, ","), mnt.storageCost, mnt.egressCost))
+		}
+	}
+	sort.Strings(mnts)
+	return strings.Join(mnts, "; ")
+}
+
+// getIncrementalState returns the state from the previous run if the
+// current run can be incremental, or nil if a full sweep is needed.
+//
+// If the previous run was done by a different process, its state is
+// loaded from Collections.BalanceStateFile.
+func (bal *Balancer) getIncrementalState(cluster *arvados.Cluster, runOptions RunOptions) *incrementalState {
+	inc := runOptions.incremental
+	if inc == nil && cluster.Collections.BalanceStateFile != "" {
+		var err error
+		inc, err = bal.loadIncrementalState(cluster.Collections.BalanceStateFile)
+		if os.IsNotExist(err) {
+			bal.logf("state file %s does not exist yet", cluster.Collections.BalanceStateFile)
+		} else if err != nil {
+			bal.logf("error loading state file: %s", err)
+		}
+	}
+	if inc == nil {
+		bal.logf("full sweep needed: no state from previous run")
+		return nil
+	}
+	if age := time.Since(inc.FullSweepAt); age >= cluster.Collections.BalanceFullSweepPeriod.Duration() {
+		bal.logf("full sweep needed: last full sweep started %v ago", age)
+		return nil
+	}
+	if inc.MountState != bal.mountState() {
+		bal.logf("full sweep needed: keep services or mounts have changed")
+		return nil
+	}
+	if inc.services != nil {
+		// Use the KeepService and KeepMount objects from the
+		// previous run, because the saved replicas refer to
+		// them. They are equivalent to the ones we just
+		// discovered (otherwise mountState would differ).
+		bal.KeepServices = inc.services
+		for _, srv := range bal.KeepServices {
+			srv.ChangeSet = &ChangeSet{}
+		}
+	}
+	return inc
+}
+
+// GetChangedState updates the replication state from the previous
+// run, using the collections that have been modified since then, and
+// the parts of the keepstore indexes that cover the affected blocks.
+//
+// It sets up ComputeChangeSets to re-evaluate only the affected
+// blocks.
+func (bal *Balancer) GetChangedState(ctx context.Context, c *arvados.Client, inc *incrementalState, pageSize int) error {
+	defer bal.time("get_changed_state", "wall clock time to get changes since previous run")()
+	bal.incrementalRun = true
+	bal.inc = inc
+	bal.BlockStateMap = inc.blocks
+
+	dd, err := c.DiscoveryDocument()
+	if err != nil {
+		return err
+	}
+	bal.DefaultReplication = dd.DefaultCollectionReplication
+	bal.MinMtime = time.Now().UnixNano() - dd.BlobSignatureTTL*1e9
+	bal.stateTime = time.Now()
+
+	prefixes := map[string]bool{}
+	for blkid := range inc.Pending {
+		prefixes[string(blkid[:incrementalPrefixLen])] = true
+	}
+	var buf [4]byte
+	err = eachCollectionSince(ctx, c, pageSize, inc.StateTime.Add(-incrementalOverlap),
+		func(coll arvados.Collection) error {
+			if rec := inc.Collections[coll.UUID]; rec != nil {
+				for i := 0; i < rec.Blocks.Len(); i++ {
+					prefixes[string(rec.Blocks.prefix(i, incrementalPrefixLen, &buf))] = true
+				}
+			}
+			blkids, err := coll.SizedDigests()
+			if err != nil {
+				return fmt.Errorf("%v: %v", coll.UUID, err)
+			}
+			err = inc.recordCollection(coll, blkids, bal.LostBlocksFile != "")
+			if err != nil {
+				return err
+			}
+			for _, blkid := range blkids {
+				prefixes[string(blkid[:incrementalPrefixLen])] = true
+			}
+			bal.collScanned++
+			return nil
+		}, func(done, total int) {
+			bal.logf("modified collections: %d/%d", done, total)
+		})
+	if err != nil {
+		return err
+	}
+
+	n := len(prefixes)
+	prefixes = coarsenPrefixes(prefixes)
+	if prefixes == nil {
+		bal.logf("%d block prefixes affected, retrieving complete indexes", n)
+	} else {
+		bal.logf("%d block prefixes affected, retrieving indexes for %d prefixes", n, len(prefixes))
+	}
+	if prefixes == nil || len(prefixes) > 0 {
+		err = bal.refreshReplicas(ctx, c, prefixes)
+		if err != nil {
+			return err
+		}
+	}
+	bal.affectedPrefixes = prefixes
+	bal.affectedPrefixLen = prefixLen(prefixes)
+	bal.recomputeDesired(inc.loaded)
+	inc.loaded = false
+	return nil
+}
+
+// coarsenPrefixes returns a set of block hash prefixes that covers
+// the given prefixes (which are incrementalPrefixLen hex digits
+// long) using at most incrementalMaxPrefixes index requests per
+// mount. Shorter prefixes are used if necessary. If the result
+// would cover more than half of all possible block hashes,
+// coarsenPrefixes returns nil, meaning complete indexes should be
+// retrieved instead.
+func coarsenPrefixes(prefixes map[string]bool) map[string]bool {
+	for plen := incrementalPrefixLen; plen > 0; plen-- {
+		set := map[string]bool{}
+		for prefix := range prefixes {
+			set[prefix[:plen]] = true
+		}
+		if len(set) <= incrementalMaxPrefixes && len(set)*2 <= 1<<(4*uint(plen)) {
+			return set
+		}
+	}
+	return nil
+}
+
+// prefixLen returns the length of the prefixes in the given set,
+// which are all the same length.
+func prefixLen(prefixes map[string]bool) int {
+	for prefix := range prefixes {
+		return len(prefix)
+	}
+	return 0
+}
+
+// affected returns true if the given block needs to be re-evaluated
+// in the current run.
+func (bal *Balancer) affected(blkid arvados.SizedDigest) bool {
+	return bal.affectedPrefixes == nil || bal.affectedPrefixes[string(blkid[:bal.affectedPrefixLen])]
+}
+
+// anyAffected returns true if any of the given blocks needs to be
+// re-evaluated in the current run.
+func (bal *Balancer) anyAffected(blkids packedDigests) bool {
+	if bal.affectedPrefixes == nil {
+		return true
+	}
+	var buf [4]byte
+	for i := 0; i < blkids.Len(); i++ {
+		if bal.affectedPrefixes[string(blkids.prefix(i, bal.affectedPrefixLen, &buf))] {
+			return true
+		}
+	}
+	return false
+}
+
+// copyUnaffectedLostBlocks copies the entries for blocks that were
+// not re-evaluated in the current run from the previous lost blocks
+// report to w.
+func (bal *Balancer) copyUnaffectedLostBlocks(w io.Writer, filename string) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<26)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < incrementalPrefixLen {
+			continue
+		}
+		if bal.affectedPrefixes == nil || bal.affectedPrefixes[line[:bal.affectedPrefixLen]] {
+			continue
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// refreshReplicas retrieves the parts of the keepstore indexes that
+// cover the given block hash prefixes (or the complete indexes, if
+// prefixes is nil), and replaces the replicas of the corresponding
+// blocks in BlockStateMap.
+func (bal *Balancer) refreshReplicas(ctx context.Context, c *arvados.Client, prefixes map[string]bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var sorted []string
+	for prefix := range prefixes {
+		sorted = append(sorted, prefix)
+	}
+	sort.Strings(sorted)
+	if prefixes == nil {
+		sorted = []string{""}
+	}
+
+	type result struct {
+		mounts []*KeepMount
+		idx    []arvados.KeepServiceIndexEntry
+	}
+	var results []result
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(chan error, 1)
+	for _, mounts := range bal.equivMounts() {
+		wg.Add(1)
+		go func(mounts []*KeepMount) {
+			defer wg.Done()
+			var idx []arvados.KeepServiceIndexEntry
+			for _, prefix := range sorted {
+				ents, err := mounts[0].KeepService.IndexMount(ctx, c, mounts[0].UUID, prefix)
+				if err != nil {
+					select {
+					case errs <- fmt.Errorf("%s: retrieve index: %v", mounts[0], err):
+					default:
+					}
+					cancel()
+					return
+				}
+				for _, ent := range ents {
+					if strings.HasPrefix(string(ent.SizedDigest), prefix) {
+						idx = append(idx, ent)
+					}
+				}
+			}
+			mtx.Lock()
+			results = append(results, result{mounts, idx})
+			mtx.Unlock()
+		}(mounts)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return <-errs
+	}
+
+	clearReplicas(bal.BlockStateMap, prefixes)
+	for _, res := range results {
+		for _, mnt := range res.mounts {
+			bal.BlockStateMap.AddReplicas(mnt, res.idx)
+		}
+	}
+	return nil
+}
+
+// clearReplicas forgets the replicas of the blocks whose hashes start
+// with any of the given prefixes (or all blocks, if prefixes is nil).
+func clearReplicas(bsm *BlockStateMap, prefixes map[string]bool) {
+	plen := prefixLen(prefixes)
+	bsm.Apply(func(blkid arvados.SizedDigest, blk *BlockState) {
+		if prefixes == nil || prefixes[string(blkid[:plen])] {
+			blk.Replicas = nil
+		}
+	})
+}
+
+// recomputeDesired recomputes the desired replication of the
+// affected blocks (or all blocks, if all is true) using the
+// remembered collections, and forgets blocks that are neither stored
+// nor referenced.
+func (bal *Balancer) recomputeDesired(all bool) {
+	bsm := bal.BlockStateMap
+	bsm.mutex.Lock()
+	defer bsm.mutex.Unlock()
+	for blkid, blk := range bsm.entries {
+		if all || bal.affected(blkid) {
+			blk.Desired = nil
+			blk.RefCount = 0
+			blk.Refs = nil
+			blk.RefUUIDs = nil
+		}
+	}
+	var buf [4]byte
+	for uuid, rec := range bal.inc.Collections {
+		repl := bal.DefaultReplication
+		if rec.Replication != nil {
+			repl = *rec.Replication
+		}
+		// As in addCollection, refs are only needed for the
+		// lost blocks report.
+		pdh := rec.PortableDataHash
+		if pdh == "" {
+			uuid = ""
+		}
+		for i := 0; i < rec.Blocks.Len(); i++ {
+			if all || bal.affectedPrefixes == nil || bal.affectedPrefixes[string(rec.Blocks.prefix(i, bal.affectedPrefixLen, &buf))] {
+				bsm.get(rec.Blocks.Digest(i)).increaseDesired(pdh, uuid, rec.Classes, repl)
+			}
+		}
+	}
+	for blkid, blk := range bsm.entries {
+		if len(blk.Replicas) == 0 && blk.RefCount == 0 {
+			delete(bsm.entries, blkid)
+		}
+	}
+}
+
+// saveIncrementalState updates bal.inc after a successful run, so it
+// can be used by the next run, and saves it to the given file (if
+// any).
+//
+// After a full sweep, the complete state is written to the file.
+// After an incremental run, only the collections recorded and the
+// replicas retrieved during the run are appended to a journal
+// (filename + ".journal"), which is replayed by
+// loadIncrementalState. The complete state is written again when the
+// journal grows too large relative to the state file.
+func (bal *Balancer) saveIncrementalState(filename string) error {
+	inc := bal.inc
+	inc.StateTime = bal.stateTime
+	if !bal.incrementalRun {
+		inc.FullSweepAt = bal.stateTime
+	}
+	inc.MountState = bal.mountState()
+	inc.blocks = bal.BlockStateMap
+	inc.services = bal.KeepServices
+	inc.Pending = map[arvados.SizedDigest]bool{}
+	for _, srv := range bal.KeepServices {
+		for _, pull := range srv.ChangeSet.Pulls {
+			inc.Pending[pull.SizedDigest] = true
+		}
+		for _, trash := range srv.ChangeSet.Trashes {
+			inc.Pending[trash.SizedDigest] = true
+		}
+	}
+	modified := inc.modified
+	inc.modified = map[string]bool{}
+	if filename == "" {
+		return nil
+	}
+
+	defer bal.time("save_state", "wall clock time to save state file")()
+	if bal.incrementalRun && bal.affectedPrefixes != nil && !journalTooLarge(filename) {
+		err := bal.appendJournal(filename+".journal", modified)
+		if err == nil {
+			return nil
+		}
+		bal.logf("error appending to state journal, rewriting state file instead: %s", err)
+	}
+	return bal.writeStateFile(filename)
+}
+
+// journalTooLarge returns true if the journal for the given state
+// file should be merged into the state file.
+func journalTooLarge(filename string) bool {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return true
+	}
+	jfi, err := os.Stat(filename + ".journal")
+	if os.IsNotExist(err) {
+		return false
+	} else if err != nil {
+		return true
+	}
+	return float64(jfi.Size()) > float64(fi.Size())*incrementalMaxJournalRatio
+}
+
+// writeStateFile writes the complete state to the given file, and
+// removes its journal.
+func (bal *Balancer) writeStateFile(filename string) error {
+	tmpfn := filename + ".tmp"
+	f, err := os.OpenFile(tmpfn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfn)
+	defer f.Close()
+	bufw := bufio.NewWriter(f)
+	err = bal.encodeIncrementalState(gob.NewEncoder(bufw))
+	if err != nil {
+		return err
+	}
+	err = bufw.Flush()
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpfn, filename)
+	if err != nil {
+		return err
+	}
+	// If this fails, the journal entries are ignored anyway the
+	// next time the state is loaded, because they are older than
+	// the state file.
+	if err := os.Remove(filename + ".journal"); err != nil && !os.IsNotExist(err) {
+		bal.logf("error removing old state journal: %s", err)
+	}
+	return nil
+}
+
+// appendJournal appends the changes made by the current incremental
+// run to the given journal file.
+//
+// Each journal entry is an 8-byte length followed by a separately
+// gob-encoded savedDelta and the replicas of the affected blocks, so
+// a partially written entry at the end of the journal can be
+// detected and ignored.
+func (bal *Balancer) appendJournal(jfilename string, modified map[string]bool) error {
+	inc := bal.inc
+	delta := savedDelta{
+		StateTime:   inc.StateTime,
+		FullSweepAt: inc.FullSweepAt,
+		Collections: map[string]*collectionRecord{},
+		Pending:     inc.Pending,
+	}
+	for uuid := range modified {
+		delta.Collections[uuid] = inc.Collections[uuid]
+	}
+	for prefix := range bal.affectedPrefixes {
+		delta.Prefixes = append(delta.Prefixes, prefix)
+	}
+	sort.Strings(delta.Prefixes)
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(delta)
+	if err != nil {
+		return err
+	}
+	err = bal.encodeReplicas(enc, bal.affected)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(jfilename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var hdr [8]byte
+	binary.BigEndian.PutUint64(hdr[:], uint64(buf.Len()))
+	_, err = f.Write(append(hdr[:], buf.Bytes()...))
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// savedReplica is the representation of a Replica in a state file.
+type savedReplica struct {
+	MountUUID string
+	Mtime     int64
+}
+
+// savedState is the representation of an incrementalState in a state
+// file. It is followed by the replicas of each block, encoded as an
+// arvados.SizedDigest and a []savedReplica, and terminated by an
+// empty arvados.SizedDigest.
+type savedState struct {
+	StateTime   time.Time
+	FullSweepAt time.Time
+	MountState  string
+	Collections map[string]*collectionRecord
+	Pending     map[arvados.SizedDigest]bool
+}
+
+// savedDelta is the representation of an incremental run in a state
+// journal. Like savedState, it is followed by the replicas of the
+// blocks whose hashes start with one of the given prefixes.
+type savedDelta struct {
+	StateTime   time.Time
+	FullSweepAt time.Time
+	Collections map[string]*collectionRecord // modified since previous entry
+	Pending     map[arvados.SizedDigest]bool
+	Prefixes    []string
+}
+
+func (bal *Balancer) encodeIncrementalState(enc *gob.Encoder) error {
+	inc := bal.inc
+	err := enc.Encode(savedState{
+		StateTime:   inc.StateTime,
+		FullSweepAt: inc.FullSweepAt,
+		MountState:  inc.MountState,
+		Collections: inc.Collections,
+		Pending:     inc.Pending,
+	})
+	if err != nil {
+		return err
+	}
+	return bal.encodeReplicas(enc, nil)
+}
+
+// encodeReplicas writes the replicas of the blocks selected by the
+// given function (or all blocks, if it is nil), followed by an empty
+// arvados.SizedDigest.
+func (bal *Balancer) encodeReplicas(enc *gob.Encoder, selected func(arvados.SizedDigest) bool) error {
+	var err error
+	bal.BlockStateMap.Apply(func(blkid arvados.SizedDigest, blk *BlockState) {
+		if err != nil || len(blk.Replicas) == 0 || (selected != nil && !selected(blkid)) {
+			return
+		}
+		replicas := make([]savedReplica, len(blk.Replicas))
+		for i, r := range blk.Replicas {
+			replicas[i] = savedReplica{MountUUID: r.KeepMount.UUID, Mtime: r.Mtime}
+		}
+		if err = enc.Encode(blkid); err == nil {
+			err = enc.Encode(replicas)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return enc.Encode(arvados.SizedDigest(""))
+}
+
+// decodeReplicas reads replicas written by encodeReplicas, and
+// returns them as Replicas attached to the given mounts.
+func decodeReplicas(dec *gob.Decoder, mounts map[string]*KeepMount) (map[arvados.SizedDigest][]Replica, error) {
+	blocks := map[arvados.SizedDigest][]Replica{}
+	for {
+		var blkid arvados.SizedDigest
+		var saved []savedReplica
+		if err := dec.Decode(&blkid); err != nil {
+			return nil, err
+		} else if blkid == "" {
+			return blocks, nil
+		} else if err = dec.Decode(&saved); err != nil {
+			return nil, err
+		}
+		replicas := make([]Replica, len(saved))
+		for i, r := range saved {
+			mnt := mounts[r.MountUUID]
+			if mnt == nil {
+				return nil, fmt.Errorf("unknown mount %s", r.MountUUID)
+			}
+			replicas[i] = Replica{KeepMount: mnt, Mtime: r.Mtime}
+		}
+		blocks[blkid] = replicas
+	}
+}
+
+// loadIncrementalState loads the state saved by a previous run,
+// including the changes recorded in its journal. The replicas in the
+// saved state are attached to the mounts in bal.KeepServices, so
+// DiscoverKeepServices and discoverMounts must be called first.
+func (bal *Balancer) loadIncrementalState(filename string) (*incrementalState, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	var saved savedState
+	err = dec.Decode(&saved)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	if saved.MountState != bal.mountState() {
+		// Don't bother loading the replicas.
+		return &incrementalState{MountState: saved.MountState}, nil
+	}
+	mounts := map[string]*KeepMount{}
+	for _, srv := range bal.KeepServices {
+		for _, mnt := range srv.mounts {
+			mounts[mnt.UUID] = mnt
+		}
+	}
+	blocks, err := decodeReplicas(dec, mounts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	bsm := NewBlockStateMap()
+	for blkid, replicas := range blocks {
+		blk := bsm.get(blkid)
+		for _, r := range replicas {
+			blk.addReplica(r)
+		}
+	}
+	inc := &incrementalState{
+		StateTime:   saved.StateTime,
+		FullSweepAt: saved.FullSweepAt,
+		MountState:  saved.MountState,
+		Collections: saved.Collections,
+		Pending:     saved.Pending,
+		blocks:      bsm,
+		loaded:      true,
+		modified:    map[string]bool{},
+	}
+	if inc.Collections == nil {
+		inc.Collections = map[string]*collectionRecord{}
+	}
+	if inc.Pending == nil {
+		inc.Pending = map[arvados.SizedDigest]bool{}
+	}
+	replayed, err := bal.replayJournal(filename+".journal", inc, mounts)
+	if err != nil {
+		return nil, err
+	}
+	bal.logf("loaded state from %s and %d journal entries: %d collections, %d blocks", filename, replayed, len(inc.Collections), len(bsm.entries))
+	return inc, nil
+}
+
+// replayJournal applies the journal entries written by appendJournal
+// to inc, and returns the number of entries applied.
+//
+// Entries that are older than inc (left over from before the state
+// file was last rewritten) are skipped. A partially written entry at
+// the end of the journal is ignored, which is safe because inc then
+// reflects an earlier run, and the next run will retrieve everything
+// that has changed since then.
+func (bal *Balancer) replayJournal(jfilename string, inc *incrementalState, mounts map[string]*KeepMount) (int, error) {
+	f, err := os.Open(jfilename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(f)
+	replayed := 0
+	for remaining := fi.Size(); ; {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+			return replayed, nil
+		} else if err != nil {
+			bal.logf("%s: ignoring incomplete entry at end of journal", jfilename)
+			return replayed, nil
+		}
+		size := binary.BigEndian.Uint64(hdr[:])
+		remaining -= int64(len(hdr))
+		if size > uint64(remaining) {
+			bal.logf("%s: ignoring incomplete entry at end of journal", jfilename)
+			return replayed, nil
+		}
+		remaining -= int64(size)
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return replayed, fmt.Errorf("%s: %s", jfilename, err)
+		}
+		dec := gob.NewDecoder(bytes.NewReader(frame))
+		var delta savedDelta
+		if err := dec.Decode(&delta); err != nil {
+			return replayed, fmt.Errorf("%s: %s", jfilename, err)
+		}
+		if !delta.StateTime.After(inc.StateTime) {
+			continue
+		}
+		blocks, err := decodeReplicas(dec, mounts)
+		if err != nil {
+			return replayed, fmt.Errorf("%s: %s", jfilename, err)
+		}
+		inc.StateTime = delta.StateTime
+		inc.FullSweepAt = delta.FullSweepAt
+		for uuid, rec := range delta.Collections {
+			inc.Collections[uuid] = rec
+		}
+		inc.Pending = delta.Pending
+		if inc.Pending == nil {
+			inc.Pending = map[arvados.SizedDigest]bool{}
+		}
+		prefixes := map[string]bool{}
+		for _, prefix := range delta.Prefixes {
+			prefixes[prefix] = true
+		}
+		clearReplicas(inc.blocks, prefixes)
+		for blkid, replicas := range blocks {
+			blk := inc.blocks.get(blkid)
+			for _, r := range replicas {
+				blk.addReplica(r)
+			}
+		}
+		replayed++
+	}
+}
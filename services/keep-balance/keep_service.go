@@ -99,6 +99,11 @@ func (srv *KeepService) discoverMounts(c *arvados.Client) error {
 type KeepMount struct {
 	arvados.KeepMount
 	KeepService *KeepService
+
+	// StorageCost and EgressCost of the mounted volume, from the
+	// cluster config (see (*Balancer)setMountCosts).
+	storageCost float64
+	egressCost  float64
 }
 
 // String implements fmt.Stringer.
@@ -9,7 +9,6 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 
 	"git.arvados.org/arvados.git/lib/config"
@@ -35,6 +34,12 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 		"send pull requests (make more replicas of blocks that are underreplicated or are not in optimal rendezvous probe order)")
 	flags.BoolVar(&options.CommitTrash, "commit-trash", false,
 		"send trash requests (delete unreferenced old blocks, and excess replicas of overreplicated blocks)")
+	flags.BoolVar(&options.CommitConfirmedFields, "commit-confirmed-fields", false,
+		"update storage_classes_confirmed fields of collections whose blocks are stored in the desired storage classes")
+	flags.StringVar(&options.SavePlan, "save-plan", "",
+		"write computed pull and trash lists to `file` (JSON)")
+	flags.StringVar(&options.ApplyPlan, "apply-plan", "",
+		"send pull and trash lists from `file` (written by -save-plan) instead of computing new ones; requires -once")
 	flags.Bool("version", false, "Write version information to stdout and exit 0")
 	dumpFlag := flags.Bool("dump", false, "dump details for each block to stdout")
 
@@ -55,10 +60,13 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 	// service.Command
 	args = nil
 	dropFlag := map[string]bool{
-		"once":         true,
-		"commit-pulls": true,
-		"commit-trash": true,
-		"dump":         true,
+		"once":                    true,
+		"commit-pulls":            true,
+		"commit-trash":            true,
+		"commit-confirmed-fields": true,
+		"save-plan":               true,
+		"apply-plan":              true,
+		"dump":                    true,
 	}
 	flags.Visit(func(f *flag.Flag) {
 		if !dropFlag[f.Name] {
@@ -71,6 +79,9 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 			if !options.Once && cluster.Collections.BalancePeriod == arvados.Duration(0) {
 				return service.ErrorHandler(ctx, cluster, fmt.Errorf("cannot start service: Collections.BalancePeriod is zero (if you want to run once and then exit, use the -once flag)"))
 			}
+			if !options.Once && options.ApplyPlan != "" {
+				return service.ErrorHandler(ctx, cluster, fmt.Errorf("cannot start service: -apply-plan requires the -once flag"))
+			}
 
 			ac, err := arvados.NewClientFromConfig(cluster)
 			ac.AuthToken = token
@@ -83,7 +94,6 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 			}
 
 			srv := &Server{
-				Handler:    http.NotFoundHandler(),
 				Cluster:    cluster,
 				ArvClient:  ac,
 				RunOptions: options,
@@ -92,6 +102,7 @@ func runCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.W
 				Dumper:     options.Dumper,
 			}
 
+			srv.setupHandler()
 			go srv.run()
 			return srv
 		}).RunCommand(prog, args, stdin, stdout, stderr)
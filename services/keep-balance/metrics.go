@@ -58,14 +58,16 @@ func (m *metrics) UpdateStats(s balancerStats) {
 		Help  string
 	}
 	s2g := map[string]gauge{
-		"total":             {s.current, "current backend storage usage"},
-		"garbage":           {s.garbage, "garbage (unreferenced, old)"},
-		"transient":         {s.unref, "transient (unreferenced, new)"},
-		"overreplicated":    {s.overrep, "overreplicated"},
-		"underreplicated":   {s.underrep, "underreplicated"},
-		"lost":              {s.lost, "lost"},
-		"dedup_byte_ratio":  {s.dedupByteRatio(), "deduplication ratio, bytes referenced / bytes stored"},
-		"dedup_block_ratio": {s.dedupBlockRatio(), "deduplication ratio, blocks referenced / blocks stored"},
+		"total":                              {s.current, "current backend storage usage"},
+		"garbage":                            {s.garbage, "garbage (unreferenced, old)"},
+		"transient":                          {s.unref, "transient (unreferenced, new)"},
+		"overreplicated":                     {s.overrep, "overreplicated"},
+		"underreplicated":                    {s.underrep, "underreplicated"},
+		"lost":                               {s.lost, "lost"},
+		"dedup_byte_ratio":                   {s.dedupByteRatio(), "deduplication ratio, bytes referenced / bytes stored"},
+		"dedup_block_ratio":                  {s.dedupBlockRatio(), "deduplication ratio, blocks referenced / blocks stored"},
+		"monthly_storage_cost":               {s.storageCost, "projected monthly cost of current storage usage (if volume StorageCost is configured)"},
+		"monthly_storage_cost_after_changes": {s.storageCostAfter, "projected monthly cost of storage usage after pulls and trashes (if volume StorageCost is configured)"},
 	}
 	m.setupOnce.Do(func() {
 		// Register gauge(s) for each balancerStats field.
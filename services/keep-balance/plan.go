@@ -0,0 +1,280 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// A plan is a saved set of ChangeSets, in a form that can be
+// reviewed (and edited) by an administrator, and applied by a later
+// invocation of keep-balance.
+type plan struct {
+	ClusterID string    `json:"cluster_id"`
+	CreatedAt time.Time `json:"created_at"`
+	// Fingerprint of the keep services and mounts the plan was
+	// computed for (see (*Balancer)mountState). A plan cannot be
+	// applied after they change.
+	MountState string `json:"mount_state"`
+	// keep service UUID => changes to send to that service
+	KeepServices map[string]*planChanges `json:"keep_services"`
+	// block => storage class => desired replication, for each
+	// block that the plan trashes. Before sending trash lists,
+	// the replicas are checked again, and blocks that would be
+	// left with less than the desired replication are not
+	// trashed.
+	Desired map[arvados.SizedDigest]map[string]int `json:"desired"`
+}
+
+type planChanges struct {
+	Pulls   []planPull  `json:"pulls"`
+	Trashes []planTrash `json:"trashes"`
+}
+
+type planPull struct {
+	Locator arvados.SizedDigest `json:"locator"`
+	// UUID of the keep service to pull from
+	From string `json:"from"`
+	// UUID of the mount to store the new replica on
+	To string `json:"to"`
+}
+
+type planTrash struct {
+	Locator arvados.SizedDigest `json:"locator"`
+	Mtime   int64               `json:"mtime"`
+	// UUID of the mount to delete the replica from
+	From string `json:"from"`
+}
+
+// SavePlan writes the computed ChangeSets to the given file.
+func (bal *Balancer) SavePlan(filename, clusterID string) error {
+	p := plan{
+		ClusterID:    clusterID,
+		CreatedAt:    bal.stateTime,
+		MountState:   bal.mountState(),
+		KeepServices: map[string]*planChanges{},
+		Desired:      map[arvados.SizedDigest]map[string]int{},
+	}
+	for _, srv := range bal.KeepServices {
+		pc := &planChanges{
+			Pulls:   []planPull{},
+			Trashes: []planTrash{},
+		}
+		for _, pull := range srv.ChangeSet.Pulls {
+			pc.Pulls = append(pc.Pulls, planPull{
+				Locator: pull.SizedDigest,
+				From:    pull.From.UUID,
+				To:      pull.To.UUID,
+			})
+		}
+		for _, trash := range srv.ChangeSet.Trashes {
+			pc.Trashes = append(pc.Trashes, planTrash{
+				Locator: trash.SizedDigest,
+				Mtime:   trash.Mtime,
+				From:    trash.From.UUID,
+			})
+			if _, ok := p.Desired[trash.SizedDigest]; !ok {
+				blk, _ := bal.BlockStateMap.Get(trash.SizedDigest)
+				p.Desired[trash.SizedDigest] = blk.Desired
+			}
+		}
+		p.KeepServices[srv.UUID] = pc
+	}
+
+	tmpfn := filename + ".tmp"
+	f, err := os.OpenFile(tmpfn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfn)
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(p); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpfn, filename); err != nil {
+		return err
+	}
+	bal.logf("saved plan to %s", filename)
+	return nil
+}
+
+// maxPlanAge returns the age beyond which a saved plan is considered
+// too old to apply: BalancePeriod, but never more than
+// BlobSigningTTL.
+func maxPlanAge(cluster *arvados.Cluster) time.Duration {
+	age := cluster.Collections.BalancePeriod.Duration()
+	if ttl := cluster.Collections.BlobSigningTTL.Duration(); age <= 0 || (ttl > 0 && age > ttl) {
+		age = ttl
+	}
+	return age
+}
+
+// LoadPlan replaces the ChangeSets with the ones saved in the given
+// file.
+//
+// It returns an error if the plan was computed for a different
+// cluster, or is older than maxPlanAge, or the keep services or
+// mounts have changed since then, or the plan refers to unknown
+// services or mounts.
+func (bal *Balancer) LoadPlan(filename string, cluster *arvados.Cluster) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var p plan
+	if err = json.NewDecoder(f).Decode(&p); err != nil {
+		return fmt.Errorf("error decoding plan %s: %s", filename, err)
+	}
+	if p.ClusterID != cluster.ClusterID {
+		return fmt.Errorf("plan %s is for cluster %q, not %q", filename, p.ClusterID, cluster.ClusterID)
+	}
+	if age, max := time.Since(p.CreatedAt), maxPlanAge(cluster); age > max {
+		return fmt.Errorf("plan %s is too old: created %v ago, limit is %v", filename, age, max)
+	}
+	if p.MountState != bal.mountState() {
+		return fmt.Errorf("plan %s is out of date: keep services or mounts have changed since it was created", filename)
+	}
+	bal.logf("loading plan %s created at %s (%v ago)", filename, p.CreatedAt.Format(time.RFC3339), time.Since(p.CreatedAt))
+
+	mounts := map[string]*KeepMount{}
+	for _, srv := range bal.KeepServices {
+		for _, mnt := range srv.mounts {
+			mounts[mnt.UUID] = mnt
+		}
+	}
+	for uuid, pc := range p.KeepServices {
+		srv := bal.KeepServices[uuid]
+		if srv == nil {
+			return fmt.Errorf("plan %s refers to unknown keep service %s", filename, uuid)
+		}
+		for _, pp := range pc.Pulls {
+			from := bal.KeepServices[pp.From]
+			to := mounts[pp.To]
+			if from == nil {
+				return fmt.Errorf("plan %s: pull %s: unknown keep service %s", filename, pp.Locator, pp.From)
+			} else if to == nil || to.KeepService != srv {
+				return fmt.Errorf("plan %s: pull %s: mount %s not found on %s", filename, pp.Locator, pp.To, uuid)
+			}
+			srv.ChangeSet.AddPull(Pull{SizedDigest: pp.Locator, From: from, To: to})
+		}
+		for _, pt := range pc.Trashes {
+			from := mounts[pt.From]
+			if from == nil || from.KeepService != srv {
+				return fmt.Errorf("plan %s: trash %s: mount %s not found on %s", filename, pt.Locator, pt.From, uuid)
+			}
+			srv.ChangeSet.AddTrash(Trash{SizedDigest: pt.Locator, Mtime: pt.Mtime, From: from})
+		}
+	}
+	bal.planDesired = p.Desired
+	return nil
+}
+
+// checkPlanTrash retrieves the current replicas of the blocks in the
+// loaded trash lists, and removes the trash requests for any block
+// that would be left with less than its desired replication (as
+// recorded in the plan) in any storage class, e.g., because some of
+// its other replicas have been lost since the plan was created.
+func (bal *Balancer) checkPlanTrash(ctx context.Context, c *arvados.Client) error {
+	trashing := map[arvados.SizedDigest]map[string]bool{} // block => mount UUIDs
+	prefixes := map[string]bool{}
+	for _, srv := range bal.KeepServices {
+		for _, t := range srv.ChangeSet.Trashes {
+			if trashing[t.SizedDigest] == nil {
+				trashing[t.SizedDigest] = map[string]bool{}
+			}
+			trashing[t.SizedDigest][t.From.UUID] = true
+			prefixes[string(t.SizedDigest[:incrementalPrefixLen])] = true
+		}
+	}
+	if len(trashing) == 0 {
+		return nil
+	}
+	bal.BlockStateMap = NewBlockStateMap()
+	err := bal.refreshReplicas(ctx, c, coarsenPrefixes(prefixes))
+	if err != nil {
+		return fmt.Errorf("error retrieving current replicas: %s", err)
+	}
+	unsafe := map[arvados.SizedDigest]bool{}
+	for blkid, from := range trashing {
+		blk, _ := bal.BlockStateMap.Get(blkid)
+		var keep BlockState
+		for _, repl := range blk.Replicas {
+			if !from[repl.KeepMount.UUID] {
+				keep.Replicas = append(keep.Replicas, repl)
+			}
+		}
+		have := keep.classReplication()
+		for class, want := range bal.planDesired[blkid] {
+			if have[class] < want {
+				bal.logf("%s: not trashing: %d replicas would remain in storage class %q, desired %d", blkid, have[class], class, want)
+				unsafe[blkid] = true
+				break
+			}
+		}
+	}
+	for _, srv := range bal.KeepServices {
+		cs := srv.ChangeSet
+		cs.mutex.Lock()
+		trashes := cs.Trashes[:0]
+		for _, t := range cs.Trashes {
+			if !unsafe[t.SizedDigest] {
+				trashes = append(trashes, t)
+			}
+		}
+		cs.Trashes = trashes
+		cs.mutex.Unlock()
+	}
+	return nil
+}
+
+// applyPlan sends the pull and trash lists saved in the given file,
+// instead of computing new ones. Like a normal run, it only sends
+// the lists enabled by runOptions.
+func (bal *Balancer) applyPlan(ctx context.Context, c *arvados.Client, cluster *arvados.Cluster, runOptions RunOptions) error {
+	err := bal.LoadPlan(runOptions.ApplyPlan, cluster)
+	if err != nil {
+		return err
+	}
+	if runOptions.CommitTrash {
+		err = bal.checkPlanTrash(ctx, c)
+		if err != nil {
+			return err
+		}
+	}
+	bal.logf("===")
+	for _, srv := range bal.KeepServices {
+		bal.logf("%s: %v\n", srv, srv.ChangeSet)
+	}
+	bal.logf("===")
+	if runOptions.CommitPulls {
+		err = bal.CommitPulls(ctx, c)
+		if err != nil {
+			// Skip trash if we can't pull. (Too cautious?)
+			return err
+		}
+	}
+	if runOptions.CommitTrash {
+		err = bal.CommitTrash(ctx, c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
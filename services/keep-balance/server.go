@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -23,17 +24,24 @@ import (
 //
 // RunOptions fields are controlled by command line flags.
 type RunOptions struct {
-	Once        bool
-	CommitPulls bool
-	CommitTrash bool
-	Logger      logrus.FieldLogger
-	Dumper      logrus.FieldLogger
+	Once                  bool
+	CommitPulls           bool
+	CommitTrash           bool
+	CommitConfirmedFields bool
+	SavePlan              string
+	ApplyPlan             string
+	Logger                logrus.FieldLogger
+	Dumper                logrus.FieldLogger
 
 	// SafeRendezvousState from the most recent balance operation,
 	// or "" if unknown. If this changes from one run to the next,
 	// we need to watch out for races. See
 	// (*Balancer)ClearTrashLists.
 	SafeRendezvousState string
+
+	// State from the most recent successful balance operation,
+	// if incremental balancing is enabled.
+	incremental *incrementalState
 }
 
 type Server struct {
@@ -46,6 +54,11 @@ type Server struct {
 
 	Logger logrus.FieldLogger
 	Dumper logrus.FieldLogger
+
+	// Most recent successful run, used by the management API
+	latest    *latestStatus
+	running   bool
+	latestMtx sync.Mutex
 }
 
 // CheckHealth implements service.Handler.
@@ -81,7 +94,9 @@ func (srv *Server) runOnce() (*Balancer, error) {
 		LostBlocksFile: srv.Cluster.Collections.BlobMissingReport,
 	}
 	var err error
+	srv.startRun()
 	srv.RunOptions, err = bal.Run(srv.ArvClient, srv.Cluster, srv.RunOptions)
+	srv.finishRun(bal, err)
 	return bal, err
 }
 
@@ -0,0 +1,249 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/auth"
+	"git.arvados.org/arvados.git/sdk/go/blockdigest"
+	"github.com/julienschmidt/httprouter"
+)
+
+// blockStatus is the response to a block status request.
+type blockStatus struct {
+	Locator   arvados.SizedDigest `json:"locator"`
+	StateTime time.Time           `json:"state_time"`
+	RefCount  int                 `json:"ref_count"`
+	// storage class => replicas wanted by all collections that
+	// reference the block
+	Desired map[string]int `json:"desired"`
+	// storage class => replicas stored on mounts with that class
+	Actual   map[string]int  `json:"actual"`
+	Replicas []replicaStatus `json:"replicas"`
+}
+
+type replicaStatus struct {
+	KeepServiceUUID string   `json:"keep_service_uuid"`
+	MountUUID       string   `json:"mount_uuid"`
+	DeviceID        string   `json:"device_id"`
+	ReadOnly        bool     `json:"read_only"`
+	Replication     int      `json:"replication"`
+	StorageClasses  []string `json:"storage_classes"`
+	Mtime           int64    `json:"mtime"`
+}
+
+// collectionStatus is the response to a collection status request.
+type collectionStatus struct {
+	UUID             string    `json:"uuid"`
+	PortableDataHash string    `json:"portable_data_hash"`
+	StateTime        time.Time `json:"state_time"`
+	// storage class => replicas wanted by this collection
+	Desired map[string]int `json:"desired"`
+	// storage class => minimum replicas of any block stored on
+	// mounts with that class
+	Actual map[string]int `json:"actual"`
+	Blocks int            `json:"blocks"`
+	// blocks stored with fewer replicas than desired, in at
+	// least one storage class
+	Underreplicated []arvados.SizedDigest `json:"underreplicated"`
+}
+
+// setupHandler installs the management API handler, which reports
+// the replication state found by the most recent successful run.
+//
+// Requests must supply Cluster.ManagementToken. If ManagementToken is
+// empty, all requests are rejected.
+func (srv *Server) setupHandler() {
+	if srv.Cluster.ManagementToken == "" {
+		srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Management API authentication is not configured", http.StatusForbidden)
+		})
+		return
+	}
+	mux := httprouter.New()
+	mux.HandlerFunc("GET", "/arvados/v1/balance/blocks/:locator", srv.apiBlockStatus)
+	mux.HandlerFunc("GET", "/arvados/v1/balance/collections/:id", srv.apiCollectionStatus)
+	srv.Handler = auth.RequireLiteralToken(srv.Cluster.ManagementToken, mux)
+}
+
+// latestStatus is the replication state found by the most recent
+// successful run.
+type latestStatus struct {
+	stateTime          time.Time
+	defaultReplication int
+	blocks             *BlockStateMap
+
+	// If incremental balancing is enabled, the next run updates
+	// blocks in place (clearing and re-adding replicas as it
+	// retrieves keepstore indexes), so it can't be used while a
+	// run is in progress.
+	shared bool
+}
+
+// startRun notes that a run is starting.
+func (srv *Server) startRun() {
+	srv.latestMtx.Lock()
+	defer srv.latestMtx.Unlock()
+	srv.running = true
+}
+
+// finishRun notes that a run has finished, and if it was successful,
+// replaces the previous results with bal's.
+//
+// If a run fails after updating the previous results in place, they
+// are discarded.
+func (srv *Server) finishRun(bal *Balancer, err error) {
+	srv.latestMtx.Lock()
+	defer srv.latestMtx.Unlock()
+	srv.running = false
+	if err == nil {
+		srv.latest = &latestStatus{
+			stateTime:          bal.stateTime,
+			defaultReplication: bal.DefaultReplication,
+			blocks:             bal.BlockStateMap,
+			shared:             bal.inc != nil,
+		}
+	} else if srv.latest != nil && srv.latest.shared {
+		srv.latest = nil
+	}
+}
+
+// getLatest returns the replication state found by the most recent
+// successful run. If no run has succeeded yet, or the state is being
+// updated by a run in progress, it sends an error response and
+// returns nil.
+func (srv *Server) getLatest(w http.ResponseWriter) *latestStatus {
+	srv.latestMtx.Lock()
+	defer srv.latestMtx.Unlock()
+	if srv.latest == nil {
+		http.Error(w, "no balancing run has completed yet", http.StatusServiceUnavailable)
+	} else if srv.running && srv.latest.shared {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "balancing run in progress", http.StatusServiceUnavailable)
+		return nil
+	}
+	return srv.latest
+}
+
+// Management API: replication state of a single block.
+func (srv *Server) apiBlockStatus(w http.ResponseWriter, r *http.Request) {
+	locator := httprouter.ParamsFromContext(r.Context()).ByName("locator")
+	loc, err := blockdigest.ParseBlockLocator(locator)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	latest := srv.getLatest(w)
+	if latest == nil {
+		return
+	}
+	blkid := arvados.SizedDigest(fmt.Sprintf("%s+%d", loc.Digest, loc.Size))
+	blk, ok := latest.blocks.Get(blkid)
+	if !ok {
+		http.Error(w, "block not found", http.StatusNotFound)
+		return
+	}
+	resp := blockStatus{
+		Locator:   blkid,
+		StateTime: latest.stateTime,
+		RefCount:  blk.RefCount,
+		Desired:   blk.Desired,
+		Actual:    blk.classReplication(),
+		Replicas:  []replicaStatus{},
+	}
+	for _, repl := range blk.Replicas {
+		classes := []string{}
+		for class := range repl.KeepMount.StorageClasses {
+			classes = append(classes, class)
+		}
+		if len(classes) == 0 {
+			classes = append(classes, defaultClasses...)
+		}
+		sort.Strings(classes)
+		resp.Replicas = append(resp.Replicas, replicaStatus{
+			KeepServiceUUID: repl.KeepMount.KeepService.UUID,
+			MountUUID:       repl.KeepMount.UUID,
+			DeviceID:        repl.KeepMount.DeviceID,
+			ReadOnly:        repl.KeepMount.ReadOnly,
+			Replication:     repl.KeepMount.Replication,
+			StorageClasses:  classes,
+			Mtime:           repl.Mtime,
+		})
+	}
+	sort.Slice(resp.Replicas, func(i, j int) bool {
+		return resp.Replicas[i].MountUUID < resp.Replicas[j].MountUUID
+	})
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Management API: replication state of the blocks referenced by a
+// collection, given its UUID or portable data hash.
+func (srv *Server) apiCollectionStatus(w http.ResponseWriter, r *http.Request) {
+	latest := srv.getLatest(w)
+	if latest == nil {
+		return
+	}
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	var coll arvados.Collection
+	err := srv.ArvClient.RequestAndDecodeContext(r.Context(), &coll, "GET", "arvados/v1/collections/"+id, nil, arvados.GetOptions{
+		Select: []string{"uuid", "portable_data_hash", "manifest_text", "replication_desired", "storage_classes_desired"},
+	})
+	if te, ok := err.(*arvados.TransactionError); ok && te.StatusCode == http.StatusNotFound {
+		http.Error(w, "collection not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	blkids, err := coll.SizedDigests()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	repl := latest.defaultReplication
+	if coll.ReplicationDesired != nil {
+		repl = *coll.ReplicationDesired
+	}
+	classes := coll.StorageClassesDesired
+	if len(classes) == 0 {
+		classes = defaultClasses
+	}
+	resp := collectionStatus{
+		UUID:             coll.UUID,
+		PortableDataHash: coll.PortableDataHash,
+		StateTime:        latest.stateTime,
+		Desired:          map[string]int{},
+		Actual:           map[string]int{},
+		Blocks:           len(blkids),
+		Underreplicated:  []arvados.SizedDigest{},
+	}
+	for _, class := range classes {
+		resp.Desired[class] = repl
+	}
+	seen := map[arvados.SizedDigest]bool{}
+	for i, blkid := range blkids {
+		blk, _ := latest.blocks.Get(blkid)
+		actual := blk.classReplication()
+		under := false
+		for _, class := range classes {
+			if i == 0 || actual[class] < resp.Actual[class] {
+				resp.Actual[class] = actual[class]
+			}
+			under = under || actual[class] < repl
+		}
+		if under && !seen[blkid] {
+			resp.Underreplicated = append(resp.Underreplicated, blkid)
+		}
+		seen[blkid] = true
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -82,6 +82,9 @@ func (h *handler) setup() {
 
 	keepclient.RefreshServiceDiscoveryOnSIGHUP()
 	keepclient.DefaultBlockCache.MaxBlocks = h.Config.cluster.Collections.WebDAVCache.MaxBlockEntries
+	keepclient.DefaultBlockCache.Dir = h.Config.cluster.Collections.WebDAVCache.BlockCacheDirectory
+	keepclient.DefaultBlockCache.MaxDiskBytes = int64(h.Config.cluster.Collections.WebDAVCache.MaxBlockCacheBytes)
+	keepclient.DefaultBlockCache.GroupShared = h.Config.cluster.Collections.WebDAVCache.BlockCacheGroupShared
 
 	h.healthHandler = &health.Handler{
 		Token:  h.Config.cluster.ManagementToken,
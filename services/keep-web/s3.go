@@ -7,6 +7,7 @@ package main
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/xml"
 	"errors"
 	"fmt"
@@ -31,6 +32,9 @@ const (
 	s3MaxKeys       = 1000
 	s3SignAlgorithm = "AWS4-HMAC-SHA256"
 	s3MaxClockSkew  = 5 * time.Minute
+	// Maximum X-Amz-Expires value in a presigned URL, as in AWS
+	// (7 days).
+	s3MaxPresignExpires = 7 * 24 * 60 * 60
 )
 
 func hmacstring(msg string, key []byte) []byte {
@@ -75,16 +79,34 @@ func s3querystring(u *url.URL) string {
 	return strings.Join(keys, "&")
 }
 
-func s3stringToSign(alg, scope, signedHeaders string, r *http.Request) (string, error) {
-	timefmt, timestr := "20060102T150405Z", r.Header.Get("X-Amz-Date")
-	if timestr == "" {
+// s3stringToSign returns the string to sign for an S3 V4 signature.
+// If presigned is true, the signature parameters and timestamp are
+// taken from the query string (as in a presigned URL) instead of the
+// request headers.
+func s3stringToSign(alg, scope, signedHeaders string, r *http.Request, presigned bool) (string, error) {
+	amzdate := r.Header.Get("X-Amz-Date")
+	if presigned {
+		amzdate = r.URL.Query().Get("X-Amz-Date")
+	}
+	timefmt, timestr := "20060102T150405Z", amzdate
+	if timestr == "" && !presigned {
 		timefmt, timestr = time.RFC1123, r.Header.Get("Date")
 	}
 	t, err := time.Parse(timefmt, timestr)
 	if err != nil {
 		return "", fmt.Errorf("invalid timestamp %q: %s", timestr, err)
 	}
-	if skew := time.Now().Sub(t); skew < -s3MaxClockSkew || skew > s3MaxClockSkew {
+	if presigned {
+		expires, err := strconv.Atoi(r.URL.Query().Get("X-Amz-Expires"))
+		if err != nil || expires < 1 || expires > s3MaxPresignExpires {
+			return "", fmt.Errorf("invalid X-Amz-Expires value %q", r.URL.Query().Get("X-Amz-Expires"))
+		}
+		if skew := time.Now().Sub(t); skew < -s3MaxClockSkew {
+			return "", errors.New("exceeded max clock skew")
+		} else if skew > time.Duration(expires)*time.Second {
+			return "", errors.New("presigned URL has expired")
+		}
+	} else if skew := time.Now().Sub(t); skew < -s3MaxClockSkew || skew > s3MaxClockSkew {
 		return "", errors.New("exceeded max clock skew")
 	}
 
@@ -97,9 +119,22 @@ func s3stringToSign(alg, scope, signedHeaders string, r *http.Request) (string,
 		}
 	}
 
-	canonicalRequest := fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n%s", r.Method, r.URL.EscapedPath(), s3querystring(r.URL), canonicalHeaders, signedHeaders, r.Header.Get("X-Amz-Content-Sha256"))
+	u := r.URL
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if presigned {
+		// The signature itself is not part of the signed
+		// query string.
+		q := r.URL.Query()
+		q.Del("X-Amz-Signature")
+		u = &url.URL{RawQuery: q.Encode()}
+		if payloadHash == "" {
+			payloadHash = "UNSIGNED-PAYLOAD"
+		}
+	}
+
+	canonicalRequest := fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n%s", r.Method, r.URL.EscapedPath(), s3querystring(u), canonicalHeaders, signedHeaders, payloadHash)
 	ctxlog.FromContext(r.Context()).Debugf("s3stringToSign: canonicalRequest %s", canonicalRequest)
-	return fmt.Sprintf("%s\n%s\n%s\n%s", alg, r.Header.Get("X-Amz-Date"), scope, hashdigest(sha256.New(), canonicalRequest)), nil
+	return fmt.Sprintf("%s\n%s\n%s\n%s", alg, amzdate, scope, hashdigest(sha256.New(), canonicalRequest)), nil
 }
 
 func s3signature(secretKey, scope, signedHeaders, stringToSign string) (string, error) {
@@ -127,28 +162,55 @@ func unescapeKey(key string) string {
 	}
 }
 
+func isTokenUUID(key string) bool {
+	return len(key) == 27 && key[5:12] == "-gj3su-"
+}
+
 // checks3signature verifies the given S3 V4 signature and returns the
 // Arvados token that corresponds to the given accessKey. An error is
 // returned if accessKey is not a valid token UUID or the signature
 // does not match.
+//
+// The signature is taken from the Authorization header if there is
+// one, otherwise from the X-Amz-* query parameters of a presigned
+// URL. Presigned URLs are meant to be shared, so they are only
+// accepted if the access key is a token UUID: otherwise the URL
+// would contain an entire Arvados token.
 func (h *handler) checks3signature(r *http.Request) (string, error) {
 	var key, scope, signedHeaders, signature string
-	authstring := strings.TrimPrefix(r.Header.Get("Authorization"), s3SignAlgorithm+" ")
-	for _, cmpt := range strings.Split(authstring, ",") {
-		cmpt = strings.TrimSpace(cmpt)
-		split := strings.SplitN(cmpt, "=", 2)
-		switch {
-		case len(split) != 2:
-			// (?) ignore
-		case split[0] == "Credential":
-			keyandscope := strings.SplitN(split[1], "/", 2)
-			if len(keyandscope) == 2 {
-				key, scope = keyandscope[0], keyandscope[1]
+	presigned := r.Header.Get("Authorization") == ""
+	if presigned {
+		q := r.URL.Query()
+		if alg := q.Get("X-Amz-Algorithm"); alg != s3SignAlgorithm {
+			return "", fmt.Errorf("unsupported algorithm %q", alg)
+		}
+		keyandscope := strings.SplitN(q.Get("X-Amz-Credential"), "/", 2)
+		if len(keyandscope) == 2 {
+			key, scope = keyandscope[0], keyandscope[1]
+		}
+		signedHeaders = q.Get("X-Amz-SignedHeaders")
+		signature = q.Get("X-Amz-Signature")
+		if !isTokenUUID(key) {
+			return "", errors.New("access key in a presigned URL must be a token UUID")
+		}
+	} else {
+		authstring := strings.TrimPrefix(r.Header.Get("Authorization"), s3SignAlgorithm+" ")
+		for _, cmpt := range strings.Split(authstring, ",") {
+			cmpt = strings.TrimSpace(cmpt)
+			split := strings.SplitN(cmpt, "=", 2)
+			switch {
+			case len(split) != 2:
+				// (?) ignore
+			case split[0] == "Credential":
+				keyandscope := strings.SplitN(split[1], "/", 2)
+				if len(keyandscope) == 2 {
+					key, scope = keyandscope[0], keyandscope[1]
+				}
+			case split[0] == "SignedHeaders":
+				signedHeaders = split[1]
+			case split[0] == "Signature":
+				signature = split[1]
 			}
-		case split[0] == "SignedHeaders":
-			signedHeaders = split[1]
-		case split[0] == "Signature":
-			signature = split[1]
 		}
 	}
 
@@ -159,7 +221,7 @@ func (h *handler) checks3signature(r *http.Request) (string, error) {
 	var aca arvados.APIClientAuthorization
 	var secret string
 	var err error
-	if len(key) == 27 && key[5:12] == "-gj3su-" {
+	if isTokenUUID(key) {
 		// Access key is the UUID of an Arvados token, secret
 		// key is the secret part.
 		ctx := arvados.ContextWithAuthorization(r.Context(), "Bearer "+h.Config.cluster.SystemRootToken)
@@ -176,7 +238,7 @@ func (h *handler) checks3signature(r *http.Request) (string, error) {
 		ctxlog.FromContext(r.Context()).WithError(err).WithField("UUID", key).Info("token lookup failed")
 		return "", errors.New("invalid access key")
 	}
-	stringToSign, err := s3stringToSign(s3SignAlgorithm, scope, signedHeaders, r)
+	stringToSign, err := s3stringToSign(s3SignAlgorithm, scope, signedHeaders, r, presigned)
 	if err != nil {
 		return "", err
 	}
@@ -200,7 +262,7 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			return true
 		}
 		token = unescapeKey(split[0])
-	} else if strings.HasPrefix(auth, s3SignAlgorithm+" ") {
+	} else if strings.HasPrefix(auth, s3SignAlgorithm+" ") || (auth == "" && r.URL.Query().Get("X-Amz-Algorithm") != "") {
 		t, err := h.checks3signature(r)
 		if err != nil {
 			http.Error(w, "signature verification failed: "+err.Error(), http.StatusForbidden)
@@ -222,16 +284,34 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 	fs.ForwardSlashNameSubstitution(h.Config.cluster.Collections.ForwardSlashNameSubstitution)
 
 	var objectNameGiven bool
+	var bucketName, objectName string
 	fspath := "/by_id"
 	if id := parseCollectionIDFromDNSName(r.Host); id != "" {
 		fspath += "/" + id
+		bucketName = id
+		objectName = strings.TrimPrefix(r.URL.Path, "/")
 		objectNameGiven = strings.Count(strings.TrimSuffix(r.URL.Path, "/"), "/") > 0
 	} else {
+		split := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		bucketName = split[0]
+		if len(split) > 1 {
+			objectName = split[1]
+		}
 		objectNameGiven = strings.Count(strings.TrimSuffix(r.URL.Path, "/"), "/") > 1
 	}
 	fspath += r.URL.Path
 
+	if objectNameGiven && h.serveS3Multipart(w, r, client, kc, fs, fspath, bucketName, objectName) {
+		return true
+	}
+	if objectNameGiven && h.serveS3Tagging(w, r, client, fs, fspath) {
+		return true
+	}
+
 	switch {
+	case r.Method == http.MethodGet && bucketName == "":
+		h.s3listBuckets(w, r, client)
+		return true
 	case r.Method == http.MethodGet && !objectNameGiven:
 		// Path is "/{uuid}" or "/{uuid}/", has no object name
 		if _, ok := r.URL.Query()["versioning"]; ok {
@@ -258,6 +338,10 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			return true
 		}
 		if err == nil && fi.IsDir() && objectNameGiven && strings.HasSuffix(fspath, "/") && h.Config.cluster.Collections.S3FolderObjects {
+			if err := s3setMetadataHeaders(w.Header(), fs, fspath); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return true
+			}
 			w.Header().Set("Content-Type", "application/x-directory")
 			w.WriteHeader(http.StatusOK)
 			return true
@@ -268,6 +352,10 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			http.Error(w, "not found", http.StatusNotFound)
 			return true
 		}
+		if err := s3setMetadataHeaders(w.Header(), fs, fspath); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return true
+		}
 		// shallow copy r, and change URL path
 		r := *r
 		r.URL.Path = fspath
@@ -278,6 +366,15 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			http.Error(w, "missing object name in PUT request", http.StatusBadRequest)
 			return true
 		}
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			h.s3copyObject(w, r, client, kc, fs, fspath)
+			return true
+		}
+		metadata, err := s3requestMetadata(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return true
+		}
 		var objectIsDir bool
 		if strings.HasSuffix(fspath, "/") {
 			if !h.Config.cluster.Collections.S3FolderObjects {
@@ -365,6 +462,15 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return true
 		}
+		if len(metadata) > 0 {
+			status, err := s3updateProperties(r, client, fs, fspath, func(props map[string]interface{}) {
+				s3mergeProperties(props, metadata)
+			})
+			if err != nil {
+				http.Error(w, err.Error(), status)
+				return true
+			}
+		}
 		w.WriteHeader(http.StatusOK)
 		return true
 	case r.Method == http.MethodDelete:
@@ -476,17 +582,142 @@ func walkFS(fs arvados.CustomFileSystem, path string, isRoot bool, fn func(path
 
 var errDone = errors.New("done")
 
+// s3listBuckets responds to a ListBuckets request. Each project and
+// collection readable by the client is listed as a bucket, using its
+// UUID as the bucket name (i.e., the name used to access it via
+// /by_id/). Buckets are listed in UUID order, so the last UUID on a
+// page serves as the continuation token for the next page.
+func (h *handler) s3listBuckets(w http.ResponseWriter, r *http.Request, client *arvados.Client) {
+	maxBuckets := s3MaxKeys
+	if mb, _ := strconv.Atoi(r.FormValue("max-buckets")); mb > 0 && mb < s3MaxKeys {
+		maxBuckets = mb
+	}
+	token := r.FormValue("continuation-token")
+	prefix := r.FormValue("prefix")
+
+	var user arvados.User
+	err := client.RequestAndDecodeContext(r.Context(), &user, "GET", "arvados/v1/users/current", nil, arvados.GetOptions{
+		Select: []string{"uuid", "full_name"},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	type item struct {
+		UUID      string    `json:"uuid"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	var items []item
+	// cutoff is the highest UUID we can return without skipping
+	// any buckets. If a list is cut short by the limit, items
+	// after its last UUID in the other list must wait for the
+	// next page.
+	var cutoff string
+	for _, lister := range []struct {
+		path    string
+		filters []arvados.Filter
+	}{
+		{"arvados/v1/groups", []arvados.Filter{{Attr: "group_class", Operator: "=", Operand: "project"}}},
+		{"arvados/v1/collections", nil},
+	} {
+		filters := lister.filters
+		if token != "" {
+			filters = append(filters, arvados.Filter{Attr: "uuid", Operator: ">", Operand: token})
+		}
+		if prefix != "" {
+			filters = append(filters, arvados.Filter{Attr: "uuid", Operator: "like", Operand: likeEscaper.Replace(prefix) + "%"})
+		}
+		var resp struct {
+			Items []item `json:"items"`
+			Limit int    `json:"limit"`
+		}
+		err = client.RequestAndDecodeContext(r.Context(), &resp, "GET", lister.path, nil, arvados.ListOptions{
+			Select:  []string{"uuid", "created_at"},
+			Filters: filters,
+			Order:   []string{"uuid"},
+			Limit:   int64(maxBuckets),
+			Count:   "none",
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if n := len(resp.Items); n > 0 && (n >= maxBuckets || (resp.Limit > 0 && n >= resp.Limit)) {
+			if last := resp.Items[n-1].UUID; cutoff == "" || last < cutoff {
+				cutoff = last
+			}
+		}
+		items = append(items, resp.Items...)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].UUID < items[j].UUID })
+	if len(items) > maxBuckets && (cutoff == "" || items[maxBuckets-1].UUID < cutoff) {
+		cutoff = items[maxBuckets-1].UUID
+	}
+
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	resp := struct {
+		XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+		Owner   struct {
+			ID          string
+			DisplayName string
+		}
+		Buckets           []bucket `xml:"Buckets>Bucket"`
+		ContinuationToken string   `xml:",omitempty"`
+		Prefix            string   `xml:",omitempty"`
+	}{
+		ContinuationToken: cutoff,
+		Prefix:            prefix,
+	}
+	resp.Owner.ID = user.UUID
+	resp.Owner.DisplayName = user.FullName
+	for _, it := range items {
+		if cutoff != "" && it.UUID > cutoff {
+			break
+		}
+		resp.Buckets = append(resp.Buckets, bucket{
+			Name:         it.UUID,
+			CreationDate: it.CreatedAt.UTC().Format("2006-01-02T15:04:05.000") + "Z",
+		})
+	}
+	s3xmlResponse(w, r, resp)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
 func (h *handler) s3list(w http.ResponseWriter, r *http.Request, fs arvados.CustomFileSystem) {
 	var params struct {
-		bucket    string
-		delimiter string
-		marker    string
-		maxKeys   int
-		prefix    string
+		v2                bool
+		bucket            string
+		delimiter         string
+		marker            string
+		maxKeys           int
+		prefix            string
+		continuationToken string
+		startAfter        string
+		fetchOwner        bool
 	}
 	params.bucket = strings.SplitN(r.URL.Path[1:], "/", 2)[0]
 	params.delimiter = r.FormValue("delimiter")
-	params.marker = r.FormValue("marker")
+	if r.FormValue("list-type") == "2" {
+		// ListObjectsV2. The continuation token is the
+		// (base64-encoded) key where the next page starts.
+		params.v2 = true
+		params.continuationToken = r.FormValue("continuation-token")
+		marker, err := base64.StdEncoding.DecodeString(params.continuationToken)
+		if err != nil {
+			http.Error(w, "invalid continuation token", http.StatusBadRequest)
+			return
+		}
+		params.marker = string(marker)
+		params.startAfter = r.FormValue("start-after")
+		params.fetchOwner = r.FormValue("fetch-owner") == "true"
+	} else {
+		params.marker = r.FormValue("marker")
+	}
 	if mk, _ := strconv.ParseInt(r.FormValue("max-keys"), 10, 64); mk > 0 && mk < s3MaxKeys {
 		params.maxKeys = int(mk)
 	} else {
@@ -536,7 +767,35 @@ func (h *handler) s3list(w http.ResponseWriter, r *http.Request, fs arvados.Cust
 			MaxKeys:   params.maxKeys,
 		},
 	}
+	var nextMarker string
 	commonPrefixes := map[string]bool{}
+	owners := map[string]string{}
+	// ownerOf returns the owner UUID of the collection that
+	// contains path (relative to bucketdir). Stat results for
+	// each directory on the way are remembered, so each
+	// directory is examined only once.
+	ownerOf := func(path string) string {
+		path = bucketdir + "/" + path
+		for i := len("by_id/"); i < len(path); i++ {
+			if path[i] != '/' {
+				continue
+			}
+			dir := path[:i]
+			owner, ok := owners[dir]
+			if !ok {
+				if fi, err := fs.Stat(dir); err == nil {
+					if coll, ok := fi.Sys().(*arvados.Collection); ok {
+						owner = coll.OwnerUUID
+					}
+				}
+				owners[dir] = owner
+			}
+			if owner != "" {
+				return owner
+			}
+		}
+		return ""
+	}
 	err := walkFS(fs, strings.TrimSuffix(bucketdir+"/"+walkpath, "/"), true, func(path string, fi os.FileInfo) error {
 		if path == bucketdir {
 			return nil
@@ -575,7 +834,7 @@ func (h *handler) s3list(w http.ResponseWriter, r *http.Request, fs arvados.Cust
 				return errDone
 			}
 		}
-		if path < params.marker || path < params.prefix {
+		if path < params.marker || path < params.prefix || path <= params.startAfter {
 			return nil
 		}
 		if fi.IsDir() && !h.Config.cluster.Collections.S3FolderObjects {
@@ -599,16 +858,20 @@ func (h *handler) s3list(w http.ResponseWriter, r *http.Request, fs arvados.Cust
 		}
 		if len(resp.Contents)+len(commonPrefixes) >= params.maxKeys {
 			resp.IsTruncated = true
-			if params.delimiter != "" {
-				resp.NextMarker = path
+			if params.delimiter != "" || params.v2 {
+				nextMarker = path
 			}
 			return errDone
 		}
-		resp.Contents = append(resp.Contents, s3.Key{
+		key := s3.Key{
 			Key:          path,
 			LastModified: fi.ModTime().UTC().Format("2006-01-02T15:04:05.999") + "Z",
 			Size:         filesize,
-		})
+		}
+		if params.fetchOwner {
+			key.Owner.ID = ownerOf(path)
+		}
+		resp.Contents = append(resp.Contents, key)
 		return nil
 	})
 	if err != nil && err != errDone {
@@ -623,9 +886,59 @@ func (h *handler) s3list(w http.ResponseWriter, r *http.Request, fs arvados.Cust
 		sort.Slice(resp.CommonPrefixes, func(i, j int) bool { return resp.CommonPrefixes[i].Prefix < resp.CommonPrefixes[j].Prefix })
 	}
 	resp.KeyCount = len(resp.Contents)
-	w.Header().Set("Content-Type", "application/xml")
-	io.WriteString(w, xml.Header)
-	if err := xml.NewEncoder(w).Encode(resp); err != nil {
-		ctxlog.FromContext(r.Context()).WithError(err).Error("error writing xml response")
+	if !params.v2 {
+		resp.NextMarker = nextMarker
+		s3xmlResponse(w, r, resp)
+		return
+	}
+
+	// ListObjectsV2 responses have no Marker/NextMarker, and
+	// only include object owners if requested.
+	type v2key struct {
+		Key          string
+		LastModified string
+		Size         int64
+		ETag         string
+		StorageClass string
+		Owner        *s3.Owner `xml:",omitempty"`
+	}
+	v2resp := struct {
+		XMLName               string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name                  string
+		Prefix                string
+		Delimiter             string
+		MaxKeys               int
+		KeyCount              int
+		IsTruncated           bool
+		Contents              []v2key
+		CommonPrefixes        []commonPrefix
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		StartAfter            string `xml:",omitempty"`
+	}{
+		Name:              resp.Name,
+		Prefix:            resp.Prefix,
+		Delimiter:         resp.Delimiter,
+		MaxKeys:           resp.MaxKeys,
+		KeyCount:          resp.KeyCount,
+		IsTruncated:       resp.IsTruncated,
+		CommonPrefixes:    resp.CommonPrefixes,
+		ContinuationToken: params.continuationToken,
+		StartAfter:        params.startAfter,
+	}
+	if resp.IsTruncated {
+		v2resp.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(nextMarker))
+	}
+	for _, key := range resp.Contents {
+		k := v2key{
+			Key:          key.Key,
+			LastModified: key.LastModified,
+			Size:         key.Size,
+		}
+		if params.fetchOwner {
+			k.Owner = &s3.Owner{ID: key.Owner.ID}
+		}
+		v2resp.Contents = append(v2resp.Contents, k)
 	}
+	s3xmlResponse(w, r, v2resp)
 }
@@ -7,12 +7,16 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/xml"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -20,9 +24,12 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
 	"github.com/AdRoll/goamz/aws"
 	"github.com/AdRoll/goamz/s3"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	check "gopkg.in/check.v1"
 )
 
@@ -145,6 +152,62 @@ func (s *IntegrationSuite) TestS3Signatures(c *check.C) {
 	}
 }
 
+func (s *IntegrationSuite) TestS3PresignedURL(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+
+	signer := v4.NewSigner(credentials.NewStaticCredentials(arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, ""), func(s *v4.Signer) {
+		s.DisableURIPathEscaping = true
+	})
+	presign := func(method, key string, exp time.Duration, signTime time.Time) string {
+		req, err := http.NewRequest(method, "http://"+s.testServer.Addr+"/"+stage.coll.UUID+"/"+key, nil)
+		c.Assert(err, check.IsNil)
+		_, err = signer.Presign(req, nil, "s3", "us-east-1", exp, signTime)
+		c.Assert(err, check.IsNil)
+		return req.URL.String()
+	}
+	do := func(method, u, body string) (int, string) {
+		req, err := http.NewRequest(method, u, strings.NewReader(body))
+		c.Assert(err, check.IsNil)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, check.IsNil)
+		return resp.StatusCode, string(buf)
+	}
+
+	code, body := do("GET", presign("GET", "sailboat.txt", time.Hour, time.Now()), "")
+	c.Check(code, check.Equals, http.StatusOK)
+	c.Check(body, check.Equals, "⛵\n")
+
+	code, _ = do("PUT", presign("PUT", "presigned.txt", time.Hour, time.Now()), "presigned")
+	c.Check(code, check.Equals, http.StatusOK)
+	buf, err := stage.collbucket.Get("presigned.txt")
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "presigned")
+
+	// Expired
+	code, _ = do("GET", presign("GET", "sailboat.txt", time.Minute, time.Now().Add(-2*time.Minute)), "")
+	c.Check(code, check.Equals, http.StatusForbidden)
+	// Expiry time too long
+	code, _ = do("GET", presign("GET", "sailboat.txt", 8*24*time.Hour, time.Now()), "")
+	c.Check(code, check.Equals, http.StatusForbidden)
+	// Wrong method
+	code, _ = do("PUT", presign("GET", "sailboat.txt", time.Hour, time.Now()), "")
+	c.Check(code, check.Equals, http.StatusForbidden)
+	// Different object
+	code, _ = do("GET", strings.Replace(presign("GET", "sailboat.txt", time.Hour, time.Now()), "sailboat.txt", "emptyfile", 1), "")
+	c.Check(code, check.Equals, http.StatusForbidden)
+	// Entire token as access key
+	key := strings.Replace(arvadostest.ActiveTokenV2, "/", "_", -1)
+	signer = v4.NewSigner(credentials.NewStaticCredentials(key, key, ""), func(s *v4.Signer) {
+		s.DisableURIPathEscaping = true
+	})
+	code, _ = do("GET", presign("GET", "sailboat.txt", time.Hour, time.Now()), "")
+	c.Check(code, check.Equals, http.StatusForbidden)
+}
+
 func (s *IntegrationSuite) TestS3HeadBucket(c *check.C) {
 	stage := s.s3setup(c)
 	defer stage.teardown(c)
@@ -262,6 +325,412 @@ func (s *IntegrationSuite) testS3PutObjectSuccess(c *check.C, bucket *s3.Bucket,
 	}
 }
 
+func (s *IntegrationSuite) TestS3CollectionMultipartUpload(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	s.testS3MultipartUpload(c, stage, stage.collbucket, "")
+}
+func (s *IntegrationSuite) TestS3ProjectMultipartUpload(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	s.testS3MultipartUpload(c, stage, stage.projbucket, stage.coll.Name+"/")
+}
+func (s *IntegrationSuite) testS3MultipartUpload(c *check.C, stage s3stage, bucket *s3.Bucket, prefix string) {
+	for _, objname := range []string{prefix + "multipart", prefix + "newdir/multi part", prefix + "sailboat.txt"} {
+		c.Logf("=== %s", objname)
+		multi, err := bucket.InitMulti(objname, "application/octet-stream", s3.Private, s3.Options{})
+		c.Assert(err, check.IsNil)
+
+		var bufs [][]byte
+		var parts []s3.Part
+		for n, size := range []int{5 << 20, 5 << 20, 1234} {
+			buf := make([]byte, size)
+			rand.Read(buf)
+			bufs = append(bufs, buf)
+			part, err := multi.PutPart(n+1, bytes.NewReader(buf))
+			c.Assert(err, check.IsNil)
+			parts = append(parts, part)
+		}
+		// Replace the middle part.
+		rand.Read(bufs[1])
+		part, err := multi.PutPart(2, bytes.NewReader(bufs[1]))
+		c.Assert(err, check.IsNil)
+		c.Check(part.ETag, check.Not(check.Equals), parts[1].ETag)
+		parts[1] = part
+
+		listed, err := multi.ListParts()
+		c.Check(err, check.IsNil)
+		c.Check(listed, check.DeepEquals, parts)
+
+		// Object doesn't appear until the upload is
+		// completed.
+		if !strings.HasSuffix(objname, "sailboat.txt") {
+			_, err = bucket.GetReader(objname)
+			c.Check(err, check.ErrorMatches, `404 Not Found`)
+		}
+
+		// Completing with a stale ETag fails.
+		stale := append([]s3.Part(nil), parts...)
+		stale[1].ETag = `"00000000000000000000000000000000"`
+		c.Check(multi.Complete(stale), check.NotNil)
+
+		err = multi.Complete(parts)
+		c.Assert(err, check.IsNil)
+
+		rdr, err := bucket.GetReader(objname)
+		c.Assert(err, check.IsNil)
+		got, err := ioutil.ReadAll(rdr)
+		c.Check(err, check.IsNil)
+		c.Check(bytes.Equal(got, bytes.Join(bufs, nil)), check.Equals, true)
+
+		// Temporary collection is trashed.
+		err = stage.arv.RequestAndDecode(nil, "GET", "arvados/v1/collections/"+multi.UploadId, nil, nil)
+		c.Check(err, check.ErrorMatches, `.*404.*`)
+	}
+
+	// Aborted uploads can't be completed.
+	multi, err := bucket.InitMulti(prefix+"aborted", "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	part, err := multi.PutPart(1, bytes.NewReader([]byte("foo")))
+	c.Assert(err, check.IsNil)
+	c.Check(multi.Abort(), check.IsNil)
+	c.Check(multi.Complete([]s3.Part{part}), check.NotNil)
+	_, err = bucket.GetReader(prefix + "aborted")
+	c.Check(err, check.ErrorMatches, `404 Not Found`)
+
+	// Upload IDs can't be used for a different object name.
+	multi, err = bucket.InitMulti(prefix+"foo", "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	defer multi.Abort()
+	other := *multi
+	other.Key = prefix + "bar"
+	_, err = other.PutPart(1, bytes.NewReader([]byte("foo")))
+	c.Check(err, check.ErrorMatches, `404 Not Found`)
+}
+
+// Part collections that weren't created by UploadPart for the same
+// upload are ignored, even if they have a matching property and part
+// file name.
+func (s *IntegrationSuite) TestS3MultipartPlantedPart(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+
+	multi, err := stage.collbucket.InitMulti("planted", "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	var upload arvados.Collection
+	err = stage.arv.RequestAndDecode(&upload, "GET", "arvados/v1/collections/"+multi.UploadId, nil, nil)
+	c.Assert(err, check.IsNil)
+	var proj arvados.Group
+	err = stage.arv.RequestAndDecode(&proj, "GET", "arvados/v1/groups/"+upload.OwnerUUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(proj.Name, check.Equals, s3MultipartProjectName)
+
+	part, err := multi.PutPart(1, strings.NewReader("good"))
+	c.Assert(err, check.IsNil)
+	etag := strings.Trim(part.ETag, `"`)
+
+	// A newer collection outside the upload's project, with the
+	// same part file name but different data.
+	bad := arvados.Collection{}
+	err = stage.arv.RequestAndDecode(&bad, "POST", "arvados/v1/collections", nil, map[string]interface{}{"collection": map[string]interface{}{
+		"owner_uuid":    stage.proj.UUID,
+		"manifest_text": ". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:" + fmt.Sprintf(s3MultipartPartNameF, 1, etag) + "\n",
+		"properties":    map[string]interface{}{s3PartProperty: multi.UploadId},
+	}})
+	c.Assert(err, check.IsNil)
+	// A newer collection in the upload's project, with a part
+	// file name whose ETag isn't recorded on the upload.
+	err = stage.arv.RequestAndDecode(&bad, "POST", "arvados/v1/collections", nil, map[string]interface{}{"collection": map[string]interface{}{
+		"owner_uuid":    upload.OwnerUUID,
+		"manifest_text": ". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:" + fmt.Sprintf(s3MultipartPartNameF, 2, "37b51d194a7513e45b56f6524f2d51f2") + "\n",
+		"properties":    map[string]interface{}{s3PartProperty: multi.UploadId},
+	}})
+	c.Assert(err, check.IsNil)
+
+	listed, err := multi.ListParts()
+	c.Check(err, check.IsNil)
+	c.Check(listed, check.DeepEquals, []s3.Part{part})
+	c.Check(multi.Complete([]s3.Part{part, {N: 2, ETag: `"37b51d194a7513e45b56f6524f2d51f2"`}}), check.NotNil)
+	c.Assert(multi.Complete([]s3.Part{part}), check.IsNil)
+	rdr, err := stage.collbucket.GetReader("planted")
+	c.Assert(err, check.IsNil)
+	got, err := ioutil.ReadAll(rdr)
+	c.Check(err, check.IsNil)
+	c.Check(string(got), check.Equals, "good")
+}
+
+// Parts of the same upload can be uploaded concurrently through
+// different keep-web processes.
+func (s *IntegrationSuite) TestS3ConcurrentMultipartUpload(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+
+	srv2 := &server{Config: s.testServer.Config}
+	err := srv2.Start(ctxlog.TestLogger(c))
+	c.Assert(err, check.IsNil)
+	defer srv2.Close()
+	bucket2 := &s3.Bucket{
+		S3:   s3.New(stage.collbucket.S3.Auth, aws.Region{Name: srv2.Addr, S3Endpoint: "http://" + srv2.Addr}),
+		Name: stage.collbucket.Name,
+	}
+	bucket2.S3.Signature = aws.V4Signature
+
+	multi, err := stage.collbucket.InitMulti("concurrent", "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	multi2 := *multi
+	multi2.Bucket = bucket2
+
+	const nparts = 10
+	bufs := make([][]byte, nparts)
+	parts := make([]s3.Part, nparts)
+	var wg sync.WaitGroup
+	for i := range bufs {
+		bufs[i] = make([]byte, 1<<20)
+		rand.Read(bufs[i])
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m := multi
+			if i%2 == 1 {
+				m = &multi2
+			}
+			var err error
+			parts[i], err = m.PutPart(i+1, bytes.NewReader(bufs[i]))
+			c.Check(err, check.IsNil)
+		}(i)
+	}
+	wg.Wait()
+
+	listed, err := multi2.ListParts()
+	c.Check(err, check.IsNil)
+	c.Check(listed, check.DeepEquals, parts)
+
+	err = multi.Complete(parts)
+	c.Assert(err, check.IsNil)
+	rdr, err := bucket2.GetReader("concurrent")
+	c.Assert(err, check.IsNil)
+	got, err := ioutil.ReadAll(rdr)
+	c.Check(err, check.IsNil)
+	c.Check(bytes.Equal(got, bytes.Join(bufs, nil)), check.Equals, true)
+
+	// Temporary part collections are trashed.
+	var resp arvados.CollectionList
+	err = stage.arv.RequestAndDecode(&resp, "GET", "arvados/v1/collections", nil, arvados.ListOptions{
+		Filters: []arvados.Filter{{Attr: "properties." + s3PartProperty, Operator: "=", Operand: multi.UploadId}},
+	})
+	c.Check(err, check.IsNil)
+	c.Check(resp.Items, check.HasLen, 0)
+}
+
+func (s *IntegrationSuite) TestS3CollectionCopyObject(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	s.testS3CopyObject(c, stage, stage.collbucket, "")
+}
+func (s *IntegrationSuite) TestS3ProjectCopyObject(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	s.testS3CopyObject(c, stage, stage.projbucket, stage.coll.Name+"/")
+}
+func (s *IntegrationSuite) testS3CopyObject(c *check.C, stage s3stage, bucket *s3.Bucket, prefix string) {
+	for _, trial := range []struct {
+		source string
+		dest   string
+		expect string
+	}{
+		{stage.coll.UUID + "/sailboat.txt", "sailboat copy.txt", "⛵\n"},
+		{stage.coll.UUID + "/sailboat.txt", "newdir/sailboat.txt", "⛵\n"},
+		{arvadostest.FooCollection + "/foo", "sailboat.txt", "foo"},
+		{arvadostest.FooCollectionPDH + "/foo", "newdir/foo", "foo"},
+		{stage.coll.UUID + "/emptyfile", "newdir/empty", ""},
+	} {
+		c.Logf("=== %+v", trial)
+		_, err := bucket.PutCopy(prefix+trial.dest, s3.Private, s3.CopyOptions{}, trial.source)
+		if !c.Check(err, check.IsNil) {
+			continue
+		}
+		rdr, err := bucket.GetReader(prefix + trial.dest)
+		if !c.Check(err, check.IsNil) {
+			continue
+		}
+		buf, err := ioutil.ReadAll(rdr)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf), check.Equals, trial.expect)
+	}
+
+	for _, source := range []string{
+		stage.coll.UUID + "/nonexistent",
+		stage.coll.UUID + "/emptydir",
+		"zzzzz-4zz18-xxxxxxxxxxxxxxx/foo",
+	} {
+		_, err := bucket.PutCopy(prefix+"failed", s3.Private, s3.CopyOptions{}, source)
+		c.Check(err, check.ErrorMatches, `404 Not Found`, check.Commentf("%s", source))
+	}
+	// Destination can't be an existing directory.
+	_, err := bucket.PutCopy(prefix+"emptydir", s3.Private, s3.CopyOptions{}, stage.coll.UUID+"/sailboat.txt")
+	c.Check(err, check.ErrorMatches, `400 Bad Request`)
+	// Destination can't be in a read-only (by PDH) bucket.
+	pdhbucket := &s3.Bucket{S3: bucket.S3, Name: arvadostest.FooCollectionPDH}
+	_, err = pdhbucket.PutCopy("foo2", s3.Private, s3.CopyOptions{}, stage.coll.UUID+"/sailboat.txt")
+	c.Check(err, check.NotNil)
+
+	// UploadPartCopy, with and without a range.
+	err = bucket.PutReader(prefix+"digits", strings.NewReader("0123456789"), 10, "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	multi, err := bucket.InitMulti(prefix+"multicopy", "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	_, part1, err := multi.PutPartCopy(1, s3.CopyOptions{CopySourceOptions: "bytes=5-9"}, bucket.Name+"/"+prefix+"digits")
+	c.Assert(err, check.IsNil)
+	_, part2, err := multi.PutPartCopy(2, s3.CopyOptions{}, bucket.Name+"/"+prefix+"digits")
+	c.Assert(err, check.IsNil)
+	_, _, err = multi.PutPartCopy(3, s3.CopyOptions{CopySourceOptions: "bytes=5-10"}, bucket.Name+"/"+prefix+"digits")
+	c.Check(err, check.NotNil)
+	c.Assert(multi.Complete([]s3.Part{part1, part2}), check.IsNil)
+	rdr, err := bucket.GetReader(prefix + "multicopy")
+	c.Assert(err, check.IsNil)
+	buf, err := ioutil.ReadAll(rdr)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "567890123456789")
+}
+
+func (s *IntegrationSuite) TestS3CollectionMetadata(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	s.testS3Metadata(c, stage, stage.collbucket, "")
+}
+func (s *IntegrationSuite) TestS3ProjectMetadata(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	s.testS3Metadata(c, stage, stage.projbucket, "keep-web s3 test collection/")
+}
+func (s *IntegrationSuite) testS3Metadata(c *check.C, stage s3stage, bucket *s3.Bucket, prefix string) {
+	getProperties := func() map[string]interface{} {
+		var coll arvados.Collection
+		err := stage.arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+stage.coll.UUID, nil, nil)
+		c.Assert(err, check.IsNil)
+		return coll.Properties
+	}
+
+	// PutObject adds x-amz-meta-* headers to the collection
+	// properties.
+	err := bucket.PutReader(prefix+"meta.txt", strings.NewReader("meta"), 4, "text/plain", s3.Private, s3.Options{
+		Meta: map[string][]string{
+			"color": {"blue"},
+			"shape": {"=?UTF-8?b?4pu1?="},
+		},
+	})
+	c.Assert(err, check.IsNil)
+	props := getProperties()
+	c.Check(props["color"], check.Equals, "blue")
+	c.Check(props["shape"], check.Equals, "⛵")
+
+	// So does CompleteMultipartUpload, using the headers from
+	// CreateMultipartUpload.
+	multi, err := bucket.InitMulti(prefix+"multimeta.txt", "text/plain", s3.Private, s3.Options{
+		Meta: map[string][]string{"stage": {"done"}},
+	})
+	c.Assert(err, check.IsNil)
+	part, err := multi.PutPart(1, strings.NewReader("meta"))
+	c.Assert(err, check.IsNil)
+	c.Assert(multi.Complete([]s3.Part{part}), check.IsNil)
+	props = getProperties()
+	c.Check(props["stage"], check.Equals, "done")
+	c.Check(props["color"], check.Equals, "blue")
+
+	// Properties set via the Arvados API (including non-string
+	// values) are returned by HeadObject and GetObject.
+	err = stage.arv.RequestAndDecode(nil, "PUT", "arvados/v1/collections/"+stage.coll.UUID, nil, map[string]interface{}{
+		"collection": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"color": "blue",
+				"shape": "⛵",
+				"size":  3,
+			},
+		},
+	})
+	c.Assert(err, check.IsNil)
+	resp, err := bucket.Head(prefix+"sailboat.txt", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(resp.Header.Get("X-Amz-Meta-Color"), check.Equals, "blue")
+	c.Check(resp.Header.Get("X-Amz-Meta-Size"), check.Equals, "3")
+	shape, err := new(mime.WordDecoder).DecodeHeader(resp.Header.Get("X-Amz-Meta-Shape"))
+	c.Check(err, check.IsNil)
+	c.Check(shape, check.Equals, "⛵")
+	_, hdr, err := bucket.GetWithHeaders(prefix + "sailboat.txt")
+	c.Assert(err, check.IsNil)
+	c.Check(hdr.Get("X-Amz-Meta-Color"), check.Equals, "blue")
+
+	tagging := func(method, key, body string) (int, string) {
+		req, err := http.NewRequest(method, bucket.URL(prefix+key), strings.NewReader(body))
+		c.Assert(err, check.IsNil)
+		req.Header.Set("Authorization", "AWS "+arvadostest.ActiveTokenV2+":none")
+		req.URL.RawQuery = "tagging"
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		defer resp.Body.Close()
+		buf, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, check.IsNil)
+		return resp.StatusCode, string(buf)
+	}
+
+	// Initially there are no tags.
+	code, body := tagging("GET", "sailboat.txt", "")
+	c.Check(code, check.Equals, http.StatusOK)
+	c.Check(body, check.Matches, `(?ms).*<TagSet></TagSet>.*`)
+
+	// PutObjectTagging replaces the tags, which are stored
+	// separately from other properties.
+	code, _ = tagging("PUT", "sailboat.txt", `<Tagging xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><TagSet><Tag><Key>color</Key><Value>red</Value></Tag><Tag><Key>shape</Key><Value>⛵</Value></Tag></TagSet></Tagging>`)
+	c.Check(code, check.Equals, http.StatusOK)
+	code, _ = tagging("PUT", "sailboat.txt", `<Tagging xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><TagSet><Tag><Key>color</Key><Value>red</Value></Tag></TagSet></Tagging>`)
+	c.Check(code, check.Equals, http.StatusOK)
+	props = getProperties()
+	c.Check(props, check.DeepEquals, map[string]interface{}{
+		"color":   "blue",
+		"shape":   "⛵",
+		"size":    float64(3),
+		"s3_tags": map[string]interface{}{"color": "red"},
+	})
+	code, body = tagging("GET", "sailboat.txt", "")
+	c.Check(code, check.Equals, http.StatusOK)
+	c.Check(body, check.Matches, `(?ms).*<TagSet><Tag><Key>color</Key><Value>red</Value></Tag></TagSet>.*`)
+
+	// Tags are not returned as metadata.
+	resp, err = bucket.Head(prefix+"sailboat.txt", nil)
+	c.Assert(err, check.IsNil)
+	c.Check(resp.Header.Get("X-Amz-Meta-Color"), check.Equals, "blue")
+	c.Check(resp.Header.Get("X-Amz-Meta-S3_tags"), check.Equals, "")
+
+	code, _ = tagging("PUT", "sailboat.txt", `<Tagging><TagSet><Tag><Key>a</Key></Tag><Tag><Key>a</Key></Tag></TagSet></Tagging>`)
+	c.Check(code, check.Equals, http.StatusBadRequest)
+
+	// DeleteObjectTagging removes the tags, and leaves other
+	// properties alone.
+	code, _ = tagging("DELETE", "sailboat.txt", "")
+	c.Check(code, check.Equals, http.StatusNoContent)
+	props = getProperties()
+	c.Check(props, check.DeepEquals, map[string]interface{}{"color": "blue", "shape": "⛵", "size": float64(3)})
+
+	// PutObject adds the tags given in the x-amz-tagging header
+	// to the existing tags.
+	code, _ = tagging("PUT", "sailboat.txt", `<Tagging><TagSet><Tag><Key>color</Key><Value>red</Value></Tag></TagSet></Tagging>`)
+	c.Check(code, check.Equals, http.StatusOK)
+	req, err := http.NewRequest("PUT", bucket.URL(prefix+"tagged.txt"), strings.NewReader("tag"))
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Authorization", "AWS "+arvadostest.ActiveTokenV2+":none")
+	req.Header.Set("X-Amz-Tagging", "shape=square")
+	putResp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	putResp.Body.Close()
+	c.Check(putResp.StatusCode, check.Equals, http.StatusOK)
+	props = getProperties()
+	c.Check(props["s3_tags"], check.DeepEquals, map[string]interface{}{"color": "red", "shape": "square"})
+	c.Check(props["shape"], check.Equals, "⛵")
+
+	code, _ = tagging("GET", "nonexistent.txt", "")
+	c.Check(code, check.Equals, http.StatusNotFound)
+}
+
 func (s *IntegrationSuite) TestS3ProjectPutObjectNotSupported(c *check.C) {
 	stage := s.s3setup(c)
 	defer stage.teardown(c)
@@ -428,6 +897,61 @@ func (stage *s3stage) writeBigDirs(c *check.C, dirs int, filesPerDir int) {
 	c.Assert(fs.Sync(), check.IsNil)
 }
 
+func (s *IntegrationSuite) TestS3ListBuckets(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+
+	listBuckets := func(query string) (resp struct {
+		s3.GetServiceResp
+		ContinuationToken string
+	}) {
+		req, err := http.NewRequest("GET", "http://"+s.testServer.Addr+"/?"+query, nil)
+		c.Assert(err, check.IsNil)
+		req.Header.Set("Authorization", "AWS "+arvadostest.ActiveTokenV2+":none")
+		httpresp, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		defer httpresp.Body.Close()
+		c.Assert(httpresp.StatusCode, check.Equals, http.StatusOK)
+		c.Assert(xml.NewDecoder(httpresp.Body).Decode(&resp), check.IsNil)
+		return
+	}
+
+	seen := map[string]bool{}
+	var names []string
+	token := ""
+	for pages := 0; ; pages++ {
+		c.Assert(pages < 1000, check.Equals, true)
+		resp := listBuckets("max-buckets=7&continuation-token=" + url.QueryEscape(token))
+		c.Check(resp.Owner.ID, check.Equals, arvadostest.ActiveUserUUID)
+		c.Check(len(resp.Buckets) <= 7, check.Equals, true)
+		for _, b := range resp.Buckets {
+			c.Check(seen[b.Name], check.Equals, false, check.Commentf("%s listed twice", b.Name))
+			seen[b.Name] = true
+			names = append(names, b.Name)
+		}
+		if resp.ContinuationToken == "" {
+			break
+		}
+		token = resp.ContinuationToken
+	}
+	c.Check(sort.StringsAreSorted(names), check.Equals, true)
+	c.Check(seen[stage.proj.UUID], check.Equals, true)
+	c.Check(seen[stage.coll.UUID], check.Equals, true)
+	c.Check(seen[arvadostest.FooCollection], check.Equals, true)
+
+	resp := listBuckets("prefix=" + stage.coll.UUID)
+	c.Check(resp.ContinuationToken, check.Equals, "")
+	if c.Check(resp.Buckets, check.HasLen, 1) {
+		c.Check(resp.Buckets[0].Name, check.Equals, stage.coll.UUID)
+		c.Check(resp.Buckets[0].CreationDate, check.Matches, `\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}Z`)
+	}
+
+	// Listed bucket names work as bucket names.
+	bucket := &s3.Bucket{S3: stage.collbucket.S3, Name: names[len(names)-1]}
+	_, err := bucket.List("", "/", "", 1)
+	c.Check(err, check.IsNil)
+}
+
 func (s *IntegrationSuite) TestS3GetBucketVersioning(c *check.C) {
 	stage := s.s3setup(c)
 	defer stage.teardown(c)
@@ -498,6 +1022,88 @@ func (s *IntegrationSuite) TestS3ListKeyCount(c *check.C) {
 	c.Check(string(buf), check.Matches, `(?ms).*<KeyCount>2</KeyCount>.*`)
 }
 
+func (s *IntegrationSuite) TestS3ListObjectsV2(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	stage.writeBigDirs(c, 2, 5)
+
+	type listV2Resp struct {
+		Contents []struct {
+			Key   string
+			Owner *s3.Owner
+		}
+		CommonPrefixes []struct {
+			Prefix string
+		}
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string
+	}
+	list := func(bucket *s3.Bucket, query string) (resp listV2Resp) {
+		req, err := http.NewRequest("GET", bucket.URL("/"), nil)
+		c.Assert(err, check.IsNil)
+		req.Header.Set("Authorization", "AWS "+arvadostest.ActiveTokenV2+":none")
+		req.URL.RawQuery = "list-type=2&" + query
+		httpresp, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		defer httpresp.Body.Close()
+		c.Assert(httpresp.StatusCode, check.Equals, http.StatusOK)
+		buf, err := ioutil.ReadAll(httpresp.Body)
+		c.Assert(err, check.IsNil)
+		c.Check(string(buf), check.Not(check.Matches), `(?ms).*Marker.*`)
+		c.Assert(xml.Unmarshal(buf, &resp), check.IsNil)
+		c.Check(resp.KeyCount, check.Equals, len(resp.Contents))
+		return
+	}
+
+	var keys []string
+	token := ""
+	for pages := 0; ; pages++ {
+		c.Assert(pages < 100, check.Equals, true)
+		resp := list(stage.collbucket, "max-keys=3&fetch-owner=true&continuation-token="+url.QueryEscape(token))
+		c.Check(len(resp.Contents) <= 3, check.Equals, true)
+		for _, key := range resp.Contents {
+			keys = append(keys, key.Key)
+			if c.Check(key.Owner, check.NotNil) {
+				c.Check(key.Owner.ID, check.Equals, stage.proj.UUID)
+			}
+		}
+		if !resp.IsTruncated {
+			c.Check(resp.NextContinuationToken, check.Equals, "")
+			break
+		}
+		token = resp.NextContinuationToken
+	}
+	c.Check(keys, check.HasLen, 12)
+	c.Check(sort.StringsAreSorted(keys), check.Equals, true)
+
+	resp := list(stage.collbucket, "start-after=dir0/file4.txt")
+	if c.Check(resp.Contents, check.HasLen, 7) {
+		c.Check(resp.Contents[0].Key, check.Equals, "dir1/file0.txt")
+		c.Check(resp.Contents[0].Owner, check.IsNil)
+	}
+
+	resp = list(stage.collbucket, "delimiter=/")
+	c.Check(resp.CommonPrefixes, check.HasLen, 2)
+	c.Check(resp.Contents, check.HasLen, 2)
+
+	resp = list(stage.projbucket, "fetch-owner=true&prefix="+url.QueryEscape("keep-web s3 test collection/dir1/"))
+	c.Check(resp.Contents, check.HasLen, 5)
+	for _, key := range resp.Contents {
+		if c.Check(key.Owner, check.NotNil) {
+			c.Check(key.Owner.ID, check.Equals, stage.proj.UUID)
+		}
+	}
+
+	req, err := http.NewRequest("GET", stage.collbucket.URL("/"), nil)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Authorization", "AWS "+arvadostest.ActiveTokenV2+":none")
+	req.URL.RawQuery = "list-type=2&continuation-token=%21%21%21"
+	httpresp, err := http.DefaultClient.Do(req)
+	c.Assert(err, check.IsNil)
+	c.Check(httpresp.StatusCode, check.Equals, http.StatusBadRequest)
+}
+
 func (s *IntegrationSuite) TestS3CollectionList(c *check.C) {
 	stage := s.s3setup(c)
 	defer stage.teardown(c)
@@ -714,3 +1320,107 @@ func (s *IntegrationSuite) TestS3BucketInHost(c *check.C) {
 	c.Check(hdr, check.Matches, `(?s)HTTP/1.1 200 OK\r\n.*`)
 	c.Check(body, check.Equals, "⛵\n")
 }
+
+func (s *UnitSuite) TestS3ManifestSegments(c *check.C) {
+	txt := ". acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 0:3:00001-acbd18db4cc2f85cedef654fccc4a4d8 3:3:00002-37b51d194a7513e45b56f6524f2d51f2 0:6:foo\\040bar\n./dir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:baz\n"
+	locators, files, err := s3rootStream(txt)
+	c.Check(err, check.IsNil)
+	c.Check(locators, check.DeepEquals, []string{"acbd18db4cc2f85cedef654fccc4a4d8+3", "37b51d194a7513e45b56f6524f2d51f2+3"})
+	c.Check(files, check.DeepEquals, map[string][]s3segment{
+		"00001-acbd18db4cc2f85cedef654fccc4a4d8": {{0, 3}},
+		"00002-37b51d194a7513e45b56f6524f2d51f2": {{3, 3}},
+		"foo\\040bar":                            {{0, 6}},
+	})
+
+	// Concatenate two files in reverse order.
+	segs := append(files["00002-37b51d194a7513e45b56f6524f2d51f2"], files["00001-acbd18db4cc2f85cedef654fccc4a4d8"]...)
+	concat := s3singleFileManifest(locators, segs, "data")
+	c.Check(concat, check.Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 3:3:data 0:3:data\n")
+	fs, err := (&arvados.Collection{ManifestText: concat}).FileSystem(nil, nil)
+	c.Assert(err, check.IsNil)
+	fi, err := fs.Stat("data")
+	c.Assert(err, check.IsNil)
+	c.Check(fi.Size(), check.Equals, int64(6))
+
+	for _, trial := range []struct {
+		offset int64
+		length int64
+		expect []s3segment
+	}{
+		{0, 6, []s3segment{{3, 3}, {0, 3}}},
+		{1, 4, []s3segment{{4, 2}, {0, 2}}},
+		{3, 3, []s3segment{{0, 3}}},
+		{2, 1, []s3segment{{5, 1}}},
+		{6, 1, nil},
+	} {
+		c.Check(s3sliceSegments(segs, trial.offset, trial.length), check.DeepEquals, trial.expect, check.Commentf("%+v", trial))
+	}
+
+	// Empty file.
+	c.Check(s3singleFileManifest(nil, nil, "data"), check.Equals, ". d41d8cd98f00b204e9800998ecf8427e+0 0:0:data\n")
+	locators, files, err = s3rootStream("./dir d41d8cd98f00b204e9800998ecf8427e+0 0:0:foo\n")
+	c.Check(err, check.IsNil)
+	c.Check(locators, check.HasLen, 0)
+	c.Check(files, check.HasLen, 0)
+}
+
+func (s *UnitSuite) TestS3PresignedStringToSign(c *check.C) {
+	signer := v4.NewSigner(credentials.NewStaticCredentials("zzzzz-gj3su-000000000000000", "secret", ""), func(s *v4.Signer) {
+		s.DisableURIPathEscaping = true
+	})
+	for _, trial := range []struct {
+		method    string
+		exp       time.Duration
+		signTime  time.Time
+		expectErr string
+	}{
+		{"GET", time.Hour, time.Now(), ""},
+		{"PUT", time.Hour, time.Now().Add(-time.Minute), ""},
+		{"GET", time.Minute, time.Now().Add(-2 * time.Minute), `presigned URL has expired`},
+		{"GET", time.Hour, time.Now().Add(time.Hour), `exceeded max clock skew`},
+		{"GET", 8 * 24 * time.Hour, time.Now(), `invalid X-Amz-Expires value .*`},
+	} {
+		c.Logf("trial %+v", trial)
+		req, err := http.NewRequest(trial.method, "http://example.com/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo%20bar.txt?max-keys=3&prefix=a+b", nil)
+		c.Assert(err, check.IsNil)
+		_, err = signer.Presign(req, nil, "s3", "us-east-1", trial.exp, trial.signTime)
+		c.Assert(err, check.IsNil)
+
+		r := httptest.NewRequest(trial.method, req.URL.String(), nil)
+		q := r.URL.Query()
+		scope := strings.SplitN(q.Get("X-Amz-Credential"), "/", 2)[1]
+		stringToSign, err := s3stringToSign(s3SignAlgorithm, scope, q.Get("X-Amz-SignedHeaders"), r, true)
+		if trial.expectErr != "" {
+			c.Check(err, check.ErrorMatches, trial.expectErr)
+			continue
+		}
+		c.Assert(err, check.IsNil)
+		signature, err := s3signature("secret", scope, q.Get("X-Amz-SignedHeaders"), stringToSign)
+		c.Check(err, check.IsNil)
+		c.Check(signature, check.Equals, q.Get("X-Amz-Signature"))
+	}
+
+	// A request with an Authorization header is still checked
+	// using the headers, not the query string.
+	req, err := http.NewRequest("GET", "http://example.com/zzzzz-4zz18-aaaaaaaaaaaaaaa/foo?X-Amz-Signature=bogus", nil)
+	c.Assert(err, check.IsNil)
+	_, err = signer.Sign(req, nil, "s3", "us-east-1", time.Now())
+	c.Assert(err, check.IsNil)
+	var scope, signedHeaders, expect string
+	for _, cmpt := range strings.Split(strings.TrimPrefix(req.Header.Get("Authorization"), s3SignAlgorithm+" "), ", ") {
+		split := strings.SplitN(cmpt, "=", 2)
+		switch split[0] {
+		case "Credential":
+			scope = strings.SplitN(split[1], "/", 2)[1]
+		case "SignedHeaders":
+			signedHeaders = split[1]
+		case "Signature":
+			expect = split[1]
+		}
+	}
+	stringToSign, err := s3stringToSign(s3SignAlgorithm, scope, signedHeaders, req, false)
+	c.Assert(err, check.IsNil)
+	signature, err := s3signature("secret", scope, signedHeaders, stringToSign)
+	c.Check(err, check.IsNil)
+	c.Check(signature, check.Equals, expect)
+}
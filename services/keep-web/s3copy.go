@@ -0,0 +1,155 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+)
+
+// CopyObject and UploadPartCopy are implemented by splicing the
+// source file's manifest segments into the destination, so no data is
+// read or written in Keep.
+//
+// The client must be able to read the source collection (the
+// collection is retrieved using the client's token) and write the
+// destination collection (the collection is updated using the
+// client's token, and the API server checks permission as usual).
+
+// s3copyObject handles a PUT request with an X-Amz-Copy-Source
+// header.
+func (h *handler) s3copyObject(w http.ResponseWriter, r *http.Request, client *arvados.Client, kc *keepclient.KeepClient, fs arvados.CustomFileSystem, fspath string) {
+	if strings.HasSuffix(fspath, "/") {
+		http.Error(w, "invalid object name: trailing slash", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("X-Amz-Copy-Source-Range") != "" {
+		http.Error(w, "X-Amz-Copy-Source-Range is only supported with UploadPartCopy", http.StatusBadRequest)
+		return
+	}
+	props, err := s3requestMetadata(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	locators, segs, status, err := s3copySource(r, client, kc, fs)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	status, err = s3replaceFile(r, client, kc, fs, fspath, s3singleFileManifest(locators, segs, "data"), props)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	s3xmlResponse(w, r, struct {
+		XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{
+		ETag:         `"` + s3copyETag(locators, segs) + `"`,
+		LastModified: time.Now().UTC().Format("2006-01-02T15:04:05.999") + "Z",
+	})
+}
+
+// s3copySource returns the block locators and file segments of the
+// object named in the request's X-Amz-Copy-Source header -- or the
+// part of it given in the X-Amz-Copy-Source-Range header, if any --
+// along with an HTTP status code if there is an error.
+func s3copySource(r *http.Request, client *arvados.Client, kc *keepclient.KeepClient, fs arvados.CustomFileSystem) ([]string, []s3segment, int, error) {
+	src := r.Header.Get("X-Amz-Copy-Source")
+	if i := strings.Index(src, "?"); i >= 0 {
+		q, err := url.ParseQuery(src[i+1:])
+		if err != nil || (q.Get("versionId") != "" && q.Get("versionId") != "null") {
+			return nil, nil, http.StatusBadRequest, errors.New("copying a specific version is not supported")
+		}
+		src = src[:i]
+	}
+	src, err := url.PathUnescape(strings.TrimPrefix(src, "/"))
+	split := strings.SplitN(src, "/", 2)
+	if err != nil || len(split) != 2 || split[0] == "" || split[1] == "" || strings.HasSuffix(split[1], "/") {
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("invalid copy source %q", r.Header.Get("X-Amz-Copy-Source"))
+	}
+	srcpath := "/by_id/" + split[0] + "/" + split[1]
+	fi, err := fs.Stat(srcpath)
+	if os.IsNotExist(err) || (err != nil && err.Error() == "not a directory") || (err == nil && fi.IsDir()) {
+		return nil, nil, http.StatusNotFound, errors.New("copy source not found")
+	} else if err != nil {
+		return nil, nil, http.StatusBadGateway, err
+	}
+	coll, relpath, err := s3collectionForPath(fs, srcpath)
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+	id := coll.UUID
+	if id == "" {
+		id = coll.PortableDataHash
+	}
+	err = client.RequestAndDecodeContext(r.Context(), coll, "GET", "arvados/v1/collections/"+id, nil, nil)
+	if err != nil {
+		return nil, nil, s3apiErrorStatus(err), err
+	}
+
+	// Move the source file to the top level of a scratch copy of
+	// the collection, so its segments can be found in the root
+	// stream of the normalized manifest.
+	srcfs, err := (&arvados.Collection{ManifestText: coll.ManifestText}).FileSystem(client, kc)
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	tmpname := "s3copy"
+	for {
+		if _, err := srcfs.Stat(tmpname); !os.IsNotExist(err) {
+			tmpname += "_"
+			continue
+		}
+		break
+	}
+	err = srcfs.Rename(relpath, tmpname)
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	txt, err := srcfs.MarshalManifest(".")
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	locators, files, err := s3rootStream(txt)
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	segs := files[tmpname]
+
+	if rng := r.Header.Get("X-Amz-Copy-Source-Range"); rng != "" {
+		var size int64
+		for _, seg := range segs {
+			size += seg.length
+		}
+		var first, last int64
+		if n, _ := fmt.Sscanf(rng, "bytes=%d-%d", &first, &last); n != 2 || first < 0 || last < first || last >= size {
+			return nil, nil, http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("invalid copy source range %q for %d-byte object", rng, size)
+		}
+		segs = s3sliceSegments(segs, first, last-first+1)
+	}
+	return locators, segs, 0, nil
+}
+
+// s3copyETag returns an ETag for copied data. Computing the MD5 sum
+// of the content would mean reading all of the data, so instead the
+// ETag is derived from the manifest segments. This is sufficient for
+// clients that use ETags to identify parts when completing a
+// multipart upload.
+func s3copyETag(locators []string, segs []s3segment) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(s3singleFileManifest(locators, segs, "data"))))
+}
@@ -0,0 +1,270 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"golang.org/x/net/http/httpguts"
+)
+
+// Object metadata and tags are stored as properties of the collection
+// that contains the object, so all objects in a collection share the
+// same metadata and tags.
+//
+// User metadata (x-amz-meta-* headers) is sent for every property
+// whose name is a valid header field name. Property values that are
+// not strings are sent as JSON. Metadata supplied when writing an
+// object is added to the collection's properties; existing
+// properties are not removed.
+//
+// Tags are stored separately, as a map in the property named by
+// s3TagsProperty, so PutObjectTagging and DeleteObjectTagging do
+// not affect properties set by other tools.
+//
+// The Arvados API replaces a collection's properties as a whole, so
+// updates made here (read, modify, write) can undo a concurrent
+// update of a different property made by another client.
+
+const (
+	s3MetaHeaderPrefix = "X-Amz-Meta-"
+	s3MaxTaggingBody   = 1 << 20
+	s3TagsProperty     = "s3_tags"
+)
+
+type s3tag struct {
+	Key   string
+	Value string
+}
+
+// s3requestMetadata returns the user metadata and tags given in the
+// x-amz-meta-* and x-amz-tagging headers of a request that writes an
+// object, in the form accepted by s3mergeProperties.
+func s3requestMetadata(r *http.Request) (map[string]interface{}, error) {
+	props := map[string]interface{}{}
+	for k, v := range r.Header {
+		if !strings.HasPrefix(k, s3MetaHeaderPrefix) || len(k) == len(s3MetaHeaderPrefix) {
+			continue
+		}
+		val, err := new(mime.WordDecoder).DecodeHeader(v[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s header: %w", k, err)
+		}
+		name := strings.ToLower(k[len(s3MetaHeaderPrefix):])
+		if name == s3TagsProperty {
+			return nil, fmt.Errorf("invalid %s header: reserved for tags", k)
+		}
+		props[name] = val
+	}
+	if tagging := r.Header.Get("X-Amz-Tagging"); tagging != "" {
+		q, err := url.ParseQuery(tagging)
+		if err != nil {
+			return nil, fmt.Errorf("invalid X-Amz-Tagging header: %w", err)
+		}
+		tags := map[string]interface{}{}
+		for k := range q {
+			tags[k] = q.Get(k)
+		}
+		props[s3TagsProperty] = tags
+	}
+	return props, nil
+}
+
+// s3mergeProperties adds the metadata and tags returned by
+// s3requestMetadata to a collection's properties. Tags are added to
+// the existing tags rather than replacing them.
+func s3mergeProperties(props, metadata map[string]interface{}) {
+	for k, v := range metadata {
+		if k == s3TagsProperty {
+			tags := s3collectionTags(props)
+			update, _ := v.(map[string]interface{})
+			for tk, tv := range update {
+				tags[tk] = tv
+			}
+			props[k] = tags
+		} else {
+			props[k] = v
+		}
+	}
+}
+
+// s3collectionTags returns a copy of the tags stored in the given
+// collection properties.
+func s3collectionTags(props map[string]interface{}) map[string]interface{} {
+	tags := map[string]interface{}{}
+	if m, ok := props[s3TagsProperty].(map[string]interface{}); ok {
+		for k, v := range m {
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// s3objectProperties returns the properties of the collection that
+// contains fspath, as loaded by fs.
+func s3objectProperties(fs arvados.CustomFileSystem, fspath string) (map[string]interface{}, error) {
+	_, relpath, err := s3collectionForPath(fs, fspath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fs.Stat(fspath[:len(fspath)-len(relpath)-1])
+	if err != nil {
+		return nil, err
+	}
+	if coll, ok := fi.Sys().(*arvados.Collection); ok {
+		return coll.Properties, nil
+	}
+	return nil, nil
+}
+
+// s3setMetadataHeaders adds an x-amz-meta-* response header for each
+// property of the collection that contains fspath.
+func s3setMetadataHeaders(header http.Header, fs arvados.CustomFileSystem, fspath string) error {
+	props, err := s3objectProperties(fs, fspath)
+	if err != nil {
+		return err
+	}
+	for k, v := range props {
+		if k == s3TagsProperty || !httpguts.ValidHeaderFieldName(k) {
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			j, err := json.Marshal(v)
+			if err != nil {
+				continue
+			}
+			s = string(j)
+		}
+		if !httpguts.ValidHeaderFieldValue(s) || strings.IndexFunc(s, func(c rune) bool { return c > '\u007f' }) >= 0 {
+			s = mime.BEncoding.Encode("UTF-8", s)
+		}
+		header.Set(s3MetaHeaderPrefix+k, s)
+	}
+	return nil
+}
+
+// s3updateProperties retrieves the current properties of the
+// collection that contains fspath, calls update to modify them, and
+// saves the result. It returns an HTTP status code along with any
+// error.
+//
+// Changes made by other clients between retrieving and saving the
+// properties are lost.
+func s3updateProperties(r *http.Request, client *arvados.Client, fs arvados.CustomFileSystem, fspath string, update func(map[string]interface{})) (int, error) {
+	coll, _, err := s3collectionForPath(fs, fspath)
+	if err != nil {
+		return http.StatusBadRequest, err
+	} else if coll.UUID == "" {
+		return http.StatusBadRequest, errors.New("cannot modify a collection identified by portable data hash")
+	}
+	err = client.RequestAndDecodeContext(r.Context(), coll, "GET", "arvados/v1/collections/"+coll.UUID, nil, map[string]interface{}{
+		"select": []string{"uuid", "properties"},
+	})
+	if err != nil {
+		return s3apiErrorStatus(err), err
+	}
+	if coll.Properties == nil {
+		coll.Properties = map[string]interface{}{}
+	}
+	update(coll.Properties)
+	err = client.RequestAndDecodeContext(r.Context(), nil, "PUT", "arvados/v1/collections/"+coll.UUID, nil, map[string]interface{}{
+		"collection": map[string]interface{}{"properties": coll.Properties},
+		"select":     []string{"uuid"},
+	})
+	if err != nil {
+		return s3apiErrorStatus(err), fmt.Errorf("error updating collection: %w", err)
+	}
+	return http.StatusOK, nil
+}
+
+// serveS3Tagging handles GetObjectTagging, PutObjectTagging, and
+// DeleteObjectTagging requests. It returns false if r is not a
+// tagging request.
+func (h *handler) serveS3Tagging(w http.ResponseWriter, r *http.Request, client *arvados.Client, fs arvados.CustomFileSystem, fspath string) bool {
+	if _, ok := r.URL.Query()["tagging"]; !ok {
+		return false
+	}
+	fi, err := fs.Stat(fspath)
+	if os.IsNotExist(err) ||
+		(err != nil && err.Error() == "not a directory") ||
+		(err == nil && fi.IsDir() != strings.HasSuffix(fspath, "/")) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return true
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return true
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		props, err := s3objectProperties(fs, fspath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return true
+		}
+		resp := struct {
+			XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ Tagging"`
+			TagSet  []s3tag  `xml:"TagSet>Tag"`
+		}{
+			TagSet: []s3tag{},
+		}
+		for k, v := range s3collectionTags(props) {
+			if s, ok := v.(string); ok {
+				resp.TagSet = append(resp.TagSet, s3tag{Key: k, Value: s})
+			}
+		}
+		sort.Slice(resp.TagSet, func(i, j int) bool { return resp.TagSet[i].Key < resp.TagSet[j].Key })
+		s3xmlResponse(w, r, resp)
+	case http.MethodPut:
+		var req struct {
+			TagSet []s3tag `xml:"TagSet>Tag"`
+		}
+		err := xml.NewDecoder(io.LimitReader(r.Body, s3MaxTaggingBody)).Decode(&req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("malformed XML: %s", err), http.StatusBadRequest)
+			return true
+		}
+		tags := map[string]interface{}{}
+		for _, tag := range req.TagSet {
+			if _, dup := tags[tag.Key]; dup || tag.Key == "" {
+				http.Error(w, fmt.Sprintf("invalid tag key %q", tag.Key), http.StatusBadRequest)
+				return true
+			}
+			tags[tag.Key] = tag.Value
+		}
+		status, err := s3updateProperties(r, client, fs, fspath, func(props map[string]interface{}) {
+			props[s3TagsProperty] = tags
+		})
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return true
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		status, err := s3updateProperties(r, client, fs, fspath, func(props map[string]interface{}) {
+			delete(props, s3TagsProperty)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return true
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+	return true
+}
@@ -0,0 +1,875 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+)
+
+// Multipart uploads are stored in temporary collections until they
+// are completed or aborted. The temporary collections are kept in a
+// dedicated project, owned by the user, so they don't clutter the
+// user's home project. The upload ID given to the client is the UUID
+// of a temporary collection that records the target bucket and key.
+// Each part is saved in its own temporary collection, as a file named
+// "{partnumber}-{etag}", with a property linking it to the upload.
+// Parts are never added to an existing collection, so concurrent
+// UploadPart requests (even when handled by different keep-web
+// processes) can write their data without coordinating.
+//
+// The ETag of each uploaded part is also recorded in the upload's
+// properties. Only part collections that are in the same project as
+// the upload, and whose ETag matches the one recorded for that part
+// number, are used: anyone who can share a collection with the user
+// could give it the same property, but can't change the upload's
+// record. Concurrent UploadPart requests update the record with
+// read-modify-write, so each request re-reads the record after
+// updating it, and tries again if its ETag was lost to a concurrent
+// update. If a part number is uploaded more than once, the part with
+// the most recently recorded ETag is used.
+//
+// On completion, the selected parts are spliced into the target
+// collection's manifest without copying any data. The temporary
+// collections are then trashed. If a client abandons an upload, its
+// temporary collections get trashed automatically when their
+// trash_at times arrive. The upload's trash_at time is extended each
+// time a part is uploaded. Parts that have been trashed this way are
+// still used if the upload is completed before they are deleted.
+
+const (
+	s3MultipartProperty    = "s3_multipart_upload"
+	s3PartProperty         = "s3_multipart_upload_part_of"
+	s3MultipartProjectName = "S3 multipart uploads"
+	s3MultipartMaxParts    = 10000
+	s3MultipartPartNameF   = "%05d-%s"
+	s3MaxCompleteBody      = 1 << 22
+	s3RecordPartAttempts   = 10
+)
+
+var (
+	errS3NoSuchUpload  = errors.New("no such upload")
+	s3PartNameRegexp   = regexp.MustCompile(`^(\d{5})-([0-9a-f]{32})$`)
+	s3UploadUUIDRegexp = regexp.MustCompile(`^[0-9a-z]{5}-4zz18-[0-9a-z]{15}$`)
+
+	// s3uploadLocks serialize updates to upload records within
+	// this process, so concurrent UploadPart requests handled here
+	// don't have to retry (see s3recordPart). Uploads are assigned
+	// to locks by the last character of the upload ID.
+	s3uploadLocks [16]sync.Mutex
+)
+
+type s3part struct {
+	number   int
+	etag     string
+	name     string
+	size     int64
+	modTime  time.Time
+	manifest string // manifest of the part's temporary collection
+}
+
+func s3xmlResponse(w http.ResponseWriter, r *http.Request, resp interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(resp); err != nil {
+		ctxlog.FromContext(r.Context()).WithError(err).Error("error writing xml response")
+	}
+}
+
+// serveS3Multipart handles multipart upload requests:
+// CreateMultipartUpload, UploadPart, CompleteMultipartUpload,
+// AbortMultipartUpload, and ListParts. It returns false if r is not
+// a multipart upload request.
+func (h *handler) serveS3Multipart(w http.ResponseWriter, r *http.Request, client *arvados.Client, kc *keepclient.KeepClient, fs arvados.CustomFileSystem, fspath, bucket, key string) bool {
+	uploadID := r.URL.Query().Get("uploadId")
+	if _, ok := r.URL.Query()["uploads"]; ok && r.Method == http.MethodPost {
+		h.s3CreateMultipartUpload(w, r, client, fs, bucket, key)
+		return true
+	} else if uploadID == "" {
+		return false
+	}
+
+	if r.Method == http.MethodPut {
+		h.s3UploadPart(w, r, client, kc, fs, uploadID, bucket, key)
+		return true
+	}
+	upload, err := s3loadUpload(r, client, uploadID, bucket, key)
+	if err == errS3NoSuchUpload {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return true
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return true
+	}
+	switch r.Method {
+	case http.MethodGet:
+		h.s3ListParts(w, r, client, kc, upload, bucket, key)
+	case http.MethodPost:
+		h.s3CompleteMultipartUpload(w, r, client, kc, fs, fspath, upload, bucket, key)
+	case http.MethodDelete:
+		err = client.RequestAndDecodeContext(r.Context(), nil, "DELETE", "arvados/v1/collections/"+upload.UUID, nil, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return true
+		}
+		s3deleteParts(r, client, upload)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+	return true
+}
+
+// s3loadUpload returns the temporary collection for the given upload
+// ID, or errS3NoSuchUpload if it doesn't exist (or has been trashed,
+// or was started for a different bucket/key).
+func s3loadUpload(r *http.Request, client *arvados.Client, uploadID, bucket, key string) (*arvados.Collection, error) {
+	if !s3UploadUUIDRegexp.MatchString(uploadID) {
+		return nil, errS3NoSuchUpload
+	}
+	var upload arvados.Collection
+	err := client.RequestAndDecodeContext(r.Context(), &upload, "GET", "arvados/v1/collections/"+uploadID, nil, nil)
+	if err, ok := err.(*arvados.TransactionError); ok && err.StatusCode == http.StatusNotFound {
+		return nil, errS3NoSuchUpload
+	} else if err != nil {
+		return nil, err
+	}
+	prop, _ := upload.Properties[s3MultipartProperty].(map[string]interface{})
+	if prop == nil || prop["bucket"] != bucket || prop["key"] != key {
+		return nil, errS3NoSuchUpload
+	}
+	return &upload, nil
+}
+
+// s3recordedParts returns the part ETags recorded in the given
+// upload's properties, indexed by part number (as a string), or nil
+// if the upload has no properties.
+func s3recordedParts(upload *arvados.Collection) map[string]interface{} {
+	prop, _ := upload.Properties[s3MultipartProperty].(map[string]interface{})
+	if prop == nil {
+		return nil
+	}
+	parts, _ := prop["parts"].(map[string]interface{})
+	if parts == nil {
+		parts = map[string]interface{}{}
+		prop["parts"] = parts
+	}
+	return parts
+}
+
+// s3recordPart records the ETag of an uploaded part in the upload's
+// properties, along with the given attributes (e.g., an updated
+// trash_at time).
+//
+// Another keep-web process might update the record concurrently,
+// based on a copy that doesn't include this part, so s3recordPart
+// re-reads the record after updating it, and tries again if the
+// part's ETag is missing (or has been replaced with an older one).
+func s3recordPart(r *http.Request, client *arvados.Client, uploadID, bucket, key string, partNumber int, etag string, attrs map[string]interface{}) error {
+	mtx := &s3uploadLocks[uploadID[len(uploadID)-1]%byte(len(s3uploadLocks))]
+	mtx.Lock()
+	defer mtx.Unlock()
+	n := strconv.Itoa(partNumber)
+	for attempt := 0; attempt < s3RecordPartAttempts; attempt++ {
+		upload, err := s3loadUpload(r, client, uploadID, bucket, key)
+		if err != nil {
+			return err
+		}
+		parts := s3recordedParts(upload)
+		if attempt > 0 && parts[n] == etag {
+			return nil
+		}
+		parts[n] = etag
+		attrs["properties"] = upload.Properties
+		err = client.RequestAndDecodeContext(r.Context(), nil, "PUT", "arvados/v1/collections/"+uploadID, nil, map[string]interface{}{
+			"collection": attrs,
+			"select":     []string{"uuid"},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("gave up after %d attempts to record part %d: too many concurrent updates", s3RecordPartAttempts, partNumber)
+}
+
+// s3multipartProject returns the UUID of the current user's project
+// for temporary multipart upload collections, creating it if needed.
+func s3multipartProject(r *http.Request, client *arvados.Client) (string, error) {
+	var user arvados.User
+	err := client.RequestAndDecodeContext(r.Context(), &user, "GET", "arvados/v1/users/current", nil, arvados.GetOptions{
+		Select: []string{"uuid"},
+	})
+	if err != nil {
+		return "", err
+	}
+	for attempt := 0; ; attempt++ {
+		var resp struct {
+			Items []arvados.Group `json:"items"`
+		}
+		err = client.RequestAndDecodeContext(r.Context(), &resp, "GET", "arvados/v1/groups", nil, map[string]interface{}{
+			"select": []string{"uuid"},
+			"filters": []arvados.Filter{
+				{Attr: "owner_uuid", Operator: "=", Operand: user.UUID},
+				{Attr: "name", Operator: "=", Operand: s3MultipartProjectName},
+				{Attr: "group_class", Operator: "=", Operand: "project"},
+			},
+			"limit": 1,
+			"count": "none",
+		})
+		if err != nil {
+			return "", err
+		} else if len(resp.Items) > 0 {
+			return resp.Items[0].UUID, nil
+		}
+		var proj arvados.Group
+		err = client.RequestAndDecodeContext(r.Context(), &proj, "POST", "arvados/v1/groups", nil, map[string]interface{}{
+			"group": map[string]interface{}{
+				"owner_uuid":  user.UUID,
+				"name":        s3MultipartProjectName,
+				"group_class": "project",
+			},
+			"select": []string{"uuid"},
+		})
+		if err == nil {
+			return proj.UUID, nil
+		} else if attempt > 0 {
+			return "", err
+		}
+		// Another request might have created the project
+		// concurrently, causing a name conflict. Look it up
+		// again.
+	}
+}
+
+// s3listParts returns the parts that have been uploaded for the
+// given upload, in part number order. Only the parts whose ETags are
+// recorded in the upload's properties, and whose collections are in
+// the same project as the upload, are returned.
+func s3listParts(r *http.Request, client *arvados.Client, upload *arvados.Collection) ([]s3part, error) {
+	recorded := s3recordedParts(upload)
+	byNumber := map[int]s3part{}
+	for offset := 0; ; {
+		var resp struct {
+			Items []arvados.Collection `json:"items"`
+		}
+		err := client.RequestAndDecodeContext(r.Context(), &resp, "GET", "arvados/v1/collections", nil, map[string]interface{}{
+			"select": []string{"uuid", "manifest_text", "created_at"},
+			"filters": []arvados.Filter{
+				{Attr: "owner_uuid", Operator: "=", Operand: upload.OwnerUUID},
+				{Attr: "properties." + s3PartProperty, Operator: "=", Operand: upload.UUID},
+			},
+			"order":         []string{"created_at", "uuid"},
+			"offset":        offset,
+			"count":         "none",
+			"include_trash": true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Items) == 0 {
+			break
+		}
+		offset += len(resp.Items)
+		for _, coll := range resp.Items {
+			_, files, err := s3rootStream(coll.ManifestText)
+			if err != nil {
+				return nil, fmt.Errorf("part collection %s: %w", coll.UUID, err)
+			}
+			for name, segs := range files {
+				m := s3PartNameRegexp.FindStringSubmatch(name)
+				if m == nil {
+					continue
+				}
+				n, _ := strconv.Atoi(m[1])
+				if recorded[strconv.Itoa(n)] != m[2] {
+					continue
+				}
+				part := s3part{
+					number:   n,
+					etag:     m[2],
+					name:     name,
+					modTime:  coll.CreatedAt,
+					manifest: coll.ManifestText,
+				}
+				for _, seg := range segs {
+					part.size += seg.length
+				}
+				byNumber[n] = part
+			}
+		}
+	}
+	var parts []s3part
+	for _, part := range byNumber {
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].number < parts[j].number })
+	return parts, nil
+}
+
+// s3deleteParts trashes the part collections of the given upload
+// after it has been completed or aborted. Errors are logged but
+// otherwise ignored: the part collections will be trashed eventually
+// anyway.
+func s3deleteParts(r *http.Request, client *arvados.Client, upload *arvados.Collection) {
+	logger := ctxlog.FromContext(r.Context()).WithField("UUID", upload.UUID)
+	var resp struct {
+		Items []arvados.Collection `json:"items"`
+	}
+	for {
+		err := client.RequestAndDecodeContext(r.Context(), &resp, "GET", "arvados/v1/collections", nil, map[string]interface{}{
+			"select": []string{"uuid"},
+			"filters": []arvados.Filter{
+				{Attr: "owner_uuid", Operator: "=", Operand: upload.OwnerUUID},
+				{Attr: "properties." + s3PartProperty, Operator: "=", Operand: upload.UUID},
+			},
+			"count": "none",
+		})
+		if err != nil {
+			logger.WithError(err).Warn("error listing temporary part collections")
+			return
+		}
+		if len(resp.Items) == 0 {
+			return
+		}
+		for _, coll := range resp.Items {
+			err = client.RequestAndDecodeContext(r.Context(), nil, "DELETE", "arvados/v1/collections/"+coll.UUID, nil, nil)
+			if err != nil {
+				logger.WithError(err).WithField("PartUUID", coll.UUID).Warn("error deleting temporary part collection")
+				return
+			}
+		}
+		resp.Items = nil
+	}
+}
+
+func (h *handler) s3CreateMultipartUpload(w http.ResponseWriter, r *http.Request, client *arvados.Client, fs arvados.CustomFileSystem, bucket, key string) {
+	if strings.HasSuffix(key, "/") {
+		http.Error(w, "invalid object name: trailing slash", http.StatusBadRequest)
+		return
+	}
+	if fi, err := fs.Stat("/by_id/" + bucket); os.IsNotExist(err) || (err == nil && !fi.IsDir()) {
+		http.Error(w, "bucket not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	metadata, err := s3requestMetadata(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	projectUUID, err := s3multipartProject(r, client)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error finding project for temporary collections: %s", err), s3apiErrorStatus(err))
+		return
+	}
+	attrs := map[string]interface{}{
+		"owner_uuid": projectUUID,
+		"name":       "S3 multipart upload " + time.Now().UTC().Format(time.RFC3339Nano),
+		"properties": map[string]interface{}{
+			s3MultipartProperty: map[string]interface{}{
+				"bucket":   bucket,
+				"key":      key,
+				"metadata": metadata,
+			},
+		},
+	}
+	if ttl := h.Config.cluster.Collections.S3MultipartUploadTTL.Duration(); ttl > 0 {
+		attrs["trash_at"] = time.Now().Add(ttl).UTC()
+	}
+	var upload arvados.Collection
+	err = client.RequestAndDecodeContext(r.Context(), &upload, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"collection":         attrs,
+		"ensure_unique_name": true,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error creating temporary collection: %s", err), http.StatusBadGateway)
+		return
+	}
+	s3xmlResponse(w, r, struct {
+		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{
+		Bucket:   bucket,
+		Key:      key,
+		UploadId: upload.UUID,
+	})
+}
+
+func (h *handler) s3UploadPart(w http.ResponseWriter, r *http.Request, client *arvados.Client, kc *keepclient.KeepClient, fs arvados.CustomFileSystem, uploadID, bucket, key string) {
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MultipartMaxParts {
+		http.Error(w, fmt.Sprintf("invalid part number (must be 1 to %d)", s3MultipartMaxParts), http.StatusBadRequest)
+		return
+	}
+	// Check the upload exists before accepting or copying any
+	// data.
+	upload, err := s3loadUpload(r, client, uploadID, bucket, key)
+	if err == errS3NoSuchUpload {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	var parttxt, etag string
+	copySource := r.Header.Get("X-Amz-Copy-Source") != ""
+	if copySource {
+		// UploadPartCopy
+		locators, segs, status, err := s3copySource(r, client, kc, fs)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		etag = s3copyETag(locators, segs)
+		parttxt = s3singleFileManifest(locators, segs, fmt.Sprintf(s3MultipartPartNameF, partNumber, etag))
+	} else {
+		var status int
+		parttxt, etag, status, err = s3writePart(r, client, kc, partNumber)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	partAttrs := map[string]interface{}{
+		"owner_uuid":    upload.OwnerUUID,
+		"name":          fmt.Sprintf("S3 multipart upload part %d %s", partNumber, time.Now().UTC().Format(time.RFC3339Nano)),
+		"manifest_text": parttxt,
+		"properties":    map[string]interface{}{s3PartProperty: uploadID},
+	}
+	uploadAttrs := map[string]interface{}{}
+	if ttl := h.Config.cluster.Collections.S3MultipartUploadTTL.Duration(); ttl > 0 {
+		partAttrs["trash_at"] = time.Now().Add(ttl).UTC()
+		uploadAttrs["trash_at"] = partAttrs["trash_at"]
+	}
+	err = client.RequestAndDecodeContext(r.Context(), nil, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"collection":         partAttrs,
+		"ensure_unique_name": true,
+		"select":             []string{"uuid"},
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error creating temporary part collection: %s", err), http.StatusBadGateway)
+		return
+	}
+	err = s3recordPart(r, client, uploadID, bucket, key, partNumber, etag, uploadAttrs)
+	if err == errS3NoSuchUpload {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("error updating temporary collection: %s", err), http.StatusBadGateway)
+		return
+	}
+	if copySource {
+		s3xmlResponse(w, r, struct {
+			XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyPartResult"`
+			ETag         string
+			LastModified string
+		}{
+			ETag:         `"` + etag + `"`,
+			LastModified: time.Now().UTC().Format("2006-01-02T15:04:05.999") + "Z",
+		})
+		return
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+// s3writePart writes the request body to Keep, and returns a
+// manifest with a single file named "{partNumber}-{etag}".
+func s3writePart(r *http.Request, client *arvados.Client, kc *keepclient.KeepClient, partNumber int) (string, string, int, error) {
+	partfs, err := (&arvados.Collection{}).FileSystem(client, kc)
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	f, err := partfs.OpenFile("part", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	hash := md5.New()
+	_, err = io.Copy(f, io.TeeReader(r.Body, hash))
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		return "", "", http.StatusBadGateway, fmt.Errorf("write part %d failed: %w", partNumber, err)
+	}
+	sum := hash.Sum(nil)
+	if want := r.Header.Get("Content-Md5"); want != "" && want != base64.StdEncoding.EncodeToString(sum) {
+		return "", "", http.StatusBadRequest, errors.New("Content-MD5 does not match uploaded data")
+	}
+	etag := hex.EncodeToString(sum)
+	err = partfs.Rename("part", fmt.Sprintf(s3MultipartPartNameF, partNumber, etag))
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	txt, err := partfs.MarshalManifest(".")
+	if err != nil {
+		return "", "", http.StatusBadGateway, fmt.Errorf("write part %d failed: %w", partNumber, err)
+	}
+	return txt, etag, 0, nil
+}
+
+func (h *handler) s3ListParts(w http.ResponseWriter, r *http.Request, client *arvados.Client, kc *keepclient.KeepClient, upload *arvados.Collection, bucket, key string) {
+	maxParts := s3MaxKeys
+	if mp, _ := strconv.Atoi(r.FormValue("max-parts")); mp > 0 && mp < s3MaxKeys {
+		maxParts = mp
+	}
+	marker, _ := strconv.Atoi(r.FormValue("part-number-marker"))
+	parts, err := s3listParts(r, client, upload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	type xmlPart struct {
+		PartNumber   int
+		LastModified string
+		ETag         string
+		Size         int64
+	}
+	resp := struct {
+		XMLName              xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+		Bucket               string
+		Key                  string
+		UploadId             string
+		PartNumberMarker     int
+		NextPartNumberMarker int `xml:",omitempty"`
+		MaxParts             int
+		IsTruncated          bool
+		Parts                []xmlPart `xml:"Part"`
+	}{
+		Bucket:           bucket,
+		Key:              key,
+		UploadId:         upload.UUID,
+		PartNumberMarker: marker,
+		MaxParts:         maxParts,
+	}
+	for _, part := range parts {
+		if part.number <= marker {
+			continue
+		}
+		if len(resp.Parts) >= maxParts {
+			resp.IsTruncated = true
+			resp.NextPartNumberMarker = resp.Parts[len(resp.Parts)-1].PartNumber
+			break
+		}
+		resp.Parts = append(resp.Parts, xmlPart{
+			PartNumber:   part.number,
+			LastModified: part.modTime.UTC().Format("2006-01-02T15:04:05.999") + "Z",
+			ETag:         `"` + part.etag + `"`,
+			Size:         part.size,
+		})
+	}
+	s3xmlResponse(w, r, resp)
+}
+
+func (h *handler) s3CompleteMultipartUpload(w http.ResponseWriter, r *http.Request, client *arvados.Client, kc *keepclient.KeepClient, fs arvados.CustomFileSystem, fspath string, upload *arvados.Collection, bucket, key string) {
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	err := xml.NewDecoder(io.LimitReader(r.Body, s3MaxCompleteBody)).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("malformed XML: %s", err), http.StatusBadRequest)
+		return
+	} else if len(req.Parts) == 0 {
+		http.Error(w, "must specify at least one part", http.StatusBadRequest)
+		return
+	}
+	uploaded, err := s3listParts(r, client, upload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	partByNumber := map[int]s3part{}
+	for _, part := range uploaded {
+		partByNumber[part.number] = part
+	}
+	var names []string
+	var manifests []string
+	etags := md5.New()
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			http.Error(w, "parts must be listed in ascending order", http.StatusBadRequest)
+			return
+		}
+		part, ok := partByNumber[p.PartNumber]
+		if !ok || part.etag != strings.Trim(p.ETag, `"`) {
+			http.Error(w, fmt.Sprintf("part %d not found, or ETag does not match", p.PartNumber), http.StatusBadRequest)
+			return
+		}
+		names = append(names, part.name)
+		manifests = append(manifests, part.manifest)
+		sum, _ := hex.DecodeString(part.etag)
+		etags.Write(sum)
+	}
+
+	// Combine the selected parts into a single stream.
+	ufs, err := (&arvados.Collection{ManifestText: strings.Join(manifests, "")}).FileSystem(client, kc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	utxt, err := ufs.MarshalManifest(".")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	locators, files, err := s3rootStream(utxt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var segs []s3segment
+	for _, name := range names {
+		fsegs, ok := files[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("part file %q not found in temporary collections", name), http.StatusInternalServerError)
+			return
+		}
+		segs = append(segs, fsegs...)
+	}
+	var props map[string]interface{}
+	if upl, ok := upload.Properties[s3MultipartProperty].(map[string]interface{}); ok {
+		props, _ = upl["metadata"].(map[string]interface{})
+	}
+	status, err := s3replaceFile(r, client, kc, fs, fspath, s3singleFileManifest(locators, segs, "data"), props)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	err = client.RequestAndDecodeContext(r.Context(), nil, "DELETE", "arvados/v1/collections/"+upload.UUID, nil, nil)
+	if err != nil {
+		// The upload is complete, so don't return an error.
+		// The temporary collection will be trashed
+		// eventually anyway.
+		ctxlog.FromContext(r.Context()).WithError(err).WithField("UUID", upload.UUID).Warn("error deleting temporary collection")
+	}
+	s3deleteParts(r, client, upload)
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	s3xmlResponse(w, r, struct {
+		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{
+		Location: scheme + "://" + r.Host + r.URL.EscapedPath(),
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     fmt.Sprintf(`"%x-%d"`, etags.Sum(nil), len(names)),
+	})
+}
+
+// s3replaceFile replaces (or creates) the file at fspath, which must
+// be inside a writable collection, with the file named "data" in the
+// given manifest, and adds the given properties (if any) to the
+// collection. It returns an HTTP status code along with any error.
+func s3replaceFile(r *http.Request, client *arvados.Client, kc *keepclient.KeepClient, fs arvados.CustomFileSystem, fspath, txt string, props map[string]interface{}) (int, error) {
+	coll, relpath, err := s3collectionForPath(fs, fspath)
+	if err != nil {
+		return http.StatusBadRequest, err
+	} else if coll.UUID == "" {
+		return http.StatusBadRequest, errors.New("cannot write to a collection identified by portable data hash")
+	}
+	dir, base := path.Split(relpath)
+	afs, err := (&arvados.Collection{ManifestText: txt}).FileSystem(client, kc)
+	if err == nil {
+		err = afs.Rename("data", base)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	atxt, err := afs.MarshalManifest(strings.TrimSuffix("./"+dir, "/"))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	err = client.RequestAndDecodeContext(r.Context(), coll, "GET", "arvados/v1/collections/"+coll.UUID, nil, nil)
+	if err != nil {
+		return s3apiErrorStatus(err), err
+	}
+	cfs, err := coll.FileSystem(client, kc)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if fi, err := cfs.Stat(relpath); err == nil && fi.IsDir() {
+		return http.StatusBadRequest, errors.New("object name conflicts with existing object")
+	} else if err == nil {
+		err = cfs.Remove(relpath)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	ctxt, err := cfs.MarshalManifest(".")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	newfs, err := (&arvados.Collection{ManifestText: ctxt + atxt}).FileSystem(client, kc)
+	if err != nil {
+		// e.g., key is "foo/bar" but "foo" is a file
+		return http.StatusBadRequest, errors.New("object name conflicts with existing object")
+	}
+	newtxt, err := newfs.MarshalManifest(".")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	attrs := map[string]interface{}{"manifest_text": newtxt}
+	if len(props) > 0 {
+		if coll.Properties == nil {
+			coll.Properties = map[string]interface{}{}
+		}
+		s3mergeProperties(coll.Properties, props)
+		attrs["properties"] = coll.Properties
+	}
+	err = client.RequestAndDecodeContext(r.Context(), nil, "PUT", "arvados/v1/collections/"+coll.UUID, nil, map[string]interface{}{
+		"collection": attrs,
+		"select":     []string{"uuid"},
+	})
+	if err != nil {
+		return s3apiErrorStatus(err), fmt.Errorf("error updating collection: %w", err)
+	}
+	return http.StatusOK, nil
+}
+
+// s3apiErrorStatus returns the HTTP status code to send when an API
+// request fails with err: the API server's status if it indicates a
+// client error (e.g., permission denied), otherwise 502.
+func s3apiErrorStatus(err error) int {
+	if err, ok := err.(*arvados.TransactionError); ok && err.StatusCode >= 400 && err.StatusCode < 500 {
+		return err.StatusCode
+	}
+	return http.StatusBadGateway
+}
+
+// s3collectionForPath returns the collection that contains the given
+// path in a site filesystem, and the path relative to the collection
+// root. Only the UUID field of the returned collection is populated,
+// unless the collection was accessed by portable data hash, in which
+// case only the PortableDataHash field is populated.
+func s3collectionForPath(fs arvados.CustomFileSystem, fspath string) (*arvados.Collection, string, error) {
+	for i := len("/by_id/"); i < len(fspath); i++ {
+		if fspath[i] != '/' {
+			continue
+		}
+		fi, err := fs.Stat(fspath[:i])
+		if err != nil {
+			return nil, "", fmt.Errorf("stat %q: %w", fspath[:i], err)
+		}
+		if coll, ok := fi.Sys().(*arvados.Collection); ok {
+			if coll.UUID == "" {
+				return &arvados.Collection{PortableDataHash: path.Base(fspath[:i])}, fspath[i+1:], nil
+			}
+			return &arvados.Collection{UUID: coll.UUID}, fspath[i+1:], nil
+		}
+	}
+	return nil, "", errors.New("object name is not inside a collection")
+}
+
+// An s3segment is a range of a manifest stream, which is a file or
+// part of a file.
+type s3segment struct {
+	offset int64
+	length int64
+}
+
+// s3rootStream parses the root stream of a normalized manifest,
+// returning its block locators and the segments of each file.
+func s3rootStream(txt string) ([]string, map[string][]s3segment, error) {
+	files := map[string][]s3segment{}
+	if !strings.HasPrefix(txt, ". ") {
+		return nil, files, nil
+	}
+	var locators []string
+	for i, token := range strings.Split(strings.SplitN(txt, "\n", 2)[0], " ") {
+		if i == 0 {
+			continue
+		}
+		split := strings.SplitN(token, ":", 3)
+		if len(split) != 3 {
+			locators = append(locators, token)
+			continue
+		}
+		offset, err := strconv.ParseInt(split[0], 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad file segment %q", token)
+		}
+		length, err := strconv.ParseInt(split[1], 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad file segment %q", token)
+		}
+		files[split[2]] = append(files[split[2]], s3segment{offset, length})
+	}
+	return locators, files, nil
+}
+
+// s3sliceSegments returns the segments that correspond to the given
+// range of the file made up of segs.
+func s3sliceSegments(segs []s3segment, offset, length int64) []s3segment {
+	var slice []s3segment
+	for _, seg := range segs {
+		if length <= 0 {
+			break
+		}
+		if offset >= seg.length {
+			offset -= seg.length
+			continue
+		}
+		n := seg.length - offset
+		if n > length {
+			n = length
+		}
+		slice = append(slice, s3segment{seg.offset + offset, n})
+		offset = 0
+		length -= n
+	}
+	return slice
+}
+
+// s3singleFileManifest returns a manifest with a single file, named
+// filename, whose content is the concatenation of the given segments
+// of a stream with the given block locators.
+func s3singleFileManifest(locators []string, segs []s3segment, filename string) string {
+	tokens := append([]string{"."}, locators...)
+	if len(locators) == 0 {
+		tokens = append(tokens, "d41d8cd98f00b204e9800998ecf8427e+0")
+	}
+	for _, seg := range segs {
+		tokens = append(tokens, fmt.Sprintf("%d:%d:%s", seg.offset, seg.length, filename))
+	}
+	if len(segs) == 0 {
+		tokens = append(tokens, "0:0:"+filename)
+	}
+	return strings.Join(tokens, " ") + "\n"
+}
@@ -0,0 +1,333 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"container/list"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const diskCacheTmpPrefix = ".tmp-"
+
+var blockHashRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// diskCache is a local disk-backed LRU cache of blocks that have
+// been retrieved from keepstore servers.
+//
+// Blocks are only added to the cache after their content has been
+// verified against their hash. Cached blocks are only returned to
+// clients that supply a valid permission signature (if blob signing
+// is enabled).
+type diskCache struct {
+	dir     string
+	maxSize int64
+	perms   blobPermissions
+
+	mtx     sync.Mutex
+	lru     *list.List // of *diskCacheEntry, most recently used first
+	entries map[string]*list.Element
+	size    int64
+
+	hits   prometheus.Counter
+	misses prometheus.Counter
+}
+
+type diskCacheEntry struct {
+	hash string
+	size int64
+}
+
+// newDiskCache returns a diskCache that stores up to maxSize bytes of
+// block data in dir, using the permission signature settings from
+// cluster. Blocks already present in dir (e.g., from a previous
+// process) are loaded into the cache index.
+//
+// If reg is not nil, cache metrics are registered there.
+func newDiskCache(cluster *arvados.Cluster, dir string, maxSize int64, reg *prometheus.Registry) (*diskCache, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid disk cache size %d", maxSize)
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	cache := &diskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		perms:   newBlobPermissions(cluster),
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+	cache.setupMetrics(reg)
+	err = cache.load()
+	if err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+func (cache *diskCache) setupMetrics(reg *prometheus.Registry) {
+	cache.hits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_diskcache",
+		Name:      "hits",
+		Help:      "Number of block requests served from the disk cache.",
+	})
+	cache.misses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_diskcache",
+		Name:      "misses",
+		Help:      "Number of block requests passed through to keepstore servers.",
+	})
+	if reg == nil {
+		return
+	}
+	reg.MustRegister(cache.hits)
+	reg.MustRegister(cache.misses)
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_diskcache",
+		Name:      "cached_bytes",
+		Help:      "Total size of all blocks in the disk cache.",
+	}, func() float64 {
+		cache.mtx.Lock()
+		defer cache.mtx.Unlock()
+		return float64(cache.size)
+	}))
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_diskcache",
+		Name:      "cached_blocks",
+		Help:      "Number of blocks in the disk cache.",
+	}, func() float64 {
+		cache.mtx.Lock()
+		defer cache.mtx.Unlock()
+		return float64(cache.lru.Len())
+	}))
+}
+
+// load adds the blocks already stored in the cache directory to the
+// index, least recently used (according to file modification time)
+// first, and deletes leftover temporary files.
+func (cache *diskCache) load() error {
+	var found []os.FileInfo
+	err := filepath.Walk(cache.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), diskCacheTmpPrefix) {
+			os.Remove(path)
+		} else if blockHashRe.MatchString(fi.Name()) && path == cache.path(fi.Name()) {
+			found = append(found, fi)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ModTime().Before(found[j].ModTime())
+	})
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	for _, fi := range found {
+		cache.add(fi.Name(), fi.Size())
+	}
+	return nil
+}
+
+func (cache *diskCache) path(hash string) string {
+	return filepath.Join(cache.dir, hash[:3], hash)
+}
+
+// Stat returns the size of the block with the given locator, if it
+// is cached and the client is permitted to read it.
+func (cache *diskCache) Stat(locator, token string) (int64, bool) {
+	if !cache.perms.Permitted(locator, token) {
+		cache.misses.Inc()
+		return 0, false
+	}
+	hash := locator[:32]
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	elt, ok := cache.entries[hash]
+	if !ok {
+		cache.misses.Inc()
+		return 0, false
+	}
+	cache.lru.MoveToFront(elt)
+	cache.hits.Inc()
+	return elt.Value.(*diskCacheEntry).size, true
+}
+
+// Get returns the content of the block with the given locator, if it
+// is cached and the client is permitted to read it.
+//
+// If the cached data no longer matches the block hash, it is deleted
+// from the cache and treated as a miss.
+func (cache *diskCache) Get(locator, token string) ([]byte, bool) {
+	if !cache.perms.Permitted(locator, token) {
+		cache.misses.Inc()
+		return nil, false
+	}
+	hash := locator[:32]
+	cache.mtx.Lock()
+	elt, ok := cache.entries[hash]
+	if ok {
+		cache.lru.MoveToFront(elt)
+	}
+	cache.mtx.Unlock()
+	if !ok {
+		cache.misses.Inc()
+		return nil, false
+	}
+	path := cache.path(hash)
+	data, err := ioutil.ReadFile(path)
+	if err == nil && fmt.Sprintf("%x", md5.Sum(data)) != hash {
+		err = fmt.Errorf("cached data does not match hash")
+	}
+	if err != nil {
+		log.Printf("disk cache: %s: %s", path, err)
+		cache.mtx.Lock()
+		cache.remove(hash)
+		cache.mtx.Unlock()
+		cache.misses.Inc()
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	cache.hits.Inc()
+	return data, true
+}
+
+// NewWriter returns a diskCacheWriter that stores the block with the
+// given hash in the cache, if the data written to it matches the
+// hash. If the block is already cached, or is too big to cache,
+// NewWriter returns nil.
+func (cache *diskCache) NewWriter(hash string, size int64) *diskCacheWriter {
+	if size > cache.maxSize {
+		return nil
+	}
+	cache.mtx.Lock()
+	_, ok := cache.entries[hash]
+	cache.mtx.Unlock()
+	if ok {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(cache.path(hash)), 0700)
+	if err != nil {
+		log.Printf("disk cache: %s", err)
+		return nil
+	}
+	f, err := ioutil.TempFile(filepath.Dir(cache.path(hash)), diskCacheTmpPrefix)
+	if err != nil {
+		log.Printf("disk cache: %s", err)
+		return nil
+	}
+	return &diskCacheWriter{
+		cache: cache,
+		hash:  hash,
+		f:     f,
+		md5:   md5.New(),
+	}
+}
+
+// add adds an entry to the index and evicts least recently used
+// entries as needed to stay within maxSize. Caller must have lock.
+func (cache *diskCache) add(hash string, size int64) {
+	if elt, ok := cache.entries[hash]; ok {
+		cache.lru.MoveToFront(elt)
+		return
+	}
+	cache.entries[hash] = cache.lru.PushFront(&diskCacheEntry{hash: hash, size: size})
+	cache.size += size
+	for cache.size > cache.maxSize {
+		cache.remove(cache.lru.Back().Value.(*diskCacheEntry).hash)
+	}
+}
+
+// remove deletes an entry from the index and the disk. Caller must
+// have lock.
+func (cache *diskCache) remove(hash string) {
+	elt, ok := cache.entries[hash]
+	if !ok {
+		return
+	}
+	cache.lru.Remove(elt)
+	delete(cache.entries, hash)
+	cache.size -= elt.Value.(*diskCacheEntry).size
+	err := os.Remove(cache.path(hash))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("disk cache: %s", err)
+	}
+}
+
+// A diskCacheWriter saves a block to a temporary file as it is
+// being retrieved, and adds it to the cache when Commit is called.
+type diskCacheWriter struct {
+	cache *diskCache
+	hash  string
+	f     *os.File
+	md5   hash.Hash
+	size  int64
+	err   error
+}
+
+// Write implements io.Writer. Errors are remembered and reported by
+// Commit, rather than returned, so a diskCacheWriter can be used with
+// io.TeeReader without affecting the client response.
+func (w *diskCacheWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.f.Write(p)
+		w.md5.Write(p)
+		w.size += int64(len(p))
+	}
+	return len(p), nil
+}
+
+// Commit adds the written data to the cache, if it matches the block
+// hash.
+func (w *diskCacheWriter) Commit() error {
+	defer os.Remove(w.f.Name())
+	err := w.f.Close()
+	if w.err != nil {
+		return w.err
+	} else if err != nil {
+		return err
+	} else if fmt.Sprintf("%x", w.md5.Sum(nil)) != w.hash {
+		return fmt.Errorf("data written to disk cache does not match hash %s", w.hash)
+	}
+	w.cache.mtx.Lock()
+	defer w.cache.mtx.Unlock()
+	err = os.Rename(w.f.Name(), w.cache.path(w.hash))
+	if err != nil {
+		return err
+	}
+	w.cache.add(w.hash, w.size)
+	return nil
+}
+
+// Abort discards the written data.
+func (w *diskCacheWriter) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
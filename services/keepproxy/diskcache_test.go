@@ -0,0 +1,149 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&DiskCacheSuite{})
+
+type DiskCacheSuite struct {
+	cluster *arvados.Cluster
+}
+
+func (s *DiskCacheSuite) SetUpTest(c *C) {
+	s.cluster = &arvados.Cluster{}
+	s.cluster.Collections.BlobSigning = true
+	s.cluster.Collections.BlobSigningKey = "zfhgfenhffzltr9dixws36j1yhksjoll2grmku38mi7yxd66h5j4q9w4jzanezacp8s6q0ro3hxakfye02152hncy6zml2ed0uc"
+	s.cluster.Collections.BlobSigningTTL = arvados.Duration(time.Hour)
+}
+
+func (s *DiskCacheSuite) put(c *C, cache *diskCache, data []byte) string {
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	w := cache.NewWriter(hash, int64(len(data)))
+	c.Assert(w, NotNil)
+	w.Write(data)
+	c.Assert(w.Commit(), IsNil)
+	return hash
+}
+
+func (s *DiskCacheSuite) sign(hash string, size int, token string) string {
+	return arvados.SignLocator(fmt.Sprintf("%s+%d", hash, size), token, time.Now().Add(time.Minute), s.cluster.Collections.BlobSigningTTL.Duration(), []byte(s.cluster.Collections.BlobSigningKey))
+}
+
+func (s *DiskCacheSuite) TestPermission(c *C) {
+	cache, err := newDiskCache(s.cluster, c.MkDir(), 1000, prometheus.NewRegistry())
+	c.Assert(err, IsNil)
+	hash := s.put(c, cache, []byte("foo"))
+
+	for _, locator := range []string{
+		hash,
+		hash + "+3",
+		s.sign(hash, 3, "badtoken"),
+	} {
+		_, ok := cache.Get(locator, "goodtoken")
+		c.Check(ok, Equals, false, Commentf("%s", locator))
+		_, ok = cache.Stat(locator, "goodtoken")
+		c.Check(ok, Equals, false, Commentf("%s", locator))
+	}
+	c.Check(testutil.ToFloat64(cache.misses), Equals, 6.0)
+
+	data, ok := cache.Get(s.sign(hash, 3, "goodtoken"), "goodtoken")
+	c.Check(ok, Equals, true)
+	c.Check(string(data), Equals, "foo")
+	size, ok := cache.Stat(s.sign(hash, 3, "goodtoken"), "goodtoken")
+	c.Check(ok, Equals, true)
+	c.Check(size, Equals, int64(3))
+	c.Check(testutil.ToFloat64(cache.hits), Equals, 2.0)
+
+	s.cluster.Collections.BlobSigning = false
+	cache, err = newDiskCache(s.cluster, cache.dir, 1000, nil)
+	c.Assert(err, IsNil)
+	data, ok = cache.Get(hash, "anytoken")
+	c.Check(ok, Equals, true)
+	c.Check(string(data), Equals, "foo")
+}
+
+func (s *DiskCacheSuite) TestEvictLeastRecentlyUsed(c *C) {
+	s.cluster.Collections.BlobSigning = false
+	cache, err := newDiskCache(s.cluster, c.MkDir(), 10, nil)
+	c.Assert(err, IsNil)
+	foo := s.put(c, cache, []byte("foo"))
+	bar := s.put(c, cache, []byte("bar"))
+	baz := s.put(c, cache, []byte("baz"))
+	_, ok := cache.Get(foo, "")
+	c.Check(ok, Equals, true)
+
+	// Adding a 3-byte block should evict "bar", the least
+	// recently used.
+	waz := s.put(c, cache, []byte("waz"))
+	for hash, expect := range map[string]bool{foo: true, bar: false, baz: true, waz: true} {
+		_, ok := cache.Get(hash, "")
+		c.Check(ok, Equals, expect, Commentf("%s", hash))
+	}
+	c.Check(cache.size, Equals, int64(9))
+
+	// Blocks bigger than the cache are not cached.
+	c.Check(cache.NewWriter(fmt.Sprintf("%x", md5.Sum([]byte("0123456789a"))), 11), IsNil)
+	// Blocks that are already cached are not written again.
+	c.Check(cache.NewWriter(foo, 3), IsNil)
+
+	// A new cache in the same directory finds the existing
+	// blocks.
+	cache, err = newDiskCache(s.cluster, cache.dir, 10, nil)
+	c.Assert(err, IsNil)
+	c.Check(cache.lru.Len(), Equals, 3)
+	c.Check(cache.size, Equals, int64(9))
+	_, ok = cache.Get(waz, "")
+	c.Check(ok, Equals, true)
+}
+
+func (s *DiskCacheSuite) TestVerifyHash(c *C) {
+	s.cluster.Collections.BlobSigning = false
+	cache, err := newDiskCache(s.cluster, c.MkDir(), 1000, nil)
+	c.Assert(err, IsNil)
+
+	// Data that doesn't match the hash is not added.
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+	w := cache.NewWriter(hash, 3)
+	c.Assert(w, NotNil)
+	w.Write([]byte("bar"))
+	c.Check(w.Commit(), NotNil)
+	_, ok := cache.Get(hash, "")
+	c.Check(ok, Equals, false)
+
+	// Aborted writes are not added.
+	w = cache.NewWriter(hash, 3)
+	c.Assert(w, NotNil)
+	w.Write([]byte("foo"))
+	w.Abort()
+	_, ok = cache.Get(hash, "")
+	c.Check(ok, Equals, false)
+
+	// Cached data that gets corrupted on disk is detected and
+	// removed.
+	hash = s.put(c, cache, []byte("foo"))
+	err = ioutil.WriteFile(cache.path(hash), []byte("bar"), 0600)
+	c.Assert(err, IsNil)
+	_, ok = cache.Get(hash, "")
+	c.Check(ok, Equals, false)
+	c.Check(cache.lru.Len(), Equals, 0)
+	c.Check(cache.size, Equals, int64(0))
+
+	// No temp files are left behind.
+	fis, err := ioutil.ReadDir(cache.dir + "/" + hash[:3])
+	c.Assert(err, IsNil)
+	c.Check(fis, HasLen, 0)
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
@@ -29,6 +30,7 @@ import (
 	"github.com/coreos/go-systemd/daemon"
 	"github.com/ghodss/yaml"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -162,9 +164,31 @@ func run(logger log.FieldLogger, cluster *arvados.Cluster) error {
 	signal.Notify(term, syscall.SIGTERM)
 	signal.Notify(term, syscall.SIGINT)
 
+	reg := prometheus.NewRegistry()
+	var cache *diskCache
+	if dir := cluster.Collections.KeepproxyDiskCache.Directory; dir != "" {
+		cache, err = newDiskCache(cluster, dir, int64(cluster.Collections.KeepproxyDiskCache.MaxSize), reg)
+		if err != nil {
+			return fmt.Errorf("Error setting up disk cache: %v", err)
+		}
+		log.Printf("using disk cache at %s (max size %d bytes)", dir, cluster.Collections.KeepproxyDiskCache.MaxSize)
+	}
+
+	var spool *writeBehindSpool
+	if wb := cluster.Collections.KeepproxyWriteBehind; wb.Directory != "" {
+		spool, err = newWriteBehindSpool(cluster, wb.Directory, int64(wb.MaxSize), wb.RetryInterval.Duration(), kc, reg)
+		if err != nil {
+			return fmt.Errorf("Error setting up write-behind spool: %v", err)
+		}
+		spool.Start()
+		defer spool.Stop()
+		log.Printf("using write-behind spool at %s (max size %d bytes)", wb.Directory, wb.MaxSize)
+	}
+
 	// Start serving requests.
-	router = MakeRESTRouter(kc, time.Duration(keepclient.DefaultProxyRequestTimeout), cluster.ManagementToken)
-	return http.Serve(listener, httpserver.AddRequestIDs(httpserver.LogRequests(router)))
+	router = MakeRESTRouter(kc, time.Duration(keepclient.DefaultProxyRequestTimeout), cluster.ManagementToken, cache, spool)
+	mh := httpserver.Instrument(reg, nil, httpserver.AddRequestIDs(httpserver.LogRequests(router)))
+	return http.Serve(listener, mh.ServeAPI(cluster.ManagementToken, mh))
 }
 
 type APITokenCache struct {
@@ -273,11 +297,20 @@ type proxyHandler struct {
 	*APITokenCache
 	timeout   time.Duration
 	transport *http.Transport
+	cache     *diskCache        // nil if disk cache is disabled
+	spool     *writeBehindSpool // nil if write-behind is disabled
 }
 
 // MakeRESTRouter returns an http.Handler that passes GET and PUT
 // requests to the appropriate handlers.
-func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, mgmtToken string) http.Handler {
+//
+// If cache is not nil, it is used to serve GET and HEAD requests for
+// recently retrieved blocks.
+//
+// If spool is not nil, PUT requests are acknowledged as soon as the
+// block is stored in the spool, and replicated to keepstore servers
+// in the background.
+func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, mgmtToken string, cache *diskCache, spool *writeBehindSpool) http.Handler {
 	rest := mux.NewRouter()
 
 	transport := defaultTransport
@@ -294,6 +327,8 @@ func MakeRESTRouter(kc *keepclient.KeepClient, timeout time.Duration, mgmtToken
 		KeepClient: kc,
 		timeout:    timeout,
 		transport:  &transport,
+		cache:      cache,
+		spool:      spool,
 		APITokenCache: &APITokenCache{
 			tokens:     make(map[string]int64),
 			expireTime: 300,
@@ -398,14 +433,68 @@ func (h *proxyHandler) Get(resp http.ResponseWriter, req *http.Request) {
 
 	locator = removeHint.ReplaceAllString(locator, "$1")
 
-	switch req.Method {
-	case "HEAD":
+	var hit bool
+	if h.spool != nil && h.spool.perms.Permitted(locator, tok) {
+		// Blocks that haven't been replicated yet can only
+		// be retrieved from the spool.
+		switch req.Method {
+		case "HEAD":
+			expectLength, hit = h.spool.Stat(locator[:32])
+		case "GET":
+			data, err := h.spool.Get(locator[:32])
+			if err == nil {
+				expectLength, hit = int64(len(data)), true
+				reader = ioutil.NopCloser(bytes.NewReader(data))
+			} else if err != errSpoolNotFound {
+				log.Printf("write-behind spool: %s: %s", locator[:32], err)
+			}
+		}
+		if hit {
+			proxiedURI = "spool"
+		}
+	}
+	if !hit && h.cache != nil {
+		switch req.Method {
+		case "HEAD":
+			expectLength, hit = h.cache.Stat(locator, tok)
+		case "GET":
+			var data []byte
+			if data, hit = h.cache.Get(locator, tok); hit {
+				expectLength = int64(len(data))
+				reader = ioutil.NopCloser(bytes.NewReader(data))
+			}
+		}
+		if hit {
+			proxiedURI = "cache"
+		}
+	}
+
+	switch {
+	case hit:
+	case req.Method == "HEAD":
 		expectLength, proxiedURI, err = kc.Ask(locator)
-	case "GET":
+	case req.Method == "GET":
 		reader, expectLength, proxiedURI, err = kc.Get(locator)
 		if reader != nil {
 			defer reader.Close()
 		}
+		if err == nil && h.cache != nil {
+			if cw := h.cache.NewWriter(locator[:32], expectLength); cw != nil {
+				reader = struct {
+					io.Reader
+					io.Closer
+				}{io.TeeReader(reader, cw), reader}
+				defer func() {
+					if err == nil && status == http.StatusOK {
+						if err := cw.Commit(); err != nil {
+							log.Printf("disk cache: %s", err)
+						}
+					} else {
+						cw.Abort()
+					}
+				}()
+			}
+		}
 	default:
 		status, err = http.StatusNotImplemented, errMethodNotSupported
 		return
@@ -484,6 +573,7 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	var hashIn string
 	if locatorIn != "" {
 		var loc *keepclient.Locator
 		if loc, err = keepclient.MakeLocator(locatorIn); err != nil {
@@ -494,6 +584,7 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 			status = http.StatusBadRequest
 			return
 		}
+		hashIn = loc.Hash
 	}
 
 	var pass bool
@@ -518,6 +609,45 @@ func (h *proxyHandler) Put(resp http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	if h.spool != nil {
+		var hash string
+		hash, err = h.spool.Put(hashIn, req.Body, expectLength, kc.Want_replicas, kc.StorageClasses)
+		switch err {
+		case nil:
+			// No replicas are stored on keepstore servers
+			// yet (wroteReplicas stays 0, so our own log
+			// doesn't overstate durability), but they will
+			// be. Existing clients (including the Python
+			// SDK and older Go SDKs) don't know about
+			// X-Keep-Replicas-Pending, and treat an
+			// X-Keep-Replicas-Stored value less than the
+			// desired replication as a failed write, so
+			// X-Keep-Replicas-Stored has to report the
+			// pending replicas too.
+			locatorOut = h.spool.perms.Sign(fmt.Sprintf("%s+%d", hash, expectLength), tok)
+			resp.Header().Set(keepclient.XKeepReplicasStored, fmt.Sprintf("%d", kc.Want_replicas))
+			resp.Header().Set(keepclient.XKeepReplicasPending, fmt.Sprintf("%d", kc.Want_replicas))
+			status = http.StatusOK
+			_, err = io.WriteString(resp, locatorOut)
+			return
+		case errSpoolFull:
+			// Fall back to writing synchronously.
+			log.Printf("%s: %s", GetRemoteAddress(req), err)
+		case keepclient.ErrOversizeBlock:
+			status = http.StatusRequestEntityTooLarge
+			return
+		case errHashMismatch:
+			status = http.StatusUnprocessableEntity
+			return
+		case errContentLengthMismatch:
+			status = http.StatusBadRequest
+			return
+		default:
+			status = http.StatusInternalServerError
+			return
+		}
+	}
+
 	// Now try to put the block through
 	if locatorIn == "" {
 		bytes, err2 := ioutil.ReadAll(req.Body)
@@ -24,6 +24,7 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	log "github.com/sirupsen/logrus"
 
 	. "gopkg.in/check.v1"
@@ -257,7 +258,7 @@ func (s *ServerRequiredSuite) TestPutWrongContentLength(c *C) {
 	// fixes the invalid Content-Length header. In order to test
 	// our server behavior, we have to call the handler directly
 	// using an httptest.ResponseRecorder.
-	rtr := MakeRESTRouter(kc, 10*time.Second, "")
+	rtr := MakeRESTRouter(kc, 10*time.Second, "", nil, nil)
 
 	type testcase struct {
 		sendLength   string
@@ -388,6 +389,97 @@ func (s *ServerRequiredSuite) TestPutAskGet(c *C) {
 	}
 }
 
+func (s *ServerRequiredSuite) TestDiskCache(c *C) {
+	kc := runProxy(c, false, false)
+	defer closeListener()
+
+	// The test keepstores don't enforce permissions, but the disk
+	// cache should.
+	cfg, err := config.NewLoader(nil, ctxlog.TestLogger(c)).Load()
+	c.Assert(err, IsNil)
+	cluster, err := cfg.GetCluster("")
+	c.Assert(err, IsNil)
+	cluster.Collections.BlobSigning = true
+	cluster.Collections.BlobSigningKey = "zfhgfenhffzltr9dixws36j1yhksjoll2grmku38mi7yxd66h5j4q9w4jzanezacp8s6q0ro3hxakfye02152hncy6zml2ed0uc"
+	cache, err := newDiskCache(cluster, c.MkDir(), 1<<26, nil)
+	c.Assert(err, IsNil)
+	router.(*proxyHandler).cache = cache
+
+	content := []byte("TestDiskCache")
+	_, _, err = kc.PutB(content)
+	c.Assert(err, IsNil)
+	c.Check(cache.lru.Len(), Equals, 0)
+
+	unsigned := fmt.Sprintf("%x+%d", md5.Sum(content), len(content))
+	signed := arvados.SignLocator(unsigned, kc.Arvados.ApiToken, time.Now().Add(time.Hour), cluster.Collections.BlobSigningTTL.Duration(), []byte(cluster.Collections.BlobSigningKey))
+	for i := 0; i < 2; i++ {
+		reader, blocklen, _, err := kc.Get(signed)
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(reader)
+		c.Check(err, IsNil)
+		c.Check(data, DeepEquals, content)
+		c.Check(blocklen, Equals, int64(len(content)))
+		c.Check(cache.lru.Len(), Equals, 1)
+	}
+	c.Check(testutil.ToFloat64(cache.misses), Equals, 1.0)
+	c.Check(testutil.ToFloat64(cache.hits), Equals, 1.0)
+
+	blocklen, _, err := kc.Ask(signed)
+	c.Check(err, IsNil)
+	c.Check(blocklen, Equals, int64(len(content)))
+	c.Check(testutil.ToFloat64(cache.hits), Equals, 2.0)
+
+	// Without a valid signature, the request is passed through
+	// to the keepstore servers.
+	reader, _, _, err := kc.Get(unsigned)
+	c.Assert(err, IsNil)
+	reader.Close()
+	c.Check(testutil.ToFloat64(cache.misses), Equals, 2.0)
+	c.Check(testutil.ToFloat64(cache.hits), Equals, 2.0)
+}
+
+func (s *ServerRequiredSuite) TestWriteBehind(c *C) {
+	kc := runProxy(c, false, false)
+	defer closeListener()
+
+	cfg, err := config.NewLoader(nil, ctxlog.TestLogger(c)).Load()
+	c.Assert(err, IsNil)
+	cluster, err := cfg.GetCluster("")
+	c.Assert(err, IsNil)
+	h := router.(*proxyHandler)
+	spool, err := newWriteBehindSpool(cluster, c.MkDir(), 1<<26, time.Second, h.KeepClient, nil)
+	c.Assert(err, IsNil)
+	h.spool = spool
+
+	// Not started yet, so the block stays in the spool.
+	content := []byte("TestWriteBehind")
+	locator, replicas, err := kc.PutB(content)
+	c.Assert(err, IsNil)
+	c.Check(locator, Matches, fmt.Sprintf(`%x\+%d(\+A.*)?`, md5.Sum(content), len(content)))
+	c.Check(replicas, Equals, 2)
+	c.Check(spool.entries, HasLen, 1)
+
+	reader, blocklen, _, err := kc.Get(locator)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(reader)
+	c.Check(err, IsNil)
+	c.Check(data, DeepEquals, content)
+	c.Check(blocklen, Equals, int64(len(content)))
+
+	spool.Start()
+	defer spool.Stop()
+	for deadline := time.Now().Add(10 * time.Second); testutil.ToFloat64(spool.replicated) < 1 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+	c.Check(testutil.ToFloat64(spool.replicated), Equals, 1.0)
+	c.Check(spool.entries, HasLen, 0)
+
+	reader, _, _, err = kc.Get(locator)
+	c.Assert(err, IsNil)
+	data, err = ioutil.ReadAll(reader)
+	c.Check(err, IsNil)
+	c.Check(data, DeepEquals, content)
+}
+
 func (s *ServerRequiredSuite) TestPutAskGetForbidden(c *C) {
 	kc := runProxy(c, true, false)
 	defer closeListener()
@@ -669,7 +761,7 @@ func (s *ServerRequiredSuite) TestPing(c *C) {
 	kc := runProxy(c, false, false)
 	defer closeListener()
 
-	rtr := MakeRESTRouter(kc, 10*time.Second, arvadostest.ManagementToken)
+	rtr := MakeRESTRouter(kc, 10*time.Second, arvadostest.ManagementToken, nil, nil)
 
 	req, err := http.NewRequest("GET",
 		"http://"+listener.Addr().String()+"/_health/ping",
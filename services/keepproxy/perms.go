@@ -0,0 +1,49 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// blobPermissions signs and verifies locators for blocks that
+// keepproxy serves or accepts itself, i.e., without passing the
+// request through to a keepstore server.
+type blobPermissions struct {
+	// If enabled is false, locators are not signed, and any
+	// authorized client can read any block.
+	enabled bool
+	key     []byte
+	ttl     time.Duration
+}
+
+func newBlobPermissions(cluster *arvados.Cluster) blobPermissions {
+	return blobPermissions{
+		enabled: cluster.Collections.BlobSigning,
+		key:     []byte(cluster.Collections.BlobSigningKey),
+		ttl:     cluster.Collections.BlobSigningTTL.Duration(),
+	}
+}
+
+// Permitted returns true if the given locator has a valid permission
+// signature for the given token, or blob signing is disabled.
+func (perms blobPermissions) Permitted(locator, token string) bool {
+	if !perms.enabled {
+		return true
+	}
+	return arvados.VerifySignature(locator, token, perms.ttl, perms.key) == nil
+}
+
+// Sign returns the given locator with a permission signature for the
+// given token, valid for BlobSigningTTL. If blob signing is disabled,
+// the locator is returned unchanged.
+func (perms blobPermissions) Sign(locator, token string) string {
+	if !perms.enabled {
+		return locator
+	}
+	return arvados.SignLocator(locator, token, time.Now().Add(perms.ttl), perms.ttl, perms.key)
+}
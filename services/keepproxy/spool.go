@@ -0,0 +1,573 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Number of goroutines replicating spooled blocks to keepstore
+// servers.
+const spoolWorkers = 4
+
+var (
+	errSpoolFull     = errors.New("write-behind spool is full")
+	errHashMismatch  = errors.New("hash of uploaded data does not match locator")
+	errSpoolNotFound = errors.New("block not found in spool")
+	errSpoolChanged  = errors.New("spool entry changed")
+)
+
+// writeBehindSpool stores uploaded blocks on local disk, and
+// replicates them to keepstore servers in the background, retrying
+// until the desired replication is achieved.
+//
+// Each spooled block is stored in two files in the spool directory:
+// {hash}, with the block data, and {hash}.json, with the desired
+// replication and storage classes. Blocks left in the spool
+// directory by a previous process are queued again by
+// newWriteBehindSpool.
+//
+// Blocks that keepstore servers reject permanently (e.g., with 413 or
+// 422) have already been acknowledged to the client, so they are not
+// deleted. Instead, they are moved to the quarantine subdirectory,
+// where they no longer count toward the spool size or get retried,
+// but can still be retrieved. An operator can retry them by moving
+// them back to the spool directory and restarting keepproxy.
+type writeBehindSpool struct {
+	dir           string
+	maxSize       int64
+	retryInterval time.Duration
+	perms         blobPermissions
+	// KeepClient used to write blocks to keepstore servers
+	kc *keepclient.KeepClient
+
+	mtx         sync.Mutex
+	entries     map[string]*spoolEntry
+	quarantined map[string]*spoolEntry
+	size        int64 // total size of entries
+	reserved    int64 // total size of uploads in progress
+	todo        chan string
+	stop        chan struct{}
+	wg          sync.WaitGroup
+
+	replicated prometheus.Counter
+	failures   prometheus.Counter
+}
+
+// Name of the subdirectory of the spool directory where rejected
+// blocks are kept.
+const spoolQuarantineDir = "quarantine"
+
+// spoolEntry is the content of a {hash}.json file.
+type spoolEntry struct {
+	Size           int64     `json:"size"`
+	WantReplicas   int       `json:"want_replicas"`
+	StorageClasses []string  `json:"storage_classes"`
+	SpooledAt      time.Time `json:"spooled_at"`
+}
+
+// newWriteBehindSpool returns a writeBehindSpool that stores up to
+// maxSize bytes of block data in dir, uses kc to write them to
+// keepstore servers, and uses the permission signature settings from
+// cluster to sign and verify locators. Call Start to begin
+// replicating.
+//
+// If reg is not nil, spool metrics are registered there.
+func newWriteBehindSpool(cluster *arvados.Cluster, dir string, maxSize int64, retryInterval time.Duration, kc *keepclient.KeepClient, reg *prometheus.Registry) (*writeBehindSpool, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("invalid write-behind spool size %d", maxSize)
+	}
+	err := os.MkdirAll(filepath.Join(dir, spoolQuarantineDir), 0700)
+	if err != nil {
+		return nil, err
+	}
+	spool := &writeBehindSpool{
+		dir:           dir,
+		maxSize:       maxSize,
+		retryInterval: retryInterval,
+		perms:         newBlobPermissions(cluster),
+		kc:            kc,
+		entries:       map[string]*spoolEntry{},
+		quarantined:   map[string]*spoolEntry{},
+		todo:          make(chan string),
+		stop:          make(chan struct{}),
+	}
+	spool.setupMetrics(reg)
+	err = spool.load()
+	if err != nil {
+		return nil, err
+	}
+	return spool, nil
+}
+
+func (spool *writeBehindSpool) setupMetrics(reg *prometheus.Registry) {
+	spool.replicated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_spool",
+		Name:      "replicated_blocks",
+		Help:      "Number of spooled blocks written to keepstore servers.",
+	})
+	spool.failures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_spool",
+		Name:      "replication_failures",
+		Help:      "Number of failed attempts to write spooled blocks to keepstore servers.",
+	})
+	if reg == nil {
+		return
+	}
+	reg.MustRegister(spool.replicated)
+	reg.MustRegister(spool.failures)
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_spool",
+		Name:      "pending_bytes",
+		Help:      "Total size of spooled blocks not yet replicated.",
+	}, func() float64 {
+		spool.mtx.Lock()
+		defer spool.mtx.Unlock()
+		return float64(spool.size)
+	}))
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_spool",
+		Name:      "pending_blocks",
+		Help:      "Number of spooled blocks not yet replicated.",
+	}, func() float64 {
+		spool.mtx.Lock()
+		defer spool.mtx.Unlock()
+		return float64(len(spool.entries))
+	}))
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "keepproxy_spool",
+		Name:      "quarantined_blocks",
+		Help:      "Number of acknowledged blocks that keepstore servers rejected, kept in the quarantine directory.",
+	}, func() float64 {
+		spool.mtx.Lock()
+		defer spool.mtx.Unlock()
+		return float64(len(spool.quarantined))
+	}))
+}
+
+// load adds the blocks already stored in the spool directory to the
+// index, and deletes leftover temporary files and incomplete
+// entries.
+func (spool *writeBehindSpool) load() error {
+	fis, err := ioutil.ReadDir(spool.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		if strings.HasPrefix(name, diskCacheTmpPrefix) {
+			os.Remove(filepath.Join(spool.dir, name))
+			continue
+		}
+		hash := strings.TrimSuffix(name, ".json")
+		if !blockHashRe.MatchString(hash) {
+			continue
+		}
+		if hash == name {
+			// Data file without metadata: the process
+			// was interrupted before the upload was
+			// acknowledged.
+			if _, err := os.Stat(spool.metaPath(hash)); os.IsNotExist(err) {
+				log.Printf("write-behind spool: deleting incomplete entry %s", hash)
+				os.Remove(spool.dataPath(hash))
+			}
+			continue
+		}
+		buf, err := ioutil.ReadFile(spool.metaPath(hash))
+		if err != nil {
+			return err
+		}
+		var ent spoolEntry
+		err = json.Unmarshal(buf, &ent)
+		if err != nil {
+			return fmt.Errorf("%s: %s", spool.metaPath(hash), err)
+		}
+		if _, err := os.Stat(spool.dataPath(hash)); err != nil {
+			return err
+		}
+		spool.entries[hash] = &ent
+		spool.size += ent.Size
+	}
+	if len(spool.entries) > 0 {
+		log.Printf("write-behind spool: found %d blocks (%d bytes) not yet replicated", len(spool.entries), spool.size)
+	}
+
+	qdir := filepath.Join(spool.dir, spoolQuarantineDir)
+	fis, err = ioutil.ReadDir(qdir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		hash := strings.TrimSuffix(fi.Name(), ".json")
+		if hash == fi.Name() || !blockHashRe.MatchString(hash) {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(qdir, fi.Name()))
+		if err != nil {
+			return err
+		}
+		var ent spoolEntry
+		err = json.Unmarshal(buf, &ent)
+		if err != nil {
+			return fmt.Errorf("%s: %s", filepath.Join(qdir, fi.Name()), err)
+		}
+		spool.quarantined[hash] = &ent
+	}
+	if len(spool.quarantined) > 0 {
+		log.Printf("write-behind spool: WARNING: %d blocks rejected by keepstore servers are in %s", len(spool.quarantined), qdir)
+	}
+	return nil
+}
+
+func (spool *writeBehindSpool) dataPath(hash string) string {
+	return filepath.Join(spool.dir, hash)
+}
+
+func (spool *writeBehindSpool) metaPath(hash string) string {
+	return filepath.Join(spool.dir, hash+".json")
+}
+
+// Start starts replicating spooled blocks, including any that were
+// found in the spool directory at startup, in the background.
+func (spool *writeBehindSpool) Start() {
+	spool.mtx.Lock()
+	var hashes []string
+	for hash := range spool.entries {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return spool.entries[hashes[i]].SpooledAt.Before(spool.entries[hashes[j]].SpooledAt)
+	})
+	spool.mtx.Unlock()
+	for i := 0; i < spoolWorkers; i++ {
+		spool.wg.Add(1)
+		go spool.runWorker()
+	}
+	go func() {
+		for _, hash := range hashes {
+			spool.enqueue(hash)
+		}
+	}()
+}
+
+// Stop waits for in-progress writes to finish, and stops
+// replicating. Blocks that have not been replicated remain in the
+// spool directory.
+func (spool *writeBehindSpool) Stop() {
+	close(spool.stop)
+	spool.wg.Wait()
+}
+
+// enqueue waits for a worker to accept the given hash, or for Stop
+// to be called.
+func (spool *writeBehindSpool) enqueue(hash string) {
+	select {
+	case spool.todo <- hash:
+	case <-spool.stop:
+	}
+}
+
+// Put stores a block in the spool and queues it to be replicated. If
+// hash is empty, it is computed from the data. It returns the hash.
+//
+// If adding the block would exceed the spool's size limit, Put
+// returns errSpoolFull without reading any data, so the caller can
+// fall back to writing synchronously.
+func (spool *writeBehindSpool) Put(hash string, r io.Reader, size int64, wantReplicas int, storageClasses []string) (string, error) {
+	if size > keepclient.BLOCKSIZE {
+		return "", keepclient.ErrOversizeBlock
+	}
+	spool.mtx.Lock()
+	if ent, ok := spool.entries[hash]; ok && ent.WantReplicas >= wantReplicas {
+		spool.mtx.Unlock()
+		// Already spooled. Drain the request body and
+		// verify, for consistency with the non-spooled
+		// case.
+		h := md5.New()
+		if _, err := io.Copy(h, io.LimitReader(r, size)); err != nil {
+			return "", err
+		} else if fmt.Sprintf("%x", h.Sum(nil)) != hash {
+			return "", errHashMismatch
+		}
+		return hash, nil
+	}
+	if spool.size+spool.reserved+size > spool.maxSize {
+		spool.mtx.Unlock()
+		return "", errSpoolFull
+	}
+	spool.reserved += size
+	spool.mtx.Unlock()
+
+	ent := &spoolEntry{
+		Size:           size,
+		WantReplicas:   wantReplicas,
+		StorageClasses: storageClasses,
+		SpooledAt:      time.Now(),
+	}
+	hash, datafile, metafile, err := spool.write(hash, r, ent)
+	if datafile != "" {
+		defer os.Remove(datafile)
+	}
+	if metafile != "" {
+		defer os.Remove(metafile)
+	}
+
+	spool.mtx.Lock()
+	spool.reserved -= size
+	if err != nil {
+		spool.mtx.Unlock()
+		return "", err
+	}
+	// Renaming the files into place while holding the lock
+	// ensures a concurrent replicate() doesn't delete them.
+	if err = os.Rename(datafile, spool.dataPath(hash)); err == nil {
+		// The metadata file is renamed last: an entry is
+		// only considered spooled (see load) if it has one.
+		err = os.Rename(metafile, spool.metaPath(hash))
+	}
+	if err != nil {
+		spool.mtx.Unlock()
+		return "", err
+	}
+	old, queued := spool.entries[hash]
+	if queued {
+		// Spooled by a concurrent upload, or a previous
+		// upload with lower WantReplicas, and already
+		// queued.
+		spool.size -= old.Size
+		ent.SpooledAt = old.SpooledAt
+	}
+	spool.entries[hash] = ent
+	spool.size += size
+	spool.mtx.Unlock()
+
+	if !queued {
+		go spool.enqueue(hash)
+	}
+	return hash, syncDir(spool.dir)
+}
+
+// write saves a block's data and metadata in temporary files, and
+// syncs them to disk. It returns the block hash and the names of
+// the temporary files, which should be renamed or removed by the
+// caller.
+func (spool *writeBehindSpool) write(hash string, r io.Reader, ent *spoolEntry) (_, datafile, metafile string, err error) {
+	f, err := ioutil.TempFile(spool.dir, diskCacheTmpPrefix)
+	if err != nil {
+		return
+	}
+	datafile = f.Name()
+	defer f.Close()
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, ent.Size))
+	if err != nil {
+		return
+	} else if n != ent.Size {
+		err = errContentLengthMismatch
+		return
+	}
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+	if hash == "" {
+		hash = sum
+	} else if hash != sum {
+		err = errHashMismatch
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+
+	buf, err := json.Marshal(ent)
+	if err != nil {
+		return
+	}
+	mf, err := ioutil.TempFile(spool.dir, diskCacheTmpPrefix)
+	if err != nil {
+		return
+	}
+	metafile = mf.Name()
+	defer mf.Close()
+	if _, err = mf.Write(buf); err != nil {
+		return
+	}
+	if err = mf.Sync(); err != nil {
+		return
+	}
+	err = mf.Close()
+	return hash, datafile, metafile, err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Get returns the content of a spooled block that has not yet been
+// replicated, or has been quarantined.
+func (spool *writeBehindSpool) Get(hash string) ([]byte, error) {
+	spool.mtx.Lock()
+	_, ok := spool.entries[hash]
+	_, quarantined := spool.quarantined[hash]
+	spool.mtx.Unlock()
+	path := spool.dataPath(hash)
+	if quarantined {
+		path = filepath.Join(spool.dir, spoolQuarantineDir, hash)
+	} else if !ok {
+		return nil, errSpoolNotFound
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// Replicated and removed (or quarantined) since we
+		// checked.
+		return nil, errSpoolNotFound
+	}
+	return data, err
+}
+
+// Stat returns the size of a spooled block that has not yet been
+// replicated, or has been quarantined.
+func (spool *writeBehindSpool) Stat(hash string) (int64, bool) {
+	spool.mtx.Lock()
+	defer spool.mtx.Unlock()
+	ent, ok := spool.entries[hash]
+	if !ok {
+		ent, ok = spool.quarantined[hash]
+	}
+	if !ok {
+		return 0, false
+	}
+	return ent.Size, true
+}
+
+func (spool *writeBehindSpool) runWorker() {
+	defer spool.wg.Done()
+	for {
+		var hash string
+		select {
+		case hash = <-spool.todo:
+		case <-spool.stop:
+			return
+		}
+		err := spool.replicate(hash)
+		if err == errSpoolChanged {
+			go spool.enqueue(hash)
+		} else if kerr, ok := err.(keepclient.Error); ok && !kerr.Temporary() {
+			log.Printf("write-behind spool: ERROR: %s: %s (not retrying, block moved to %s)", hash, err, filepath.Join(spool.dir, spoolQuarantineDir))
+		} else if err != nil {
+			spool.failures.Inc()
+			log.Printf("write-behind spool: %s: %s (will retry in %v)", hash, err, spool.retryInterval)
+			time.AfterFunc(spool.retryInterval, func() { spool.enqueue(hash) })
+		}
+	}
+}
+
+// replicate writes a spooled block to keepstore servers, and removes
+// it from the spool if the desired replication is achieved. If the
+// servers reject it permanently, it is quarantined and the
+// keepclient.Error is returned.
+func (spool *writeBehindSpool) replicate(hash string) error {
+	spool.mtx.Lock()
+	ent, ok := spool.entries[hash]
+	spool.mtx.Unlock()
+	if !ok {
+		return nil
+	}
+	f, err := os.Open(spool.dataPath(hash))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	kc := spool.kc.Clone()
+	kc.Want_replicas = ent.WantReplicas
+	kc.StorageClasses = ent.StorageClasses
+	_, replicas, err := kc.PutHR(hash, f, ent.Size)
+	if kerr, ok := err.(keepclient.Error); ok && !kerr.Temporary() {
+		if qerr := spool.quarantine(hash, ent); qerr == errSpoolChanged {
+			return qerr
+		} else if qerr != nil {
+			return fmt.Errorf("%s (error quarantining: %s)", err, qerr)
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+	if !spool.remove(hash, ent) {
+		// Uploaded again (with higher WantReplicas) while we
+		// were writing.
+		return errSpoolChanged
+	}
+	spool.replicated.Inc()
+	log.Printf("write-behind spool: %s: wrote %d replicas", hash, replicas)
+	return nil
+}
+
+// remove deletes a block from the spool, unless its entry has been
+// replaced by a new upload since ent was retrieved. It returns false
+// if the entry has been replaced.
+func (spool *writeBehindSpool) remove(hash string, ent *spoolEntry) bool {
+	spool.mtx.Lock()
+	defer spool.mtx.Unlock()
+	if spool.entries[hash] != ent {
+		return false
+	}
+	delete(spool.entries, hash)
+	spool.size -= ent.Size
+	os.Remove(spool.metaPath(hash))
+	os.Remove(spool.dataPath(hash))
+	return true
+}
+
+// quarantine moves a block to the quarantine directory, unless its
+// entry has been replaced by a new upload since ent was retrieved, in
+// which case it returns errSpoolChanged.
+func (spool *writeBehindSpool) quarantine(hash string, ent *spoolEntry) error {
+	spool.mtx.Lock()
+	defer spool.mtx.Unlock()
+	if spool.entries[hash] != ent {
+		return errSpoolChanged
+	}
+	qdir := filepath.Join(spool.dir, spoolQuarantineDir)
+	err := os.Rename(spool.dataPath(hash), filepath.Join(qdir, hash))
+	if err != nil {
+		return err
+	}
+	err = os.Rename(spool.metaPath(hash), filepath.Join(qdir, hash+".json"))
+	if err != nil {
+		os.Rename(filepath.Join(qdir, hash), spool.dataPath(hash))
+		return err
+	}
+	delete(spool.entries, hash)
+	spool.size -= ent.Size
+	spool.quarantined[hash] = ent
+	return syncDir(qdir)
+}
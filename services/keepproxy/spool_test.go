@@ -0,0 +1,288 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&SpoolSuite{})
+
+type SpoolSuite struct {
+	cluster *arvados.Cluster
+	stub    *stubKeepstore
+	server  *httptest.Server
+	kc      *keepclient.KeepClient
+}
+
+// stubKeepstore accepts PUT requests (unless failCode is non-zero,
+// in which case it responds with that status) and remembers the
+// data.
+type stubKeepstore struct {
+	mtx      sync.Mutex
+	failCode int
+	puts     int
+	blocks   map[string][]byte
+}
+
+func (stub *stubKeepstore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	if r.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stub.puts++
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "stub failure", http.StatusServiceUnavailable)
+		return
+	} else if stub.failCode != 0 {
+		http.Error(w, "stub failure", stub.failCode)
+		return
+	}
+	stub.blocks[r.URL.Path[1:]] = data
+	w.Header().Set(keepclient.XKeepReplicasStored, "1")
+	fmt.Fprintf(w, "%s+%d", r.URL.Path[1:], len(data))
+}
+
+func (stub *stubKeepstore) get(hash string) []byte {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	return stub.blocks[hash]
+}
+
+func (stub *stubKeepstore) setFail(code int) {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	stub.failCode = code
+}
+
+func (stub *stubKeepstore) putCount() int {
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+	return stub.puts
+}
+
+func (s *SpoolSuite) SetUpTest(c *C) {
+	s.cluster = &arvados.Cluster{}
+	s.cluster.Collections.BlobSigning = true
+	s.cluster.Collections.BlobSigningKey = "zfhgfenhffzltr9dixws36j1yhksjoll2grmku38mi7yxd66h5j4q9w4jzanezacp8s6q0ro3hxakfye02152hncy6zml2ed0uc"
+	s.cluster.Collections.BlobSigningTTL = arvados.Duration(time.Hour)
+	s.stub = &stubKeepstore{blocks: map[string][]byte{}}
+	s.server = httptest.NewServer(s.stub)
+	s.kc = &keepclient.KeepClient{
+		Arvados:       &arvadosclient.ArvadosClient{},
+		Want_replicas: 1,
+	}
+	roots := map[string]string{"zzzzz-bi6l4-000000000000000": s.server.URL}
+	s.kc.SetServiceRoots(roots, roots, nil)
+}
+
+func (s *SpoolSuite) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+func (s *SpoolSuite) waitForReplication(c *C, spool *writeBehindSpool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		spool.mtx.Lock()
+		n := len(spool.entries)
+		spool.mtx.Unlock()
+		if n == 0 {
+			return
+		}
+	}
+	c.Fatal("timed out waiting for spooled blocks to be replicated")
+}
+
+func (s *SpoolSuite) TestRetry(c *C) {
+	spool, err := newWriteBehindSpool(s.cluster, c.MkDir(), 1000, time.Millisecond, s.kc, nil)
+	c.Assert(err, IsNil)
+	s.stub.setFail(http.StatusServiceUnavailable)
+	spool.Start()
+	defer spool.Stop()
+
+	hash, err := spool.Put("", bytes.NewReader([]byte("foo")), 3, 1, nil)
+	c.Assert(err, IsNil)
+	c.Check(hash, Equals, fmt.Sprintf("%x", md5.Sum([]byte("foo"))))
+
+	// Pending blocks can be retrieved from the spool.
+	data, err := spool.Get(hash)
+	c.Check(err, IsNil)
+	c.Check(string(data), Equals, "foo")
+	size, ok := spool.Stat(hash)
+	c.Check(ok, Equals, true)
+	c.Check(size, Equals, int64(3))
+
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(spool.failures) < 2 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+	}
+	c.Check(testutil.ToFloat64(spool.failures) >= 2, Equals, true)
+	c.Check(s.stub.get(hash), IsNil)
+
+	s.stub.setFail(0)
+	s.waitForReplication(c, spool)
+	c.Check(string(s.stub.get(hash)), Equals, "foo")
+	c.Check(testutil.ToFloat64(spool.replicated), Equals, 1.0)
+	_, err = spool.Get(hash)
+	c.Check(err, Equals, errSpoolNotFound)
+	c.Check(s.spoolFiles(c, spool.dir), HasLen, 0)
+}
+
+// spoolFiles returns the names of the files in dir, other than the
+// quarantine directory.
+func (s *SpoolSuite) spoolFiles(c *C, dir string) []string {
+	fis, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	var names []string
+	for _, fi := range fis {
+		if fi.Name() != spoolQuarantineDir {
+			names = append(names, fi.Name())
+		}
+	}
+	return names
+}
+
+func (s *SpoolSuite) TestPermanentFailure(c *C) {
+	for _, code := range []int{http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity} {
+		s.stub.setFail(code)
+		puts := s.stub.putCount()
+		dir := c.MkDir()
+		spool, err := newWriteBehindSpool(s.cluster, dir, 1000, time.Millisecond, s.kc, nil)
+		c.Assert(err, IsNil)
+		spool.Start()
+
+		hash, err := spool.Put("", bytes.NewReader([]byte("foo")), 3, 1, nil)
+		c.Assert(err, IsNil)
+		s.waitForReplication(c, spool)
+		spool.Stop()
+
+		// The block is quarantined after the first attempt,
+		// rather than retried, and no longer takes up spool
+		// space -- but it can still be retrieved.
+		c.Check(testutil.ToFloat64(spool.failures), Equals, 0.0)
+		c.Check(testutil.ToFloat64(spool.replicated), Equals, 0.0)
+		c.Check(s.stub.putCount()-puts, Equals, 1)
+		c.Check(s.stub.get(hash), IsNil)
+		c.Check(spool.size, Equals, int64(0))
+		data, err := spool.Get(hash)
+		c.Check(err, IsNil)
+		c.Check(string(data), Equals, "foo")
+		size, ok := spool.Stat(hash)
+		c.Check(ok, Equals, true)
+		c.Check(size, Equals, int64(3))
+		c.Check(s.spoolFiles(c, dir), HasLen, 0)
+		fis, err := ioutil.ReadDir(filepath.Join(dir, spoolQuarantineDir))
+		c.Assert(err, IsNil)
+		c.Check(fis, HasLen, 2)
+
+		// Quarantined blocks are still found after a restart,
+		// and are not retried.
+		spool, err = newWriteBehindSpool(s.cluster, dir, 1000, time.Millisecond, s.kc, nil)
+		c.Assert(err, IsNil)
+		c.Check(spool.entries, HasLen, 0)
+		c.Check(spool.quarantined, HasLen, 1)
+		data, err = spool.Get(hash)
+		c.Check(err, IsNil)
+		c.Check(string(data), Equals, "foo")
+	}
+}
+
+// Authorization errors are more likely to be caused by a
+// misconfiguration than by the block itself, so the block stays in
+// the spool and is retried.
+func (s *SpoolSuite) TestAuthorizationFailure(c *C) {
+	for _, code := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		s.stub.setFail(code)
+		spool, err := newWriteBehindSpool(s.cluster, c.MkDir(), 1000, time.Millisecond, s.kc, nil)
+		c.Assert(err, IsNil)
+		spool.Start()
+
+		hash, err := spool.Put("", bytes.NewReader([]byte("foo")), 3, 1, nil)
+		c.Assert(err, IsNil)
+		for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(spool.failures) < 2 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		}
+		c.Check(testutil.ToFloat64(spool.failures) >= 2, Equals, true)
+		c.Check(spool.quarantined, HasLen, 0)
+
+		s.stub.setFail(0)
+		s.waitForReplication(c, spool)
+		spool.Stop()
+		c.Check(string(s.stub.get(hash)), Equals, "foo")
+	}
+}
+
+func (s *SpoolSuite) TestRestart(c *C) {
+	dir := c.MkDir()
+	spool, err := newWriteBehindSpool(s.cluster, dir, 1000, time.Millisecond, s.kc, nil)
+	c.Assert(err, IsNil)
+	hash, err := spool.Put(fmt.Sprintf("%x", md5.Sum([]byte("foo"))), bytes.NewReader([]byte("foo")), 3, 1, []string{"archival"})
+	c.Assert(err, IsNil)
+
+	// Leave an incomplete entry (data file without metadata) and
+	// a temp file, as if interrupted while writing.
+	incomplete := fmt.Sprintf("%x", md5.Sum([]byte("bar")))
+	c.Assert(ioutil.WriteFile(dir+"/"+incomplete, []byte("bar"), 0600), IsNil)
+	c.Assert(ioutil.WriteFile(dir+"/"+diskCacheTmpPrefix+"123", []byte("baz"), 0600), IsNil)
+
+	// Never started, so nothing was replicated. A new spool in
+	// the same directory picks up where it left off.
+	spool, err = newWriteBehindSpool(s.cluster, dir, 1000, time.Millisecond, s.kc, nil)
+	c.Assert(err, IsNil)
+	c.Check(spool.entries, HasLen, 1)
+	c.Check(spool.entries[hash].StorageClasses, DeepEquals, []string{"archival"})
+	c.Check(spool.size, Equals, int64(3))
+	_, err = os.Stat(dir + "/" + incomplete)
+	c.Check(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(dir + "/" + diskCacheTmpPrefix + "123")
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	spool.Start()
+	defer spool.Stop()
+	s.waitForReplication(c, spool)
+	c.Check(string(s.stub.get(hash)), Equals, "foo")
+}
+
+func (s *SpoolSuite) TestPutErrors(c *C) {
+	spool, err := newWriteBehindSpool(s.cluster, c.MkDir(), 5, time.Millisecond, s.kc, nil)
+	c.Assert(err, IsNil)
+
+	_, err = spool.Put(fmt.Sprintf("%x", md5.Sum([]byte("foo"))), bytes.NewReader([]byte("bar")), 3, 1, nil)
+	c.Check(err, Equals, errHashMismatch)
+	_, err = spool.Put("", bytes.NewReader([]byte("fo")), 3, 1, nil)
+	c.Check(err, Equals, errContentLengthMismatch)
+	_, err = spool.Put("", bytes.NewReader([]byte("foobar")), 6, 1, nil)
+	c.Check(err, Equals, errSpoolFull)
+	c.Check(spool.size, Equals, int64(0))
+	c.Check(spool.reserved, Equals, int64(0))
+
+	_, err = spool.Put("", bytes.NewReader([]byte("foo")), 3, 1, nil)
+	c.Check(err, IsNil)
+	_, err = spool.Put("", bytes.NewReader([]byte("bar")), 3, 1, nil)
+	c.Check(err, Equals, errSpoolFull)
+
+	// Uploading a block that is already spooled doesn't use more
+	// space.
+	_, err = spool.Put(fmt.Sprintf("%x", md5.Sum([]byte("foo"))), bytes.NewReader([]byte("foo")), 3, 1, nil)
+	c.Check(err, IsNil)
+	c.Check(spool.size, Equals, int64(3))
+
+	c.Check(s.spoolFiles(c, spool.dir), HasLen, 2)
+}
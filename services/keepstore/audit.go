@@ -0,0 +1,535 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Number of records waiting to be resolved and written.
+	// When the queue is full, new records are dropped.
+	auditQueueSize = 10000
+
+	// Maximum number of records written to the sink at once.
+	auditBatchSize = 100
+
+	// Maximum number of records kept for retrying after the
+	// sink returns an error.
+	auditMaxPending = 10000
+
+	auditFlushInterval = time.Second
+
+	// Maximum time to wait before retrying after the sink returns
+	// an error. The delay starts at auditFlushInterval and doubles
+	// after each consecutive error.
+	auditMaxRetryDelay = time.Minute
+
+	// Timeout for looking up the owner of a token.
+	auditResolveTimeout = 10 * time.Second
+
+	// Maximum number of concurrent token lookups.
+	auditResolveWorkers = 8
+)
+
+// An auditRecord describes one block-level request, as written to
+// the audit log.
+type auditRecord struct {
+	Time         time.Time `json:"time"`
+	Operation    string    `json:"operation"`
+	Locator      string    `json:"locator"`
+	UserUUID     string    `json:"user_uuid"`
+	TokenUUID    string    `json:"token_uuid"`
+	ClientIP     string    `json:"client_ip"`
+	ForwardedFor string    `json:"forwarded_for,omitempty"`
+	Bytes        int64     `json:"bytes"`
+	Status       int       `json:"status"`
+	RequestID    string    `json:"request_id,omitempty"`
+
+	// token is resolved to UserUUID and TokenUUID before the
+	// record is written. resolved is closed when that is done.
+	token    string
+	resolved chan struct{}
+}
+
+// An auditSink writes audit records to a file, syslog, etc.
+type auditSink interface {
+	Write([]*auditRecord) error
+	Close() error
+}
+
+// An auditLogger records block-level requests in the audit log
+// configured in Collections.BlobAuditLog.
+//
+// Records are written asynchronously so a slow or unavailable
+// destination does not slow down requests. Tokens are resolved by a
+// pool of workers (and cached by the tokenCache), so a slow API
+// server does not hold up records that don't need a lookup. If the
+// destination falls too far behind, records are dropped, counted in
+// the audit_dropped_records metric, and reported in the error log.
+type auditLogger struct {
+	logger logrus.FieldLogger
+	tokens *tokenCache
+	sink   auditSink
+
+	queue      chan *auditRecord // waiting to be resolved
+	lookups    chan *auditRecord // waiting for a token lookup
+	ordered    chan *auditRecord // waiting to be written, in order received
+	done       chan struct{}
+	dropped    uint64 // dropped since last logged
+	written    prometheus.Counter
+	droppedCtr prometheus.Counter
+
+	// closeMtx is held by enqueue while sending to queue, so
+	// Close doesn't close queue during a send. After Close,
+	// records are dropped.
+	closeMtx sync.RWMutex
+	closed   bool
+	started  bool
+
+	// After a write error, the next attempt is delayed until
+	// retryAt, and the delay is doubled after each consecutive
+	// error.
+	retryAt    time.Time
+	retryDelay time.Duration
+}
+
+// newAuditLogger returns a new auditLogger for the configured
+// destination, or nil if audit logging is disabled. Records are not
+// written until Start is called.
+func newAuditLogger(cluster *arvados.Cluster, logger logrus.FieldLogger, reg *prometheus.Registry) (*auditLogger, error) {
+	cfg := cluster.Collections.BlobAuditLog
+	if cfg.Destination == "" {
+		return nil, nil
+	}
+	sink, err := newAuditSink(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Collections.BlobAuditLog: %s", err)
+	}
+	al := &auditLogger{
+		logger:  logger,
+		sink:    sink,
+		queue:   make(chan *auditRecord, auditQueueSize),
+		lookups: make(chan *auditRecord),
+		ordered: make(chan *auditRecord, auditQueueSize),
+		done:    make(chan struct{}),
+	}
+	al.written = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "keepstore",
+		Name:      "audit_records",
+		Help:      "Number of audit log records written",
+	})
+	al.droppedCtr = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "keepstore",
+		Name:      "audit_dropped_records",
+		Help:      "Number of audit log records dropped because the destination was unavailable or too slow",
+	})
+	if reg != nil {
+		reg.MustRegister(al.written)
+		reg.MustRegister(al.droppedCtr)
+	}
+	return al, nil
+}
+
+// Start writing records, using the given tokenCache to look up the
+// owners of tokens. If al is nil, Start does nothing.
+func (al *auditLogger) Start(tokens *tokenCache) {
+	if al == nil {
+		return
+	}
+	al.closeMtx.Lock()
+	defer al.closeMtx.Unlock()
+	if al.closed {
+		return
+	}
+	al.started = true
+	al.tokens = tokens
+	for i := 0; i < auditResolveWorkers; i++ {
+		go al.runResolver()
+	}
+	go al.dispatch()
+	go al.run()
+}
+
+func newAuditSink(cfg arvados.BlobAuditLogConfig) (auditSink, error) {
+	dest := cfg.Destination
+	switch {
+	case strings.HasPrefix(dest, "/"):
+		return newAuditFileSink(dest, int64(cfg.MaxFileSize), cfg.MaxFiles)
+	case dest == "syslog:":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "keepstore-audit")
+		if err != nil {
+			return nil, err
+		}
+		return &auditSyslogSink{w: w}, nil
+	case strings.HasPrefix(dest, "syslog://"):
+		u, err := url.Parse(dest)
+		if err != nil {
+			return nil, err
+		}
+		w, err := syslog.Dial("udp", u.Host, syslog.LOG_INFO|syslog.LOG_DAEMON, "keepstore-audit")
+		if err != nil {
+			return nil, err
+		}
+		return &auditSyslogSink{w: w}, nil
+	case strings.HasPrefix(dest, "http://"), strings.HasPrefix(dest, "https://"):
+		if _, err := url.Parse(dest); err != nil {
+			return nil, err
+		}
+		return &auditHTTPSink{url: dest, client: &http.Client{Timeout: time.Minute}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported destination %q", dest)
+	}
+}
+
+// Wrap returns a handler that calls h and adds a record to the audit
+// log. If al is nil, Wrap returns h.
+func (al *auditLogger) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	if al == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		rec := &auditRecord{
+			Time:         time.Now(),
+			Operation:    req.Method,
+			Locator:      auditLocator(req.URL.Path[1:]),
+			ForwardedFor: req.Header.Get("X-Forwarded-For"),
+			RequestID:    req.Header.Get("X-Request-Id"),
+			token:        GetAPIToken(req),
+		}
+		rec.ClientIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+		if rec.ClientIP == "" {
+			rec.ClientIP = req.RemoteAddr
+		}
+		body := &countingReadCloser{ReadCloser: req.Body}
+		if req.Body != nil {
+			req.Body = body
+		}
+		wrapped := httpserver.WrapResponseWriter(w)
+		defer func() {
+			rec.Status = wrapped.WroteStatus()
+			if rec.Status == 0 {
+				rec.Status = http.StatusOK
+			}
+			if req.Method == "PUT" {
+				rec.Bytes = body.n
+			} else {
+				rec.Bytes = int64(wrapped.WroteBodyBytes())
+			}
+			al.enqueue(rec)
+		}()
+		h(wrapped, req)
+	}
+}
+
+// auditLocator returns the given locator without its permission
+// signature, which could otherwise be used by anyone who can read
+// the audit log.
+func auditLocator(loc string) string {
+	parts := strings.Split(loc, "+")
+	keep := parts[:1]
+	for _, part := range parts[1:] {
+		if !strings.HasPrefix(part, "A") {
+			keep = append(keep, part)
+		}
+	}
+	return strings.Join(keep, "+")
+}
+
+func (al *auditLogger) enqueue(rec *auditRecord) {
+	al.closeMtx.RLock()
+	defer al.closeMtx.RUnlock()
+	if !al.closed {
+		select {
+		case al.queue <- rec:
+			return
+		default:
+		}
+	}
+	atomic.AddUint64(&al.dropped, 1)
+	al.droppedCtr.Inc()
+}
+
+// Close writes any queued records and closes the destination.
+// Records of requests that finish after Close is called are dropped.
+func (al *auditLogger) Close() error {
+	if al == nil {
+		return nil
+	}
+	al.closeMtx.Lock()
+	if al.closed {
+		al.closeMtx.Unlock()
+		return nil
+	}
+	al.closed = true
+	close(al.queue)
+	al.closeMtx.Unlock()
+	if al.started {
+		<-al.done
+	}
+	return al.sink.Close()
+}
+
+// dispatch passes queued records to the writer in the order they
+// were received, and hands off those with tokens to the resolver
+// workers.
+func (al *auditLogger) dispatch() {
+	defer close(al.ordered)
+	defer close(al.lookups)
+	for rec := range al.queue {
+		rec.resolved = make(chan struct{})
+		if rec.token == "" {
+			close(rec.resolved)
+		} else {
+			al.lookups <- rec
+		}
+		al.ordered <- rec
+	}
+}
+
+func (al *auditLogger) runResolver() {
+	for rec := range al.lookups {
+		al.resolve(rec)
+		close(rec.resolved)
+	}
+}
+
+// run writes resolved records to the sink.
+func (al *auditLogger) run() {
+	defer close(al.done)
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+	var batch []*auditRecord
+	for {
+		select {
+		case rec, ok := <-al.ordered:
+			if !ok {
+				al.retryAt = time.Time{}
+				al.flush(batch)
+				return
+			}
+			<-rec.resolved
+			batch = append(batch, rec)
+			if len(batch) < auditBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		batch = al.flush(batch)
+	}
+}
+
+// resolve fills in the user and token UUIDs for the given record.
+func (al *auditLogger) resolve(rec *auditRecord) {
+	ctx, cancel := context.WithTimeout(context.Background(), auditResolveTimeout)
+	defer cancel()
+	ti := al.tokens.Get(ctx, rec.token)
+	rec.UserUUID, rec.TokenUUID = ti.UserUUID, ti.TokenUUID
+	rec.token = ""
+}
+
+// flush writes the given records to the sink, and returns the
+// records that still need to be written. After a write error, flush
+// does nothing until the retry delay has passed.
+func (al *auditLogger) flush(batch []*auditRecord) []*auditRecord {
+	if n := atomic.SwapUint64(&al.dropped, 0); n > 0 {
+		al.logger.Errorf("audit log: dropped %d records because destination was unavailable or too slow", n)
+	}
+	if len(batch) == 0 || time.Now().Before(al.retryAt) {
+		return al.trim(batch)
+	}
+	err := al.sink.Write(batch)
+	if err == nil {
+		al.written.Add(float64(len(batch)))
+		al.retryAt, al.retryDelay = time.Time{}, 0
+		return batch[:0]
+	}
+	if al.retryDelay == 0 {
+		al.retryDelay = auditFlushInterval
+	} else if al.retryDelay *= 2; al.retryDelay > auditMaxRetryDelay {
+		al.retryDelay = auditMaxRetryDelay
+	}
+	al.retryAt = time.Now().Add(al.retryDelay)
+	al.logger.WithError(err).Errorf("audit log: error writing %d records, will retry in %v", len(batch), al.retryDelay)
+	return al.trim(batch)
+}
+
+// trim drops the oldest records from batch, if needed, to keep it
+// within auditMaxPending.
+func (al *auditLogger) trim(batch []*auditRecord) []*auditRecord {
+	if over := len(batch) - auditMaxPending; over > 0 {
+		atomic.AddUint64(&al.dropped, uint64(over))
+		al.droppedCtr.Add(float64(over))
+		batch = append(batch[:0], batch[over:]...)
+	}
+	return batch
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// auditFileSink writes records to a local file, one JSON object per
+// line, rotating the file when it reaches maxSize.
+type auditFileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func newAuditFileSink(path string, maxSize int64, maxFiles int) (*auditFileSink, error) {
+	s := &auditFileSink{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	return s, s.open()
+}
+
+func (s *auditFileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, fi.Size()
+	return nil
+}
+
+func (s *auditFileSink) Write(recs []*auditRecord) error {
+	if s.f == nil {
+		// A previous rotation failed.
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(buf.Len()) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(buf.Bytes())
+	s.size += int64(n)
+	return err
+}
+
+// rotate renames the current file to path.1 (renaming path.1 to
+// path.2, etc., and deleting the oldest) and opens a new file.
+func (s *auditFileSink) rotate() error {
+	err := s.f.Close()
+	s.f = nil
+	if err != nil {
+		return err
+	}
+	if s.maxFiles < 1 {
+		err = os.Remove(s.path)
+	} else {
+		for i := s.maxFiles - 1; i > 0; i-- {
+			err = os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		err = os.Rename(s.path, s.path+".1")
+	}
+	if err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *auditFileSink) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// auditSyslogSink sends each record to syslog as a JSON object.
+type auditSyslogSink struct {
+	w *syslog.Writer
+}
+
+func (s *auditSyslogSink) Write(recs []*auditRecord) error {
+	for _, rec := range recs {
+		buf, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if err := s.w.Info(string(buf)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *auditSyslogSink) Close() error {
+	return s.w.Close()
+}
+
+// auditHTTPSink sends batches of records as a JSON array in a POST
+// request.
+type auditHTTPSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *auditHTTPSink) Write(recs []*auditRecord) error {
+	buf, err := json.Marshal(recs)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *auditHTTPSink) Close() error {
+	return nil
+}
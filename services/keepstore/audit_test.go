@@ -0,0 +1,351 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&AuditSuite{})
+
+type AuditSuite struct {
+	cluster *arvados.Cluster
+	tmpdir  string
+}
+
+func (s *AuditSuite) SetUpTest(c *check.C) {
+	var err error
+	s.tmpdir, err = ioutil.TempDir("", "audit_test")
+	c.Assert(err, check.IsNil)
+	s.cluster = testCluster(c)
+	s.cluster.SystemRootToken = "systemroottoken"
+	s.cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Replication: 1, Driver: "mock"},
+	}
+}
+
+func (s *AuditSuite) TearDownTest(c *check.C) {
+	os.RemoveAll(s.tmpdir)
+}
+
+// newRouter returns a router that writes to an audit log at the
+// configured destination, and looks up tokens using a stub.
+func (s *AuditSuite) newRouter(c *check.C) (http.Handler, *auditLogger) {
+	reg := prometheus.NewRegistry()
+	audit, err := newAuditLogger(s.cluster, ctxlog.TestLogger(c), reg)
+	c.Assert(err, check.IsNil)
+	c.Assert(audit, check.NotNil)
+	volmgr, err := makeRRVolumeManager(ctxlog.TestLogger(c), s.cluster, testServiceURL, newVolumeMetricsVecs(reg))
+	c.Assert(err, check.IsNil)
+	rtr := MakeRESTRouter(context.Background(), s.cluster, reg, volmgr, NewWorkQueue(), NewWorkQueue(), nil, audit)
+	audit.tokens.lookup = func(ctx context.Context, token string) (*arvados.APIClientAuthorization, error) {
+		if token == knownToken {
+			return &arvados.APIClientAuthorization{UUID: "zzzzz-gj3su-000000000000000", OwnerUUID: "zzzzz-tpzed-000000000000000"}, nil
+		}
+		return nil, errors.New("401 Unauthorized")
+	}
+	return rtr, audit
+}
+
+func (s *AuditSuite) readRecords(c *check.C, path string) []auditRecord {
+	f, err := os.Open(path)
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	var recs []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec auditRecord
+		c.Assert(json.Unmarshal(scanner.Bytes(), &rec), check.IsNil)
+		recs = append(recs, rec)
+	}
+	c.Assert(scanner.Err(), check.IsNil)
+	return recs
+}
+
+func (s *AuditSuite) TestFile(c *check.C) {
+	path := filepath.Join(s.tmpdir, "audit.log")
+	s.cluster.Collections.BlobAuditLog.Destination = path
+	s.cluster.Collections.BlobSigning = true
+	s.cluster.Collections.BlobSigningKey = knownKey
+	rtr, audit := s.newRouter(c)
+
+	resp := IssueRequest(rtr, &RequestTester{
+		method:      "PUT",
+		uri:         "/" + TestHash,
+		apiToken:    knownToken,
+		requestBody: TestBlock,
+	})
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	signed := strings.TrimSpace(resp.Body.String())
+	c.Assert(signed, check.Matches, `.*\+A.*`)
+
+	resp = IssueRequest(rtr, &RequestTester{
+		method:   "GET",
+		uri:      "/" + signed,
+		apiToken: knownToken,
+	})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	resp = IssueRequest(rtr, &RequestTester{
+		method:   "GET",
+		uri:      "/" + TestHash2,
+		apiToken: "v2/zzzzz-gj3su-111111111111111/bogus",
+	})
+	c.Check(resp.Code, check.Equals, http.StatusForbidden)
+	resp = IssueRequest(rtr, &RequestTester{
+		method:   "TOUCH",
+		uri:      "/" + TestHash,
+		apiToken: s.cluster.SystemRootToken,
+	})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	resp = IssueRequest(rtr, &RequestTester{
+		method:   "DELETE",
+		uri:      "/" + TestHash,
+		apiToken: knownToken,
+	})
+	c.Check(resp.Code, check.Equals, http.StatusForbidden)
+
+	// Other requests are not logged.
+	IssueRequest(rtr, &RequestTester{method: "GET", uri: "/status.json"})
+
+	c.Assert(audit.Close(), check.IsNil)
+	recs := s.readRecords(c, path)
+	c.Assert(recs, check.HasLen, 5)
+	for i, trial := range []struct {
+		op        string
+		locator   string
+		userUUID  string
+		tokenUUID string
+		bytes     int64
+		status    int
+	}{
+		{"PUT", TestHash, "zzzzz-tpzed-000000000000000", "zzzzz-gj3su-000000000000000", int64(len(TestBlock)), 200},
+		{"GET", TestHash + fmt.Sprintf("+%d", len(TestBlock)), "zzzzz-tpzed-000000000000000", "zzzzz-gj3su-000000000000000", int64(len(TestBlock)), 200},
+		{"GET", TestHash2, "", "zzzzz-gj3su-111111111111111", int64(len("Forbidden\n")), 403},
+		{"TOUCH", TestHash, "", "", 0, 200},
+		{"DELETE", TestHash, "zzzzz-tpzed-000000000000000", "zzzzz-gj3su-000000000000000", int64(len("Forbidden\n")), 403},
+	} {
+		c.Logf("trial %d: %+v", i, recs[i])
+		c.Check(recs[i].Operation, check.Equals, trial.op)
+		c.Check(recs[i].Locator, check.Equals, trial.locator)
+		c.Check(recs[i].UserUUID, check.Equals, trial.userUUID)
+		c.Check(recs[i].TokenUUID, check.Equals, trial.tokenUUID)
+		c.Check(recs[i].Bytes, check.Equals, trial.bytes)
+		c.Check(recs[i].Status, check.Equals, trial.status)
+		c.Check(recs[i].ClientIP, check.Equals, "")
+		c.Check(time.Since(recs[i].Time) < time.Minute, check.Equals, true)
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Check(strings.Contains(string(buf), knownToken), check.Equals, false)
+	c.Check(strings.Contains(string(buf), "+A"), check.Equals, false)
+}
+
+func (s *AuditSuite) TestFileRotation(c *check.C) {
+	path := filepath.Join(s.tmpdir, "audit.log")
+	sink, err := newAuditFileSink(path, 1000, 2)
+	c.Assert(err, check.IsNil)
+	rec := &auditRecord{Operation: "GET", Locator: TestHash, Status: 200}
+	for i := 0; i < 40; i++ {
+		c.Assert(sink.Write([]*auditRecord{rec}), check.IsNil)
+	}
+	c.Assert(sink.Close(), check.IsNil)
+	for _, fnm := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(fnm)
+		c.Assert(err, check.IsNil)
+		c.Check(fi.Size() <= 1000, check.Equals, true)
+		c.Check(fi.Size() > 0, check.Equals, true)
+	}
+	_, err = os.Stat(path + ".3")
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *AuditSuite) TestHTTP(c *check.C) {
+	var mtx sync.Mutex
+	var recs []auditRecord
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if fail {
+			// Fail the first attempt; the logger
+			// should retry.
+			fail = false
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var batch []auditRecord
+		c.Check(json.NewDecoder(req.Body).Decode(&batch), check.IsNil)
+		recs = append(recs, batch...)
+	}))
+	defer srv.Close()
+	s.cluster.Collections.BlobAuditLog.Destination = srv.URL + "/audit"
+	rtr, audit := s.newRouter(c)
+
+	for i := 0; i < 3; i++ {
+		IssueRequest(rtr, &RequestTester{
+			method:      "PUT",
+			uri:         "/" + TestHash,
+			apiToken:    knownToken,
+			requestBody: TestBlock,
+		})
+		time.Sleep(auditFlushInterval * 3 / 4)
+	}
+	c.Assert(audit.Close(), check.IsNil)
+	mtx.Lock()
+	defer mtx.Unlock()
+	c.Check(fail, check.Equals, false)
+	c.Assert(recs, check.HasLen, 3)
+	for _, rec := range recs {
+		c.Check(rec.Operation, check.Equals, "PUT")
+		c.Check(rec.UserUUID, check.Equals, "zzzzz-tpzed-000000000000000")
+	}
+}
+
+func (s *AuditSuite) TestBadDestination(c *check.C) {
+	for _, dest := range []string{"relative/path", "ftp://example.com/", filepath.Join(s.tmpdir, "nonexistent", "audit.log")} {
+		s.cluster.Collections.BlobAuditLog.Destination = dest
+		_, err := newAuditLogger(s.cluster, ctxlog.TestLogger(c), nil)
+		c.Check(err, check.ErrorMatches, `Collections.BlobAuditLog: .*`)
+	}
+	s.cluster.Collections.BlobAuditLog.Destination = ""
+	audit, err := newAuditLogger(s.cluster, ctxlog.TestLogger(c), nil)
+	c.Check(err, check.IsNil)
+	c.Check(audit, check.IsNil)
+}
+
+// stubAuditSink counts calls to Write, and fails them while fail is
+// true.
+type stubAuditSink struct {
+	mtx    sync.Mutex
+	fail   bool
+	writes int
+	recs   []*auditRecord
+}
+
+func (s *stubAuditSink) Write(recs []*auditRecord) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.writes++
+	if s.fail {
+		return errors.New("stub error")
+	}
+	s.recs = append(s.recs, recs...)
+	return nil
+}
+
+func (s *stubAuditSink) Close() error {
+	return nil
+}
+
+// newStubLogger returns an auditLogger that writes to a stub sink
+// and looks up tokens using the given function.
+func (s *AuditSuite) newStubLogger(c *check.C, lookup func(context.Context, string) (*arvados.APIClientAuthorization, error)) (*auditLogger, *stubAuditSink) {
+	s.cluster.Collections.BlobAuditLog.Destination = filepath.Join(s.tmpdir, "audit.log")
+	reg := prometheus.NewRegistry()
+	audit, err := newAuditLogger(s.cluster, ctxlog.TestLogger(c), reg)
+	c.Assert(err, check.IsNil)
+	sink := &stubAuditSink{}
+	audit.sink = sink
+	tokens := newTokenCache(s.cluster, ctxlog.TestLogger(c))
+	tokens.lookup = lookup
+	audit.Start(tokens)
+	return audit, sink
+}
+
+func (s *AuditSuite) TestConcurrentLookups(c *check.C) {
+	var mtx sync.Mutex
+	lookups := map[string]int{}
+	audit, sink := s.newStubLogger(c, func(ctx context.Context, token string) (*arvados.APIClientAuthorization, error) {
+		mtx.Lock()
+		lookups[token]++
+		mtx.Unlock()
+		time.Sleep(time.Second / 4)
+		return &arvados.APIClientAuthorization{UUID: "zzzzz-gj3su-" + token, OwnerUUID: "zzzzz-tpzed-" + token}, nil
+	})
+
+	// Each distinct token takes 1/4 second to look up, so
+	// looking them up one at a time would take 4 seconds.
+	t0 := time.Now()
+	for i := 0; i < 64; i++ {
+		audit.enqueue(&auditRecord{Locator: fmt.Sprintf("%d", i), token: fmt.Sprintf("%015d", i%16)})
+	}
+	c.Assert(audit.Close(), check.IsNil)
+	c.Check(time.Since(t0) < 2*time.Second, check.Equals, true)
+
+	c.Assert(sink.recs, check.HasLen, 64)
+	for i, rec := range sink.recs {
+		c.Check(rec.Locator, check.Equals, fmt.Sprintf("%d", i))
+		c.Check(rec.UserUUID, check.Equals, fmt.Sprintf("zzzzz-tpzed-%015d", i%16))
+	}
+	// Each token is looked up once, even though records with the
+	// same token were resolved concurrently.
+	c.Check(lookups, check.HasLen, 16)
+	for token, n := range lookups {
+		c.Check(n, check.Equals, 1, check.Commentf("token %s", token))
+	}
+}
+
+func (s *AuditSuite) TestRetryDelay(c *check.C) {
+	audit, sink := s.newStubLogger(c, nil)
+	sink.fail = true
+	for i := 0; i < auditBatchSize*5; i++ {
+		audit.enqueue(&auditRecord{Locator: fmt.Sprintf("%d", i)})
+		if i%auditBatchSize == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	time.Sleep(auditFlushInterval / 2)
+	// The first failed write delays the next attempt, even
+	// though more than a full batch is waiting.
+	sink.mtx.Lock()
+	c.Check(sink.writes, check.Equals, 1)
+	sink.fail = false
+	sink.mtx.Unlock()
+
+	c.Assert(audit.Close(), check.IsNil)
+	c.Check(sink.writes, check.Equals, 2)
+	c.Check(sink.recs, check.HasLen, auditBatchSize*5)
+	c.Check(testutil.ToFloat64(audit.written), check.Equals, float64(auditBatchSize*5))
+}
+
+func (s *AuditSuite) TestDropped(c *check.C) {
+	audit, sink := s.newStubLogger(c, nil)
+	sink.fail = true
+	for i := 0; i < auditQueueSize*2+auditMaxPending*2; i++ {
+		audit.enqueue(&auditRecord{Locator: fmt.Sprintf("%d", i)})
+	}
+	c.Assert(audit.Close(), check.IsNil)
+	c.Check(testutil.ToFloat64(audit.droppedCtr) > 0, check.Equals, true)
+}
+
+func (s *AuditSuite) TestEnqueueAfterClose(c *check.C) {
+	audit, sink := s.newStubLogger(c, nil)
+	audit.enqueue(&auditRecord{Locator: "before"})
+	c.Assert(audit.Close(), check.IsNil)
+	c.Check(sink.recs, check.HasLen, 1)
+	// A request that finishes during shutdown doesn't panic.
+	audit.enqueue(&auditRecord{Locator: "after"})
+	c.Check(testutil.ToFloat64(audit.droppedCtr), check.Equals, float64(1))
+	c.Check(audit.Close(), check.IsNil)
+}
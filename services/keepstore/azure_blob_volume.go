@@ -196,6 +196,31 @@ func (v *AzureBlobVolume) Get(ctx context.Context, loc string, buf []byte) (int,
 	return size, err
 }
 
+// ReadPrefix implements prefixReader. It requests only the first n
+// bytes of the block.
+func (v *AzureBlobVolume) ReadPrefix(ctx context.Context, loc string, n int) ([]byte, error) {
+	trashed, _, err := v.checkTrashed(loc)
+	if err != nil {
+		return nil, err
+	}
+	if trashed {
+		return nil, os.ErrNotExist
+	}
+	if n <= 0 {
+		return []byte{}, nil
+	}
+	rdr, err := v.container.GetBlobRange(loc, 0, n-1, nil)
+	if err, ok := err.(storage.AzureStorageServiceError); ok && err.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// The block is empty.
+		return []byte{}, nil
+	}
+	if err != nil {
+		return nil, v.translateError(err)
+	}
+	buf, err := readPrefixFrom(rdr, n)
+	return buf, v.translateError(err)
+}
+
 func (v *AzureBlobVolume) get(ctx context.Context, loc string, buf []byte) (int, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -214,8 +239,8 @@ func (v *AzureBlobVolume) get(ctx context.Context, loc string, buf []byte) (int,
 		if err != nil {
 			return 0, v.translateError(err)
 		}
-		if props.ContentLength > int64(BlockSize) || props.ContentLength < 0 {
-			return 0, fmt.Errorf("block %s invalid size %d (max %d)", loc, props.ContentLength, BlockSize)
+		if props.ContentLength > int64(maxStoredBlockSize) || props.ContentLength < 0 {
+			return 0, fmt.Errorf("block %s invalid size %d (max %d)", loc, props.ContentLength, maxStoredBlockSize)
 		}
 		expectSize = int(props.ContentLength)
 		pieces = (expectSize + pieceSize - 1) / pieceSize
@@ -538,6 +563,8 @@ func (v *AzureBlobVolume) Status() *VolumeStatus {
 		DeviceNum: 1,
 		BytesFree: BlockSize * 1000,
 		BytesUsed: 1,
+
+		freeUnknown: true,
 	}
 }
 
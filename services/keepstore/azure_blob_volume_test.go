@@ -258,6 +258,11 @@ func (h *azStubHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		if rangeSpec := rangeRegexp.FindStringSubmatch(r.Header.Get("Range")); rangeSpec != nil {
 			b0, err0 := strconv.Atoi(rangeSpec[1])
 			b1, err1 := strconv.Atoi(rangeSpec[2])
+			if b1 >= len(data) && b0 < len(data) {
+				// Like Azure, return the available
+				// part of the requested range.
+				b1 = len(data) - 1
+			}
 			if err0 != nil || err1 != nil || b0 >= len(data) || b1 >= len(data) || b0 > b1 {
 				rw.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
 				rw.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
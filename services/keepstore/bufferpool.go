@@ -12,45 +12,159 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// bufferPoolMinSize is the size of the smallest buffers handed out
+// by a bufferPool. Larger requests get the smallest power-of-two
+// multiple of bufferPoolMinSize that fits (or the pool's maximum
+// buffer size).
+const bufferPoolMinSize = 1 << 16
+
+// A bufferPool hands out buffers of various sizes, limiting the
+// total size of the buffers in use to count*bufSize bytes. A caller
+// that needs a small buffer only uses as much of the limit as it
+// needs.
+//
+// Callers that have to wait are served in the order they arrive, and
+// no new callers are admitted while anyone is waiting, so a stream
+// of small requests can't starve a large one.
 type bufferPool struct {
 	log logrus.FieldLogger
-	// limiter has a "true" placeholder for each in-use buffer.
-	limiter chan bool
-	// allocated is the number of bytes currently allocated to buffers.
+	// count is the number of full-size buffers that fit within
+	// the limit.
+	count int
+	// maxBytes is the limit on the total size of buffers in use.
+	maxBytes int
+	// allocated is the cumulative number of bytes allocated to
+	// buffers.
 	allocated uint64
-	// Pool has unused buffers.
-	sync.Pool
+
+	// sizes and pools hold the buffer size classes, in
+	// increasing order, and the unused buffers of each size.
+	sizes []int
+	pools []sync.Pool
+
+	inuse      int // buffers in use
+	inuseBytes int // total size of buffers in use
+	// Waiting callers take numbered tickets, and are served
+	// in ticket order.
+	nextTicket uint64
+	serving    uint64
+	cond       *sync.Cond
+	mtx        sync.Mutex
 }
 
 func newBufferPool(log logrus.FieldLogger, count int, bufSize int) *bufferPool {
-	p := bufferPool{log: log}
-	p.Pool.New = func() interface{} {
-		atomic.AddUint64(&p.allocated, uint64(bufSize))
-		return make([]byte, bufSize)
+	p := &bufferPool{
+		log:      log,
+		count:    count,
+		maxBytes: count * bufSize,
+	}
+	p.cond = sync.NewCond(&p.mtx)
+	for size := bufferPoolMinSize; size < bufSize; size *= 2 {
+		p.sizes = append(p.sizes, size)
+	}
+	p.sizes = append(p.sizes, bufSize)
+	p.pools = make([]sync.Pool, len(p.sizes))
+	for i, size := range p.sizes {
+		size := size
+		p.pools[i].New = func() interface{} {
+			atomic.AddUint64(&p.allocated, uint64(size))
+			return make([]byte, size)
+		}
 	}
-	p.limiter = make(chan bool, count)
-	return &p
+	return p
 }
 
+// sizeClass returns the index of the smallest size class that can
+// hold size bytes, or -1 if size is too big.
+func (p *bufferPool) sizeClass(size int) int {
+	for i, s := range p.sizes {
+		if size <= s {
+			return i
+		}
+	}
+	return -1
+}
+
+// Get returns a buffer with len(buf)==size, waiting if necessary
+// until enough buffers are returned to the pool to stay within the
+// limit, and all callers that started waiting earlier have been
+// served.
 func (p *bufferPool) Get(size int) []byte {
-	select {
-	case p.limiter <- true:
-	default:
+	class := p.sizeClass(size)
+	if class < 0 {
+		p.log.Fatalf("bufferPool Get(size=%d) but max=%d", size, p.sizes[len(p.sizes)-1])
+	}
+	need := p.sizes[class]
+	p.mtx.Lock()
+	if p.nextTicket != p.serving || p.inuseBytes+need > p.maxBytes {
 		t0 := time.Now()
-		p.log.Printf("reached max buffers (%d), waiting", cap(p.limiter))
-		p.limiter <- true
+		p.log.Printf("reached max buffers (%d), waiting", p.count)
+		ticket := p.nextTicket
+		p.nextTicket++
+		for ticket != p.serving || p.inuseBytes+need > p.maxBytes {
+			p.cond.Wait()
+		}
+		p.serving++
+		// The next caller in line might fit, too.
+		p.cond.Broadcast()
 		p.log.Printf("waited %v for a buffer", time.Since(t0))
 	}
-	buf := p.Pool.Get().([]byte)
-	if cap(buf) < size {
-		p.log.Fatalf("bufferPool Get(size=%d) but max=%d", size, cap(buf))
+	p.inuse++
+	p.inuseBytes += need
+	p.mtx.Unlock()
+	buf := p.pools[class].Get().([]byte)
+	return buf[:size]
+}
+
+// TryGet is like Get, but returns nil instead of waiting if the
+// buffer would exceed the limit, or other callers are waiting.
+func (p *bufferPool) TryGet(size int) []byte {
+	class := p.sizeClass(size)
+	if class < 0 {
+		return nil
+	}
+	need := p.sizes[class]
+	p.mtx.Lock()
+	if p.nextTicket != p.serving || p.inuseBytes+need > p.maxBytes {
+		p.mtx.Unlock()
+		return nil
+	}
+	p.inuse++
+	p.inuseBytes += need
+	p.mtx.Unlock()
+	buf := p.pools[class].Get().([]byte)
+	return buf[:size]
+}
+
+// GetNow is like Get, but never waits: the buffer is counted toward
+// the limit, but is returned right away even if that exceeds the
+// limit. It is meant for callers that already hold a buffer from
+// the pool, so waiting could deadlock (see getScratch).
+func (p *bufferPool) GetNow(size int) []byte {
+	class := p.sizeClass(size)
+	if class < 0 {
+		p.log.Fatalf("bufferPool GetNow(size=%d) but max=%d", size, p.sizes[len(p.sizes)-1])
 	}
+	p.mtx.Lock()
+	p.inuse++
+	p.inuseBytes += p.sizes[class]
+	p.mtx.Unlock()
+	buf := p.pools[class].Get().([]byte)
 	return buf[:size]
 }
 
+// Put returns a buffer obtained from Get to the pool.
 func (p *bufferPool) Put(buf []byte) {
-	p.Pool.Put(buf)
-	<-p.limiter
+	class := p.sizeClass(cap(buf))
+	if class < 0 || p.sizes[class] != cap(buf) {
+		p.log.Fatalf("bufferPool Put(cap=%d) does not match any buffer size", cap(buf))
+	}
+	p.pools[class].Put(buf[:cap(buf)])
+	p.mtx.Lock()
+	p.inuse--
+	p.inuseBytes -= cap(buf)
+	p.mtx.Unlock()
+	p.cond.Broadcast()
 }
 
 // Alloc returns the number of bytes allocated to buffers.
@@ -58,12 +172,21 @@ func (p *bufferPool) Alloc() uint64 {
 	return atomic.LoadUint64(&p.allocated)
 }
 
-// Cap returns the maximum number of buffers allowed.
+// Cap returns the maximum number of full-size buffers allowed.
 func (p *bufferPool) Cap() int {
-	return cap(p.limiter)
+	return p.count
 }
 
 // Len returns the number of buffers in use right now.
 func (p *bufferPool) Len() int {
-	return len(p.limiter)
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.inuse
+}
+
+// BytesInUse returns the total size of the buffers in use right now.
+func (p *bufferPool) BytesInUse() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.inuseBytes
 }
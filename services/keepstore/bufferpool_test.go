@@ -19,12 +19,12 @@ type BufferPoolSuite struct{}
 // Initialize a default-sized buffer pool for the benefit of test
 // suites that don't run main().
 func init() {
-	bufs = newBufferPool(ctxlog.FromContext(context.Background()), 12, BlockSize)
+	bufs = newBufferPool(ctxlog.FromContext(context.Background()), 12, maxStoredBlockSize)
 }
 
 // Restore sane default after bufferpool's own tests
 func (s *BufferPoolSuite) TearDownTest(c *C) {
-	bufs = newBufferPool(ctxlog.FromContext(context.Background()), 12, BlockSize)
+	bufs = newBufferPool(ctxlog.FromContext(context.Background()), 12, maxStoredBlockSize)
 }
 
 func (s *BufferPoolSuite) TestBufferPoolBufSize(c *C) {
@@ -91,3 +91,64 @@ func (s *BufferPoolSuite) TestBufferPoolReuse(c *C) {
 	}
 	c.Check(reuses > allocs*95/100, Equals, true)
 }
+
+func (s *BufferPoolSuite) TestBufferPoolSizeClasses(c *C) {
+	bufs := newBufferPool(ctxlog.TestLogger(c), 2, BlockSize)
+	c.Check(cap(bufs.Get(0)), Equals, bufferPoolMinSize)
+	c.Check(cap(bufs.Get(bufferPoolMinSize+1)), Equals, bufferPoolMinSize*2)
+	c.Check(bufs.Len(), Equals, 2)
+	c.Check(bufs.BytesInUse(), Equals, bufferPoolMinSize*3)
+
+	// Small buffers don't count as full-size buffers: there is
+	// still room for one full-size buffer, plus more small ones.
+	big := bufs.Get(BlockSize)
+	c.Check(len(big), Equals, BlockSize)
+	small := bufs.Get(1)
+	c.Check(cap(small), Equals, bufferPoolMinSize)
+	bufs.Put(small)
+	bufs.Put(big)
+	c.Check(bufs.BytesInUse(), Equals, bufferPoolMinSize*3)
+}
+
+func (s *BufferPoolSuite) TestBufferPoolGetNow(c *C) {
+	bufs := newBufferPool(ctxlog.TestLogger(c), 1, 10)
+	b1 := bufs.Get(10)
+	// GetNow doesn't wait, but the buffer still counts toward
+	// the limit.
+	b2 := bufs.GetNow(5)
+	c.Check(len(b2), Equals, 5)
+	c.Check(bufs.Len(), Equals, 2)
+	c.Check(bufs.TryGet(1), IsNil)
+	bufs.Put(b1)
+	c.Check(bufs.TryGet(1), IsNil)
+	bufs.Put(b2)
+	c.Check(bufs.BytesInUse(), Equals, 0)
+}
+
+func (s *BufferPoolSuite) TestBufferPoolFIFO(c *C) {
+	bufs := newBufferPool(ctxlog.TestLogger(c), 2, bufferPoolMinSize*4)
+	big := bufs.Get(bufferPoolMinSize * 4)
+	bufs.Get(bufferPoolMinSize)
+
+	got := make(chan string, 2)
+	go func() {
+		bufs.Get(bufferPoolMinSize * 4)
+		got <- "big"
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// A small buffer would fit within the limit, but the large
+	// request is waiting, so the small one has to wait its turn.
+	c.Check(bufs.TryGet(1), IsNil)
+	go func() {
+		bufs.Get(bufferPoolMinSize)
+		got <- "small"
+	}()
+	select {
+	case who := <-got:
+		c.Fatalf("%s request did not wait", who)
+	case <-time.After(10 * time.Millisecond):
+	}
+	bufs.Put(big)
+	c.Check(<-got, Equals, "big")
+	c.Check(<-got, Equals, "small")
+}
@@ -122,6 +122,7 @@ type handler struct {
 	pullq      *WorkQueue
 	trashq     *WorkQueue
 	volmgr     *RRVolumeManager
+	scrubber   *scrubber
 	keepClient *keepclient.KeepClient
 
 	err       error
@@ -155,7 +156,7 @@ func (h *handler) setup(ctx context.Context, cluster *arvados.Cluster, token str
 	if h.Cluster.API.MaxKeepBlobBuffers <= 0 {
 		return fmt.Errorf("API.MaxKeepBlobBuffers must be greater than zero")
 	}
-	bufs = newBufferPool(h.Logger, h.Cluster.API.MaxKeepBlobBuffers, BlockSize)
+	bufs = newBufferPool(h.Logger, h.Cluster.API.MaxKeepBlobBuffers, maxStoredBlockSize)
 
 	if h.Cluster.API.MaxConcurrentRequests > 0 && h.Cluster.API.MaxConcurrentRequests < h.Cluster.API.MaxKeepBlobBuffers {
 		h.Logger.Warnf("Possible configuration mistake: not useful to set API.MaxKeepBlobBuffers (%d) higher than API.MaxConcurrentRequests (%d)", h.Cluster.API.MaxKeepBlobBuffers, h.Cluster.API.MaxConcurrentRequests)
@@ -174,6 +175,12 @@ func (h *handler) setup(ctx context.Context, cluster *arvados.Cluster, token str
 
 	h.Logger.Printf("keepstore %s starting, pid %d", version, os.Getpid())
 
+	// Open the audit log (if enabled)
+	audit, err := newAuditLogger(h.Cluster, h.Logger, reg)
+	if err != nil {
+		return err
+	}
+
 	// Start a round-robin VolumeManager with the configured volumes.
 	vm, err := makeRRVolumeManager(h.Logger, h.Cluster, serviceURL, newVolumeMetricsVecs(reg))
 	if err != nil {
@@ -183,6 +190,14 @@ func (h *handler) setup(ctx context.Context, cluster *arvados.Cluster, token str
 		return fmt.Errorf("no volumes configured for %s", serviceURL)
 	}
 	h.volmgr = vm
+	go func() {
+		<-ctx.Done()
+		vm.Close()
+		// Write any records that are still queued.
+		if err := audit.Close(); err != nil {
+			h.Logger.WithError(err).Error("error closing audit log")
+		}
+	}()
 
 	// Initialize the pullq and workers
 	h.pullq = NewWorkQueue()
@@ -196,8 +211,12 @@ func (h *handler) setup(ctx context.Context, cluster *arvados.Cluster, token str
 		go RunTrashWorker(h.volmgr, h.Logger, h.Cluster, h.trashq)
 	}
 
+	// Start the background scrubber (if enabled)
+	h.scrubber = newScrubber(h.Cluster, h.volmgr, h.Logger, reg)
+	h.scrubber.Start(ctx)
+
 	// Set up routes and metrics
-	h.Handler = MakeRESTRouter(ctx, cluster, reg, vm, h.pullq, h.trashq)
+	h.Handler = MakeRESTRouter(ctx, cluster, reg, vm, h.pullq, h.trashq, h.scrubber, audit)
 
 	// Initialize keepclient for pull workers
 	c, err := arvados.NewClientFromConfig(cluster)
@@ -0,0 +1,376 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionNone byte = iota
+	compressionGzip
+	compressionZstd
+	// compressionStored indicates a block that is stored
+	// uncompressed after the header, because compressing it
+	// didn't save any space.
+	compressionStored
+)
+
+var compressionAlgorithms = map[string]byte{
+	"":     compressionNone,
+	"none": compressionNone,
+	"gzip": compressionGzip,
+	"zstd": compressionZstd,
+}
+
+// A compressed block is stored as a header followed by the
+// compressed data. The header is a magic string, a byte indicating
+// the compression algorithm, the uncompressed size as a 64-bit
+// big-endian integer, and a CRC-32 checksum of the preceding header
+// fields.
+//
+// Blocks that don't get smaller when compressed are stored with a
+// header indicating compressionStored, followed by the original
+// data, so every block written while compression is enabled has a
+// header, even if the data itself starts with something that looks
+// like one. Only blocks written before compression was enabled are
+// stored without a header. Such a block that happens to start with
+// a valid-looking header is still returned correctly, because a
+// block whose header checksum doesn't match, or whose payload
+// doesn't decompress to the indicated size, is treated as
+// uncompressed.
+var compressedMagic = []byte("\xffARZ")
+
+const compressedHeaderSize = 4 + 1 + 8 + 4
+
+var (
+	zstdSetup   sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// zstdCoders returns the shared zstd encoder and decoder. Their
+// EncodeAll and DecodeAll methods are safe for concurrent use, and
+// run up to GOMAXPROCS calls at a time.
+func zstdCoders() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdSetup.Do(func() {
+		n := runtime.GOMAXPROCS(0)
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(n))
+		if zstdErr != nil {
+			zstdErr = fmt.Errorf("error setting up zstd encoder: %w", zstdErr)
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(n), zstd.WithDecoderMaxMemory(BlockSize))
+		if zstdErr != nil {
+			zstdErr = fmt.Errorf("error setting up zstd decoder: %w", zstdErr)
+		}
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+var errCompressedTooBig = errors.New("compressed data is not smaller than original")
+
+// compressedVolume wraps another Volume, compressing block data
+// before it is written and decompressing it after it is read.
+//
+// IndexTo reports the uncompressed size of each block, so
+// keep-balance and other index consumers see the same sizes they
+// would see on an uncompressed volume. Getting the uncompressed
+// size requires reading the header of each block that hasn't been
+// indexed, read, or written since keepstore started, so the first
+// index request can be slow.
+type compressedVolume struct {
+	Volume
+	algorithm byte
+	name      string
+	sizes     blockSizeCache
+}
+
+// newCompressedVolume wraps vol in a compressedVolume if
+// cfgvol.DriverParameters has a non-empty Compression entry.
+// Otherwise it returns vol itself.
+func newCompressedVolume(cfgvol arvados.Volume, vol Volume) (Volume, error) {
+	var params struct{ Compression string }
+	if len(cfgvol.DriverParameters) > 0 {
+		err := json.Unmarshal(cfgvol.DriverParameters, &params)
+		if err != nil {
+			return nil, err
+		}
+	}
+	alg, ok := compressionAlgorithms[strings.ToLower(params.Compression)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported DriverParameters.Compression %q (supported: gzip, zstd, none)", params.Compression)
+	} else if alg == compressionNone {
+		return vol, nil
+	} else if alg == compressionZstd {
+		if _, _, err := zstdCoders(); err != nil {
+			return nil, err
+		}
+	}
+	return &compressedVolume{
+		Volume:    vol,
+		algorithm: alg,
+		name:      strings.ToLower(params.Compression),
+	}, nil
+}
+
+// compress writes the stored form of data -- a header followed by
+// the compressed data, or the original data if compression doesn't
+// save any space -- into dst (which must be at least
+// len(data)+compressedHeaderSize bytes), and returns the number of
+// bytes used.
+func compress(alg byte, data, dst []byte) (int, error) {
+	n, err := compressPayload(alg, data, dst[compressedHeaderSize:compressedHeaderSize+len(data)])
+	if err == errCompressedTooBig {
+		alg = compressionStored
+		n = copy(dst[compressedHeaderSize:], data)
+	} else if err != nil {
+		return 0, err
+	}
+	copy(dst, compressedMagic)
+	dst[4] = alg
+	binary.BigEndian.PutUint64(dst[5:], uint64(len(data)))
+	binary.BigEndian.PutUint32(dst[13:], crc32.ChecksumIEEE(dst[:13]))
+	return compressedHeaderSize + n, nil
+}
+
+// compressPayload writes the compressed form of data into dst, and
+// returns the number of bytes used. It returns errCompressedTooBig if
+// the compressed data is not smaller than data.
+func compressPayload(alg byte, data, dst []byte) (int, error) {
+	switch alg {
+	case compressionGzip:
+		fb := &fixedBuffer{buf: dst[:len(data)]}
+		zw := gzip.NewWriter(fb)
+		_, err := zw.Write(data)
+		if err == nil {
+			err = zw.Close()
+		}
+		if err == io.ErrShortWrite || (err == nil && fb.n >= len(data)) {
+			return 0, errCompressedTooBig
+		} else if err != nil {
+			return 0, err
+		}
+		return fb.n, nil
+	case compressionZstd:
+		enc, _, err := zstdCoders()
+		if err != nil {
+			return 0, err
+		}
+		out := enc.EncodeAll(data, dst[:0:len(data)])
+		if len(out) >= len(data) {
+			return 0, errCompressedTooBig
+		}
+		return len(out), nil
+	default:
+		return 0, fmt.Errorf("unsupported compression algorithm %d", alg)
+	}
+}
+
+// parseCompressedHeader returns the compression algorithm and
+// uncompressed size indicated by the given header. If the header
+// is not valid (which means the block is stored uncompressed), it
+// returns compressionNone.
+func parseCompressedHeader(hdr []byte) (byte, int) {
+	if len(hdr) < compressedHeaderSize || !bytes.Equal(hdr[:4], compressedMagic) {
+		return compressionNone, 0
+	}
+	if crc32.ChecksumIEEE(hdr[:13]) != binary.BigEndian.Uint32(hdr[13:compressedHeaderSize]) {
+		return compressionNone, 0
+	}
+	alg := hdr[4]
+	size := binary.BigEndian.Uint64(hdr[5:13])
+	if (alg != compressionGzip && alg != compressionZstd && alg != compressionStored) || size > BlockSize {
+		return compressionNone, 0
+	}
+	return alg, int(size)
+}
+
+// decompress decodes stored data into buf, and returns the number of
+// bytes written to buf. If the stored data does not have a valid
+// compression header, or its payload does not decompress to the
+// size indicated by the header, it is copied to buf as is. (If it is
+// really a corrupt compressed block, the caller's hash check will
+// catch it.) If the header indicates a size larger than buf, it
+// returns TooLongError.
+func decompress(stored, buf []byte) (int, error) {
+	alg, size := parseCompressedHeader(stored)
+	if alg != compressionNone && size > len(buf) {
+		return 0, TooLongError
+	} else if alg != compressionNone {
+		if n, err := decompressPayload(alg, size, stored[compressedHeaderSize:], buf); err == nil {
+			return n, nil
+		}
+	}
+	if len(stored) > len(buf) {
+		return 0, TooLongError
+	}
+	return copy(buf, stored), nil
+}
+
+// decompressPayload decodes the given compressed data, which is
+// expected to have the given uncompressed size, into buf.
+func decompressPayload(alg byte, size int, payload, buf []byte) (int, error) {
+	switch alg {
+	case compressionStored:
+		if len(payload) != size {
+			return 0, fmt.Errorf("stored data size %d does not match header %d", len(payload), size)
+		}
+		return copy(buf, payload), nil
+	case compressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return 0, err
+		}
+		n, err := io.ReadFull(zr, buf[:size])
+		if err != nil {
+			return n, err
+		}
+		if n, _ := zr.Read(make([]byte, 1)); n > 0 {
+			return 0, errors.New("decompressed data is larger than header indicates")
+		}
+		return size, zr.Close()
+	case compressionZstd:
+		_, dec, err := zstdCoders()
+		if err != nil {
+			return 0, err
+		}
+		out, err := dec.DecodeAll(payload, buf[:0])
+		if err != nil {
+			return 0, err
+		} else if len(out) != size {
+			return 0, fmt.Errorf("decompressed data size %d does not match header %d", len(out), size)
+		} else if size > 0 && &out[0] != &buf[0] {
+			copy(buf, out)
+		}
+		return size, nil
+	}
+	return 0, fmt.Errorf("unsupported compression algorithm %d", alg)
+}
+
+// Get implements Volume.
+func (v *compressedVolume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
+	// Leave room for one more byte than the largest stored form
+	// of a block that fits in buf, so a stored block that is too
+	// long isn't mistaken for a truncated one.
+	stored, ctx, err := getScratch(ctx, len(buf)+compressedHeaderSize+1)
+	if err != nil {
+		return 0, err
+	}
+	defer bufs.Put(stored)
+	n, err := v.Volume.Get(ctx, loc, stored)
+	if err != nil {
+		return 0, err
+	} else if n > len(buf)+compressedHeaderSize {
+		return 0, TooLongError
+	}
+	size, err := decompress(stored[:n], buf)
+	if err == TooLongError {
+		return 0, err
+	} else if err != nil {
+		return 0, fmt.Errorf("error decompressing %s: %s", loc, err)
+	}
+	v.sizes.Add(locatorHash(loc), n, size)
+	return size, nil
+}
+
+// Compare implements Volume.
+func (v *compressedVolume) Compare(ctx context.Context, loc string, expect []byte) error {
+	return compareWithGet(ctx, v, loc, expect)
+}
+
+// Put implements Volume.
+func (v *compressedVolume) Put(ctx context.Context, loc string, block []byte) error {
+	buf, ctx, err := getScratch(ctx, len(block)+compressedHeaderSize)
+	if err != nil {
+		return err
+	}
+	defer bufs.Put(buf)
+	n, err := compress(v.algorithm, block, buf)
+	if err != nil {
+		return err
+	}
+	err = v.Volume.Put(ctx, loc, buf[:n])
+	if err == nil {
+		v.sizes.Add(locatorHash(loc), n, len(block))
+	}
+	return err
+}
+
+// Rekey implements rekeyer, if the underlying volume is encrypted.
+func (v *compressedVolume) Rekey(ctx context.Context, loc string, data []byte) (bool, error) {
+	rk, ok := v.Volume.(rekeyer)
+	if !ok {
+		return false, nil
+	}
+	buf, ctx, err := getScratch(ctx, len(data)+compressedHeaderSize)
+	if err != nil {
+		return false, err
+	}
+	defer bufs.Put(buf)
+	n, err := compress(v.algorithm, data, buf)
+	if err != nil {
+		return false, err
+	}
+	return rk.Rekey(ctx, loc, buf[:n])
+}
+
+// IndexTo implements Volume. It replaces the stored size of each
+// block with the uncompressed size.
+func (v *compressedVolume) IndexTo(prefix string, w io.Writer) error {
+	return v.sizes.IndexTo(v.Volume, prefix, w, v.uncompressedSize)
+}
+
+// uncompressedSize returns the uncompressed size of the given block,
+// according to its header.
+//
+// Only the header is read, so the payload is not checked. Every
+// block written while compression is enabled has a header, so the
+// size can only be wrong for a block that was written before
+// compression was enabled and happens to start with a valid header.
+func (v *compressedVolume) uncompressedSize(ctx context.Context, hash string, storedSize int) (int, error) {
+	if storedSize < compressedHeaderSize {
+		// Too short to have a header. Note an empty block is
+		// stored as a header with no payload, so it is not
+		// handled here.
+		return storedSize, nil
+	}
+	hdr, err := readBlockPrefix(ctx, v.Volume, hash, compressedHeaderSize)
+	if err != nil {
+		return 0, err
+	}
+	if alg, size := parseCompressedHeader(hdr); alg != compressionNone {
+		return size, nil
+	}
+	return storedSize, nil
+}
+
+// String implements Volume.
+func (v *compressedVolume) String() string {
+	return fmt.Sprintf("%s (%s)", v.Volume, v.name)
+}
+
+// InternalStats returns the underlying volume's stats, if any.
+func (v *compressedVolume) InternalStats() interface{} {
+	if is, ok := v.Volume.(InternalStatser); ok {
+		return is.InternalStats()
+	}
+	return nil
+}
@@ -0,0 +1,398 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	check "gopkg.in/check.v1"
+)
+
+type testableCompressedVolume struct {
+	*compressedVolume
+	inner TestableVolume
+}
+
+// PutRaw stores data such that Get will return it, bypassing
+// constraints like readonly.
+func (v *testableCompressedVolume) PutRaw(loc string, data []byte) {
+	buf := make([]byte, len(data)+compressedHeaderSize)
+	n, err := compress(v.algorithm, data, buf)
+	if err != nil {
+		panic(err)
+	}
+	v.inner.PutRaw(loc, buf[:n])
+}
+
+func (v *testableCompressedVolume) TouchWithDate(loc string, t time.Time) {
+	v.inner.TouchWithDate(loc, t)
+}
+
+func (v *testableCompressedVolume) Teardown() {
+	v.inner.Teardown()
+}
+
+func (v *testableCompressedVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return v.inner.ReadWriteOperationLabelValues()
+}
+
+var _ = check.Suite(&CompressedVolumeSuite{})
+
+type CompressedVolumeSuite struct{}
+
+func (s *CompressedVolumeSuite) newTestableVolume(c *check.C, cluster *arvados.Cluster, volume arvados.Volume, metrics *volumeMetricsVecs, algorithm string) *testableCompressedVolume {
+	dir, err := ioutil.TempDir("", "compressed_volume_test")
+	c.Assert(err, check.IsNil)
+	inner := &TestableUnixVolume{
+		UnixVolume: UnixVolume{
+			Root:    dir,
+			cluster: cluster,
+			logger:  ctxlog.TestLogger(c),
+			volume:  volume,
+			metrics: metrics,
+		},
+		t: c,
+	}
+	c.Assert(inner.check(), check.IsNil)
+	volume.DriverParameters = []byte(`{"Compression":"` + algorithm + `"}`)
+	cv, err := newCompressedVolume(volume, inner)
+	c.Assert(err, check.IsNil)
+	return &testableCompressedVolume{compressedVolume: cv.(*compressedVolume), inner: inner}
+}
+
+func (s *CompressedVolumeSuite) TestGenericVolumeTests(c *check.C) {
+	for _, alg := range []string{"gzip", "zstd"} {
+		c.Logf("=== %s", alg)
+		DoGenericVolumeTests(c, false, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+			return s.newTestableVolume(c, cluster, volume, metrics, alg)
+		})
+	}
+}
+
+func (s *CompressedVolumeSuite) TestGenericVolumeTestsReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics, "zstd")
+	})
+}
+
+func (s *CompressedVolumeSuite) TestConfig(c *check.C) {
+	vol, err := newCompressedVolume(arvados.Volume{DriverParameters: []byte(`{"Root":"/tmp"}`)}, nil)
+	c.Check(err, check.IsNil)
+	c.Check(vol, check.IsNil)
+	_, err = newCompressedVolume(arvados.Volume{DriverParameters: []byte(`{"Compression":"lzma"}`)}, nil)
+	c.Check(err, check.ErrorMatches, `unsupported DriverParameters.Compression "lzma".*`)
+}
+
+func (s *CompressedVolumeSuite) TestCompressibleBlock(c *check.C) {
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("compressible "), 100000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	for _, alg := range []string{"gzip", "zstd"} {
+		c.Logf("=== %s", alg)
+		cluster := testCluster(c)
+		v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), alg)
+		defer v.Teardown()
+		c.Assert(v.Put(ctx, hash, data), check.IsNil)
+
+		raw, err := ioutil.ReadFile(v.inner.(*TestableUnixVolume).blockPath(hash))
+		c.Assert(err, check.IsNil)
+		c.Check(len(raw) < len(data)/10, check.Equals, true)
+
+		buf := make([]byte, BlockSize)
+		n, err := v.Get(ctx, hash, buf)
+		c.Assert(err, check.IsNil)
+		c.Check(bytes.Equal(buf[:n], data), check.Equals, true)
+		c.Check(v.Compare(ctx, hash, data), check.IsNil)
+		c.Check(v.Compare(ctx, hash, data[1:]), check.Equals, CollisionError)
+
+		// The index reports the uncompressed size, whether or
+		// not the size is cached.
+		for _, fresh := range []bool{false, true} {
+			if fresh {
+				v = s.reopen(c, v, alg)
+			}
+			var idx bytes.Buffer
+			c.Assert(v.IndexTo("", &idx), check.IsNil)
+			c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, hash, len(data)))
+		}
+	}
+}
+
+func (s *CompressedVolumeSuite) TestIncompressibleBlock(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), "gzip")
+	defer v.Teardown()
+	c.Assert(v.Put(ctx, TestHash, TestBlock), check.IsNil)
+	raw, err := ioutil.ReadFile(v.inner.(*TestableUnixVolume).blockPath(TestHash))
+	c.Assert(err, check.IsNil)
+	c.Check(raw[4], check.Equals, compressionStored)
+	c.Check(raw[compressedHeaderSize:], check.DeepEquals, TestBlock)
+	buf := make([]byte, BlockSize)
+	n, err := v.Get(ctx, TestHash, buf)
+	c.Assert(err, check.IsNil)
+	c.Check(buf[:n], check.DeepEquals, TestBlock)
+}
+
+func (s *CompressedVolumeSuite) TestUncompressedBlocks(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), "zstd")
+	defer v.Teardown()
+	data := bytes.Repeat([]byte("x"), 1000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	v.inner.PutRaw(hash, data) // stored before compression was enabled
+	buf := make([]byte, BlockSize)
+	n, err := v.Get(ctx, hash, buf)
+	c.Assert(err, check.IsNil)
+	c.Check(buf[:n], check.DeepEquals, data)
+	var idx bytes.Buffer
+	c.Assert(v.IndexTo("", &idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, hash+`\+1000 \d+\n`)
+}
+
+func (s *CompressedVolumeSuite) TestUncompressedBlockWithMagic(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), "zstd")
+	defer v.Teardown()
+
+	// Uncompressed data that starts with the magic string and a
+	// plausible algorithm and size.
+	data := append(append([]byte(nil), compressedMagic...), compressionZstd, 0, 0, 0, 0, 0, 0, 0, 8)
+	data = append(data, bytes.Repeat([]byte("x"), 1000)...)
+	// Uncompressed data that starts with a valid header, but
+	// isn't followed by valid compressed data.
+	withHeader := make([]byte, 1000+compressedHeaderSize)
+	_, err := compress(compressionZstd, bytes.Repeat([]byte("x"), 1000), withHeader)
+	c.Assert(err, check.IsNil)
+	withHeader = append(withHeader[:compressedHeaderSize], bytes.Repeat([]byte("y"), 1000)...)
+
+	for _, data := range [][]byte{data, withHeader} {
+		hash := fmt.Sprintf("%x", md5.Sum(data))
+		v.inner.PutRaw(hash, data)
+		buf := make([]byte, BlockSize)
+		n, err := v.Get(ctx, hash, buf)
+		c.Assert(err, check.IsNil)
+		c.Check(buf[:n], check.DeepEquals, data)
+		c.Check(v.Compare(ctx, hash, data), check.IsNil)
+	}
+	var idx bytes.Buffer
+	c.Assert(v.IndexTo("", &idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`(?ms).*%x\+%d .*`, md5.Sum(data), len(data)))
+}
+
+// A block that starts with a valid header is stored with another
+// header when it is written, so its size is indexed correctly.
+func (s *CompressedVolumeSuite) TestBlockWithHeader(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), "zstd")
+	defer v.Teardown()
+
+	data := make([]byte, 1000+compressedHeaderSize)
+	_, err := compress(compressionZstd, bytes.Repeat([]byte("x"), 1000), data)
+	c.Assert(err, check.IsNil)
+	data = append(data[:compressedHeaderSize], make([]byte, 1000)...)
+	rand.Read(data[compressedHeaderSize:])
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(v.Put(ctx, hash, data), check.IsNil)
+
+	v = s.reopen(c, v, "zstd")
+	var idx bytes.Buffer
+	c.Assert(v.IndexTo("", &idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, hash, len(data)))
+	buf := make([]byte, BlockSize)
+	n, err := v.Get(ctx, hash, buf)
+	c.Assert(err, check.IsNil)
+	c.Check(buf[:n], check.DeepEquals, data)
+}
+
+// vanishingVolume is a Volume whose blocks disappear from the index
+// when they are read -- or, if err is not nil, can't be read at all.
+type vanishingVolume struct {
+	Volume
+	gone map[string]bool
+	err  error
+}
+
+func (v *vanishingVolume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
+	if v.gone[loc] && v.err != nil {
+		return 0, v.err
+	} else if v.gone[loc] {
+		return 0, os.ErrNotExist
+	}
+	return v.Volume.Get(ctx, loc, buf)
+}
+
+func (s *CompressedVolumeSuite) TestIndexSkipsVanishedBlocks(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), "zstd")
+	defer v.Teardown()
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(v.Put(ctx, hash, data), check.IsNil)
+	c.Assert(v.Put(ctx, TestHash, TestBlock), check.IsNil)
+
+	// Index with an empty size cache, where one block is deleted
+	// (e.g., trashed) after it is listed but before its header is
+	// read.
+	cv, err := newCompressedVolume(arvados.Volume{DriverParameters: []byte(`{"Compression":"zstd"}`)}, &vanishingVolume{
+		Volume: v.inner,
+		gone:   map[string]bool{hash: true},
+	})
+	c.Assert(err, check.IsNil)
+	var idx bytes.Buffer
+	c.Assert(cv.IndexTo("", &idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, TestHash+`\+44 \d+\n`)
+
+	// Other errors are returned, rather than omitting the block
+	// from the index.
+	cv, err = newCompressedVolume(arvados.Volume{DriverParameters: []byte(`{"Compression":"zstd"}`)}, &vanishingVolume{
+		Volume: v.inner,
+		gone:   map[string]bool{hash: true},
+		err:    errors.New("I/O error"),
+	})
+	c.Assert(err, check.IsNil)
+	idx.Reset()
+	c.Check(cv.IndexTo("", &idx), check.ErrorMatches, `.*error reading header of `+hash+`: I/O error`)
+}
+
+// prefixOnlyVolume is a Volume that reads the beginning of a block
+// without reading the whole block. It fails the test if Get is
+// called.
+type prefixOnlyVolume struct {
+	Volume
+	c           *check.C
+	prefixReads int
+}
+
+func (v *prefixOnlyVolume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
+	v.c.Errorf("unexpected Get(%s)", loc)
+	return v.Volume.Get(ctx, loc, buf)
+}
+
+func (v *prefixOnlyVolume) ReadPrefix(ctx context.Context, loc string, n int) ([]byte, error) {
+	v.prefixReads++
+	buf := make([]byte, BlockSize)
+	size, err := v.Volume.Get(ctx, loc, buf)
+	if err != nil {
+		return nil, err
+	} else if size > n {
+		size = n
+	}
+	return buf[:size], nil
+}
+
+func (s *CompressedVolumeSuite) TestIndexReadsHeaderOnly(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), "zstd")
+	defer v.Teardown()
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(v.Put(ctx, hash, data), check.IsNil)
+
+	pv := &prefixOnlyVolume{Volume: v.inner, c: c}
+	cv, err := newCompressedVolume(arvados.Volume{DriverParameters: []byte(`{"Compression":"zstd"}`)}, pv)
+	c.Assert(err, check.IsNil)
+	var idx bytes.Buffer
+	c.Assert(cv.IndexTo("", &idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+
+`, hash, len(data)))
+	c.Check(pv.prefixReads, check.Equals, 1)
+}
+
+// reopen returns a new compressedVolume (with an empty size cache)
+// using the same backing directory as v.
+func (s *CompressedVolumeSuite) reopen(c *check.C, v *testableCompressedVolume, alg string) *testableCompressedVolume {
+	cv, err := newCompressedVolume(arvados.Volume{DriverParameters: []byte(`{"Compression":"` + alg + `"}`)}, v.inner)
+	c.Assert(err, check.IsNil)
+	return &testableCompressedVolume{compressedVolume: cv.(*compressedVolume), inner: v.inner}
+}
+
+func (s *CompressedVolumeSuite) TestEmptyBlock(c *check.C) {
+	ctx := context.Background()
+	hash := fmt.Sprintf("%x", md5.Sum(nil))
+	for _, alg := range []string{"gzip", "zstd"} {
+		c.Logf("=== %s", alg)
+		cluster := testCluster(c)
+		v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), alg)
+		defer v.Teardown()
+		c.Assert(v.Put(ctx, hash, nil), check.IsNil)
+
+		// Index with an empty size cache, as if keepstore had
+		// been restarted.
+		v = s.reopen(c, v, alg)
+		var idx bytes.Buffer
+		c.Assert(v.IndexTo("", &idx), check.IsNil)
+		c.Check(idx.String(), check.Matches, hash+`\+0 \d+\n`)
+
+		buf := make([]byte, BlockSize)
+		n, err := v.Get(ctx, hash, buf)
+		c.Check(err, check.IsNil)
+		c.Check(n, check.Equals, 0)
+	}
+}
+
+func (s *CompressedVolumeSuite) TestCompressedAndEncrypted(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	dir, err := ioutil.TempDir("", "compressed_volume_test")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	cluster.Collections.BlobEncryptionKeys = testEncryptionKeys
+	cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {
+			Driver:           "Directory",
+			DriverParameters: []byte(`{"Root":"` + dir + `","Compression":"zstd"}`),
+			EncryptionKey:    "key1",
+		},
+	}
+	volmgr, err := makeRRVolumeManager(ctxlog.TestLogger(c), cluster, testServiceURL, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Assert(err, check.IsNil)
+	mnt := volmgr.Lookup("zzzzz-nyw5e-000000000000000", true)
+	data := bytes.Repeat([]byte("compressible "), 100000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(mnt.Put(ctx, hash, data), check.IsNil)
+
+	raw, err := ioutil.ReadFile(mnt.Volume.(*compressedVolume).Volume.(*encryptedVolume).Volume.(*UnixVolume).blockPath(hash))
+	c.Assert(err, check.IsNil)
+	c.Check(len(raw) < len(data)/10, check.Equals, true)
+	c.Check(bytes.HasPrefix(raw, compressedMagic), check.Equals, false)
+
+	buf := make([]byte, BlockSize)
+	n, err := mnt.Get(ctx, hash, buf)
+	c.Assert(err, check.IsNil)
+	c.Check(bytes.Equal(buf[:n], data), check.Equals, true)
+
+	// Rotate the key; the scrubber re-encrypts the block.
+	cv := cluster.Volumes["zzzzz-nyw5e-000000000000000"]
+	cv.EncryptionKey = "key2"
+	cluster.Volumes["zzzzz-nyw5e-000000000000000"] = cv
+	volmgr, err = makeRRVolumeManager(ctxlog.TestLogger(c), cluster, testServiceURL, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Assert(err, check.IsNil)
+	mnt = volmgr.Lookup("zzzzz-nyw5e-000000000000000", true)
+	scr := newScrubber(cluster, volmgr, ctxlog.TestLogger(c), nil)
+	c.Assert(scr.scrubMount(ctx, mnt), check.IsNil)
+	c.Check(scr.Status(mnt.UUID).CorruptBlocks, check.Equals, uint64(0))
+	c.Check(scr.Status(mnt.UUID).RekeyedBlocks, check.Equals, uint64(1))
+	c.Check(scr.Status(mnt.UUID).BytesChecked, check.Equals, uint64(len(data)))
+	c.Assert(scr.scrubMount(ctx, mnt), check.IsNil)
+	c.Check(scr.Status(mnt.UUID).RekeyedBlocks, check.Equals, uint64(0))
+}
@@ -0,0 +1,363 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// An encrypted block is stored as a header followed by the
+// ciphertext and the GCM authentication tag. The header is a magic
+// string, an identifier for the key that was used (the first 8
+// bytes of the SHA-256 hash of the key), and a random nonce.
+//
+// Blocks written before encryption was enabled are stored without a
+// header. A stored block that starts with the magic string and is
+// long enough to hold a header and tag is treated as encrypted,
+// unless it fails to decrypt and its stored content matches its
+// hash: then it is a block written before encryption was enabled
+// that happens to start with the magic string.
+var encryptedMagic = []byte("\xffARX")
+
+const (
+	encryptedKeyIDSize  = 8
+	encryptedNonceSize  = 12
+	encryptedHeaderSize = 4 + encryptedKeyIDSize + encryptedNonceSize
+	encryptedOverhead   = encryptedHeaderSize + 16
+)
+
+// encryptedVolume wraps another Volume, encrypting block data before
+// it is written and decrypting it after it is read.
+//
+// Data is encrypted with AES-256-GCM using a random nonce, and the
+// block hash as additional authenticated data, so a block that has
+// been modified or moved to a different locator fails to decrypt
+// and is reported as corrupt.
+//
+// IndexTo reports the plaintext size of each block, so keep-balance
+// and other index consumers see the same sizes they would see on an
+// unencrypted volume. Getting the plaintext size requires reading the
+// header of each block that hasn't been indexed, read, or written
+// since keepstore started, so the first index request can be slow.
+type encryptedVolume struct {
+	Volume
+	current *encryptionKey
+	keys    map[string]*encryptionKey // key ID => key
+	sizes   blockSizeCache
+}
+
+type encryptionKey struct {
+	id    string
+	block cipher.Block
+	aead  cipher.AEAD
+}
+
+// newEncryptedVolume wraps vol in an encryptedVolume that uses the
+// key named by cfgvol.EncryptionKey for new writes, and accepts
+// data written with any key listed in
+// Collections.BlobEncryptionKeys.
+func newEncryptedVolume(cluster *arvados.Cluster, cfgvol arvados.Volume, vol Volume) (*encryptedVolume, error) {
+	v := &encryptedVolume{
+		Volume: vol,
+		keys:   map[string]*encryptionKey{},
+	}
+	if _, ok := cluster.Collections.BlobEncryptionKeys[cfgvol.EncryptionKey]; !ok {
+		return nil, fmt.Errorf("EncryptionKey %q is not listed in Collections.BlobEncryptionKeys", cfgvol.EncryptionKey)
+	}
+	for name, secret := range cluster.Collections.BlobEncryptionKeys {
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("Collections.BlobEncryptionKeys: key %q is too short (must be at least 32 characters)", name)
+		}
+		key := sha256.Sum256([]byte(secret))
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := sha256.Sum256(key[:])
+		k := &encryptionKey{id: string(id[:encryptedKeyIDSize]), block: block, aead: aead}
+		v.keys[k.id] = k
+		if name == cfgvol.EncryptionKey {
+			v.current = k
+		}
+	}
+	return v, nil
+}
+
+// encrypt writes the encrypted form of data, using the current key,
+// into dst (which must be at least len(data)+encryptedOverhead
+// bytes), and returns the number of bytes used.
+func (v *encryptedVolume) encrypt(loc string, data, dst []byte) (int, error) {
+	copy(dst, encryptedMagic)
+	copy(dst[4:], v.current.id)
+	nonce := dst[4+encryptedKeyIDSize : encryptedHeaderSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, err
+	}
+	out := v.current.aead.Seal(dst[encryptedHeaderSize:encryptedHeaderSize], nonce, data, []byte(locatorHash(loc)))
+	return encryptedHeaderSize + len(out), nil
+}
+
+// isEncrypted returns true if the given stored data (or a prefix of
+// it at least encryptedHeaderSize bytes long) has an encryption
+// header, given the size of the whole stored block.
+func isEncrypted(stored []byte, size int) bool {
+	return size >= encryptedOverhead && bytes.HasPrefix(stored, encryptedMagic)
+}
+
+// storedKey returns the key that was used to encrypt the given
+// stored data, or nil if the data has no encryption header. It
+// returns UnknownKeyError if the data was encrypted with a key that
+// is not configured.
+func (v *encryptedVolume) storedKey(stored []byte, size int) (*encryptionKey, error) {
+	if !isEncrypted(stored, size) {
+		return nil, nil
+	}
+	k := v.keys[string(stored[4:4+encryptedKeyIDSize])]
+	if k == nil {
+		return nil, UnknownKeyError
+	}
+	return k, nil
+}
+
+// isPlaintext returns true if stored is the entire content of the
+// given block as written before encryption was enabled, i.e., its
+// MD5 hash matches the locator.
+func isPlaintext(loc string, stored []byte) bool {
+	return fmt.Sprintf("%x", md5.Sum(stored)) == locatorHash(loc)
+}
+
+// decrypt decodes stored data into buf, and returns the number of
+// bytes written to buf.
+//
+// If the stored data has no encryption header it is presumed to have
+// been written before encryption was enabled, and is copied to buf
+// as is; if it is garbage, the caller's hash check will catch it. If
+// the header refers to a key that is not configured, decrypt returns
+// UnknownKeyError: the data isn't necessarily corrupt, so it must
+// not be reported as DiskHashError. If the data fails
+// authentication, decrypt returns DiskHashError.
+//
+// In either of those error cases, if the stored data matches the
+// block hash, it is a block written before encryption was enabled
+// that happens to start with the magic string, and it is copied to
+// buf as is.
+func (v *encryptedVolume) decrypt(loc string, stored, buf []byte) (int, error) {
+	k, err := v.storedKey(stored, len(stored))
+	if err == nil && k != nil {
+		if len(stored)-encryptedOverhead > len(buf) {
+			return 0, TooLongError
+		}
+		// Decrypt into buf rather than in place, so stored is
+		// still intact if authentication fails.
+		nonce := stored[4+encryptedKeyIDSize : encryptedHeaderSize]
+		out, err2 := k.aead.Open(buf[:0], nonce, stored[encryptedHeaderSize:], []byte(locatorHash(loc)))
+		if err2 == nil {
+			return len(out), nil
+		}
+		err = DiskHashError
+	}
+	if err != nil && !isPlaintext(loc, stored) {
+		return 0, err
+	}
+	if len(stored) > len(buf) {
+		return 0, TooLongError
+	}
+	return copy(buf, stored), nil
+}
+
+// isPlaintextBlock reads the entire stored block and returns true if
+// it matches the block hash (see isPlaintext).
+func (v *encryptedVolume) isPlaintextBlock(ctx context.Context, loc string) (bool, error) {
+	buf, ctx, err := getScratch(ctx, BlockSize+encryptedOverhead)
+	if err != nil {
+		return false, err
+	}
+	defer bufs.Put(buf)
+	n, err := v.Volume.Get(ctx, loc, buf)
+	if err != nil {
+		return false, err
+	}
+	return n <= BlockSize && isPlaintext(loc, buf[:n]), nil
+}
+
+// locatorHash returns the hash portion of loc.
+func locatorHash(loc string) string {
+	if len(loc) > 32 {
+		return loc[:32]
+	}
+	return loc
+}
+
+// Get implements Volume.
+func (v *encryptedVolume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
+	// Leave room for one more byte than fits in buf, so a stored
+	// block that is too long isn't mistaken for a truncated one.
+	stored, ctx, err := getScratch(ctx, len(buf)+encryptedOverhead+1)
+	if err != nil {
+		return 0, err
+	}
+	defer bufs.Put(stored)
+	n, err := v.Volume.Get(ctx, loc, stored)
+	if err != nil {
+		return 0, err
+	} else if n > len(buf)+encryptedOverhead {
+		return 0, TooLongError
+	}
+	size, err := v.decrypt(loc, stored[:n], buf)
+	if err != nil {
+		return 0, err
+	}
+	v.sizes.Add(locatorHash(loc), n, size)
+	return size, nil
+}
+
+// Compare implements Volume.
+func (v *encryptedVolume) Compare(ctx context.Context, loc string, expect []byte) error {
+	return compareWithGet(ctx, v, loc, expect)
+}
+
+// Put implements Volume.
+func (v *encryptedVolume) Put(ctx context.Context, loc string, block []byte) error {
+	buf, ctx, err := getScratch(ctx, len(block)+encryptedOverhead)
+	if err != nil {
+		return err
+	}
+	defer bufs.Put(buf)
+	n, err := v.encrypt(loc, block, buf)
+	if err != nil {
+		return err
+	}
+	err = v.Volume.Put(ctx, loc, buf[:n])
+	if err == nil {
+		v.sizes.Add(locatorHash(loc), n, len(block))
+	}
+	return err
+}
+
+// ReadPrefix returns the first n bytes of the plaintext of the given
+// block, or the whole plaintext if it is shorter than n bytes. Only
+// the beginning of the stored block is read (if the underlying
+// volume supports it), so the data is not authenticated: it is
+// suitable for reading headers of upper layers, like
+// compressedVolume, but not for returning to clients.
+func (v *encryptedVolume) ReadPrefix(ctx context.Context, loc string, n int) ([]byte, error) {
+	stored, err := readBlockPrefix(ctx, v.Volume, loc, encryptedOverhead+n)
+	if err != nil {
+		return nil, err
+	}
+	// If we read fewer than encryptedOverhead+n bytes, we read the
+	// whole block; otherwise the block is at least that long.
+	k, err := v.storedKey(stored, len(stored))
+	if err == UnknownKeyError {
+		// Only the whole block can tell us whether it is
+		// really encrypted.
+		if plain, err := v.isPlaintextBlock(ctx, loc); err != nil {
+			return nil, err
+		} else if !plain {
+			return nil, UnknownKeyError
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		if len(stored) > n {
+			stored = stored[:n]
+		}
+		return stored, nil
+	}
+	// GCM encrypts the plaintext with CTR mode, starting with
+	// counter value 2.
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, stored[4+encryptedKeyIDSize:encryptedHeaderSize])
+	iv[aes.BlockSize-1] = 2
+	data := stored[encryptedHeaderSize:]
+	if len(stored) < encryptedOverhead+n {
+		// We read the whole block, including the
+		// authentication tag at the end.
+		data = stored[encryptedHeaderSize : len(stored)-(encryptedOverhead-encryptedHeaderSize)]
+	} else {
+		data = data[:n]
+	}
+	cipher.NewCTR(k.block, iv).XORKeyStream(data, data)
+	return data, nil
+}
+
+// IndexTo implements Volume. It replaces the stored size of each
+// block with the plaintext size.
+func (v *encryptedVolume) IndexTo(prefix string, w io.Writer) error {
+	return v.sizes.IndexTo(v.Volume, prefix, w, func(ctx context.Context, hash string, stored int) (int, error) {
+		if stored < encryptedOverhead {
+			return stored, nil
+		}
+		hdr, err := readBlockPrefix(ctx, v.Volume, hash, encryptedHeaderSize)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := v.storedKey(hdr, stored); err == UnknownKeyError {
+			// Only the whole block can tell us whether it
+			// is really encrypted.
+			if plain, err := v.isPlaintextBlock(ctx, hash); err != nil {
+				return 0, err
+			} else if plain {
+				return stored, nil
+			}
+		}
+		if isEncrypted(hdr, stored) {
+			return stored - encryptedOverhead, nil
+		}
+		return stored, nil
+	})
+}
+
+// A rekeyer is a volume that can rewrite a block using its current
+// encryption key.
+type rekeyer interface {
+	Rekey(ctx context.Context, loc string, data []byte) (bool, error)
+}
+
+// Rekey rewrites the given block using the current key, if it was
+// stored unencrypted or encrypted with a different key. The caller
+// must supply the block's (already verified) plaintext. Rekey
+// returns true if the block was rewritten.
+//
+// Rewriting a block updates its timestamp, so a block that was
+// already garbage will be kept for another BlobSigningTTL.
+func (v *encryptedVolume) Rekey(ctx context.Context, loc string, data []byte) (bool, error) {
+	hdr, err := readBlockPrefix(ctx, v.Volume, loc, encryptedHeaderSize)
+	if err != nil {
+		return false, err
+	}
+	if len(hdr) >= encryptedHeaderSize && bytes.HasPrefix(hdr, encryptedMagic) && string(hdr[4:4+encryptedKeyIDSize]) == v.current.id {
+		return false, nil
+	}
+	return true, v.Put(ctx, loc, data)
+}
+
+// String implements Volume.
+func (v *encryptedVolume) String() string {
+	return fmt.Sprintf("%s (encrypted)", v.Volume)
+}
+
+// InternalStats returns the underlying volume's stats, if any.
+func (v *encryptedVolume) InternalStats() interface{} {
+	if is, ok := v.Volume.(InternalStatser); ok {
+		return is.InternalStats()
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	check "gopkg.in/check.v1"
+)
+
+type testableEncryptedVolume struct {
+	*encryptedVolume
+	inner TestableVolume
+}
+
+// PutRaw stores data such that Get will return it, bypassing
+// constraints like readonly.
+func (v *testableEncryptedVolume) PutRaw(loc string, data []byte) {
+	buf := make([]byte, len(data)+encryptedOverhead)
+	n, err := v.encrypt(loc, data, buf)
+	if err != nil {
+		panic(err)
+	}
+	v.inner.PutRaw(loc, buf[:n])
+}
+
+func (v *testableEncryptedVolume) TouchWithDate(loc string, t time.Time) {
+	v.inner.TouchWithDate(loc, t)
+}
+
+func (v *testableEncryptedVolume) Teardown() {
+	v.inner.Teardown()
+}
+
+func (v *testableEncryptedVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return v.inner.ReadWriteOperationLabelValues()
+}
+
+var _ = check.Suite(&EncryptedVolumeSuite{})
+
+type EncryptedVolumeSuite struct{}
+
+var testEncryptionKeys = map[string]string{
+	"key1": "abcdefghijklmnopqrstuvwxyz0123456789",
+	"key2": "0123456789abcdefghijklmnopqrstuvwxyz",
+}
+
+func (s *EncryptedVolumeSuite) newTestableVolume(c *check.C, cluster *arvados.Cluster, volume arvados.Volume, metrics *volumeMetricsVecs, keyname string) *testableEncryptedVolume {
+	dir, err := ioutil.TempDir("", "encrypted_volume_test")
+	c.Assert(err, check.IsNil)
+	inner := &TestableUnixVolume{
+		UnixVolume: UnixVolume{
+			Root:    dir,
+			cluster: cluster,
+			logger:  ctxlog.TestLogger(c),
+			volume:  volume,
+			metrics: metrics,
+		},
+		t: c,
+	}
+	c.Assert(inner.check(), check.IsNil)
+	cluster.Collections.BlobEncryptionKeys = testEncryptionKeys
+	volume.EncryptionKey = keyname
+	ev, err := newEncryptedVolume(cluster, volume, inner)
+	c.Assert(err, check.IsNil)
+	return &testableEncryptedVolume{encryptedVolume: ev, inner: inner}
+}
+
+func (s *EncryptedVolumeSuite) TestGenericVolumeTests(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics, "key1")
+	})
+}
+
+func (s *EncryptedVolumeSuite) TestGenericVolumeTestsReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics, "key1")
+	})
+}
+
+func (s *EncryptedVolumeSuite) TestConfigErrors(c *check.C) {
+	cluster := testCluster(c)
+	cluster.Collections.BlobEncryptionKeys = map[string]string{"short": "tooshort"}
+	_, err := newEncryptedVolume(cluster, arvados.Volume{EncryptionKey: "short"}, nil)
+	c.Check(err, check.ErrorMatches, `.*too short.*`)
+	_, err = newEncryptedVolume(cluster, arvados.Volume{EncryptionKey: "missing"}, nil)
+	c.Check(err, check.ErrorMatches, `.*not listed in Collections.BlobEncryptionKeys`)
+}
+
+func (s *EncryptedVolumeSuite) TestDataEncryptedAtRest(c *check.C) {
+	cluster := testCluster(c)
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), "key1")
+	defer v.Teardown()
+	c.Assert(v.Put(context.Background(), TestHash, TestBlock), check.IsNil)
+
+	raw, err := ioutil.ReadFile(v.inner.(*TestableUnixVolume).blockPath(TestHash))
+	c.Assert(err, check.IsNil)
+	c.Check(len(raw), check.Equals, len(TestBlock)+encryptedOverhead)
+	c.Check(bytes.Contains(raw, TestBlock), check.Equals, false)
+
+	var idx bytes.Buffer
+	c.Assert(v.IndexTo("", &idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, TestHash+`\+44 \d+\n`)
+
+	// Writing the same block again uses a new nonce.
+	c.Assert(v.Put(context.Background(), TestHash, TestBlock), check.IsNil)
+	raw2, err := ioutil.ReadFile(v.inner.(*TestableUnixVolume).blockPath(TestHash))
+	c.Assert(err, check.IsNil)
+	c.Check(bytes.Equal(raw, raw2), check.Equals, false)
+}
+
+func (s *EncryptedVolumeSuite) TestTamperedData(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), "key1")
+	defer v.Teardown()
+	c.Assert(v.Put(ctx, TestHash, TestBlock), check.IsNil)
+	path := v.inner.(*TestableUnixVolume).blockPath(TestHash)
+	raw, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	raw[encryptedHeaderSize+3] ^= 1
+	v.inner.PutRaw(TestHash, raw)
+
+	buf := make([]byte, BlockSize)
+	_, err = v.Get(ctx, TestHash, buf)
+	c.Check(err, check.Equals, DiskHashError)
+	c.Check(v.Compare(ctx, TestHash, TestBlock), check.Equals, DiskHashError)
+
+	// Ciphertext copied to a different locator is rejected, too.
+	raw[encryptedHeaderSize+3] ^= 1
+	v.inner.PutRaw(TestHash2, raw)
+	_, err = v.Get(ctx, TestHash2, buf)
+	c.Check(err, check.Equals, DiskHashError)
+}
+
+func (s *EncryptedVolumeSuite) TestScratchBuffers(c *check.C) {
+	defer func(orig *bufferPool) {
+		bufs = orig
+	}(bufs)
+	bufs = newBufferPool(ctxlog.TestLogger(c), 1, maxStoredBlockSize)
+	ctx := context.Background()
+	v := s.newTestableVolume(c, testCluster(c), arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), "key1")
+	defer v.Teardown()
+
+	// Scratch space is taken from the buffer pool, sized to fit
+	// the block, and returned afterward.
+	c.Assert(v.Put(ctx, TestHash, TestBlock), check.IsNil)
+	c.Check(bufs.BytesInUse(), check.Equals, 0)
+
+	// A caller that holds the whole pool can still read the
+	// block.
+	buf := bufs.Get(BlockSize)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := v.Get(withBuffer(ctx), TestHash, buf)
+		c.Check(err, check.IsNil)
+		c.Check(buf[:n], check.DeepEquals, TestBlock)
+		c.Check(v.Compare(withBuffer(ctx), TestHash, TestBlock), check.IsNil)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out")
+	}
+	bufs.Put(buf)
+	c.Check(bufs.BytesInUse(), check.Equals, 0)
+}
+
+func (s *EncryptedVolumeSuite) TestKeyRotation(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	metrics := newVolumeMetricsVecs(prometheus.NewRegistry())
+	v1 := s.newTestableVolume(c, cluster, arvados.Volume{}, metrics, "key1")
+	defer v1.Teardown()
+	c.Assert(v1.Put(ctx, TestHash, TestBlock), check.IsNil)
+	v1.inner.PutRaw(TestHash2, TestBlock2) // stored before encryption was enabled
+
+	// Switch the current key to key2, using the same backing
+	// directory.
+	v2, err := newEncryptedVolume(cluster, arvados.Volume{EncryptionKey: "key2"}, v1.inner)
+	c.Assert(err, check.IsNil)
+	path := v1.inner.(*TestableUnixVolume).blockPath(TestHash)
+	before, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+
+	for _, trial := range []struct {
+		hash string
+		data []byte
+	}{
+		{TestHash, TestBlock},
+		{TestHash2, TestBlock2},
+	} {
+		buf := make([]byte, BlockSize)
+		n, err := v2.Get(ctx, trial.hash, buf)
+		c.Assert(err, check.IsNil)
+		c.Check(buf[:n], check.DeepEquals, trial.data)
+		c.Check(v2.Compare(ctx, trial.hash, trial.data), check.IsNil)
+
+		rekeyed, err := v2.Rekey(ctx, trial.hash, trial.data)
+		c.Check(err, check.IsNil)
+		c.Check(rekeyed, check.Equals, true)
+		rekeyed, err = v2.Rekey(ctx, trial.hash, trial.data)
+		c.Check(err, check.IsNil)
+		c.Check(rekeyed, check.Equals, false)
+
+		n, err = v2.Get(ctx, trial.hash, buf)
+		c.Assert(err, check.IsNil)
+		c.Check(buf[:n], check.DeepEquals, trial.data)
+	}
+
+	after, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Check(bytes.Equal(before, after), check.Equals, false)
+
+	// After rotation, key1 is no longer needed.
+	cluster.Collections.BlobEncryptionKeys = map[string]string{"key2": testEncryptionKeys["key2"]}
+	v3, err := newEncryptedVolume(cluster, arvados.Volume{EncryptionKey: "key2"}, v1.inner)
+	c.Assert(err, check.IsNil)
+	c.Check(v3.Compare(ctx, TestHash, TestBlock), check.IsNil)
+	c.Check(v3.Compare(ctx, TestHash, BadBlock), check.Equals, CollisionError)
+}
+
+func (s *EncryptedVolumeSuite) TestScrubberRekeys(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	dir, err := ioutil.TempDir("", "encrypted_volume_test")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	cluster.Collections.BlobEncryptionKeys = testEncryptionKeys
+	cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {
+			Driver:           "Directory",
+			DriverParameters: []byte(`{"Root":"` + dir + `"}`),
+			EncryptionKey:    "key1",
+		},
+	}
+	volmgr, err := makeRRVolumeManager(ctxlog.TestLogger(c), cluster, testServiceURL, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Assert(err, check.IsNil)
+	mnt := volmgr.Lookup("zzzzz-nyw5e-000000000000000", true)
+	c.Assert(mnt.Put(ctx, TestHash, TestBlock), check.IsNil)
+
+	scr := newScrubber(cluster, volmgr, ctxlog.TestLogger(c), nil)
+	c.Assert(scr.scrubMount(ctx, mnt), check.IsNil)
+	c.Check(scr.Status(mnt.UUID).RekeyedBlocks, check.Equals, uint64(0))
+
+	cv := cluster.Volumes["zzzzz-nyw5e-000000000000000"]
+	cv.EncryptionKey = "key2"
+	cluster.Volumes["zzzzz-nyw5e-000000000000000"] = cv
+	volmgr, err = makeRRVolumeManager(ctxlog.TestLogger(c), cluster, testServiceURL, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Assert(err, check.IsNil)
+	mnt = volmgr.Lookup("zzzzz-nyw5e-000000000000000", true)
+	scr = newScrubber(cluster, volmgr, ctxlog.TestLogger(c), nil)
+	c.Assert(scr.scrubMount(ctx, mnt), check.IsNil)
+	c.Check(scr.Status(mnt.UUID).CorruptBlocks, check.Equals, uint64(0))
+	c.Check(scr.Status(mnt.UUID).RekeyedBlocks, check.Equals, uint64(1))
+	c.Assert(scr.scrubMount(ctx, mnt), check.IsNil)
+	c.Check(scr.Status(mnt.UUID).RekeyedBlocks, check.Equals, uint64(0))
+}
+
+func (s *EncryptedVolumeSuite) TestUnknownKey(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	metrics := newVolumeMetricsVecs(prometheus.NewRegistry())
+	v1 := s.newTestableVolume(c, cluster, arvados.Volume{}, metrics, "key1")
+	defer v1.Teardown()
+	c.Assert(v1.Put(ctx, TestHash, TestBlock), check.IsNil)
+
+	cluster.Collections.BlobEncryptionKeys = map[string]string{"key2": testEncryptionKeys["key2"]}
+	v2, err := newEncryptedVolume(cluster, arvados.Volume{EncryptionKey: "key2"}, v1.inner)
+	c.Assert(err, check.IsNil)
+	_, err = v2.Get(ctx, TestHash, make([]byte, BlockSize))
+	c.Check(err, check.Equals, UnknownKeyError)
+	c.Check(v2.Compare(ctx, TestHash, TestBlock), check.Equals, UnknownKeyError)
+	_, err = v2.ReadPrefix(ctx, TestHash, 4)
+	c.Check(err, check.Equals, UnknownKeyError)
+
+	// IndexTo still reports the plaintext size, like Get would
+	// if the key were configured.
+	var buf bytes.Buffer
+	c.Assert(v2.IndexTo(TestHash, &buf), check.IsNil)
+	c.Check(buf.String(), check.Matches, TestHash+`\+`+fmt.Sprintf("%d", len(TestBlock))+` \d+\n`)
+}
+
+func (s *EncryptedVolumeSuite) TestLegacyBlockWithMagic(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), "key1")
+	defer v.Teardown()
+
+	// Blocks stored before encryption was enabled that happen to
+	// start with the magic string, followed by an unknown key ID
+	// or by the ID of a configured key.
+	for _, keyID := range []string{"unknown!", v.current.id} {
+		data := append(append(append([]byte(nil), encryptedMagic...), keyID...), bytes.Repeat([]byte("legacy "), 10)...)
+		hash := fmt.Sprintf("%x", md5.Sum(data))
+		v.inner.PutRaw(hash, data)
+
+		buf := make([]byte, BlockSize)
+		n, err := v.Get(ctx, hash, buf)
+		c.Check(err, check.IsNil)
+		c.Check(buf[:n], check.DeepEquals, data)
+		c.Check(v.Compare(ctx, hash, data), check.IsNil)
+
+		// Index with an empty size cache.
+		ev, err := newEncryptedVolume(cluster, arvados.Volume{EncryptionKey: "key1"}, v.inner)
+		c.Assert(err, check.IsNil)
+		var idx bytes.Buffer
+		c.Assert(ev.IndexTo(hash, &idx), check.IsNil)
+		if keyID == v.current.id {
+			// Only the whole block can tell us it
+			// isn't encrypted, and reading every block
+			// that has a configured key ID would make
+			// the index too slow. The size is corrected
+			// once the block is read.
+			c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, hash, len(data)-encryptedOverhead))
+		} else {
+			c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, hash, len(data)))
+			prefix, err := ev.ReadPrefix(ctx, hash, 4)
+			c.Check(err, check.IsNil)
+			c.Check(prefix, check.DeepEquals, encryptedMagic)
+		}
+		_, err = ev.Get(ctx, hash, buf)
+		c.Check(err, check.IsNil)
+		idx.Reset()
+		c.Assert(ev.IndexTo(hash, &idx), check.IsNil)
+		c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, hash, len(data)))
+
+		// A corrupt block with the same header is still an
+		// error.
+		v.inner.PutRaw(hash, append(data, 'x'))
+		_, err = v.Get(ctx, hash, buf)
+		c.Check(err, check.NotNil)
+	}
+}
+
+func (s *EncryptedVolumeSuite) TestScrubberSkipsUnknownKey(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	dir, err := ioutil.TempDir("", "encrypted_volume_test")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	cluster.Collections.BlobEncryptionKeys = testEncryptionKeys
+	cluster.Collections.BlobTrash = true
+	cluster.Collections.BlobSigningTTL = arvados.Duration(time.Nanosecond)
+	cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {
+			Driver:           "Directory",
+			DriverParameters: []byte(`{"Root":"` + dir + `"}`),
+			EncryptionKey:    "key1",
+		},
+	}
+	volmgr, err := makeRRVolumeManager(ctxlog.TestLogger(c), cluster, testServiceURL, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Assert(err, check.IsNil)
+	mnt := volmgr.Lookup("zzzzz-nyw5e-000000000000000", true)
+	c.Assert(mnt.Put(ctx, TestHash, TestBlock), check.IsNil)
+
+	// Remove key1 from the configuration. The block can't be
+	// read, but it isn't corrupt, so it is left alone.
+	cluster.Collections.BlobEncryptionKeys = map[string]string{"key2": testEncryptionKeys["key2"]}
+	cv := cluster.Volumes["zzzzz-nyw5e-000000000000000"]
+	cv.EncryptionKey = "key2"
+	cluster.Volumes["zzzzz-nyw5e-000000000000000"] = cv
+	volmgr, err = makeRRVolumeManager(ctxlog.TestLogger(c), cluster, testServiceURL, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Assert(err, check.IsNil)
+	mnt = volmgr.Lookup("zzzzz-nyw5e-000000000000000", true)
+	scr := newScrubber(cluster, volmgr, ctxlog.TestLogger(c), nil)
+	c.Assert(scr.scrubMount(ctx, mnt), check.IsNil)
+	c.Check(scr.Status(mnt.UUID).Errors, check.Equals, uint64(1))
+	c.Check(scr.Status(mnt.UUID).CorruptBlocks, check.Equals, uint64(0))
+	c.Check(scr.Status(mnt.UUID).TrashedBlocks, check.Equals, uint64(0))
+	_, err = mnt.Mtime(TestHash)
+	c.Check(err, check.IsNil)
+}
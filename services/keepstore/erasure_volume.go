@@ -0,0 +1,791 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	driver["ErasureCoded"] = newErasureVolume
+}
+
+// Each shard of an erasure-coded block is stored on its backing
+// volume as a header followed by the shard data. The header is a
+// magic string, the number of data and parity shards, the index of
+// this shard, a reserved byte, the size of the original block as a
+// 64-bit big-endian integer, and the MD5 digest of the shard data.
+//
+// The shard data is ceil(size/DataShards) bytes. The original block
+// is the concatenation of the data shards, truncated to size.
+var erasureMagic = []byte("\xffARE")
+
+const erasureHeaderSize = 4 + 4 + 8 + md5.Size
+
+// maxErasureSizeEntries is the maximum number of block sizes
+// remembered by an erasureVolume, to avoid reading shard headers
+// when generating an index.
+const maxErasureSizeEntries = 1 << 20
+
+// ErasureVolume stores each block as DataShards+ParityShards
+// Reed-Solomon shards, one on each of the backing volumes listed in
+// Shards. A block can be read as long as any DataShards of its
+// shards are available, so it survives the loss of up to
+// ParityShards backing volumes.
+type ErasureVolume struct {
+	DataShards   int
+	ParityShards int
+	Shards       []arvados.Volume
+
+	cluster *arvados.Cluster
+	volume  arvados.Volume
+	logger  logrus.FieldLogger
+	shards  []Volume
+	metrics *volumeMetricsVecs
+	rs      *reedSolomon
+	sizes   *lru.Cache // block hash => original size
+	stats   erasureVolumeStats
+}
+
+type erasureVolumeStats struct {
+	statsTicker
+	GetOps         uint64
+	PutOps         uint64
+	ReconstructOps uint64
+	RepairedShards uint64
+}
+
+func newErasureVolume(cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) (Volume, error) {
+	v := &ErasureVolume{cluster: cluster, volume: volume, logger: logger, metrics: metrics}
+	err := json.Unmarshal(volume.DriverParameters, &v)
+	if err != nil {
+		return nil, err
+	}
+	if len(v.Shards) != v.DataShards+v.ParityShards {
+		return nil, fmt.Errorf("DriverParameters.Shards has %d entries, but DataShards+ParityShards is %d", len(v.Shards), v.DataShards+v.ParityShards)
+	}
+	for i, cfgshard := range v.Shards {
+		if cfgshard.Driver == "ErasureCoded" {
+			return nil, fmt.Errorf("DriverParameters.Shards[%d]: nested ErasureCoded volumes are not supported", i)
+		}
+		if err := checkBackingVolume(cfgshard); err != nil {
+			return nil, fmt.Errorf("DriverParameters.Shards[%d]: %s", i, err)
+		}
+		cfgshard.ReadOnly = cfgshard.ReadOnly || volume.ReadOnly
+		shard, err := newVolume(cluster, cfgshard, logger, metrics)
+		if err != nil {
+			return nil, fmt.Errorf("DriverParameters.Shards[%d]: %s", i, err)
+		}
+		v.shards = append(v.shards, shard)
+	}
+	return v, v.check()
+}
+
+func (v *ErasureVolume) check() error {
+	rs, err := newReedSolomon(v.DataShards, v.ParityShards)
+	if err != nil {
+		return err
+	}
+	v.rs = rs
+	if len(v.shards) != v.DataShards+v.ParityShards {
+		return fmt.Errorf("have %d backing volumes, but DataShards+ParityShards is %d", len(v.shards), v.DataShards+v.ParityShards)
+	}
+	v.sizes, err = lru.New(maxErasureSizeEntries)
+	if err != nil {
+		return err
+	}
+	v.logger = v.logger.WithField("Volume", v.String())
+
+	// Set up prometheus metrics
+	lbls := prometheus.Labels{"device_id": v.GetDeviceID()}
+	v.stats.opsCounters, v.stats.errCounters, v.stats.ioBytes = v.metrics.getCounterVecsFor(lbls)
+	return nil
+}
+
+// shardCap returns the size of a stored shard of a block of the
+// given size.
+func (v *ErasureVolume) shardCap(size int) int {
+	return erasureHeaderSize + (size+v.DataShards-1)/v.DataShards
+}
+
+// shardBufs returns len(v.shards) scratch buffers from the shared
+// bufferPool (see getScratch), each big enough to hold one stored
+// shard of a block of the given size. The caller must return them
+// with putShardBufs, and pass the returned context to nested volume
+// calls.
+func (v *ErasureVolume) shardBufs(ctx context.Context, size int) ([][]byte, context.Context, error) {
+	stored := make([][]byte, len(v.shards))
+	for i := range stored {
+		buf, bctx, err := getScratch(ctx, v.shardCap(size))
+		if err != nil {
+			putShardBufs(stored)
+			return nil, ctx, err
+		}
+		stored[i], ctx = buf, bctx
+	}
+	return stored, ctx, nil
+}
+
+// putShardBufs returns buffers obtained from shardBufs to the pool.
+func putShardBufs(stored [][]byte) {
+	for _, buf := range stored {
+		if buf != nil {
+			bufs.Put(buf)
+		}
+	}
+}
+
+// Replication returns the replication level to report for this
+// volume, if Replication is not configured explicitly: the effective
+// durability, ParityShards+1, multiplied by the lowest Replication
+// of the backing volumes.
+//
+// A block survives the loss of up to ParityShards backing volumes,
+// like ParityShards+1 separate replicas. Unlike separate replicas,
+// losing one more backing volume loses every block, so admins who
+// are not satisfied that the backing volumes fail independently
+// should configure a lower Replication.
+func (v *ErasureVolume) Replication() int {
+	repl := 0
+	for _, cfgshard := range v.Shards {
+		r := cfgshard.Replication
+		if r < 1 {
+			r = 1
+		}
+		if repl == 0 || r < repl {
+			repl = r
+		}
+	}
+	if repl == 0 {
+		repl = 1
+	}
+	return repl * (v.ParityShards + 1)
+}
+
+// encode splits block into shards and writes the stored form of each
+// shard (header followed by data) into the corresponding element of
+// bufs, which are resliced to the correct length.
+func (v *ErasureVolume) encode(block []byte, bufs [][]byte) {
+	k := v.DataShards
+	shardSize := (len(block) + k - 1) / k
+	data := make([][]byte, len(bufs))
+	for i := range bufs {
+		bufs[i] = bufs[i][:erasureHeaderSize+shardSize]
+		data[i] = bufs[i][erasureHeaderSize:]
+		if i < k {
+			n := 0
+			if start := i * shardSize; start < len(block) {
+				n = copy(data[i], block[start:])
+			}
+			for j := n; j < shardSize; j++ {
+				data[i][j] = 0
+			}
+		}
+	}
+	v.rs.Encode(data)
+	for i, buf := range bufs {
+		copy(buf, erasureMagic)
+		buf[4] = byte(v.DataShards)
+		buf[5] = byte(v.ParityShards)
+		buf[6] = byte(i)
+		buf[7] = 0
+		binary.BigEndian.PutUint64(buf[8:], uint64(len(block)))
+		sum := md5.Sum(data[i])
+		copy(buf[16:erasureHeaderSize], sum[:])
+	}
+}
+
+// parseShardHeader returns the original block size indicated by the
+// given shard header, or an error if the header is not valid for
+// shard i of this volume.
+func (v *ErasureVolume) parseShardHeader(hdr []byte, i int) (int, error) {
+	if len(hdr) < erasureHeaderSize || !bytes.Equal(hdr[:4], erasureMagic) {
+		return 0, errors.New("missing or invalid shard header")
+	}
+	if int(hdr[4]) != v.DataShards || int(hdr[5]) != v.ParityShards {
+		return 0, fmt.Errorf("shard header indicates %d+%d encoding, expected %d+%d", hdr[4], hdr[5], v.DataShards, v.ParityShards)
+	}
+	if int(hdr[6]) != i {
+		return 0, fmt.Errorf("shard header indicates shard %d, expected %d", hdr[6], i)
+	}
+	size := binary.BigEndian.Uint64(hdr[8:16])
+	if size > maxStoredBlockSize {
+		return 0, fmt.Errorf("shard header indicates invalid size %d", size)
+	}
+	return int(size), nil
+}
+
+// checkShard returns the original block size and the shard data from
+// the given stored shard, or an error if it is corrupt.
+func (v *ErasureVolume) checkShard(stored []byte, i int) (int, []byte, error) {
+	size, err := v.parseShardHeader(stored, i)
+	if err != nil {
+		return 0, nil, err
+	}
+	data := stored[erasureHeaderSize:]
+	if len(data) != (size+v.DataShards-1)/v.DataShards {
+		return 0, nil, fmt.Errorf("shard data is %d bytes, expected %d for block size %d", len(data), (size+v.DataShards-1)/v.DataShards, size)
+	}
+	if sum := md5.Sum(data); !bytes.Equal(sum[:], stored[16:erasureHeaderSize]) {
+		return 0, nil, errors.New("shard data does not match checksum")
+	}
+	return size, data, nil
+}
+
+// eachShard calls fn concurrently for the indicated shards (all
+// shards if idx is nil), and returns the resulting errors, indexed
+// by shard.
+func (v *ErasureVolume) eachShard(idx []int, fn func(i int, shard Volume) error) []error {
+	if idx == nil {
+		for i := range v.shards {
+			idx = append(idx, i)
+		}
+	}
+	errs := make([]error, len(v.shards))
+	var wg sync.WaitGroup
+	for _, i := range idx {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(i, v.shards[i])
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// summarize returns nil if at least min of the given errors are nil.
+// Otherwise, it returns os.ErrNotExist if all of the non-nil errors
+// indicate the block does not exist, or an error describing the
+// failures.
+func (v *ErasureVolume) summarize(errs []error, min int) error {
+	ok, notfound := 0, 0
+	var msgs []string
+	for i, err := range errs {
+		if err == nil {
+			ok++
+		} else if os.IsNotExist(err) {
+			notfound++
+		} else {
+			msgs = append(msgs, fmt.Sprintf("shard %d: %s", i, err))
+		}
+	}
+	if ok >= min {
+		return nil
+	} else if ok == 0 && len(msgs) == 0 {
+		return os.ErrNotExist
+	}
+	msgs = append(msgs, fmt.Sprintf("%d shards not found", notfound))
+	return fmt.Errorf("%d of %d shards succeeded, need %d (%s)", ok, len(errs), min, strings.Join(msgs, "; "))
+}
+
+// Get implements Volume. It reads the data shards, and if any of
+// them are missing or corrupt, reads the parity shards and
+// reconstructs the missing data. Missing or corrupt shards are then
+// rewritten (see repair).
+func (v *ErasureVolume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
+	v.stats.TickOps("get")
+	v.stats.Tick(&v.stats.GetOps)
+	stored, ctx, err := v.shardBufs(ctx, len(buf))
+	if err != nil {
+		return 0, err
+	}
+	defer putShardBufs(stored)
+	k := v.DataShards
+	data := make([][]byte, len(v.shards))
+	sizes := make([]int, len(v.shards))
+	read := func(i int, shard Volume) error {
+		n, err := shard.Get(ctx, loc, stored[i])
+		if err != nil {
+			return err
+		}
+		if n == len(stored[i]) {
+			// The shard might have been truncated to fit
+			// the buffer, which only happens if the block
+			// doesn't fit in buf.
+			if size, err := v.parseShardHeader(stored[i][:n], i); err == nil && size > len(buf) {
+				return TooLongError
+			}
+		}
+		sizes[i], data[i], err = v.checkShard(stored[i][:n], i)
+		if err != nil {
+			v.logger.WithError(err).Warnf("%s: ignoring shard %d", loc, i)
+		}
+		return err
+	}
+	var dataIdx, parityIdx []int
+	for i := range v.shards {
+		if i < k {
+			dataIdx = append(dataIdx, i)
+		} else {
+			parityIdx = append(parityIdx, i)
+		}
+	}
+	errs := v.eachShard(dataIdx, read)
+	missing := false
+	for i := 0; i < k; i++ {
+		missing = missing || errs[i] != nil
+	}
+	if missing && len(parityIdx) > 0 {
+		perrs := v.eachShard(parityIdx, read)
+		for _, i := range parityIdx {
+			errs[i] = perrs[i]
+		}
+	} else {
+		for _, i := range parityIdx {
+			errs[i] = errors.New("not read")
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	for _, err := range errs {
+		if err == TooLongError {
+			return 0, err
+		}
+	}
+
+	// Use the size reported by the first good shard, and ignore
+	// any shards that disagree (e.g., left over from a
+	// different block with the same hash).
+	size := -1
+	present := make([]bool, len(v.shards))
+	for i, err := range errs {
+		if err != nil {
+			continue
+		} else if size < 0 {
+			size = sizes[i]
+		} else if sizes[i] != size {
+			errs[i] = fmt.Errorf("shard indicates block size %d, expected %d", sizes[i], size)
+			continue
+		}
+		present[i] = true
+	}
+	if err := v.summarize(errs, k); err != nil {
+		if !os.IsNotExist(err) {
+			v.stats.TickErr(err, "reconstruct")
+			v.logger.WithError(err).Warnf("%s: cannot reconstruct block", loc)
+		}
+		return 0, err
+	}
+	if size > len(buf) {
+		return 0, TooLongError
+	}
+	if missing {
+		v.stats.TickOps("reconstruct")
+		v.stats.Tick(&v.stats.ReconstructOps)
+	}
+	shardSize := (size + k - 1) / k
+	for i := range data {
+		if !present[i] {
+			data[i] = stored[i][erasureHeaderSize : erasureHeaderSize+shardSize]
+		}
+	}
+	if err := v.rs.ReconstructData(data, present); err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := 0; i < k && n < size; i++ {
+		n += copy(buf[n:size], data[i])
+	}
+	v.stats.TickInBytes(uint64(size))
+	v.sizes.Add(locatorHash(loc), size)
+	if missing {
+		var bad []int
+		for i, ok := range present {
+			if !ok {
+				bad = append(bad, i)
+			}
+		}
+		v.repair(ctx, loc, buf[:size], stored, present, bad)
+	}
+	return size, nil
+}
+
+// repair rewrites the given shards of a block that was reconstructed
+// from the remaining shards, so the block can once again survive the
+// loss of ParityShards backing volumes. Errors are logged rather than
+// returned, since the caller already has the block data.
+//
+// Before rewriting anything, repair re-encodes the block and checks
+// that the resulting shards match the checksums in the headers of
+// the good shards (old, which are marked in present). The block
+// itself can't be checked against its locator, because the data
+// stored on an erasure-coded volume is compressed or encrypted when
+// the volume is configured that way.
+//
+// Rewriting a shard updates its timestamp, so a repaired block that
+// was already garbage will be kept for another BlobSigningTTL.
+func (v *ErasureVolume) repair(ctx context.Context, loc string, block []byte, old [][]byte, present []bool, bad []int) {
+	if v.volume.ReadOnly || len(bad) == 0 {
+		return
+	}
+	stored, ctx, err := v.shardBufs(ctx, len(block))
+	if err != nil {
+		v.logger.WithError(err).Warnf("%s: not repairing shards", loc)
+		return
+	}
+	defer putShardBufs(stored)
+	v.encode(block, stored)
+	for i, ok := range present {
+		if ok && !bytes.Equal(stored[i][16:erasureHeaderSize], old[i][16:erasureHeaderSize]) {
+			// Don't propagate bad data to more shards.
+			v.logger.Warnf("%s: not repairing shards: reconstructed block does not match shard %d", loc, i)
+			return
+		}
+	}
+	errs := v.eachShard(bad, func(i int, shard Volume) error {
+		return shard.Put(ctx, loc, stored[i])
+	})
+	for _, i := range bad {
+		if errs[i] != nil {
+			v.logger.WithError(errs[i]).Warnf("%s: error repairing shard %d", loc, i)
+			continue
+		}
+		v.stats.Tick(&v.stats.RepairedShards)
+	}
+}
+
+// Compare implements Volume.
+func (v *ErasureVolume) Compare(ctx context.Context, loc string, expect []byte) error {
+	return compareWithGet(ctx, v, loc, expect)
+}
+
+// Put implements Volume. It returns an error unless all shards are
+// written successfully.
+func (v *ErasureVolume) Put(ctx context.Context, loc string, block []byte) error {
+	if v.volume.ReadOnly {
+		return MethodDisabledError
+	}
+	v.stats.TickOps("put")
+	v.stats.Tick(&v.stats.PutOps)
+	stored, ctx, err := v.shardBufs(ctx, len(block))
+	if err != nil {
+		return err
+	}
+	defer putShardBufs(stored)
+	v.encode(block, stored)
+	errs := v.eachShard(nil, func(i int, shard Volume) error {
+		return shard.Put(ctx, loc, stored[i])
+	})
+	for i, err := range errs {
+		if err != nil {
+			err = fmt.Errorf("error writing shard %d: %s", i, err)
+			v.stats.TickErr(err, "put")
+			return err
+		}
+	}
+	v.stats.TickOutBytes(uint64(len(block)))
+	v.sizes.Add(locatorHash(loc), len(block))
+	return nil
+}
+
+// Touch implements Volume. It succeeds if at least DataShards shards
+// are touched successfully.
+func (v *ErasureVolume) Touch(loc string) error {
+	if v.volume.ReadOnly {
+		return MethodDisabledError
+	}
+	errs := v.eachShard(nil, func(i int, shard Volume) error {
+		return shard.Touch(loc)
+	})
+	return v.summarize(errs, v.DataShards)
+}
+
+// Mtime implements Volume. It returns the most recent timestamp of
+// all available shards.
+func (v *ErasureVolume) Mtime(loc string) (time.Time, error) {
+	mtimes := make([]time.Time, len(v.shards))
+	errs := v.eachShard(nil, func(i int, shard Volume) (err error) {
+		mtimes[i], err = shard.Mtime(loc)
+		return
+	})
+	if err := v.summarize(errs, v.DataShards); err != nil {
+		return time.Time{}, err
+	}
+	var max time.Time
+	for i, t := range mtimes {
+		if errs[i] == nil && t.After(max) {
+			max = t
+		}
+	}
+	return max, nil
+}
+
+// erasureIndexPrefixLen is the hash prefix length used to split up
+// IndexTo, so only the shard index entries for one prefix at a time
+// are held in memory.
+const erasureIndexPrefixLen = 2
+
+// IndexTo implements Volume. It lists the blocks for which at least
+// DataShards shards are listed in the backing volumes' indexes, with
+// their original sizes and the most recent timestamp of their
+// shards. It tolerates index failures on up to ParityShards backing
+// volumes, and skips blocks that disappear from all of their shards
+// while the index is being built.
+func (v *ErasureVolume) IndexTo(prefix string, w io.Writer) error {
+	prefixes := []string{prefix}
+	for len(prefixes[0]) < erasureIndexPrefixLen {
+		var longer []string
+		for _, p := range prefixes {
+			for _, c := range "0123456789abcdef" {
+				longer = append(longer, p+string(c))
+			}
+		}
+		prefixes = longer
+	}
+	failed := map[int]string{} // shard => error
+	for _, p := range prefixes {
+		err := v.indexPrefix(p, w, failed)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexPrefix writes the index entries for the given prefix. Shards
+// whose indexes can't be retrieved are added to failed, and are not
+// tried again for subsequent prefixes.
+func (v *ErasureVolume) indexPrefix(prefix string, w io.Writer, failed map[int]string) error {
+	type entry struct {
+		shards []int // shards where the block was found
+		mtime  int64
+	}
+	blocks := map[string]*entry{}
+	for i, shard := range v.shards {
+		if _, ok := failed[i]; ok {
+			continue
+		}
+		err := scanIndex(shard, prefix, func(hash, line string, mtime int64) error {
+			ent := blocks[hash]
+			if ent == nil {
+				ent = &entry{}
+				blocks[hash] = ent
+			}
+			ent.shards = append(ent.shards, i)
+			if mtime > ent.mtime {
+				ent.mtime = mtime
+			}
+			return nil
+		})
+		if err != nil {
+			v.logger.WithError(err).Warnf("error getting index from shard %d", i)
+			failed[i] = fmt.Sprintf("shard %d: %s", i, err)
+		}
+	}
+	if len(failed) > v.ParityShards {
+		var msgs []string
+		for i := range v.shards {
+			if msg, ok := failed[i]; ok {
+				msgs = append(msgs, msg)
+			}
+		}
+		return fmt.Errorf("cannot get index from %d of %d shards: %s", len(failed), len(v.shards), strings.Join(msgs, "; "))
+	}
+	for hash, ent := range blocks {
+		if len(ent.shards) < v.DataShards {
+			continue
+		}
+		size, err := v.indexedBlockSize(hash, ent.shards)
+		if os.IsNotExist(err) {
+			// Trashed or deleted since the shard indexes
+			// were retrieved.
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error reading header of %s: %s", hash, err)
+		}
+		_, err = fmt.Fprintf(w, "%s+%d %d\n", hash, size, ent.mtime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexedBlockSize returns the original size of the given block,
+// trying each of the given shards in turn until one of them has a
+// readable header. It returns os.ErrNotExist if the block is missing
+// from all of them.
+func (v *ErasureVolume) indexedBlockSize(hash string, shards []int) (int, error) {
+	var msgs []string
+	for _, shard := range shards {
+		size, err := v.blockSize(hash, shard)
+		if err == nil {
+			return size, nil
+		} else if !os.IsNotExist(err) {
+			msgs = append(msgs, fmt.Sprintf("shard %d: %s", shard, err))
+		}
+	}
+	if len(msgs) == 0 {
+		return 0, os.ErrNotExist
+	}
+	return 0, errors.New(strings.Join(msgs, "; "))
+}
+
+// blockSize returns the original size of the given block, using the
+// cache if possible. Otherwise it reads the header of the given
+// shard.
+func (v *ErasureVolume) blockSize(hash string, shard int) (int, error) {
+	if size, ok := v.sizes.Get(hash); ok {
+		return size.(int), nil
+	}
+	hdr, err := readBlockPrefix(context.Background(), v.shards[shard], hash, erasureHeaderSize)
+	if err != nil {
+		return 0, err
+	}
+	size, err := v.parseShardHeader(hdr, shard)
+	if err != nil {
+		return 0, err
+	}
+	v.sizes.Add(hash, size)
+	return size, nil
+}
+
+// Trash implements Volume. It trashes all shards of the block, unless
+// any of them has been touched within BlobSigningTTL.
+//
+// If any shard cannot be trashed, the shards that were trashed are
+// untrashed, so the block is left readable rather than with fewer
+// than DataShards shards. If that fails too (e.g., BlobTrashLifetime
+// is zero, so trashed shards were deleted immediately), the block is
+// logged as degraded.
+func (v *ErasureVolume) Trash(loc string) error {
+	if v.volume.ReadOnly || !v.cluster.Collections.BlobTrash {
+		return MethodDisabledError
+	}
+	mtime, err := v.Mtime(loc)
+	if err != nil {
+		return err
+	}
+	if time.Since(mtime) < v.cluster.Collections.BlobSigningTTL.Duration() {
+		return nil
+	}
+	errs := v.eachShard(nil, func(i int, shard Volume) error {
+		return shard.Trash(loc)
+	})
+	var trashed []int
+	var failed []string
+	for i, err := range errs {
+		if err == nil {
+			trashed = append(trashed, i)
+		} else if !os.IsNotExist(err) {
+			failed = append(failed, fmt.Sprintf("shard %d: %s", i, err))
+		}
+	}
+	if len(failed) == 0 {
+		return v.summarize(errs, 1)
+	}
+	uerrs := v.eachShard(trashed, func(i int, shard Volume) error {
+		return shard.Untrash(loc)
+	})
+	for _, i := range trashed {
+		if uerrs[i] != nil {
+			v.logger.WithError(uerrs[i]).Errorf("%s: block may be degraded: cannot untrash shard %d after failing to trash other shards", loc, i)
+		}
+	}
+	return fmt.Errorf("error trashing shards (%s)", strings.Join(failed, "; "))
+}
+
+// Untrash implements Volume. It succeeds if at least DataShards
+// shards are untrashed successfully.
+func (v *ErasureVolume) Untrash(loc string) error {
+	if v.volume.ReadOnly {
+		return MethodDisabledError
+	}
+	errs := v.eachShard(nil, func(i int, shard Volume) error {
+		return shard.Untrash(loc)
+	})
+	return v.summarize(errs, v.DataShards)
+}
+
+// EmptyTrash implements Volume.
+func (v *ErasureVolume) EmptyTrash() {
+	v.eachShard(nil, func(i int, shard Volume) error {
+		shard.EmptyTrash()
+		return nil
+	})
+}
+
+// Close implements volumeCloser.
+func (v *ErasureVolume) Close() {
+	for _, shard := range v.shards {
+		closeVolume(shard)
+	}
+}
+
+// Status implements Volume. BytesFree is the amount of block data
+// that can be stored before the fullest backing volume fills up, and
+// BytesUsed is the amount of block data (not including parity)
+// stored on the backing volumes.
+func (v *ErasureVolume) Status() *VolumeStatus {
+	var free, used uint64
+	var freeUnknown bool
+	for i, shard := range v.shards {
+		st := shard.Status()
+		if st == nil {
+			return nil
+		}
+		if i == 0 || st.BytesFree < free {
+			free = st.BytesFree
+		}
+		used += st.BytesUsed
+		freeUnknown = freeUnknown || st.freeUnknown
+	}
+	k := uint64(v.DataShards)
+	return &VolumeStatus{
+		MountPoint:  v.String(),
+		DeviceNum:   1,
+		BytesFree:   free * k,
+		BytesUsed:   used * k / uint64(len(v.shards)),
+		freeUnknown: freeUnknown,
+	}
+}
+
+// String implements Volume.
+func (v *ErasureVolume) String() string {
+	var names []string
+	for _, shard := range v.shards {
+		names = append(names, shard.String())
+	}
+	return fmt.Sprintf("erasure-coded(%d+%d)[%s]", v.DataShards, v.ParityShards, strings.Join(names, ", "))
+}
+
+// GetDeviceID implements Volume. It returns the device IDs of the
+// backing volumes, or "" if any of them is unknown.
+func (v *ErasureVolume) GetDeviceID() string {
+	var ids []string
+	for _, shard := range v.shards {
+		id := shard.GetDeviceID()
+		if id == "" {
+			return ""
+		}
+		ids = append(ids, id)
+	}
+	return fmt.Sprintf("erasure-coded(%d+%d)[%s]", v.DataShards, v.ParityShards, strings.Join(ids, ","))
+}
+
+// InternalStats returns block-level operation counters. Prometheus
+// metrics for the backing volumes are reported under their own
+// device IDs.
+func (v *ErasureVolume) InternalStats() interface{} {
+	return &v.stats
+}
@@ -0,0 +1,469 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	check "gopkg.in/check.v1"
+)
+
+type TestableErasureVolume struct {
+	*ErasureVolume
+	inner []*TestableUnixVolume
+}
+
+// PutRaw stores data such that Get will return it, bypassing
+// constraints like readonly.
+func (v *TestableErasureVolume) PutRaw(loc string, data []byte) {
+	stored, _, err := v.shardBufs(context.Background(), len(data))
+	if err != nil {
+		panic(err)
+	}
+	defer putShardBufs(stored)
+	v.encode(data, stored)
+	for i, inner := range v.inner {
+		inner.PutRaw(loc, stored[i])
+	}
+}
+
+func (v *TestableErasureVolume) TouchWithDate(loc string, t time.Time) {
+	for _, inner := range v.inner {
+		inner.TouchWithDate(loc, t)
+	}
+}
+
+func (v *TestableErasureVolume) Teardown() {
+	for _, inner := range v.inner {
+		inner.Teardown()
+	}
+}
+
+func (v *TestableErasureVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return "get", "put"
+}
+
+// removeShards deletes the given shards of the given block from the
+// backing volumes.
+func (v *TestableErasureVolume) removeShards(c *check.C, loc string, shards ...int) {
+	for _, i := range shards {
+		c.Assert(os.Remove(v.inner[i].blockPath(loc)), check.IsNil)
+	}
+}
+
+var _ = check.Suite(&ErasureVolumeSuite{})
+
+type ErasureVolumeSuite struct{}
+
+func (s *ErasureVolumeSuite) newTestableVolume(c *check.C, cluster *arvados.Cluster, volume arvados.Volume, metrics *volumeMetricsVecs, k, m int) *TestableErasureVolume {
+	v := &TestableErasureVolume{
+		ErasureVolume: &ErasureVolume{
+			DataShards:   k,
+			ParityShards: m,
+			cluster:      cluster,
+			volume:       volume,
+			logger:       ctxlog.TestLogger(c),
+			metrics:      metrics,
+		},
+	}
+	for i := 0; i < k+m; i++ {
+		dir, err := ioutil.TempDir("", "erasure_volume_test")
+		c.Assert(err, check.IsNil)
+		inner := &TestableUnixVolume{
+			UnixVolume: UnixVolume{
+				Root:    dir,
+				cluster: cluster,
+				logger:  ctxlog.TestLogger(c),
+				volume:  volume,
+				metrics: metrics,
+			},
+			t: c,
+		}
+		c.Assert(inner.check(), check.IsNil)
+		v.inner = append(v.inner, inner)
+		v.shards = append(v.shards, inner)
+	}
+	c.Assert(v.check(), check.IsNil)
+	return v
+}
+
+func (s *ErasureVolumeSuite) TestGenericVolumeTests(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics, 3, 2)
+	})
+}
+
+func (s *ErasureVolumeSuite) TestGenericVolumeTestsReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics, 3, 2)
+	})
+}
+
+func (s *ErasureVolumeSuite) TestReedSolomon(c *check.C) {
+	for _, km := range [][2]int{{1, 0}, {1, 2}, {4, 2}, {6, 3}} {
+		k, m := km[0], km[1]
+		rs, err := newReedSolomon(k, m)
+		c.Assert(err, check.IsNil)
+		orig := make([][]byte, k+m)
+		for i := range orig {
+			orig[i] = make([]byte, 100)
+			if i < k {
+				rand.Read(orig[i])
+			}
+		}
+		rs.Encode(orig)
+		// Try every combination of missing shards that
+		// leaves at least k shards.
+		for missing := 0; missing < 1<<uint(k+m); missing++ {
+			present := make([]bool, k+m)
+			shards := make([][]byte, k+m)
+			npresent := 0
+			for i := range shards {
+				shards[i] = append([]byte(nil), orig[i]...)
+				if missing&(1<<uint(i)) == 0 {
+					present[i] = true
+					npresent++
+				} else {
+					for j := range shards[i] {
+						shards[i][j] = 0xff
+					}
+				}
+			}
+			err := rs.ReconstructData(shards, present)
+			if npresent < k {
+				c.Check(err, check.NotNil)
+				continue
+			}
+			c.Assert(err, check.IsNil)
+			for i := 0; i < k; i++ {
+				c.Check(shards[i], check.DeepEquals, orig[i], check.Commentf("k=%d m=%d missing=%b shard %d", k, m, missing, i))
+			}
+		}
+	}
+	_, err := newReedSolomon(0, 2)
+	c.Check(err, check.NotNil)
+	_, err = newReedSolomon(200, 100)
+	c.Check(err, check.NotNil)
+}
+
+func (s *ErasureVolumeSuite) TestReconstruct(c *check.C) {
+	ctx := context.Background()
+	data := make([]byte, 1000001)
+	rand.Read(data)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+
+	v := s.newTestableVolume(c, testCluster(c), arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), 3, 2)
+	defer v.Teardown()
+	buf := make([]byte, BlockSize)
+	for _, trial := range []struct {
+		remove  []int
+		corrupt []int
+		ok      bool
+	}{
+		{nil, nil, true},
+		{[]int{0}, nil, true},
+		{[]int{3, 4}, nil, true},
+		{[]int{0, 2}, nil, true},
+		{[]int{1}, []int{2}, true},
+		{nil, []int{0, 1}, true},
+		{[]int{0, 1, 2}, nil, false},
+		{[]int{4}, []int{0, 1}, false},
+	} {
+		c.Logf("trial %+v", trial)
+		c.Assert(v.Put(ctx, hash, data), check.IsNil)
+		v.removeShards(c, hash, trial.remove...)
+		for _, i := range trial.corrupt {
+			fnm := v.inner[i].blockPath(hash)
+			stored, err := ioutil.ReadFile(fnm)
+			c.Assert(err, check.IsNil)
+			stored[len(stored)/2] ^= 1
+			c.Assert(ioutil.WriteFile(fnm, stored, 0644), check.IsNil)
+		}
+		n, err := v.Get(ctx, hash, buf)
+		if !trial.ok {
+			c.Check(err, check.ErrorMatches, `.*2 of 5 shards succeeded, need 3.*`)
+			c.Check(os.IsNotExist(err), check.Equals, false)
+			continue
+		}
+		c.Assert(err, check.IsNil)
+		c.Check(n, check.Equals, len(data))
+		c.Check(bytes.Equal(buf[:n], data), check.Equals, true)
+		c.Check(v.Compare(ctx, hash, data), check.IsNil)
+
+		// If any data shards were missing or corrupt, all
+		// missing and corrupt shards have been rewritten.
+		// (Parity shards are only read, and therefore only
+		// repaired, when they are needed.)
+		degraded := false
+		for _, i := range append(trial.remove, trial.corrupt...) {
+			degraded = degraded || i < 3
+		}
+		for i, inner := range v.inner {
+			if degraded {
+				stored, err := ioutil.ReadFile(inner.blockPath(hash))
+				c.Assert(err, check.IsNil)
+				_, _, err = v.checkShard(stored, i)
+				c.Check(err, check.IsNil)
+			}
+		}
+	}
+	// 4 trials needed reconstruction. The shards were repaired
+	// during Get, so Compare did not need reconstruction.
+	c.Check(v.stats.ReconstructOps, check.Equals, uint64(4))
+	c.Check(v.stats.RepairedShards, check.Equals, uint64(7))
+
+	c.Assert(v.Put(ctx, hash, data), check.IsNil)
+	v.removeShards(c, hash, 0, 1, 2, 3, 4)
+	_, err := v.Get(ctx, hash, buf)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *ErasureVolumeSuite) TestRepairCompressed(c *check.C) {
+	ctx := context.Background()
+	v := s.newTestableVolume(c, testCluster(c), arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), 2, 1)
+	defer v.Teardown()
+	cv, err := newCompressedVolume(arvados.Volume{DriverParameters: []byte(`{"Compression":"zstd"}`)}, v)
+	c.Assert(err, check.IsNil)
+
+	// The erasure-coded volume stores compressed data, which
+	// doesn't match the block hash, but degraded shards are
+	// still repaired.
+	data := bytes.Repeat([]byte("compressible "), 100000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(cv.Put(ctx, hash, data), check.IsNil)
+	v.removeShards(c, hash, 0)
+	buf := make([]byte, BlockSize)
+	n, err := cv.Get(ctx, hash, buf)
+	c.Assert(err, check.IsNil)
+	c.Check(bytes.Equal(buf[:n], data), check.Equals, true)
+	c.Check(v.stats.RepairedShards, check.Equals, uint64(1))
+	stored, err := ioutil.ReadFile(v.inner[0].blockPath(hash))
+	c.Assert(err, check.IsNil)
+	_, _, err = v.checkShard(stored, 0)
+	c.Check(err, check.IsNil)
+}
+
+func (s *ErasureVolumeSuite) TestShortBuffer(c *check.C) {
+	ctx := context.Background()
+	v := s.newTestableVolume(c, testCluster(c), arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), 3, 2)
+	defer v.Teardown()
+	data := make([]byte, 1000001)
+	rand.Read(data)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(v.Put(ctx, hash, data), check.IsNil)
+
+	// Shards are truncated to fit the scratch buffers sized for
+	// buf, but that is reported as TooLongError, not corruption.
+	for _, size := range []int{10, len(data) - 3, len(data) - 1} {
+		_, err := v.Get(ctx, hash, make([]byte, size))
+		c.Check(err, check.Equals, TooLongError)
+	}
+	n, err := v.Get(ctx, hash, make([]byte, len(data)))
+	c.Check(err, check.IsNil)
+	c.Check(n, check.Equals, len(data))
+	c.Check(v.Compare(ctx, hash, data[:10]), check.Equals, CollisionError)
+	c.Check(v.stats.ReconstructOps, check.Equals, uint64(0))
+	c.Check(bufs.BytesInUse(), check.Equals, 0)
+}
+
+func (s *ErasureVolumeSuite) TestIndex(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), 2, 1)
+	defer v.Teardown()
+	for _, trial := range []struct {
+		data   []byte
+		hash   string
+		remove []int
+	}{
+		{TestBlock, TestHash, nil},
+		{TestBlock2, TestHash2, []int{1}},
+		{TestBlock3, TestHash3, []int{0, 2}},
+	} {
+		c.Assert(v.Put(ctx, trial.hash, trial.data), check.IsNil)
+		v.removeShards(c, trial.hash, trial.remove...)
+	}
+
+	// The index reports the original block sizes, whether or
+	// not they are cached, and omits blocks that can't be
+	// reconstructed.
+	for _, fresh := range []bool{false, true} {
+		if fresh {
+			v.sizes.Purge()
+		}
+		var idx bytes.Buffer
+		c.Assert(v.IndexTo("", &idx), check.IsNil)
+		c.Check(idx.String(), check.Matches, fmt.Sprintf(`(%s\+%d \d+\n%s\+%d \d+\n|%[3]s\+%[4]d \d+\n%[1]s\+%[2]d \d+\n)`, TestHash, len(TestBlock), TestHash2, len(TestBlock2)))
+	}
+}
+
+// brokenIndexVolume is a Volume whose IndexTo always fails.
+type brokenIndexVolume struct {
+	Volume
+	calls int
+}
+
+func (v *brokenIndexVolume) IndexTo(prefix string, w io.Writer) error {
+	v.calls++
+	return errors.New("index unavailable")
+}
+
+func (s *ErasureVolumeSuite) TestIndexShardFailures(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), 2, 1)
+	defer v.Teardown()
+	c.Assert(v.Put(ctx, TestHash, TestBlock), check.IsNil)
+	c.Assert(v.Put(ctx, TestHash2, TestBlock2), check.IsNil)
+
+	// Up to ParityShards shard indexes can fail. A failed shard
+	// is not retried for each prefix.
+	broken := &brokenIndexVolume{Volume: v.inner[1]}
+	v.shards[1] = broken
+	var idx bytes.Buffer
+	c.Assert(v.IndexTo("", &idx), check.IsNil)
+	c.Check(strings.Count(idx.String(), "\n"), check.Equals, 2)
+	c.Check(broken.calls, check.Equals, 1)
+
+	idx.Reset()
+	c.Assert(v.IndexTo(TestHash[:3], &idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, TestHash, len(TestBlock)))
+
+	v.shards[2] = &brokenIndexVolume{Volume: v.inner[2]}
+	c.Check(v.IndexTo("", &idx), check.ErrorMatches, `cannot get index from 2 of 3 shards: shard 1: index unavailable; shard 2: index unavailable`)
+}
+
+func (s *ErasureVolumeSuite) TestIndexHeaderErrors(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), 2, 1)
+	defer v.Teardown()
+	c.Assert(v.Put(ctx, TestHash, TestBlock), check.IsNil)
+	c.Assert(v.Put(ctx, TestHash2, TestBlock2), check.IsNil)
+	ioerr := errors.New("I/O error")
+	for _, trial := range []struct {
+		errs  []error // error returned when reading each shard of TestHash
+		match string
+		fail  bool
+	}{
+		// If a shard header can't be read, another shard is
+		// used instead.
+		{[]error{ioerr, os.ErrNotExist, nil}, fmt.Sprintf(`(?ms).*%s\+%d .*`, TestHash, len(TestBlock)), false},
+		// A block that has vanished from all shards since
+		// they were indexed is omitted.
+		{[]error{os.ErrNotExist, os.ErrNotExist, os.ErrNotExist}, fmt.Sprintf(`%s\+%d \d+\n`, TestHash2, len(TestBlock2)), false},
+		// If no shard header can be read, indexing fails.
+		{[]error{ioerr, os.ErrNotExist, ioerr}, `error reading header of ` + TestHash + `: shard 0: I/O error; shard 2: I/O error`, true},
+	} {
+		v.sizes.Purge()
+		for i, inner := range v.inner {
+			v.shards[i] = &vanishingVolume{
+				Volume: inner,
+				gone:   map[string]bool{TestHash: trial.errs[i] != nil},
+				err:    trial.errs[i],
+			}
+		}
+		var idx bytes.Buffer
+		err := v.IndexTo("", &idx)
+		if trial.fail {
+			c.Check(err, check.ErrorMatches, trial.match)
+		} else {
+			c.Check(err, check.IsNil)
+			c.Check(idx.String(), check.Matches, trial.match)
+		}
+	}
+}
+
+func (s *ErasureVolumeSuite) TestTrashAllOrNone(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	cluster.Collections.BlobTrash = true
+	cluster.Collections.BlobTrashLifetime = arvados.Duration(time.Hour)
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), 2, 1)
+	defer v.Teardown()
+	c.Assert(v.Put(ctx, TestHash, TestBlock), check.IsNil)
+	v.TouchWithDate(TestHash, time.Now().Add(-2*cluster.Collections.BlobSigningTTL.Duration()))
+
+	// One shard can't be trashed, so the others are put back.
+	v.inner[1].volume.ReadOnly = true
+	c.Check(v.Trash(TestHash), check.ErrorMatches, `error trashing shards \(shard 1: .*\)`)
+	for _, inner := range v.inner {
+		_, err := os.Stat(inner.blockPath(TestHash))
+		c.Check(err, check.IsNil)
+	}
+	buf := make([]byte, BlockSize)
+	n, err := v.Get(ctx, TestHash, buf)
+	c.Assert(err, check.IsNil)
+	c.Check(buf[:n], check.DeepEquals, TestBlock)
+	c.Check(v.stats.ReconstructOps, check.Equals, uint64(0))
+
+	v.inner[1].volume.ReadOnly = false
+	c.Check(v.Trash(TestHash), check.IsNil)
+	_, err = v.Get(ctx, TestHash, buf)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *ErasureVolumeSuite) TestConfig(c *check.C) {
+	cluster := testCluster(c)
+	var dirs []string
+	for i := 0; i < 3; i++ {
+		dir, err := ioutil.TempDir("", "erasure_volume_test")
+		c.Assert(err, check.IsNil)
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+	cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {
+			Driver: "ErasureCoded",
+			DriverParameters: []byte(fmt.Sprintf(`{"DataShards":2,"ParityShards":1,"Shards":[
+				{"Driver":"Directory","DriverParameters":{"Root":%q}},
+				{"Driver":"Directory","DriverParameters":{"Root":%q},"Replication":2},
+				{"Driver":"Directory","DriverParameters":{"Root":%q},"Replication":3}]}`, dirs[0], dirs[1], dirs[2])),
+		},
+	}
+	vm, err := makeRRVolumeManager(ctxlog.TestLogger(c), cluster, testServiceURL, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Assert(err, check.IsNil)
+	c.Assert(vm.Mounts(), check.HasLen, 1)
+	// 1 parity shard, lowest backing volume replication 1.
+	c.Check(vm.Mounts()[0].Replication, check.Equals, 2)
+	c.Check(vm.Mounts()[0].String(), check.Equals, fmt.Sprintf("erasure-coded(2+1)[%s, %s, %s]", "[UnixVolume "+dirs[0]+"]", "[UnixVolume "+dirs[1]+"]", "[UnixVolume "+dirs[2]+"]"))
+
+	// Explicitly configured replication takes precedence.
+	cfgvol := cluster.Volumes["zzzzz-nyw5e-000000000000000"]
+	cfgvol.Replication = 5
+	cluster.Volumes["zzzzz-nyw5e-000000000000000"] = cfgvol
+	vm, err = makeRRVolumeManager(ctxlog.TestLogger(c), cluster, testServiceURL, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Assert(err, check.IsNil)
+	c.Check(vm.Mounts()[0].Replication, check.Equals, 5)
+
+	for _, trial := range []struct {
+		params string
+		err    string
+	}{
+		{`{"DataShards":2,"ParityShards":2,"Shards":[{"Driver":"Directory","DriverParameters":{"Root":"/tmp"}}]}`, `.*Shards has 1 entries, but DataShards\+ParityShards is 4`},
+		{`{"DataShards":0,"ParityShards":1,"Shards":[{"Driver":"Directory","DriverParameters":{"Root":"/tmp"}}]}`, `.*invalid erasure coding parameters.*`},
+		{`{"DataShards":1,"ParityShards":0,"Shards":[{"Driver":"Bogus"}]}`, `.*Shards\[0\]: invalid driver "Bogus"`},
+		{`{"DataShards":1,"ParityShards":0,"Shards":[{"Driver":"ErasureCoded"}]}`, `.*Shards\[0\]: nested ErasureCoded volumes are not supported`},
+		{`{"DataShards":1,"ParityShards":0,"Shards":[{"Driver":"Directory","DriverParameters":{"Root":"/tmp"},"EncryptionKey":"foo"}]}`, `.*Shards\[0\]: EncryptionKey is not supported on a backing volume.*`},
+		{`{"DataShards":1,"ParityShards":0,"Shards":[{"Driver":"Directory","DriverParameters":{"Root":"/tmp","Compression":"zstd"}}]}`, `.*Shards\[0\]: DriverParameters.Compression is not supported on a backing volume.*`},
+	} {
+		_, err := newErasureVolume(cluster, arvados.Volume{Driver: "ErasureCoded", DriverParameters: []byte(trial.params)}, ctxlog.TestLogger(c), newVolumeMetricsVecs(prometheus.NewRegistry()))
+		c.Check(err, check.ErrorMatches, trial.err)
+	}
+}
@@ -0,0 +1,595 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+)
+
+func init() {
+	driver["GCS"] = newGCSVolume
+}
+
+func newGCSVolume(cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) (Volume, error) {
+	v := &GCSVolume{
+		RequestTimeout: gcsDefaultRequestTimeout,
+		IndexPageSize:  gcsDefaultIndexPageSize,
+		cluster:        cluster,
+		volume:         volume,
+		logger:         logger,
+		metrics:        metrics,
+	}
+	err := json.Unmarshal(volume.DriverParameters, &v)
+	if err != nil {
+		return nil, err
+	}
+	if v.Bucket == "" {
+		return nil, errors.New("DriverParameters: Bucket must be provided")
+	}
+	opts := []option.ClientOption{option.WithScopes(storage.DevstorageReadWriteScope)}
+	if v.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(v.Endpoint))
+	}
+	if v.ServiceAccountKey != "" {
+		opts = append(opts, option.WithCredentialsJSON([]byte(v.ServiceAccountKey)))
+	} else if v.Endpoint != "" {
+		// Presumably an emulator.
+		opts = append(opts, option.WithoutAuthentication())
+	}
+	// Otherwise, use the default credentials provided by the
+	// GCE metadata server or GOOGLE_APPLICATION_CREDENTIALS.
+	svc, err := storage.NewService(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating GCS client: %s", err)
+	}
+	v.bucket = &gcsBucket{
+		svc:     svc,
+		name:    v.Bucket,
+		timeout: v.RequestTimeout.Duration(),
+	}
+	if err := v.bucket.Exists(); err != nil {
+		return nil, fmt.Errorf("GCS bucket %q: %s", v.Bucket, err)
+	}
+	return v, v.check()
+}
+
+func (v *GCSVolume) check() error {
+	lbls := prometheus.Labels{"device_id": v.GetDeviceID()}
+	v.bucket.stats.opsCounters, v.bucket.stats.errCounters, v.bucket.stats.ioBytes = v.metrics.getCounterVecsFor(lbls)
+	return nil
+}
+
+const (
+	gcsDefaultRequestTimeout = arvados.Duration(10 * time.Minute)
+	gcsDefaultIndexPageSize  = 1000
+)
+
+// A GCSVolume stores and retrieves blocks in a Google Cloud Storage
+// bucket, using the GCS JSON API.
+//
+// Trashed blocks are flagged with an "expires_at" metadata entry.
+// Metadata updates use generation and metageneration preconditions,
+// so a block that is rewritten or touched by another process between
+// reading its metadata and updating it is left alone.
+type GCSVolume struct {
+	Bucket            string
+	ServiceAccountKey string
+	Endpoint          string // "" means default, "https://storage.googleapis.com/storage/v1/"
+	RequestTimeout    arvados.Duration
+	IndexPageSize     int
+
+	cluster *arvados.Cluster
+	volume  arvados.Volume
+	logger  logrus.FieldLogger
+	metrics *volumeMetricsVecs
+	bucket  *gcsBucket
+}
+
+// Type implements Volume.
+func (v *GCSVolume) Type() string {
+	return "GCS"
+}
+
+// GetDeviceID returns a globally unique ID for the storage bucket.
+func (v *GCSVolume) GetDeviceID() string {
+	if v.Endpoint != "" {
+		return "gs://" + v.Endpoint + "/" + v.Bucket
+	}
+	return "gs://" + v.Bucket
+}
+
+// attrs returns the given object's metadata, or os.ErrNotExist if
+// the object does not exist or is trashed.
+func (v *GCSVolume) attrs(ctx context.Context, loc string) (*storage.Object, error) {
+	obj, err := v.bucket.Attrs(ctx, loc)
+	if err != nil {
+		return nil, v.translateError(err)
+	}
+	if obj.Metadata["expires_at"] != "" {
+		return nil, os.ErrNotExist
+	}
+	return obj, nil
+}
+
+// Get reads a Keep block that has been stored as an object in the
+// bucket.
+func (v *GCSVolume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
+	obj, err := v.attrs(ctx, loc)
+	if err != nil {
+		return 0, err
+	}
+	if obj.Size > uint64(len(buf)) {
+		return 0, fmt.Errorf("block %s invalid size %d (buffer size %d)", loc, obj.Size, len(buf))
+	}
+	rdr, err := v.bucket.Download(ctx, loc, obj.Generation)
+	if err != nil {
+		return 0, v.translateError(err)
+	}
+	defer rdr.Close()
+	n, err := io.ReadFull(rdr, buf[:obj.Size])
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, v.translateError(err)
+	}
+	return n, nil
+}
+
+// ReadPrefix implements prefixReader. It requests only the first n
+// bytes of the block.
+func (v *GCSVolume) ReadPrefix(ctx context.Context, loc string, n int) ([]byte, error) {
+	obj, err := v.attrs(ctx, loc)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Size < uint64(n) {
+		n = int(obj.Size)
+	}
+	if n <= 0 {
+		return []byte{}, nil
+	}
+	rdr, err := v.bucket.DownloadRange(ctx, loc, obj.Generation, n)
+	if err != nil {
+		return nil, v.translateError(err)
+	}
+	buf, err := readPrefixFrom(rdr, n)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, v.translateError(err)
+	}
+	return buf, nil
+}
+
+// Compare the given data with existing stored data.
+func (v *GCSVolume) Compare(ctx context.Context, loc string, expect []byte) error {
+	obj, err := v.attrs(ctx, loc)
+	if err != nil {
+		return err
+	}
+	rdr, err := v.bucket.Download(ctx, loc, obj.Generation)
+	if err != nil {
+		return v.translateError(err)
+	}
+	defer rdr.Close()
+	return v.translateError(compareReaderWithBuf(ctx, rdr, expect, loc[:32]))
+}
+
+// Put stores a Keep block as an object in the bucket.
+func (v *GCSVolume) Put(ctx context.Context, loc string, block []byte) error {
+	if v.volume.ReadOnly {
+		return MethodDisabledError
+	}
+	return v.translateError(v.bucket.Insert(ctx, loc, block))
+}
+
+// Touch updates the metadata modification time of an object.
+func (v *GCSVolume) Touch(loc string) error {
+	if v.volume.ReadOnly {
+		return MethodDisabledError
+	}
+	ctx := context.Background()
+	obj, err := v.attrs(ctx, loc)
+	if err != nil {
+		return err
+	}
+	err = v.bucket.Patch(ctx, loc, obj, map[string]string{
+		"touch": fmt.Sprintf("%d", time.Now().Unix()),
+	})
+	return v.translateError(err)
+}
+
+// Mtime returns the metadata modification time of an object.
+func (v *GCSVolume) Mtime(loc string) (time.Time, error) {
+	obj, err := v.attrs(context.Background(), loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, obj.Updated)
+}
+
+// IndexTo writes a list of Keep blocks that are stored in the
+// bucket.
+func (v *GCSVolume) IndexTo(prefix string, writer io.Writer) error {
+	return v.bucket.List(context.Background(), prefix, v.IndexPageSize, func(obj *storage.Object) error {
+		if !keepBlockRegexp.MatchString(obj.Name) || obj.Metadata["expires_at"] != "" {
+			return nil
+		}
+		t, err := time.Parse(time.RFC3339Nano, obj.Updated)
+		if err != nil {
+			return fmt.Errorf("error parsing modification time of %s: %s", obj.Name, err)
+		}
+		_, err = fmt.Fprintf(writer, "%s+%d %d\n", obj.Name, obj.Size, t.UnixNano())
+		return err
+	})
+}
+
+// Trash a Keep block.
+func (v *GCSVolume) Trash(loc string) error {
+	if v.volume.ReadOnly {
+		return MethodDisabledError
+	}
+	ctx := context.Background()
+	obj, err := v.attrs(ctx, loc)
+	if err != nil {
+		return err
+	}
+	if t, err := time.Parse(time.RFC3339Nano, obj.Updated); err != nil {
+		return err
+	} else if time.Since(t) < v.cluster.Collections.BlobSigningTTL.Duration() {
+		return nil
+	}
+
+	// If BlobTrashLifetime == 0, just delete it
+	if v.cluster.Collections.BlobTrashLifetime == 0 {
+		return v.translateError(v.bucket.Delete(ctx, loc, obj))
+	}
+
+	// Otherwise, mark as trash
+	err = v.bucket.Patch(ctx, loc, obj, map[string]string{
+		"expires_at": fmt.Sprintf("%d", time.Now().Add(v.cluster.Collections.BlobTrashLifetime.Duration()).Unix()),
+	})
+	return v.translateError(err)
+}
+
+// Untrash a Keep block.
+// Clear the expires_at metadata attribute
+func (v *GCSVolume) Untrash(loc string) error {
+	ctx := context.Background()
+	obj, err := v.bucket.Attrs(ctx, loc)
+	if err != nil {
+		return v.translateError(err)
+	}
+	if obj.Metadata["expires_at"] == "" {
+		return os.ErrNotExist
+	}
+	err = v.bucket.Patch(ctx, loc, obj, map[string]string{"expires_at": ""})
+	return v.translateError(err)
+}
+
+// Status returns a VolumeStatus struct with placeholder data.
+func (v *GCSVolume) Status() *VolumeStatus {
+	return &VolumeStatus{
+		DeviceNum: 1,
+		BytesFree: BlockSize * 1000,
+		BytesUsed: 1,
+
+		freeUnknown: true,
+	}
+}
+
+// String returns a volume label, including the bucket name.
+func (v *GCSVolume) String() string {
+	return fmt.Sprintf("gcs-bucket:%+q", v.Bucket)
+}
+
+// If possible, translate a GCS API error to a recognizable error
+// like os.ErrNotExist.
+func (v *GCSVolume) translateError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok && (urlErr.Err == context.Canceled || urlErr.Err == context.DeadlineExceeded) {
+		return urlErr.Err
+	}
+	if err, ok := err.(*googleapi.Error); ok {
+		switch err.Code {
+		case http.StatusNotFound:
+			return os.ErrNotExist
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return VolumeBusyError
+		}
+	}
+	return err
+}
+
+// EmptyTrash looks for trashed blocks that exceeded BlobTrashLifetime
+// and deletes them from the volume.
+func (v *GCSVolume) EmptyTrash() {
+	if v.cluster.Collections.BlobDeleteConcurrency < 1 {
+		return
+	}
+
+	var bytesDeleted, bytesInTrash int64
+	var blocksDeleted, blocksInTrash int64
+
+	doObject := func(obj *storage.Object) {
+		atomic.AddInt64(&blocksInTrash, 1)
+		atomic.AddInt64(&bytesInTrash, int64(obj.Size))
+
+		expiresAt, err := strconv.ParseInt(obj.Metadata["expires_at"], 10, 64)
+		if err != nil {
+			v.logger.Printf("EmptyTrash: ParseInt(%v): %v", obj.Metadata["expires_at"], err)
+			return
+		}
+
+		if expiresAt > time.Now().Unix() {
+			return
+		}
+
+		// The generation and metageneration preconditions
+		// ensure we don't delete the block if it was
+		// rewritten or untrashed since we listed it.
+		err = v.bucket.Delete(context.Background(), obj.Name, obj)
+		if err != nil {
+			v.logger.Printf("EmptyTrash: Delete(%v): %v", obj.Name, err)
+			return
+		}
+		atomic.AddInt64(&blocksDeleted, 1)
+		atomic.AddInt64(&bytesDeleted, int64(obj.Size))
+	}
+
+	var wg sync.WaitGroup
+	todo := make(chan *storage.Object, v.cluster.Collections.BlobDeleteConcurrency)
+	for i := 0; i < v.cluster.Collections.BlobDeleteConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range todo {
+				doObject(obj)
+			}
+		}()
+	}
+
+	err := v.bucket.List(context.Background(), "", v.IndexPageSize, func(obj *storage.Object) error {
+		if keepBlockRegexp.MatchString(obj.Name) && obj.Metadata["expires_at"] != "" {
+			todo <- obj
+		}
+		return nil
+	})
+	if err != nil {
+		v.logger.Printf("EmptyTrash: List: %v", err)
+	}
+	close(todo)
+	wg.Wait()
+
+	v.logger.Printf("EmptyTrash stats for %v: Deleted %v bytes in %v blocks. Remaining in trash: %v bytes in %v blocks.", v.String(), bytesDeleted, blocksDeleted, bytesInTrash-bytesDeleted, blocksInTrash-blocksDeleted)
+}
+
+// InternalStats returns bucket I/O and API call counters.
+func (v *GCSVolume) InternalStats() interface{} {
+	return &v.bucket.stats
+}
+
+type gcsBucketStats struct {
+	statsTicker
+	Ops         uint64
+	GetOps      uint64
+	DownloadOps uint64
+	InsertOps   uint64
+	PatchOps    uint64
+	DelOps      uint64
+	ListOps     uint64
+}
+
+func (s *gcsBucketStats) TickErr(err error) {
+	if err == nil {
+		return
+	}
+	errType := fmt.Sprintf("%T", err)
+	if err, ok := err.(*googleapi.Error); ok {
+		errType = errType + fmt.Sprintf(" %d", err.Code)
+	}
+	s.statsTicker.TickErr(err, errType)
+}
+
+// gcsBucket wraps storage.Service in order to count I/O and API
+// usage stats, and apply the configured request timeout.
+type gcsBucket struct {
+	svc     *storage.Service
+	name    string
+	timeout time.Duration
+	stats   gcsBucketStats
+}
+
+// withTimeout returns a child context that is cancelled after the
+// configured request timeout.
+func (b *gcsBucket) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if b.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, b.timeout)
+}
+
+func (b *gcsBucket) Exists() error {
+	b.stats.TickOps("get_bucket")
+	b.stats.Tick(&b.stats.Ops)
+	ctx, cancel := b.withTimeout(context.Background())
+	defer cancel()
+	_, err := b.svc.Buckets.Get(b.name).Context(ctx).Do()
+	b.stats.TickErr(err)
+	return err
+}
+
+func (b *gcsBucket) Attrs(ctx context.Context, name string) (*storage.Object, error) {
+	b.stats.TickOps("get")
+	b.stats.Tick(&b.stats.Ops, &b.stats.GetOps)
+	ctx, cancel := b.withTimeout(ctx)
+	defer cancel()
+	obj, err := b.svc.Objects.Get(b.name, name).Context(ctx).Do()
+	b.stats.TickErr(err)
+	return obj, err
+}
+
+// Download returns a reader for the content of the given generation
+// of an object.
+func (b *gcsBucket) Download(ctx context.Context, name string, generation int64) (io.ReadCloser, error) {
+	return b.DownloadRange(ctx, name, generation, 0)
+}
+
+// DownloadRange is like Download, but if n > 0, only the first n
+// bytes of the object are requested.
+func (b *gcsBucket) DownloadRange(ctx context.Context, name string, generation int64, n int) (io.ReadCloser, error) {
+	b.stats.TickOps("download")
+	b.stats.Tick(&b.stats.Ops, &b.stats.DownloadOps)
+	ctx, cancel := b.withTimeout(ctx)
+	call := b.svc.Objects.Get(b.name, name).IfGenerationMatch(generation).Context(ctx)
+	if n > 0 {
+		call.Header().Set("Range", fmt.Sprintf("bytes=0-%d", n-1))
+	}
+	resp, err := call.Download()
+	b.stats.TickErr(err)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &cancelOnClose{
+		ReadCloser: NewCountingReader(resp.Body, b.stats.TickInBytes),
+		cancel:     cancel,
+	}, nil
+}
+
+func (b *gcsBucket) Insert(ctx context.Context, name string, data []byte) error {
+	b.stats.TickOps("insert")
+	b.stats.Tick(&b.stats.Ops, &b.stats.InsertOps)
+	ctx, cancel := b.withTimeout(ctx)
+	defer cancel()
+	// If ctx is cancelled, Do() can return while the HTTP
+	// transport is still reading the request body. Closing the
+	// fenced reader ensures the caller's buffer isn't accessed
+	// after we return.
+	rdr := &fencedReader{r: bytes.NewReader(data)}
+	defer rdr.Close()
+	_, err := b.svc.Objects.Insert(b.name, &storage.Object{Name: name}).
+		Media(NewCountingReader(rdr, b.stats.TickOutBytes), googleapi.ChunkSize(0), googleapi.ContentType("application/octet-stream")).
+		Context(ctx).Do()
+	b.stats.TickErr(err)
+	return err
+}
+
+// Patch merges the given entries into an object's metadata, as long
+// as the object has not been changed since obj was retrieved.
+func (b *gcsBucket) Patch(ctx context.Context, name string, obj *storage.Object, metadata map[string]string) error {
+	b.stats.TickOps("patch")
+	b.stats.Tick(&b.stats.Ops, &b.stats.PatchOps)
+	ctx, cancel := b.withTimeout(ctx)
+	defer cancel()
+	_, err := b.svc.Objects.Patch(b.name, name, &storage.Object{Metadata: metadata}).
+		IfGenerationMatch(obj.Generation).
+		IfMetagenerationMatch(obj.Metageneration).
+		Context(ctx).Do()
+	b.stats.TickErr(err)
+	return err
+}
+
+// Delete deletes an object, as long as it has not been changed since
+// obj was retrieved.
+func (b *gcsBucket) Delete(ctx context.Context, name string, obj *storage.Object) error {
+	b.stats.TickOps("delete")
+	b.stats.Tick(&b.stats.Ops, &b.stats.DelOps)
+	ctx, cancel := b.withTimeout(ctx)
+	defer cancel()
+	err := b.svc.Objects.Delete(b.name, name).
+		IfGenerationMatch(obj.Generation).
+		IfMetagenerationMatch(obj.Metageneration).
+		Context(ctx).Do()
+	b.stats.TickErr(err)
+	return err
+}
+
+// List calls fn for each object whose name starts with prefix,
+// retrieving pageSize objects per API call.
+func (b *gcsBucket) List(ctx context.Context, prefix string, pageSize int, fn func(*storage.Object) error) error {
+	pageToken := ""
+	for {
+		b.stats.TickOps("list")
+		b.stats.Tick(&b.stats.Ops, &b.stats.ListOps)
+		call := b.svc.Objects.List(b.name).Prefix(prefix).PageToken(pageToken)
+		if pageSize > 0 {
+			call = call.MaxResults(int64(pageSize))
+		}
+		lctx, cancel := b.withTimeout(ctx)
+		resp, err := call.Context(lctx).Do()
+		cancel()
+		b.stats.TickErr(err)
+		if err != nil {
+			return err
+		}
+		for _, obj := range resp.Items {
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+		if resp.NextPageToken == "" {
+			return nil
+		}
+		pageToken = resp.NextPageToken
+	}
+}
+
+// cancelOnClose is an io.ReadCloser that calls cancel when it is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// fencedReader is an io.Reader that returns io.ErrClosedPipe after
+// it is closed.
+type fencedReader struct {
+	r      io.Reader
+	closed bool
+	mtx    sync.Mutex
+}
+
+func (f *fencedReader) Read(p []byte) (int, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return f.r.Read(p)
+}
+
+func (f *fencedReader) Close() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.closed = true
+	return nil
+}
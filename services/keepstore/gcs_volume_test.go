@@ -0,0 +1,414 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	check "gopkg.in/check.v1"
+)
+
+type gcsObject struct {
+	Data           []byte
+	Generation     int64
+	Metageneration int64
+	Metadata       map[string]string
+	Updated        time.Time
+}
+
+// gcsStubHandler is a minimal in-memory emulation of the parts of
+// the GCS JSON API used by GCSVolume.
+type gcsStubHandler struct {
+	sync.Mutex
+	logger     logrus.FieldLogger
+	bucket     string
+	objects    map[string]*gcsObject
+	generation int64
+	race       chan chan struct{}
+}
+
+func newGCSStubHandler(c *check.C, bucket string) *gcsStubHandler {
+	return &gcsStubHandler{
+		logger:  ctxlog.TestLogger(c),
+		bucket:  bucket,
+		objects: map[string]*gcsObject{},
+	}
+}
+
+func (h *gcsStubHandler) PutRaw(name string, data []byte) {
+	h.Lock()
+	defer h.Unlock()
+	h.put(name, data)
+}
+
+func (h *gcsStubHandler) put(name string, data []byte) {
+	h.generation++
+	h.objects[name] = &gcsObject{
+		Data:           data,
+		Generation:     h.generation,
+		Metageneration: 1,
+		Metadata:       map[string]string{},
+		Updated:        time.Now(),
+	}
+}
+
+func (h *gcsStubHandler) TouchWithDate(name string, t time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	if obj, ok := h.objects[name]; ok {
+		obj.Updated = t
+	}
+}
+
+// unlockAndRace works like azStubHandler.unlockAndRace.
+func (h *gcsStubHandler) unlockAndRace() {
+	if h.race == nil {
+		return
+	}
+	h.Unlock()
+	if c := <-h.race; c != nil {
+		c <- struct{}{}
+	}
+	h.Lock()
+}
+
+func (h *gcsStubHandler) objectJSON(name string, obj *gcsObject) map[string]interface{} {
+	return map[string]interface{}{
+		"kind":           "storage#object",
+		"bucket":         h.bucket,
+		"name":           name,
+		"size":           strconv.Itoa(len(obj.Data)),
+		"generation":     strconv.FormatInt(obj.Generation, 10),
+		"metageneration": strconv.FormatInt(obj.Metageneration, 10),
+		"metadata":       obj.Metadata,
+		"updated":        obj.Updated.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+func (h *gcsStubHandler) writeError(w http.ResponseWriter, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": http.StatusText(code),
+		},
+	})
+}
+
+func (h *gcsStubHandler) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// checkPreconditions returns false (after sending a 412 response)
+// if the request has ifGenerationMatch or ifMetagenerationMatch
+// parameters that don't match obj.
+func (h *gcsStubHandler) checkPreconditions(w http.ResponseWriter, r *http.Request, obj *gcsObject) bool {
+	if g := r.FormValue("ifGenerationMatch"); g != "" && g != strconv.FormatInt(obj.Generation, 10) {
+		h.writeError(w, http.StatusPreconditionFailed)
+		return false
+	}
+	if g := r.FormValue("ifMetagenerationMatch"); g != "" && g != strconv.FormatInt(obj.Metageneration, 10) {
+		h.writeError(w, http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+func (h *gcsStubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	h.logger.Debugf("gcsStubHandler: %s %s", r.Method, r.URL)
+
+	bucketPath := "/storage/v1/b/" + h.bucket
+	switch {
+	case r.Method == "GET" && r.URL.Path == bucketPath:
+		h.writeJSON(w, map[string]interface{}{"kind": "storage#bucket", "name": h.bucket})
+	case r.Method == "POST" && r.URL.Path == "/upload"+bucketPath+"/o":
+		h.unlockAndRace()
+		name, data, err := h.readMultipartUpload(r)
+		if err != nil {
+			h.logger.WithError(err).Error("gcsStubHandler: bad upload")
+			h.writeError(w, http.StatusBadRequest)
+			return
+		}
+		h.put(name, data)
+		h.writeJSON(w, h.objectJSON(name, h.objects[name]))
+	case r.Method == "GET" && r.URL.Path == bucketPath+"/o":
+		h.list(w, r)
+	case strings.HasPrefix(r.URL.Path, bucketPath+"/o/"):
+		name := strings.TrimPrefix(r.URL.Path, bucketPath+"/o/")
+		obj, ok := h.objects[name]
+		if !ok {
+			h.writeError(w, http.StatusNotFound)
+			return
+		}
+		if !h.checkPreconditions(w, r, obj) {
+			return
+		}
+		switch r.Method {
+		case "GET":
+			if r.FormValue("alt") == "media" {
+				h.unlockAndRace()
+				w.Header().Set("Content-Length", strconv.Itoa(len(obj.Data)))
+				w.Write(obj.Data)
+			} else {
+				h.writeJSON(w, h.objectJSON(name, obj))
+			}
+		case "PATCH":
+			var patch struct{ Metadata map[string]string }
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				h.writeError(w, http.StatusBadRequest)
+				return
+			}
+			for k, v := range patch.Metadata {
+				obj.Metadata[k] = v
+			}
+			obj.Metageneration++
+			obj.Updated = time.Now()
+			h.writeJSON(w, h.objectJSON(name, obj))
+		case "DELETE":
+			delete(h.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			h.writeError(w, http.StatusMethodNotAllowed)
+		}
+	default:
+		h.logger.Infof("gcsStubHandler: no such bucket or method: %s %s", r.Method, r.URL)
+		h.writeError(w, http.StatusNotFound)
+	}
+}
+
+func (h *gcsStubHandler) readMultipartUpload(r *http.Request) (string, []byte, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return "", nil, err
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		return "", nil, err
+	}
+	var meta struct{ Name string }
+	if err := json.NewDecoder(part).Decode(&meta); err != nil {
+		return "", nil, err
+	}
+	part, err = mr.NextPart()
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := ioutil.ReadAll(part)
+	if err != nil {
+		return "", nil, err
+	}
+	if meta.Name == "" {
+		return "", nil, fmt.Errorf("missing object name")
+	}
+	return meta.Name, data, nil
+}
+
+func (h *gcsStubHandler) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.FormValue("prefix")
+	maxResults, _ := strconv.Atoi(r.FormValue("maxResults"))
+	var names []string
+	for name := range h.objects {
+		if strings.HasPrefix(name, prefix) && name > r.FormValue("pageToken") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	resp := map[string]interface{}{"kind": "storage#objects"}
+	if maxResults > 0 && len(names) > maxResults {
+		names = names[:maxResults]
+		resp["nextPageToken"] = names[maxResults-1]
+	}
+	var items []interface{}
+	for _, name := range names {
+		items = append(items, h.objectJSON(name, h.objects[name]))
+	}
+	resp["items"] = items
+	h.writeJSON(w, resp)
+}
+
+type TestableGCSVolume struct {
+	*GCSVolume
+	handler *gcsStubHandler
+	server  *httptest.Server
+}
+
+func (s *StubbedGCSSuite) newTestableGCSVolume(c *check.C, cluster *arvados.Cluster, volume arvados.Volume, metrics *volumeMetricsVecs) *TestableGCSVolume {
+	handler := newGCSStubHandler(c, "test-bucket")
+	server := httptest.NewServer(handler)
+	volume.Driver = "GCS"
+	volume.DriverParameters = []byte(fmt.Sprintf(`{"Bucket":"test-bucket","Endpoint":%q,"IndexPageSize":3}`, server.URL+"/storage/v1/"))
+	v, err := newGCSVolume(cluster, volume, ctxlog.TestLogger(c), metrics)
+	c.Assert(err, check.IsNil)
+	return &TestableGCSVolume{
+		GCSVolume: v.(*GCSVolume),
+		handler:   handler,
+		server:    server,
+	}
+}
+
+func (v *TestableGCSVolume) PutRaw(loc string, data []byte) {
+	v.handler.PutRaw(loc, data)
+}
+
+func (v *TestableGCSVolume) TouchWithDate(loc string, t time.Time) {
+	v.handler.TouchWithDate(loc, t)
+}
+
+func (v *TestableGCSVolume) Teardown() {
+	v.server.Close()
+}
+
+func (v *TestableGCSVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return "download", "insert"
+}
+
+var _ = check.Suite(&StubbedGCSSuite{})
+
+type StubbedGCSSuite struct{}
+
+func (s *StubbedGCSSuite) TestGeneric(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableGCSVolume(c, cluster, volume, metrics)
+	})
+}
+
+func (s *StubbedGCSSuite) TestGenericReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableGCSVolume(c, cluster, volume, metrics)
+	})
+}
+
+func (s *StubbedGCSSuite) TestConfig(c *check.C) {
+	_, err := newGCSVolume(testCluster(c), arvados.Volume{DriverParameters: []byte(`{}`)}, ctxlog.TestLogger(c), newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Check(err, check.ErrorMatches, `DriverParameters: Bucket must be provided`)
+
+	server := httptest.NewServer(newGCSStubHandler(c, "test-bucket"))
+	defer server.Close()
+	_, err = newGCSVolume(testCluster(c), arvados.Volume{DriverParameters: []byte(fmt.Sprintf(`{"Bucket":"missing-bucket","Endpoint":%q}`, server.URL+"/storage/v1/"))}, ctxlog.TestLogger(c), newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Check(err, check.ErrorMatches, `GCS bucket "missing-bucket": .*404.*`)
+}
+
+// A block that is rewritten after being trashed must not be deleted
+// by a Trash or EmptyTrash that started before the rewrite.
+func (s *StubbedGCSSuite) TestPreconditions(c *check.C) {
+	cluster := testCluster(c)
+	cluster.Collections.BlobTrashLifetime = 0
+	v := s.newTestableGCSVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	defer v.Teardown()
+
+	v.PutRaw(TestHash, TestBlock)
+	obj, err := v.bucket.Attrs(context.Background(), TestHash)
+	c.Assert(err, check.IsNil)
+	v.PutRaw(TestHash, TestBlock)
+	err = v.bucket.Delete(context.Background(), TestHash, obj)
+	c.Check(err, check.ErrorMatches, `.*412.*`)
+	_, err = v.Mtime(TestHash)
+	c.Check(err, check.IsNil)
+}
+
+func (s *StubbedGCSSuite) TestContextCancelGet(c *check.C) {
+	s.testContextCancel(c, func(ctx context.Context, v *TestableGCSVolume) error {
+		v.PutRaw(TestHash, TestBlock)
+		_, err := v.Get(ctx, TestHash, make([]byte, BlockSize))
+		return err
+	})
+}
+
+func (s *StubbedGCSSuite) TestContextCancelPut(c *check.C) {
+	s.testContextCancel(c, func(ctx context.Context, v *TestableGCSVolume) error {
+		return v.Put(ctx, TestHash, make([]byte, BlockSize))
+	})
+}
+
+func (s *StubbedGCSSuite) testContextCancel(c *check.C, testFunc func(context.Context, *TestableGCSVolume) error) {
+	v := s.newTestableGCSVolume(c, testCluster(c), arvados.Volume{Replication: 3}, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	defer v.Teardown()
+	v.handler.Lock()
+	v.handler.race = make(chan chan struct{})
+	v.handler.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	allDone := make(chan struct{})
+	go func() {
+		defer close(allDone)
+		err := testFunc(ctx, v)
+		if err != context.Canceled {
+			c.Errorf("got %T %q, expected %q", err, err, context.Canceled)
+		}
+	}()
+	releaseHandler := make(chan struct{})
+	select {
+	case <-allDone:
+		c.Error("testFunc finished without waiting for v.handler.race")
+	case <-time.After(10 * time.Second):
+		c.Error("timed out waiting to enter handler")
+	case v.handler.race <- releaseHandler:
+	}
+
+	cancel()
+
+	select {
+	case <-time.After(10 * time.Second):
+		c.Error("timed out waiting to cancel")
+	case <-allDone:
+	}
+
+	go func() {
+		<-releaseHandler
+	}()
+}
+
+func (s *StubbedGCSSuite) TestStats(c *check.C) {
+	v := s.newTestableGCSVolume(c, testCluster(c), arvados.Volume{Replication: 3}, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	defer v.Teardown()
+
+	stats := func() string {
+		buf, err := json.Marshal(v.InternalStats())
+		c.Check(err, check.IsNil)
+		return string(buf)
+	}
+
+	c.Check(stats(), check.Matches, `.*"Errors":0,.*`)
+
+	loc := "acbd18db4cc2f85cedef654fccc4a4d8"
+	_, err := v.Get(context.Background(), loc, make([]byte, 3))
+	c.Check(err, check.NotNil)
+	c.Check(stats(), check.Matches, `.*"Ops":[^0],.*`)
+	c.Check(stats(), check.Matches, `.*"Errors":[^0],.*`)
+	c.Check(stats(), check.Matches, `.*"\*googleapi\.Error 404":[^0].*`)
+	c.Check(stats(), check.Matches, `.*"InBytes":0,.*`)
+
+	err = v.Put(context.Background(), loc, []byte("foo"))
+	c.Check(err, check.IsNil)
+	c.Check(stats(), check.Matches, `.*"OutBytes":3,.*`)
+	c.Check(stats(), check.Matches, `.*"InsertOps":1,.*`)
+
+	_, err = v.Get(context.Background(), loc, make([]byte, 3))
+	c.Check(err, check.IsNil)
+	_, err = v.Get(context.Background(), loc, make([]byte, 3))
+	c.Check(err, check.IsNil)
+	c.Check(stats(), check.Matches, `.*"InBytes":6,.*`)
+}
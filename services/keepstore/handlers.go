@@ -11,6 +11,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
 	"regexp"
@@ -38,36 +39,45 @@ type router struct {
 	volmgr      *RRVolumeManager
 	pullq       *WorkQueue
 	trashq      *WorkQueue
+	scrubber    *scrubber
+	writeLimit  *writeLimiter
+	tokens      *tokenCache
+	audit       *auditLogger
 }
 
 // MakeRESTRouter returns a new router that forwards all Keep requests
 // to the appropriate handlers.
-func MakeRESTRouter(ctx context.Context, cluster *arvados.Cluster, reg *prometheus.Registry, volmgr *RRVolumeManager, pullq, trashq *WorkQueue) http.Handler {
+func MakeRESTRouter(ctx context.Context, cluster *arvados.Cluster, reg *prometheus.Registry, volmgr *RRVolumeManager, pullq, trashq *WorkQueue, scrubber *scrubber, audit *auditLogger) http.Handler {
 	rtr := &router{
-		Router:  mux.NewRouter(),
-		cluster: cluster,
-		logger:  ctxlog.FromContext(ctx),
-		metrics: &nodeMetrics{reg: reg},
-		volmgr:  volmgr,
-		pullq:   pullq,
-		trashq:  trashq,
+		Router:   mux.NewRouter(),
+		cluster:  cluster,
+		logger:   ctxlog.FromContext(ctx),
+		metrics:  &nodeMetrics{reg: reg},
+		volmgr:   volmgr,
+		pullq:    pullq,
+		trashq:   trashq,
+		scrubber: scrubber,
+		audit:    audit,
 	}
+	rtr.tokens = newTokenCache(cluster, rtr.logger)
+	rtr.writeLimit = newWriteLimiter(cluster, rtr.logger, reg, rtr.tokens)
+	rtr.audit.Start(rtr.tokens)
 
 	rtr.HandleFunc(
-		`/{hash:[0-9a-f]{32}}`, rtr.handleGET).Methods("GET", "HEAD")
+		`/{hash:[0-9a-f]{32}}`, rtr.audit.Wrap(rtr.handleGET)).Methods("GET", "HEAD")
 	rtr.HandleFunc(
 		`/{hash:[0-9a-f]{32}}+{hints}`,
-		rtr.handleGET).Methods("GET", "HEAD")
+		rtr.audit.Wrap(rtr.handleGET)).Methods("GET", "HEAD")
 
-	rtr.HandleFunc(`/{hash:[0-9a-f]{32}}`, rtr.handlePUT).Methods("PUT")
-	rtr.HandleFunc(`/{hash:[0-9a-f]{32}}`, rtr.handleDELETE).Methods("DELETE")
+	rtr.HandleFunc(`/{hash:[0-9a-f]{32}}`, rtr.audit.Wrap(rtr.handlePUT)).Methods("PUT")
+	rtr.HandleFunc(`/{hash:[0-9a-f]{32}}`, rtr.audit.Wrap(rtr.handleDELETE)).Methods("DELETE")
 	// List all blocks stored here. Privileged client only.
 	rtr.HandleFunc(`/index`, rtr.handleIndex).Methods("GET", "HEAD")
 	// List blocks stored here whose hash has the given prefix.
 	// Privileged client only.
 	rtr.HandleFunc(`/index/{prefix:[0-9a-f]{0,32}}`, rtr.handleIndex).Methods("GET", "HEAD")
 	// Update timestamp on existing block. Privileged client only.
-	rtr.HandleFunc(`/{hash:[0-9a-f]{32}}`, rtr.handleTOUCH).Methods("TOUCH")
+	rtr.HandleFunc(`/{hash:[0-9a-f]{32}}`, rtr.audit.Wrap(rtr.handleTOUCH)).Methods("TOUCH")
 
 	// Internals/debugging info (runtime.MemStats)
 	rtr.HandleFunc(`/debug.json`, rtr.DebugHandler).Methods("GET", "HEAD")
@@ -75,6 +85,9 @@ func MakeRESTRouter(ctx context.Context, cluster *arvados.Cluster, reg *promethe
 	// List volumes: path, device number, bytes used/avail.
 	rtr.HandleFunc(`/status.json`, rtr.StatusHandler).Methods("GET", "HEAD")
 
+	// Per-user write rate limit status. Management token only.
+	rtr.HandleFunc(`/write-limits`, rtr.WriteLimitsHandler).Methods("GET")
+
 	// List mounts: UUID, readonly, tier, device ID, ...
 	rtr.HandleFunc(`/mounts`, rtr.MountsHandler).Methods("GET")
 	rtr.HandleFunc(`/mounts/{uuid}/blocks`, rtr.handleIndex).Methods("GET")
@@ -128,6 +141,25 @@ func (rtr *router) handleGET(resp http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	hint := sizeHint(locator)
+	if hint >= 0 && hint <= BlockSize {
+		err := GetBlockStream(ctx, rtr.volmgr, mux.Vars(req)["hash"], hint, resp)
+		if err != errSizeHintMismatch {
+			if err != nil {
+				code := http.StatusInternalServerError
+				if err, ok := err.(*KeepError); ok {
+					code = err.HTTPCode
+				}
+				http.Error(resp, err.Error(), code)
+			}
+			return
+		}
+		// The stored block is not the size indicated by the
+		// locator. Read it into a full-size buffer to find
+		// out whether the locator or the stored data is
+		// wrong.
+	}
+
 	// TODO: Probe volumes to check whether the block _might_
 	// exist. Some volumes/types could support a quick existence
 	// check without causing other operations to suffer. If all
@@ -141,6 +173,7 @@ func (rtr *router) handleGET(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 	defer bufs.Put(buf)
+	ctx = withBuffer(ctx)
 
 	size, err := GetBlock(ctx, rtr.volmgr, mux.Vars(req)["hash"], buf, resp)
 	if err != nil {
@@ -151,6 +184,10 @@ func (rtr *router) handleGET(resp http.ResponseWriter, req *http.Request) {
 		http.Error(resp, err.Error(), code)
 		return
 	}
+	if hint >= 0 && size != hint {
+		http.Error(resp, SizeHintError.Error(), SizeHintError.HTTPCode)
+		return
+	}
 
 	resp.Header().Set("Content-Length", strconv.Itoa(size))
 	resp.Header().Set("Content-Type", "application/octet-stream")
@@ -246,22 +283,96 @@ func (rtr *router) handlePUT(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	buf, err := getBufferWithContext(ctx, bufs, int(req.ContentLength))
-	if err != nil {
-		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+	pr := newPutProgress(parseStorageClasses(req.Header.Get("X-Keep-Storage-Classes")), rtr.volmgr.AllWritable())
+	if pr.Impossible() {
+		http.Error(resp, fmt.Sprintf("%s: %s", StorageClassError.Error(), strings.Join(pr.Unavailable(), ", ")), StorageClassError.HTTPCode)
 		return
 	}
 
-	_, err = io.ReadFull(req.Body, buf)
-	if err != nil {
-		http.Error(resp, err.Error(), 500)
-		bufs.Put(buf)
+	if wait := rtr.writeLimit.Check(ctx, GetAPIToken(req), req.ContentLength); wait > 0 {
+		resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(resp, RateLimitError.Error(), RateLimitError.HTTPCode)
 		return
 	}
 
-	replication, err := PutBlock(ctx, rtr.volmgr, buf, hash)
-	bufs.Put(buf)
+	// If the block isn't already stored here, and the volume we
+	// would write it to can accept a stream, write it without
+	// buffering. Otherwise (or if the volume rejects the block
+	// without reading it) read the whole block into a buffer
+	// first, so we can compare it with existing data, and retry
+	// on other volumes if needed.
+	// If storage classes were requested, only a volume that
+	// satisfies all of them by itself is considered for
+	// streaming.
+	//
+	// While streaming, a copy of the data is kept if a buffer is
+	// available without waiting, so the block can still be
+	// written elsewhere if the volume fails partway through.
+	var mnt *VolumeMount
+	var err error
+	var streamed bool
+	var buf []byte
+	var prefilled int // bytes of buf already read from req.Body
+	defer func() {
+		if buf != nil {
+			bufs.Put(buf)
+		}
+	}()
+	if !blockExists(rtr.volmgr, hash) {
+		mnt = nextWritableFor(rtr.volmgr, pr)
+	}
+	if mnt != nil {
+		if bw := streamingWriter(mnt.Volume); bw != nil {
+			var body io.Reader = req.Body
+			var spare *fixedBuffer
+			if buf = bufs.TryGet(int(req.ContentLength)); buf != nil {
+				spare = &fixedBuffer{buf: buf}
+				body = io.TeeReader(req.Body, spare)
+				ctx = withBuffer(ctx)
+			}
+			var consumed bool
+			_, consumed, err = PutBlockStream(ctx, rtr.volmgr, mnt, bw, hash, body, req.ContentLength)
+			switch {
+			case err == nil:
+				pr.Add(mnt)
+				streamed = true
+			case !consumed:
+			case err == RequestHashError || err == ErrClientDisconnect:
+				streamed = true
+			case spare == nil:
+				streamed = true
+				err = GenericError
+			default:
+				ctxlog.FromContext(ctx).Printf("%s: retrying on other volumes after streaming write failed", hash)
+				prefilled = spare.n
+			}
+			mnt = nil
+		}
+	}
+	if !streamed {
+		if buf == nil {
+			buf, err = getBufferWithContext(ctx, bufs, int(req.ContentLength))
+			if err != nil {
+				http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			ctx = withBuffer(ctx)
+		}
+
+		_, err = io.ReadFull(req.Body, buf[prefilled:])
+		if err != nil {
+			http.Error(resp, err.Error(), 500)
+			return
+		}
 
+		err = putBlock(ctx, rtr.volmgr, buf, hash, mnt, pr)
+	}
+
+	// Report the storage classes that were satisfied, even if
+	// the request failed to satisfy all of them.
+	if classes := pr.ClassReplication(); classes != "" {
+		resp.Header().Set("X-Keep-Storage-Classes-Confirmed", classes)
+	}
 	if err != nil {
 		code := http.StatusInternalServerError
 		if err, ok := err.(*KeepError); ok {
@@ -279,7 +390,7 @@ func (rtr *router) handlePUT(resp http.ResponseWriter, req *http.Request) {
 		expiry := time.Now().Add(rtr.cluster.Collections.BlobSigningTTL.Duration())
 		returnHash = SignLocator(rtr.cluster, returnHash, apiToken, expiry)
 	}
-	resp.Header().Set("X-Keep-Replicas-Stored", strconv.Itoa(replication))
+	resp.Header().Set("X-Keep-Replicas-Stored", strconv.Itoa(pr.totalReplication))
 	resp.Write([]byte(returnHash + "\n"))
 }
 
@@ -341,6 +452,7 @@ type PoolStatus struct {
 	Alloc uint64 `json:"BytesAllocatedCumulative"`
 	Cap   int    `json:"BuffersMax"`
 	Len   int    `json:"BuffersInUse"`
+	Bytes int    `json:"BytesInUse"`
 }
 
 type volumeStatusEnt struct {
@@ -348,6 +460,7 @@ type volumeStatusEnt struct {
 	Status        *VolumeStatus `json:",omitempty"`
 	VolumeStats   *ioStats      `json:",omitempty"`
 	InternalStats interface{}   `json:",omitempty"`
+	Scrub         *ScrubStatus  `json:",omitempty"`
 }
 
 // NodeStatus struct
@@ -358,6 +471,7 @@ type NodeStatus struct {
 	TrashQueue      WorkQueueStatus
 	RequestsCurrent int
 	RequestsMax     int
+	WriteLimits     *WriteLimitStatus `json:",omitempty"`
 	Version         string
 }
 
@@ -409,14 +523,42 @@ func (rtr *router) readNodeStatus(st *NodeStatus) {
 			Label:         vol.String(),
 			Status:        vol.Status(),
 			InternalStats: internalStats,
+			Scrub:         rtr.scrubber.Status(vol.UUID),
 			//VolumeStats: rtr.volmgr.VolumeStats(vol),
 		})
 	}
 	st.BufferPool.Alloc = bufs.Alloc()
 	st.BufferPool.Cap = bufs.Cap()
 	st.BufferPool.Len = bufs.Len()
+	st.BufferPool.Bytes = bufs.BytesInUse()
 	st.PullQueue = getWorkQueueStatus(rtr.pullq)
 	st.TrashQueue = getWorkQueueStatus(rtr.trashq)
+	st.WriteLimits = rtr.writeLimit.Status(false)
+}
+
+// WriteLimitsHandler addresses /write-limits requests.
+func (rtr *router) WriteLimitsHandler(resp http.ResponseWriter, req *http.Request) {
+	if rtr.cluster.ManagementToken == "" {
+		http.Error(resp, "disabled", http.StatusNotFound)
+		return
+	} else if ah := req.Header.Get("Authorization"); ah == "" {
+		http.Error(resp, "authorization required", http.StatusUnauthorized)
+		return
+	} else if ah != "Bearer "+rtr.cluster.ManagementToken {
+		http.Error(resp, "authorization error", http.StatusForbidden)
+		return
+	}
+	st := rtr.writeLimit.Status(true)
+	if st == nil {
+		http.Error(resp, "write limits are not enabled", http.StatusNotFound)
+		return
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Write(data)
 }
 
 // return a WorkQueueStatus for the given queue. If q is nil (which
@@ -752,52 +894,83 @@ func GetBlock(ctx context.Context, volmgr *RRVolumeManager, hash string, buf []b
 //          provide as much detail as possible.
 //
 func PutBlock(ctx context.Context, volmgr *RRVolumeManager, block []byte, hash string) (int, error) {
+	pr := newPutProgress(nil, volmgr.AllWritable())
+	err := putBlock(ctx, volmgr, block, hash, nil, pr)
+	return pr.totalReplication, err
+}
+
+// putBlock is like PutBlock, but only writes to volumes that are
+// useful to the given putProgress, and records its progress there.
+// If the block needs to be written, the given mount (if useful) is
+// tried first, instead of the one returned by volmgr.NextWritable().
+func putBlock(ctx context.Context, volmgr *RRVolumeManager, block []byte, hash string, mnt *VolumeMount, pr *putProgress) error {
 	log := ctxlog.FromContext(ctx)
 
 	// Check that BLOCK's checksum matches HASH.
 	blockhash := fmt.Sprintf("%x", md5.Sum(block))
 	if blockhash != hash {
 		log.Printf("%s: MD5 checksum %s did not match request", hash, blockhash)
-		return 0, RequestHashError
+		return RequestHashError
 	}
 
 	// If we already have this data, it's intact on disk, and we
 	// can update its timestamp, return success. If we have
 	// different data with the same hash, return failure.
-	if n, err := CompareAndTouch(ctx, volmgr, hash, block); err == nil || err == CollisionError {
-		return n, err
+	if err := compareAndTouch(ctx, volmgr, hash, block, pr); err == CollisionError {
+		return err
 	} else if ctx.Err() != nil {
-		return 0, ErrClientDisconnect
+		return ErrClientDisconnect
+	} else if pr.Satisfied() {
+		return nil
 	}
 
 	// Choose a Keep volume to write to.
 	// If this volume fails, try all of the volumes in order.
-	if mnt := volmgr.NextWritable(); mnt != nil {
-		if err := mnt.Put(ctx, hash, block); err != nil {
+	if !pr.Useful(mnt) {
+		mnt = volmgr.NextWritable()
+	}
+	if pr.Useful(mnt) {
+		t0 := time.Now()
+		err := mnt.Put(ctx, hash, block)
+		if ctx.Err() == nil {
+			volmgr.WriteFinished(mnt, len(block), time.Since(t0), err)
+		}
+		if err != nil {
 			log.WithError(err).Errorf("%s: Put(%s) failed", mnt.Volume, hash)
 		} else {
-			return mnt.Replication, nil // success!
+			pr.Add(mnt)
+			if pr.Satisfied() {
+				return nil // success!
+			}
 		}
 	}
 	if ctx.Err() != nil {
-		return 0, ErrClientDisconnect
+		return ErrClientDisconnect
 	}
 
 	writables := volmgr.AllWritable()
 	if len(writables) == 0 {
 		log.Error("no writable volumes")
-		return 0, FullError
+		return FullError
 	}
 
 	allFull := true
 	for _, vol := range writables {
+		if !pr.Useful(vol) {
+			continue
+		}
+		t0 := time.Now()
 		err := vol.Put(ctx, hash, block)
 		if ctx.Err() != nil {
-			return 0, ErrClientDisconnect
+			return ErrClientDisconnect
 		}
+		volmgr.WriteFinished(vol, len(block), time.Since(t0), err)
 		switch err {
 		case nil:
-			return vol.Replication, nil // success!
+			pr.Add(vol)
+			if pr.Satisfied() {
+				return nil // success!
+			}
 		case FullError:
 			continue
 		default:
@@ -811,10 +984,10 @@ func PutBlock(ctx context.Context, volmgr *RRVolumeManager, block []byte, hash s
 
 	if allFull {
 		log.Error("all volumes are full")
-		return 0, FullError
+		return FullError
 	}
 	// Already logged the non-full errors.
-	return 0, GenericError
+	return GenericError
 }
 
 // CompareAndTouch returns the current replication level if one of the
@@ -823,12 +996,30 @@ func PutBlock(ctx context.Context, volmgr *RRVolumeManager, block []byte, hash s
 // premature garbage collection. Otherwise, it returns a non-nil
 // error.
 func CompareAndTouch(ctx context.Context, volmgr *RRVolumeManager, hash string, buf []byte) (int, error) {
+	pr := newPutProgress(nil, volmgr.AllWritable())
+	err := compareAndTouch(ctx, volmgr, hash, buf, pr)
+	if err == nil && !pr.Satisfied() {
+		err = NotFoundError
+	}
+	return pr.totalReplication, err
+}
+
+// compareAndTouch updates the modification time of existing copies
+// of the given content on volumes that are useful to the given
+// putProgress, and records them there, until the putProgress is
+// satisfied. It returns CollisionError if a volume has different
+// data with the same hash, or the context's error if the context is
+// done. Otherwise it returns the last error from Touch, if any.
+func compareAndTouch(ctx context.Context, volmgr *RRVolumeManager, hash string, buf []byte, pr *putProgress) error {
 	log := ctxlog.FromContext(ctx)
-	var bestErr error = NotFoundError
+	var bestErr error
 	for _, mnt := range volmgr.AllWritable() {
-		err := mnt.Compare(ctx, hash, buf)
+		if !pr.Useful(mnt) {
+			continue
+		}
+		err := mnt.Compare(withInternalRead(ctx), hash, buf)
 		if ctx.Err() != nil {
-			return 0, ctx.Err()
+			return ctx.Err()
 		} else if err == CollisionError {
 			// Stop if we have a block with same hash but
 			// different content. (It will be impossible
@@ -836,7 +1027,7 @@ func CompareAndTouch(ctx context.Context, volmgr *RRVolumeManager, hash string,
 			// both, so there's no point writing it even
 			// on a different volume.)
 			log.Error("collision in Compare(%s) on volume %s", hash, mnt.Volume)
-			return 0, err
+			return err
 		} else if os.IsNotExist(err) {
 			// Block does not exist. This is the only
 			// "normal" error: we don't log anything.
@@ -853,10 +1044,13 @@ func CompareAndTouch(ctx context.Context, volmgr *RRVolumeManager, hash string,
 			bestErr = err
 			continue
 		}
-		// Compare and Touch both worked --> done.
-		return mnt.Replication, nil
+		// Compare and Touch both worked.
+		pr.Add(mnt)
+		if pr.Satisfied() {
+			return nil
+		}
 	}
-	return 0, bestErr
+	return bestErr
 }
 
 var validLocatorRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
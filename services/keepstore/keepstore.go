@@ -11,6 +11,13 @@ import (
 // BlockSize for a Keep "block" is 64MB.
 const BlockSize = 64 * 1024 * 1024
 
+// maxStoredBlockSize is the largest block a volume driver is asked
+// to store. It exceeds BlockSize because compressedVolume adds a
+// header to each block, encryptedVolume adds a header and
+// authentication tag, and ErasureVolume adds a header to each shard
+// (with DataShards=1, a shard is as big as the block).
+const maxStoredBlockSize = BlockSize + compressedHeaderSize + encryptedOverhead + erasureHeaderSize
+
 // MinFreeKilobytes is the amount of space a Keep volume must have available
 // in order to permit writes.
 const MinFreeKilobytes = BlockSize / 1024
@@ -41,6 +48,10 @@ var (
 	MethodDisabledError = &KeepError{405, "Method disabled"}
 	ErrNotImplemented   = &KeepError{500, "Unsupported configuration"}
 	ErrClientDisconnect = &KeepError{503, "Client disconnected"}
+	RateLimitError      = &KeepError{429, "Write rate limit exceeded"}
+	StorageClassError   = &KeepError{422, "Requested storage classes not available"}
+	SizeHintError       = &KeepError{422, "Block size does not match locator"}
+	UnknownKeyError     = &KeepError{500, "Block is encrypted with an unknown key"}
 )
 
 func (e *KeepError) Error() string {
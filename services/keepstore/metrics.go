@@ -42,6 +42,15 @@ func (m *nodeMetrics) setupBufferPoolMetrics(b *bufferPool) {
 		},
 		func() float64 { return float64(b.Len()) },
 	))
+	m.reg.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "bufferpool_inuse_bytes",
+			Help:      "Total size of buffers in use",
+		},
+		func() float64 { return float64(b.BytesInUse()) },
+	))
 }
 
 func (m *nodeMetrics) setupWorkQueueMetrics(q *WorkQueue, qName string) {
@@ -69,6 +78,9 @@ type volumeMetricsVecs struct {
 	ioBytes     *prometheus.CounterVec
 	errCounters *prometheus.CounterVec
 	opsCounters *prometheus.CounterVec
+
+	tierMigrations     *prometheus.CounterVec
+	tierMigrationBytes *prometheus.CounterVec
 }
 
 func newVolumeMetricsVecs(reg *prometheus.Registry) *volumeMetricsVecs {
@@ -103,6 +115,26 @@ func newVolumeMetricsVecs(reg *prometheus.Registry) *volumeMetricsVecs {
 		[]string{"device_id", "direction"},
 	)
 	reg.MustRegister(m.ioBytes)
+	m.tierMigrations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "tier_migrations",
+			Help:      "Number of blocks moved between tiers of a tiered volume",
+		},
+		[]string{"device_id", "direction"},
+	)
+	reg.MustRegister(m.tierMigrations)
+	m.tierMigrationBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "tier_migration_bytes",
+			Help:      "Number of bytes moved between tiers of a tiered volume",
+		},
+		[]string{"device_id", "direction"},
+	)
+	reg.MustRegister(m.tierMigrationBytes)
 
 	return m
 }
@@ -113,3 +145,9 @@ func (vm *volumeMetricsVecs) getCounterVecsFor(lbls prometheus.Labels) (opsCV, e
 	ioCV = vm.ioBytes.MustCurryWith(lbls)
 	return
 }
+
+func (vm *volumeMetricsVecs) getTierCounterVecsFor(lbls prometheus.Labels) (migrationsCV, bytesCV *prometheus.CounterVec) {
+	migrationsCV = vm.tierMigrations.MustCurryWith(lbls)
+	bytesCV = vm.tierMigrationBytes.MustCurryWith(lbls)
+	return
+}
@@ -91,3 +91,108 @@ func putWithPipe(ctx context.Context, loc string, buf []byte, bw BlockWriter) er
 		return err
 	}
 }
+
+type holdsBufferKey struct{}
+
+// withBuffer returns a context indicating that the caller holds a
+// buffer from the shared bufferPool while it uses ctx.
+func withBuffer(ctx context.Context) context.Context {
+	return context.WithValue(ctx, holdsBufferKey{}, true)
+}
+
+// getScratch returns a scratch buffer of the given size (or
+// maxStoredBlockSize, if that is smaller) from the shared
+// bufferPool, e.g., to hold the stored form of a block while a
+// volume wrapper encrypts or compresses it. The caller must return
+// it with bufs.Put.
+//
+// If ctx indicates that the caller already holds a buffer from the
+// pool (because it was returned by withBuffer, or by getScratch
+// itself), the buffer is allocated right away, even if that exceeds
+// the pool's limit: if every caller that holds a buffer waited for
+// another one, they could all wait forever. The excess is bounded by
+// the scratch space needed by the requests that were admitted within
+// the limit. Otherwise, getScratch waits until the buffer fits
+// within the limit, or ctx is done.
+//
+// The returned context indicates that the caller holds a buffer, and
+// should be passed to nested volume calls.
+func getScratch(ctx context.Context, size int) ([]byte, context.Context, error) {
+	if size > maxStoredBlockSize {
+		size = maxStoredBlockSize
+	}
+	if ctx.Value(holdsBufferKey{}) != nil {
+		return bufs.GetNow(size), ctx, nil
+	}
+	buf, err := getBufferWithContext(ctx, bufs, size)
+	if err != nil {
+		return nil, ctx, err
+	}
+	return buf, withBuffer(ctx), nil
+}
+
+// A prefixReader is a volume that can read the beginning of a block
+// without reading the whole block, even though it does not
+// implement BlockReader.
+type prefixReader interface {
+	ReadPrefix(ctx context.Context, loc string, n int) ([]byte, error)
+}
+
+// readBlockPrefix returns the first n bytes of the given block, or
+// the whole block if it is shorter than n bytes. If vol is a
+// prefixReader (like the S3, Azure, and GCS volumes) or a
+// BlockReader, only the beginning of the block is transferred;
+// otherwise the whole block is read into a scratch buffer.
+func readBlockPrefix(ctx context.Context, vol Volume, loc string, n int) ([]byte, error) {
+	if pr, ok := vol.(prefixReader); ok {
+		return pr.ReadPrefix(ctx, loc, n)
+	}
+	if br, ok := vol.(BlockReader); ok {
+		fb := &fixedBuffer{buf: make([]byte, n)}
+		err := br.ReadBlock(ctx, loc, fb)
+		if err != nil && err != io.ErrShortWrite {
+			return nil, err
+		}
+		return fb.buf[:fb.n], nil
+	}
+	buf, ctx, err := getScratch(ctx, maxStoredBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	defer bufs.Put(buf)
+	size, err := vol.Get(withInternalRead(ctx), loc, buf)
+	if err != nil {
+		return nil, err
+	}
+	if size > n {
+		size = n
+	}
+	return append([]byte(nil), buf[:size]...), nil
+}
+
+// readPrefixFrom reads up to n bytes from rdr, then closes it.
+func readPrefixFrom(rdr io.ReadCloser, n int) ([]byte, error) {
+	defer rdr.Close()
+	buf := make([]byte, n)
+	n, err := io.ReadFull(rdr, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// fixedBuffer is an io.Writer that fills a fixed-size buffer, and
+// returns io.ErrShortWrite when it is full.
+type fixedBuffer struct {
+	buf []byte
+	n   int
+}
+
+func (fb *fixedBuffer) Write(p []byte) (int, error) {
+	n := copy(fb.buf[fb.n:], p)
+	fb.n += n
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
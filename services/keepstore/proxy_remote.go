@@ -43,6 +43,7 @@ func (rp *remoteProxy) Get(ctx context.Context, w http.ResponseWriter, r *http.R
 			return
 		}
 		defer bufs.Put(buf)
+		ctx = withBuffer(ctx)
 		rrc := &remoteResponseCacher{
 			Locator:        r.URL.Path[1:],
 			Token:          token,
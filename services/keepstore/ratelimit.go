@@ -0,0 +1,236 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Number of users whose state is remembered by a writeLimiter. When
+// the limit is reached, the least recently used entries are
+// forgotten (which means a forgotten user's limits are reset).
+const writeLimiterCacheSize = 10000
+
+// A writeLimiter enforces per-user limits on the rate of PUT
+// requests (API.MaxKeepWriteRequestRate) and the rate of data
+// written (API.MaxKeepWriteBandwidth).
+type writeLimiter struct {
+	cluster *arvados.Cluster
+	logger  logrus.FieldLogger
+
+	tokens   *tokenCache
+	buckets  *lru.Cache // user key => *writeLimiterBuckets
+	rejected *prometheus.CounterVec
+	total    uint64 // total requests rejected
+	mtx      sync.Mutex
+}
+
+type writeLimiterBuckets struct {
+	requests tokenBucket
+	bytes    tokenBucket
+	rejected uint64
+}
+
+// WriteLimitStatus describes the state of the write limiter, as
+// reported in /status.json. Users is only populated in the
+// /write-limits report, which requires the management token.
+type WriteLimitStatus struct {
+	RequestRate  float64
+	Bandwidth    int64
+	Rejected     uint64
+	TrackedUsers int
+	Users        map[string]WriteLimitUserStatus `json:",omitempty"`
+}
+
+// WriteLimitUserStatus describes the remaining allowance of a single
+// user. A negative Bytes value means the user has recently written
+// more than their allowance, and will be limited until the deficit
+// is paid off.
+type WriteLimitUserStatus struct {
+	Requests float64
+	Bytes    float64
+	Rejected uint64
+}
+
+func newWriteLimiter(cluster *arvados.Cluster, logger logrus.FieldLogger, reg *prometheus.Registry, tokens *tokenCache) *writeLimiter {
+	wl := &writeLimiter{
+		cluster: cluster,
+		logger:  logger,
+		tokens:  tokens,
+	}
+	wl.buckets, _ = lru.New(writeLimiterCacheSize)
+	wl.rejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "keepstore",
+		Name:      "write_limit_rejected_requests",
+		Help:      "Number of PUT requests rejected because the user exceeded a rate limit",
+	}, []string{"limit"})
+	if reg != nil {
+		reg.MustRegister(wl.rejected)
+	}
+	return wl
+}
+
+// Enabled returns true if any limits are configured.
+func (wl *writeLimiter) Enabled() bool {
+	return wl.cluster.API.MaxKeepWriteRequestRate > 0 || wl.cluster.API.MaxKeepWriteBandwidth > 0
+}
+
+// Check returns zero if the user that owns the given token is
+// allowed to write a block of the given size right now, and charges
+// the request against the user's limits. Otherwise, it returns the
+// time the client should wait before retrying.
+func (wl *writeLimiter) Check(ctx context.Context, token string, size int64) time.Duration {
+	if !wl.Enabled() || token == wl.cluster.SystemRootToken {
+		return 0
+	}
+	key := wl.userKey(ctx, token)
+
+	wl.mtx.Lock()
+	defer wl.mtx.Unlock()
+	now := time.Now()
+	burst := wl.cluster.API.KeepWriteRateLimitBurst.Duration().Seconds()
+	if burst <= 0 {
+		burst = 1
+	}
+	var b *writeLimiterBuckets
+	if ent, ok := wl.buckets.Get(key); ok {
+		b = ent.(*writeLimiterBuckets)
+	} else {
+		b = &writeLimiterBuckets{}
+		wl.buckets.Add(key, b)
+	}
+	b.requests.configure(wl.cluster.API.MaxKeepWriteRequestRate, burst, now)
+	b.bytes.configure(float64(wl.cluster.API.MaxKeepWriteBandwidth), burst, now)
+
+	var wait time.Duration
+	var limit string
+	if w := b.requests.wait(1, now); w > wait {
+		wait, limit = w, "requests"
+	}
+	if w := b.bytes.wait(float64(size), now); w > wait {
+		wait, limit = w, "bandwidth"
+	}
+	if wait > 0 {
+		b.rejected++
+		wl.total++
+		wl.rejected.WithLabelValues(limit).Inc()
+		wl.logger.WithFields(logrus.Fields{
+			"user":  key,
+			"limit": limit,
+			"wait":  wait,
+		}).Info("write rate limit exceeded")
+		return wait
+	}
+	b.requests.take(1)
+	b.bytes.take(float64(size))
+	return 0
+}
+
+// userKey returns the key used to track the limits for the given
+// token: the UUID of the user that owns it, if it can be looked up,
+// otherwise a digest of the token itself.
+func (wl *writeLimiter) userKey(ctx context.Context, token string) string {
+	if token == "" {
+		return "anonymous"
+	}
+	if ti := wl.tokens.Get(ctx, token); ti.UserUUID != "" {
+		return ti.UserUUID
+	}
+	return tokenDigest(token)
+}
+
+// Status returns the current state of the limiter. The remaining
+// allowance of each user is only included if withUsers is true.
+func (wl *writeLimiter) Status(withUsers bool) *WriteLimitStatus {
+	if !wl.Enabled() {
+		return nil
+	}
+	wl.mtx.Lock()
+	defer wl.mtx.Unlock()
+	now := time.Now()
+	st := &WriteLimitStatus{
+		RequestRate:  wl.cluster.API.MaxKeepWriteRequestRate,
+		Bandwidth:    int64(wl.cluster.API.MaxKeepWriteBandwidth),
+		Rejected:     wl.total,
+		TrackedUsers: wl.buckets.Len(),
+	}
+	if !withUsers {
+		return st
+	}
+	st.Users = map[string]WriteLimitUserStatus{}
+	for _, key := range wl.buckets.Keys() {
+		ent, ok := wl.buckets.Peek(key)
+		if !ok {
+			continue
+		}
+		b := ent.(*writeLimiterBuckets)
+		b.requests.refill(now)
+		b.bytes.refill(now)
+		st.Users[key.(string)] = WriteLimitUserStatus{
+			Requests: b.requests.level,
+			Bytes:    b.bytes.level,
+			Rejected: b.rejected,
+		}
+	}
+	return st
+}
+
+// A tokenBucket accumulates allowance at a given rate, up to a
+// maximum of burst seconds' worth. A rate of zero means unlimited.
+//
+// A request larger than the maximum allowance is accepted when the
+// bucket is full, leaving the bucket with a deficit that must be
+// paid off before the next request is accepted.
+type tokenBucket struct {
+	rate  float64
+	max   float64
+	level float64
+	last  time.Time
+}
+
+// configure updates the bucket's rate and size (in case the
+// configuration has changed), and fills it if it is new.
+func (tb *tokenBucket) configure(rate, burst float64, now time.Time) {
+	if tb.last.IsZero() {
+		tb.level = rate * burst
+		tb.last = now
+	}
+	tb.rate = rate
+	tb.max = rate * burst
+	tb.refill(now)
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.level = math.Min(tb.max, tb.level+tb.rate*now.Sub(tb.last).Seconds())
+	tb.last = now
+}
+
+// wait returns how long it will be until n can be taken from the
+// bucket, or zero if n can be taken now.
+func (tb *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	if tb.rate <= 0 {
+		return 0
+	}
+	need := math.Min(n, tb.max)
+	if tb.level >= need {
+		return 0
+	}
+	return time.Duration((need - tb.level) / tb.rate * float64(time.Second))
+}
+
+func (tb *tokenBucket) take(n float64) {
+	if tb.rate > 0 {
+		tb.level -= n
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&WriteLimiterSuite{})
+
+type WriteLimiterSuite struct {
+	cluster *arvados.Cluster
+}
+
+func (s *WriteLimiterSuite) SetUpTest(c *check.C) {
+	s.cluster = testCluster(c)
+	s.cluster.SystemRootToken = "systemroottoken"
+	s.cluster.API.KeepWriteRateLimitBurst = arvados.Duration(time.Second)
+}
+
+func (s *WriteLimiterSuite) newLimiter(c *check.C) *writeLimiter {
+	tokens := newTokenCache(s.cluster, ctxlog.TestLogger(c))
+	tokens.lookup = func(ctx context.Context, token string) (*arvados.APIClientAuthorization, error) {
+		switch token {
+		case "tokenA1", "tokenA2":
+			return &arvados.APIClientAuthorization{UUID: "zzzzz-gj3su-" + token + "aaaaaaaa", OwnerUUID: "zzzzz-tpzed-aaaaaaaaaaaaaaa"}, nil
+		case "tokenB":
+			return &arvados.APIClientAuthorization{UUID: "zzzzz-gj3su-bbbbbbbbbbbbbbb", OwnerUUID: "zzzzz-tpzed-bbbbbbbbbbbbbbb"}, nil
+		default:
+			return nil, errors.New("401 Unauthorized")
+		}
+	}
+	return newWriteLimiter(s.cluster, ctxlog.TestLogger(c), prometheus.NewRegistry(), tokens)
+}
+
+func (s *WriteLimiterSuite) TestDisabled(c *check.C) {
+	wl := s.newLimiter(c)
+	wl.tokens.lookup = func(context.Context, string) (*arvados.APIClientAuthorization, error) {
+		c.Error("unexpected token lookup")
+		return nil, nil
+	}
+	for i := 0; i < 100; i++ {
+		c.Check(wl.Check(context.Background(), "tokenA1", BlockSize), check.Equals, time.Duration(0))
+	}
+	c.Check(wl.Status(true), check.IsNil)
+}
+
+func (s *WriteLimiterSuite) TestRequestRate(c *check.C) {
+	s.cluster.API.MaxKeepWriteRequestRate = 2
+	wl := s.newLimiter(c)
+	ctx := context.Background()
+
+	// Tokens belonging to the same user share a limit.
+	c.Check(wl.Check(ctx, "tokenA1", 1), check.Equals, time.Duration(0))
+	c.Check(wl.Check(ctx, "tokenA2", 1), check.Equals, time.Duration(0))
+	wait := wl.Check(ctx, "tokenA1", 1)
+	c.Check(wait > 0, check.Equals, true)
+	c.Check(wait <= 500*time.Millisecond, check.Equals, true)
+
+	// Other users are unaffected, and so is the system root
+	// token.
+	c.Check(wl.Check(ctx, "tokenB", 1), check.Equals, time.Duration(0))
+	for i := 0; i < 10; i++ {
+		c.Check(wl.Check(ctx, s.cluster.SystemRootToken, 1), check.Equals, time.Duration(0))
+	}
+
+	st := wl.Status(true)
+	c.Assert(st, check.NotNil)
+	c.Check(st.Rejected, check.Equals, uint64(1))
+	c.Check(st.Users, check.HasLen, 2)
+	c.Check(st.Users["zzzzz-tpzed-aaaaaaaaaaaaaaa"].Rejected, check.Equals, uint64(1))
+	c.Check(st.Users["zzzzz-tpzed-bbbbbbbbbbbbbbb"].Requests > 0.9, check.Equals, true)
+
+	// The allowance is replenished over time.
+	time.Sleep(wait)
+	c.Check(wl.Check(ctx, "tokenA1", 1), check.Equals, time.Duration(0))
+}
+
+func (s *WriteLimiterSuite) TestBandwidth(c *check.C) {
+	s.cluster.API.MaxKeepWriteBandwidth = 1000000
+	wl := s.newLimiter(c)
+	ctx := context.Background()
+
+	// A block larger than the burst allowance is accepted when
+	// the user has been idle, but leaves a deficit.
+	c.Check(wl.Check(ctx, "tokenA1", 3000000), check.Equals, time.Duration(0))
+	wait := wl.Check(ctx, "tokenA2", 1000)
+	c.Check(wait > 1900*time.Millisecond, check.Equals, true)
+	c.Check(wait < 2100*time.Millisecond, check.Equals, true)
+	c.Check(wl.Status(true).Users["zzzzz-tpzed-aaaaaaaaaaaaaaa"].Bytes < -1900000, check.Equals, true)
+}
+
+func (s *WriteLimiterSuite) TestUnresolvedToken(c *check.C) {
+	s.cluster.API.MaxKeepWriteRequestRate = 1
+	wl := s.newLimiter(c)
+	ctx := context.Background()
+	c.Check(wl.Check(ctx, "bogustoken1", 1), check.Equals, time.Duration(0))
+	c.Check(wl.Check(ctx, "bogustoken2", 1), check.Equals, time.Duration(0))
+	c.Check(wl.Check(ctx, "bogustoken1", 1) > 0, check.Equals, true)
+	c.Check(wl.Check(ctx, "", 1), check.Equals, time.Duration(0))
+	c.Check(wl.Check(ctx, "", 1) > 0, check.Equals, true)
+
+	// Tokens are not revealed in the status report.
+	buf, err := json.Marshal(wl.Status(true))
+	c.Assert(err, check.IsNil)
+	c.Check(strings.Contains(string(buf), "bogustoken"), check.Equals, false)
+	c.Check(wl.Status(true).Users, check.HasLen, 3)
+}
+
+func (s *WriteLimiterSuite) TestHandler(c *check.C) {
+	s.cluster.API.MaxKeepWriteRequestRate = 0.1
+	s.cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Replication: 1, Driver: "mock"},
+	}
+	reg := prometheus.NewRegistry()
+	volmgr, err := makeRRVolumeManager(ctxlog.TestLogger(c), s.cluster, testServiceURL, newVolumeMetricsVecs(reg))
+	c.Assert(err, check.IsNil)
+	rtr := MakeRESTRouter(context.Background(), s.cluster, reg, volmgr, NewWorkQueue(), NewWorkQueue(), nil, nil)
+
+	put := &RequestTester{
+		method:      "PUT",
+		uri:         "/" + TestHash,
+		apiToken:    "bogustoken",
+		requestBody: TestBlock,
+	}
+	resp := IssueRequest(rtr, put)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	resp = IssueRequest(rtr, put)
+	c.Check(resp.Code, check.Equals, http.StatusTooManyRequests)
+	c.Check(resp.Header().Get("Retry-After"), check.Matches, `(9|10)`)
+
+	resp = IssueRequest(rtr, &RequestTester{method: "GET", uri: "/status.json"})
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	var st NodeStatus
+	c.Assert(json.Unmarshal(resp.Body.Bytes(), &st), check.IsNil)
+	c.Assert(st.WriteLimits, check.NotNil)
+	c.Check(st.WriteLimits.RequestRate, check.Equals, 0.1)
+	c.Check(st.WriteLimits.Rejected, check.Equals, uint64(1))
+	c.Check(st.WriteLimits.TrackedUsers, check.Equals, 1)
+	c.Check(st.WriteLimits.Users, check.HasLen, 0)
+
+	// Per-user details require the management token.
+	s.cluster.ManagementToken = ""
+	resp = IssueRequest(rtr, &RequestTester{method: "GET", uri: "/write-limits"})
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+	s.cluster.ManagementToken = arvadostest.ManagementToken
+	resp = IssueRequest(rtr, &RequestTester{method: "GET", uri: "/write-limits"})
+	c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+	resp = IssueHealthCheckRequest(rtr, &RequestTester{method: "GET", uri: "/write-limits", apiToken: "bogustoken"})
+	c.Check(resp.Code, check.Equals, http.StatusForbidden)
+	resp = IssueHealthCheckRequest(rtr, &RequestTester{method: "GET", uri: "/write-limits", apiToken: arvadostest.ManagementToken})
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	var wst WriteLimitStatus
+	c.Assert(json.Unmarshal(resp.Body.Bytes(), &wst), check.IsNil)
+	c.Check(wst.Users, check.HasLen, 1)
+}
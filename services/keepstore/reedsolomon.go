@@ -0,0 +1,210 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reed-Solomon erasure coding over GF(2^8), using a systematic
+// encoding matrix derived from a Vandermonde matrix: the first k
+// shards are the data itself, and any k of the k+m shards are
+// enough to recover it.
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInverse(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfPow returns a**n.
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	} else if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+type gfMatrix [][]byte
+
+func newGFMatrix(rows, cols int) gfMatrix {
+	m := make(gfMatrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m gfMatrix) multiply(other gfMatrix) gfMatrix {
+	out := newGFMatrix(len(m), len(other[0]))
+	for r := range out {
+		for c := range out[r] {
+			var v byte
+			for i := range other {
+				v ^= gfMul[m[r][i]][other[i][c]]
+			}
+			out[r][c] = v
+		}
+	}
+	return out
+}
+
+// invert returns the inverse of a square matrix, using Gauss-Jordan
+// elimination.
+func (m gfMatrix) invert() (gfMatrix, error) {
+	n := len(m)
+	work := newGFMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		if work[c][c] == 0 {
+			for r := c + 1; r < n; r++ {
+				if work[r][c] != 0 {
+					work[c], work[r] = work[r], work[c]
+					break
+				}
+			}
+		}
+		if work[c][c] == 0 {
+			return nil, errors.New("matrix is singular")
+		}
+		if inv := gfInverse(work[c][c]); inv != 1 {
+			for i := range work[c] {
+				work[c][i] = gfMul[inv][work[c][i]]
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			f := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= gfMul[f][work[c][i]]
+			}
+		}
+	}
+	out := newGFMatrix(n, n)
+	for r := range out {
+		copy(out[r], work[r][n:])
+	}
+	return out, nil
+}
+
+// A reedSolomon encodes k data shards into k+m shards.
+type reedSolomon struct {
+	k, m   int
+	matrix gfMatrix // (k+m) x k; the first k rows are the identity
+}
+
+func newReedSolomon(k, m int) (*reedSolomon, error) {
+	if k < 1 || m < 0 || k+m > 255 {
+		return nil, fmt.Errorf("invalid erasure coding parameters: %d data shards, %d parity shards", k, m)
+	}
+	vm := newGFMatrix(k+m, k)
+	for r := range vm {
+		for c := range vm[r] {
+			vm[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := gfMatrix(vm[:k]).invert()
+	if err != nil {
+		return nil, err
+	}
+	return &reedSolomon{k: k, m: m, matrix: vm.multiply(top)}, nil
+}
+
+// mulAdd sets dst[i] ^= c*src[i] for each i.
+func mulAdd(c byte, src, dst []byte) {
+	if c == 0 {
+		return
+	}
+	mt := &gfMul[c]
+	for i, b := range src {
+		dst[i] ^= mt[b]
+	}
+}
+
+// Encode computes the parity shards (shards[k:]) from the data
+// shards (shards[:k]). All shards must be the same size.
+func (rs *reedSolomon) Encode(shards [][]byte) {
+	for p := rs.k; p < rs.k+rs.m; p++ {
+		out := shards[p]
+		for i := range out {
+			out[i] = 0
+		}
+		for d := 0; d < rs.k; d++ {
+			mulAdd(rs.matrix[p][d], shards[d], out)
+		}
+	}
+}
+
+// ReconstructData fills in the data shards (shards[:k]) that are not
+// marked present, using any k present shards. The missing shards
+// must already have the correct size.
+func (rs *reedSolomon) ReconstructData(shards [][]byte, present []bool) error {
+	var rows []int
+	missing := false
+	for i := 0; i < rs.k+rs.m && len(rows) < rs.k; i++ {
+		if present[i] {
+			rows = append(rows, i)
+		} else if i < rs.k {
+			missing = true
+		}
+	}
+	if !missing {
+		return nil
+	}
+	if len(rows) < rs.k {
+		return fmt.Errorf("too few shards: have %d, need %d", len(rows), rs.k)
+	}
+	sub := make(gfMatrix, rs.k)
+	for i, r := range rows {
+		sub[i] = rs.matrix[r]
+	}
+	dec, err := sub.invert()
+	if err != nil {
+		return err
+	}
+	for d := 0; d < rs.k; d++ {
+		if present[d] {
+			continue
+		}
+		out := shards[d]
+		for i := range out {
+			out[i] = 0
+		}
+		for i, r := range rows {
+			mulAdd(dec[d][i], shards[r], out)
+		}
+	}
+	return nil
+}
@@ -371,6 +371,30 @@ func (v *S3Volume) Get(ctx context.Context, loc string, buf []byte) (int, error)
 	}
 }
 
+// ReadPrefix implements prefixReader. It requests only the first n
+// bytes of the block.
+func (v *S3Volume) ReadPrefix(ctx context.Context, loc string, n int) ([]byte, error) {
+	if n <= 0 {
+		return []byte{}, nil
+	}
+	rdr, err := v.bucket.GetRangeReader(loc, n)
+	if err, ok := err.(*s3.Error); ok && err.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// The block is empty.
+		return []byte{}, nil
+	}
+	err = v.translateError(err)
+	if os.IsNotExist(err) {
+		// getReader knows how to recover from a race with
+		// Trash.
+		rdr, err = v.getReaderWithContext(ctx, loc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf, err := readPrefixFrom(rdr, n)
+	return buf, v.translateError(err)
+}
+
 // Compare the given data with the stored data.
 func (v *S3Volume) Compare(ctx context.Context, loc string, expect []byte) error {
 	errChan := make(chan error, 1)
@@ -710,6 +734,8 @@ func (v *S3Volume) Status() *VolumeStatus {
 		DeviceNum: 1,
 		BytesFree: BlockSize * 1000,
 		BytesUsed: 1,
+
+		freeUnknown: true,
 	}
 }
 
@@ -1006,6 +1032,21 @@ func (b *s3bucket) GetReader(path string) (io.ReadCloser, error) {
 	return NewCountingReader(rdr, b.stats.TickInBytes), err
 }
 
+// GetRangeReader is like GetReader, but only requests the first n
+// bytes of the object.
+func (b *s3bucket) GetRangeReader(path string, n int) (io.ReadCloser, error) {
+	resp, err := b.Bucket().GetResponseWithHeaders(path, map[string][]string{
+		"Range": {fmt.Sprintf("bytes=0-%d", n-1)},
+	})
+	b.stats.TickOps("get")
+	b.stats.Tick(&b.stats.Ops, &b.stats.GetOps)
+	b.stats.TickErr(err)
+	if err != nil {
+		return nil, err
+	}
+	return NewCountingReader(resp.Body, b.stats.TickInBytes), nil
+}
+
 func (b *s3bucket) Head(path string, headers map[string][]string) (*http.Response, error) {
 	resp, err := b.Bucket().Head(path, headers)
 	b.stats.TickOps("head")
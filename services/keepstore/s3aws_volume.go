@@ -13,6 +13,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"regexp"
 	"strings"
@@ -517,6 +518,41 @@ func (v *S3AWSVolume) ReadBlock(ctx context.Context, loc string, w io.Writer) er
 	return err
 }
 
+// ReadPrefix implements prefixReader. It requests only the first n
+// bytes of the block.
+func (v *S3AWSVolume) ReadPrefix(ctx context.Context, loc string, n int) ([]byte, error) {
+	if n <= 0 {
+		return []byte{}, nil
+	}
+	req := v.bucket.svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(v.bucket.bucket),
+		Key:    aws.String(loc),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", n-1)),
+	})
+	result, err := req.Send(ctx)
+	v.bucket.stats.TickOps("get")
+	v.bucket.stats.Tick(&v.bucket.stats.Ops, &v.bucket.stats.GetOps)
+	v.bucket.stats.TickErr(err)
+	if err, ok := err.(awserr.RequestFailure); ok && err.StatusCode() == http.StatusRequestedRangeNotSatisfiable {
+		// The block is empty.
+		return []byte{}, nil
+	}
+	err = v.translateError(err)
+	if os.IsNotExist(err) {
+		// ReadBlock knows how to recover from a race with
+		// Trash.
+		fb := &fixedBuffer{buf: make([]byte, n)}
+		err = v.ReadBlock(ctx, loc, fb)
+		if err != nil && err != io.ErrShortWrite {
+			return nil, err
+		}
+		return fb.buf[:fb.n], nil
+	} else if err != nil {
+		return nil, err
+	}
+	return readPrefixFrom(NewCountingReader(result.Body, v.bucket.stats.TickInBytes), n)
+}
+
 func (v *S3AWSVolume) writeObject(ctx context.Context, name string, r io.Reader) error {
 	if r == nil {
 		// r == nil leads to a memory violation in func readFillBuf in
@@ -771,6 +807,8 @@ func (v *S3AWSVolume) Status() *VolumeStatus {
 		DeviceNum: 1,
 		BytesFree: BlockSize * 1000,
 		BytesUsed: 1,
+
+		freeUnknown: true,
 	}
 }
 
@@ -0,0 +1,284 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// A scrubber periodically reads every block on every mount and
+// verifies that its content matches its hash.
+//
+// Volume.Get does not check data integrity, so without scrubbing, a
+// corrupt block is only noticed when a client tries to read it. When
+// the scrubber finds a corrupt block, it moves it to the trash. The
+// next keep-balance run sees the missing replica and asks a server
+// with a good copy to replicate it.
+//
+// On encrypted volumes, the scrubber also re-encrypts blocks that are
+// not stored with the volume's current key.
+type scrubber struct {
+	cluster *arvados.Cluster
+	volmgr  *RRVolumeManager
+	logger  logrus.FieldLogger
+
+	blocksChecked *prometheus.CounterVec
+	bytesChecked  *prometheus.CounterVec
+	corruptBlocks *prometheus.CounterVec
+
+	status map[string]*ScrubStatus // mount UUID => status
+	mtx    sync.Mutex
+}
+
+// ScrubStatus describes the progress of the scrubber on one mount,
+// as reported in /status.json.
+type ScrubStatus struct {
+	PassStarted      time.Time
+	LastPassFinished time.Time `json:",omitempty"`
+	BlocksChecked    uint64
+	BytesChecked     uint64
+	CorruptBlocks    uint64
+	TrashedBlocks    uint64
+	RekeyedBlocks    uint64
+	Errors           uint64
+	LastCorrupt      string `json:",omitempty"`
+}
+
+func newScrubber(cluster *arvados.Cluster, volmgr *RRVolumeManager, logger logrus.FieldLogger, reg *prometheus.Registry) *scrubber {
+	s := &scrubber{
+		cluster: cluster,
+		volmgr:  volmgr,
+		logger:  logger,
+		status:  map[string]*ScrubStatus{},
+	}
+	s.blocksChecked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "keepstore",
+		Name:      "scrub_blocks",
+		Help:      "Number of blocks verified by the scrubber",
+	}, []string{"device_id"})
+	s.bytesChecked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "keepstore",
+		Name:      "scrub_bytes",
+		Help:      "Number of bytes read by the scrubber",
+	}, []string{"device_id"})
+	s.corruptBlocks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "keepstore",
+		Name:      "scrub_corrupt_blocks",
+		Help:      "Number of blocks found by the scrubber whose content does not match their hash",
+	}, []string{"device_id"})
+	if reg != nil {
+		reg.MustRegister(s.blocksChecked)
+		reg.MustRegister(s.bytesChecked)
+		reg.MustRegister(s.corruptBlocks)
+	}
+	return s
+}
+
+// Start one goroutine per mount that scrubs the mount once per
+// BlobScrubInterval. The goroutines return when ctx is done.
+func (s *scrubber) Start(ctx context.Context) {
+	interval := s.cluster.Collections.BlobScrubInterval.Duration()
+	if interval <= 0 {
+		return
+	}
+	for _, mnt := range s.volmgr.AllReadable() {
+		go func(mnt *VolumeMount) {
+			for {
+				t0 := time.Now()
+				err := s.scrubMount(ctx, mnt)
+				if err != nil {
+					s.logger.WithError(err).Errorf("scrub pass failed on %s", mnt)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(interval - time.Since(t0)):
+				}
+			}
+		}(mnt)
+	}
+}
+
+// scrubMount reads every block listed in mnt's index and checks its
+// hash, pausing as needed to stay within BlobScrubBandwidth.
+func (s *scrubber) scrubMount(ctx context.Context, mnt *VolumeMount) error {
+	st := &ScrubStatus{PassStarted: time.Now()}
+	s.mtx.Lock()
+	if prev := s.status[mnt.UUID]; prev != nil {
+		st.LastPassFinished = prev.LastPassFinished
+		st.CorruptBlocks = prev.CorruptBlocks
+		st.TrashedBlocks = prev.TrashedBlocks
+		st.LastCorrupt = prev.LastCorrupt
+	}
+	s.status[mnt.UUID] = st
+	s.mtx.Unlock()
+
+	lbls := prometheus.Labels{"device_id": mnt.DeviceID}
+	blocksChecked := s.blocksChecked.With(lbls)
+	bytesChecked := s.bytesChecked.With(lbls)
+	corruptBlocks := s.corruptBlocks.With(lbls)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rdr, wtr := io.Pipe()
+	go func() {
+		wtr.CloseWithError(mnt.IndexTo("", wtr))
+	}()
+	defer rdr.Close()
+
+	bandwidth := int64(s.cluster.Collections.BlobScrubBandwidth)
+	var bytesRead int64
+	scanner := bufio.NewScanner(rdr)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		line := scanner.Text()
+		if len(line) < 32 || !IsValidLocator(line[:32]) {
+			continue
+		}
+		hash := line[:32]
+		n, rekeyed, err := s.verify(ctx, mnt, hash)
+		bytesRead += int64(n)
+		// A block encrypted with a key that is no longer
+		// configured (UnknownKeyError) is not necessarily
+		// corrupt, so it is reported as an error but never
+		// trashed.
+		trashed := err == DiskHashError && s.quarantine(mnt, hash) == nil
+		s.mtx.Lock()
+		st.BlocksChecked++
+		st.BytesChecked += uint64(n)
+		if err == DiskHashError {
+			st.CorruptBlocks++
+			st.LastCorrupt = hash
+		} else if err != nil {
+			st.Errors++
+		}
+		if trashed {
+			st.TrashedBlocks++
+		}
+		if rekeyed {
+			st.RekeyedBlocks++
+		}
+		s.mtx.Unlock()
+		blocksChecked.Inc()
+		bytesChecked.Add(float64(n))
+		if err == DiskHashError {
+			corruptBlocks.Inc()
+		}
+		if bandwidth > 0 {
+			// Sleep until the average read rate since the
+			// start of this pass is back down to the
+			// configured limit.
+			due := st.PassStarted.Add(time.Duration(bytesRead * int64(time.Second) / bandwidth))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Until(due)):
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	st.LastPassFinished = time.Now()
+	s.mtx.Unlock()
+	s.logger.Infof("scrub pass finished on %s: checked %d blocks (%d bytes), found %d corrupt", mnt, st.BlocksChecked, st.BytesChecked, st.CorruptBlocks)
+	return nil
+}
+
+// verify reads the given block from mnt and returns the number of
+// bytes read. It returns DiskHashError if the data does not match
+// the hash.
+//
+// If the block is intact and mnt is an encrypted volume, verify
+// also re-encrypts the block if needed, and reports whether it did.
+func (s *scrubber) verify(ctx context.Context, mnt *VolumeMount, hash string) (int, bool, error) {
+	buf, err := getBufferWithContext(ctx, bufs, BlockSize)
+	if err != nil {
+		return 0, false, err
+	}
+	defer bufs.Put(buf)
+	ctx = withBuffer(ctx)
+	n, err := mnt.Get(withInternalRead(ctx), hash, buf)
+	if os.IsNotExist(err) {
+		// Deleted since the index was generated.
+		return 0, false, nil
+	} else if err != nil {
+		s.logger.WithError(err).Warnf("scrubber: Get(%s) failed on %s", hash, mnt)
+		return 0, false, err
+	}
+	if actual := fmt.Sprintf("%x", md5.Sum(buf[:n])); actual != hash {
+		s.logger.Errorf("scrubber: checksum mismatch for block %s (actual %s) on %s", hash, actual, mnt)
+		return n, false, DiskHashError
+	}
+	if rk, ok := mnt.Volume.(rekeyer); ok && !mnt.ReadOnly {
+		rekeyed, err := rk.Rekey(ctx, hash, buf[:n])
+		if err != nil {
+			s.logger.WithError(err).Errorf("scrubber: error re-encrypting block %s on %s", hash, mnt)
+			return n, false, err
+		} else if rekeyed {
+			s.logger.Infof("scrubber: re-encrypted block %s on %s", hash, mnt)
+		}
+		return n, rekeyed, nil
+	}
+	return n, false, nil
+}
+
+// quarantine moves a corrupt block to the trash, if the mount is
+// writable and trash is enabled.
+//
+// Volumes refuse to trash blocks that were written or touched less
+// than BlobSigningTTL ago, so a recently written corrupt block is
+// left alone until a later pass.
+func (s *scrubber) quarantine(mnt *VolumeMount, hash string) error {
+	var err error
+	if mnt.ReadOnly || !s.cluster.Collections.BlobTrash {
+		err = MethodDisabledError
+	} else if mtime, err2 := mnt.Mtime(hash); err2 != nil {
+		err = err2
+	} else if age := time.Since(mtime); age < s.cluster.Collections.BlobSigningTTL.Duration() {
+		err = fmt.Errorf("block is too new to trash (age %v < BlobSigningTTL)", arvados.Duration(age))
+	} else {
+		err = mnt.Trash(hash)
+	}
+	if err != nil {
+		s.logger.WithError(err).Errorf("scrubber: could not trash corrupt block %s on %s", hash, mnt)
+		return err
+	}
+	s.logger.Warnf("scrubber: moved corrupt block %s to trash on %s", hash, mnt)
+	return nil
+}
+
+// Status returns a copy of the scrub status for the given mount, or
+// nil if no scrub pass has started yet.
+func (s *scrubber) Status(uuid string) *ScrubStatus {
+	if s == nil {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	st, ok := s.status[uuid]
+	if !ok {
+		return nil
+	}
+	cp := *st
+	return &cp
+}
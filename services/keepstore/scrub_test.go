@@ -0,0 +1,129 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&ScrubberSuite{})
+
+type ScrubberSuite struct {
+	cluster *arvados.Cluster
+	volmgr  *RRVolumeManager
+	tmpdirs []string
+}
+
+func (s *ScrubberSuite) SetUpTest(c *check.C) {
+	s.cluster = testCluster(c)
+	s.cluster.Collections.BlobSigningTTL = arvados.Duration(time.Hour)
+	s.cluster.Collections.BlobTrashLifetime = arvados.Duration(time.Hour)
+	s.cluster.Volumes = map[string]arvados.Volume{}
+	s.tmpdirs = nil
+	for _, uuid := range []string{"zzzzz-nyw5e-000000000000000", "zzzzz-nyw5e-111111111111111"} {
+		dir, err := ioutil.TempDir("", "scrub_test")
+		c.Assert(err, check.IsNil)
+		s.tmpdirs = append(s.tmpdirs, dir)
+		params, _ := json.Marshal(map[string]string{"Root": dir})
+		s.cluster.Volumes[uuid] = arvados.Volume{Driver: "Directory", DriverParameters: params}
+	}
+	var err error
+	s.volmgr, err = makeRRVolumeManager(ctxlog.TestLogger(c), s.cluster, testServiceURL, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Assert(err, check.IsNil)
+}
+
+func (s *ScrubberSuite) TearDownTest(c *check.C) {
+	for _, dir := range s.tmpdirs {
+		os.RemoveAll(dir)
+	}
+}
+
+func (s *ScrubberSuite) TestScrubMount(c *check.C) {
+	ctx := context.Background()
+	mnt := s.volmgr.Lookup("zzzzz-nyw5e-000000000000000", true)
+	c.Assert(mnt, check.NotNil)
+	c.Assert(mnt.Put(ctx, TestHash, TestBlock), check.IsNil)
+	c.Assert(mnt.Put(ctx, TestHash2, BadBlock), check.IsNil)
+	c.Assert(mnt.Put(ctx, TestHash3, BadBlock), check.IsNil)
+
+	// TestHash2 is old enough to trash, TestHash3 is not.
+	old := time.Now().Add(-2 * time.Hour)
+	c.Assert(os.Chtimes(mnt.Volume.(*UnixVolume).blockPath(TestHash2), old, old), check.IsNil)
+
+	reg := prometheus.NewRegistry()
+	scr := newScrubber(s.cluster, s.volmgr, ctxlog.TestLogger(c), reg)
+	c.Check(scr.Status(mnt.UUID), check.IsNil)
+	c.Assert(scr.scrubMount(ctx, mnt), check.IsNil)
+
+	st := scr.Status(mnt.UUID)
+	c.Assert(st, check.NotNil)
+	c.Check(st.BlocksChecked, check.Equals, uint64(3))
+	c.Check(st.BytesChecked, check.Equals, uint64(len(TestBlock)+2*len(BadBlock)))
+	c.Check(st.CorruptBlocks, check.Equals, uint64(2))
+	c.Check(st.TrashedBlocks, check.Equals, uint64(1))
+	c.Check(st.LastPassFinished.IsZero(), check.Equals, false)
+
+	_, err := mnt.Mtime(TestHash)
+	c.Check(err, check.IsNil)
+	_, err = mnt.Mtime(TestHash2)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	_, err = mnt.Mtime(TestHash3)
+	c.Check(err, check.IsNil)
+
+	// Counters accumulate across passes.
+	c.Assert(scr.scrubMount(ctx, mnt), check.IsNil)
+	st = scr.Status(mnt.UUID)
+	c.Check(st.BlocksChecked, check.Equals, uint64(2))
+	c.Check(st.CorruptBlocks, check.Equals, uint64(3))
+	c.Check(st.LastCorrupt, check.Equals, TestHash3)
+
+	mfs, err := reg.Gather()
+	c.Assert(err, check.IsNil)
+	found := map[string]float64{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			found[mf.GetName()] += m.GetCounter().GetValue()
+		}
+	}
+	c.Check(found["arvados_keepstore_scrub_blocks"], check.Equals, float64(5))
+	c.Check(found["arvados_keepstore_scrub_corrupt_blocks"], check.Equals, float64(3))
+}
+
+func (s *ScrubberSuite) TestBandwidthLimit(c *check.C) {
+	ctx := context.Background()
+	mnt := s.volmgr.Lookup("zzzzz-nyw5e-111111111111111", true)
+	c.Assert(mnt.Put(ctx, TestHash, TestBlock), check.IsNil)
+	c.Assert(mnt.Put(ctx, TestHash2, TestBlock2), check.IsNil)
+	s.cluster.Collections.BlobScrubBandwidth = arvados.ByteSize(len(TestBlock) + len(TestBlock2))
+	scr := newScrubber(s.cluster, s.volmgr, ctxlog.TestLogger(c), nil)
+	t0 := time.Now()
+	c.Assert(scr.scrubMount(ctx, mnt), check.IsNil)
+	c.Check(time.Since(t0) > 900*time.Millisecond, check.Equals, true)
+	c.Check(scr.Status(mnt.UUID).BlocksChecked, check.Equals, uint64(2))
+}
+
+func (s *ScrubberSuite) TestCancel(c *check.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mnt := s.volmgr.Lookup("zzzzz-nyw5e-111111111111111", true)
+	c.Assert(mnt.Put(ctx, TestHash, TestBlock), check.IsNil)
+	c.Assert(mnt.Put(ctx, TestHash2, TestBlock2), check.IsNil)
+	s.cluster.Collections.BlobScrubBandwidth = 1
+	scr := newScrubber(s.cluster, s.volmgr, ctxlog.TestLogger(c), nil)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	c.Check(scr.scrubMount(ctx, mnt), check.Equals, context.Canceled)
+	c.Check(scr.Status(mnt.UUID).LastPassFinished.IsZero(), check.Equals, true)
+}
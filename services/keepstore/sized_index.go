@@ -0,0 +1,184 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// indexSizeWorkers is the maximum number of blocks whose headers are
+// read concurrently while generating an index.
+const indexSizeWorkers = 8
+
+// A blockSizeCache remembers the logical size of each block on a
+// volume that stores blocks in a transformed (compressed, encrypted,
+// etc.) form, so the sizes reported by IndexTo can be corrected
+// without reading every block each time.
+//
+// Each entry records the stored size along with the logical size, so
+// a block that has been rewritten in a different form since it was
+// cached is detected and its header is read again. Entries are
+// keyed by the first 8 bytes of the block hash and take 16 bytes
+// each, so even a volume with tens of millions of blocks can be
+// cached in full.
+type blockSizeCache struct {
+	mtx   sync.Mutex
+	sizes map[uint64]uint64 // hash prefix => stored size << 32 | logical size
+}
+
+func cacheKey(hash string) (uint64, bool) {
+	if len(hash) < 16 {
+		return 0, false
+	}
+	b, err := hex.DecodeString(hash[:16])
+	if err != nil {
+		return 0, false
+	}
+	var key uint64
+	for _, c := range b {
+		key = key<<8 | uint64(c)
+	}
+	return key, true
+}
+
+// Add records the stored and logical sizes of the given block.
+func (c *blockSizeCache) Add(hash string, stored, logical int) {
+	key, ok := cacheKey(hash)
+	if !ok {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.sizes == nil {
+		c.sizes = map[uint64]uint64{}
+	}
+	c.sizes[key] = uint64(stored)<<32 | uint64(uint32(logical))
+}
+
+// Get returns the logical size of the given block, if it is cached
+// and was cached with the given stored size.
+func (c *blockSizeCache) Get(hash string, stored int) (int, bool) {
+	key, ok := cacheKey(hash)
+	if !ok {
+		return 0, false
+	}
+	c.mtx.Lock()
+	ent, ok := c.sizes[key]
+	c.mtx.Unlock()
+	if !ok || ent>>32 != uint64(stored) {
+		return 0, false
+	}
+	return int(uint32(ent)), true
+}
+
+// IndexTo copies vol's index to w, replacing each block's stored
+// size with its logical size. Sizes that are not cached are obtained
+// by calling readSize, using up to indexSizeWorkers concurrent
+// calls.
+//
+// Blocks that disappear while the index is being generated (e.g.,
+// because they were trashed) are left out, and the rest of the index
+// is still returned. Any other error reading a block's size aborts
+// the index, as an error from the underlying volume would, so a
+// block that is still stored is never silently omitted.
+func (c *blockSizeCache) IndexTo(vol Volume, prefix string, w io.Writer, readSize func(ctx context.Context, hash string, stored int) (int, error)) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rdr, wtr := io.Pipe()
+	go func() {
+		wtr.CloseWithError(vol.IndexTo(prefix, wtr))
+	}()
+	defer rdr.Close()
+
+	var (
+		wmtx sync.Mutex
+		werr error // first error writing to w or reading a size
+	)
+	write := func(hash string, size int, rest string) {
+		wmtx.Lock()
+		defer wmtx.Unlock()
+		if werr != nil {
+			return
+		}
+		_, werr = fmt.Fprintf(w, "%s+%d%s\n", hash, size, rest)
+		if werr != nil {
+			cancel()
+		}
+	}
+
+	type todo struct {
+		hash   string
+		stored int
+		rest   string
+	}
+	todos := make(chan todo)
+	var wg sync.WaitGroup
+	for i := 0; i < indexSizeWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range todos {
+				if ctx.Err() != nil {
+					continue
+				}
+				size, err := readSize(ctx, t.hash, t.stored)
+				if os.IsNotExist(err) {
+					continue
+				} else if err != nil {
+					wmtx.Lock()
+					if werr == nil {
+						werr = fmt.Errorf("%s: error reading header of %s: %w", vol, t.hash, err)
+					}
+					wmtx.Unlock()
+					cancel()
+					continue
+				}
+				c.Add(t.hash, t.stored, size)
+				write(t.hash, size, t.rest)
+			}
+		}()
+	}
+
+	scanner := bufio.NewScanner(rdr)
+	var err error
+	for scanner.Scan() && ctx.Err() == nil {
+		line := scanner.Text()
+		// line is "{hash}+{size} {timestamp}"
+		plus := strings.Index(line, "+")
+		space := strings.Index(line, " ")
+		if plus < 0 || space < plus {
+			err = fmt.Errorf("cannot parse index line %q", line)
+			break
+		}
+		hash := line[:plus]
+		stored, perr := strconv.Atoi(line[plus+1 : space])
+		if perr != nil {
+			err = fmt.Errorf("cannot parse index line %q: %s", line, perr)
+			break
+		}
+		if size, ok := c.Get(hash, stored); ok {
+			write(hash, size, line[space:])
+		} else {
+			todos <- todo{hash, stored, line[space:]}
+		}
+	}
+	close(todos)
+	wg.Wait()
+	if err == nil {
+		err = scanner.Err()
+	}
+	if err == nil {
+		err = werr
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// parseStorageClasses returns the storage classes listed in an
+// X-Keep-Storage-Classes request header, or nil if the header is
+// empty.
+func parseStorageClasses(hdr string) []string {
+	var classes []string
+	for _, class := range strings.Split(hdr, ",") {
+		class = strings.TrimSpace(class)
+		if class != "" {
+			classes = append(classes, class)
+		}
+	}
+	return classes
+}
+
+// A putProgress keeps track of the mounts a block has been written
+// to (or found on) during a PUT request, and the storage classes
+// that still need to be satisfied.
+//
+// If no storage classes were requested, the request is satisfied as
+// soon as the block is stored on any one mount.
+type putProgress struct {
+	classRequested   bool
+	classNeeded      map[string]bool
+	classUnavailable []string
+	classDone        map[string]int
+	mountUsed        map[*VolumeMount]bool
+	totalReplication int
+}
+
+// newPutProgress returns a putProgress for a request for the given
+// storage classes. Classes that are not offered by any of the given
+// mounts are recorded (see Unavailable) and do not need to be
+// satisfied: other keepstore servers may offer them.
+func newPutProgress(classes []string, writables []*VolumeMount) *putProgress {
+	pr := &putProgress{
+		classRequested: len(classes) > 0,
+		classNeeded:    map[string]bool{},
+		classDone:      map[string]int{},
+		mountUsed:      map[*VolumeMount]bool{},
+	}
+	for _, class := range classes {
+		for _, mnt := range writables {
+			if mnt.StorageClasses[class] {
+				pr.classNeeded[class] = true
+				break
+			}
+		}
+		if !pr.classNeeded[class] {
+			pr.classUnavailable = append(pr.classUnavailable, class)
+		}
+	}
+	return pr
+}
+
+// Unavailable returns the requested storage classes that are not
+// offered by any writable mount, in the order they were requested.
+func (pr *putProgress) Unavailable() []string {
+	return pr.classUnavailable
+}
+
+// Impossible returns true if storage classes were requested, but
+// none of them is offered by any writable mount.
+func (pr *putProgress) Impossible() bool {
+	return pr.classRequested && len(pr.classUnavailable) > 0 && len(pr.classNeeded) == 0
+}
+
+// Add records that the block has been stored on the given mount.
+func (pr *putProgress) Add(mnt *VolumeMount) {
+	if pr.mountUsed[mnt] {
+		return
+	}
+	pr.mountUsed[mnt] = true
+	pr.totalReplication += mnt.Replication
+	for class := range mnt.StorageClasses {
+		pr.classDone[class] += mnt.Replication
+		delete(pr.classNeeded, class)
+	}
+}
+
+// Satisfied returns true if no more writes are needed.
+func (pr *putProgress) Satisfied() bool {
+	if !pr.classRequested {
+		return len(pr.mountUsed) > 0
+	}
+	return len(pr.classNeeded) == 0
+}
+
+// Useful returns true if storing the block on the given mount would
+// bring the request closer to being satisfied.
+func (pr *putProgress) Useful(mnt *VolumeMount) bool {
+	if mnt == nil || pr.mountUsed[mnt] {
+		return false
+	}
+	if !pr.classRequested {
+		return !pr.Satisfied()
+	}
+	for class := range mnt.StorageClasses {
+		if pr.classNeeded[class] {
+			return true
+		}
+	}
+	return false
+}
+
+// Covers returns true if storing the block on the given mount would
+// satisfy the request by itself.
+func (pr *putProgress) Covers(mnt *VolumeMount) bool {
+	if !pr.Useful(mnt) {
+		return false
+	}
+	for class := range pr.classNeeded {
+		if !mnt.StorageClasses[class] {
+			return false
+		}
+	}
+	return true
+}
+
+// ClassReplication returns the storage classes that have been
+// satisfied, and the number of replicas stored in each, in the
+// format used by the X-Keep-Storage-Classes-Confirmed response
+// header.
+func (pr *putProgress) ClassReplication() string {
+	var classes []string
+	for class := range pr.classDone {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	var s []string
+	for _, class := range classes {
+		s = append(s, fmt.Sprintf("%s=%d", class, pr.classDone[class]))
+	}
+	return strings.Join(s, ", ")
+}
+
+// nextWritableFor returns a writable mount that would satisfy the
+// request by itself, preferring the one returned by NextWritable, or
+// nil if there is no such mount.
+func nextWritableFor(volmgr *RRVolumeManager, pr *putProgress) *VolumeMount {
+	if mnt := volmgr.NextWritable(); mnt == nil || pr.Covers(mnt) {
+		return mnt
+	}
+	for _, mnt := range volmgr.AllWritable() {
+		if pr.Covers(mnt) {
+			return mnt
+		}
+	}
+	return nil
+}
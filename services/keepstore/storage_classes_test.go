@@ -0,0 +1,166 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&StorageClassSuite{})
+
+type StorageClassSuite struct {
+	cluster *arvados.Cluster
+	handler http.Handler
+	mounts  map[string]*MockVolume // storage class => volume
+}
+
+func (s *StorageClassSuite) SetUpTest(c *check.C) {
+	s.cluster = testCluster(c)
+	s.cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Replication: 1, Driver: "mock", StorageClasses: map[string]bool{"hot": true}},
+		"zzzzz-nyw5e-111111111111111": {Replication: 2, Driver: "mock", StorageClasses: map[string]bool{"cold": true}},
+		"zzzzz-nyw5e-222222222222222": {Replication: 1, Driver: "mock"},
+	}
+	reg := prometheus.NewRegistry()
+	volmgr, err := makeRRVolumeManager(ctxlog.TestLogger(c), s.cluster, testServiceURL, newVolumeMetricsVecs(reg))
+	c.Assert(err, check.IsNil)
+	s.handler = MakeRESTRouter(context.Background(), s.cluster, reg, volmgr, NewWorkQueue(), NewWorkQueue(), nil, nil)
+	s.mounts = map[string]*MockVolume{}
+	for _, mnt := range volmgr.AllWritable() {
+		for class := range mnt.StorageClasses {
+			s.mounts[class] = mnt.Volume.(*MockVolume)
+		}
+	}
+	c.Assert(s.mounts, check.HasLen, 3)
+}
+
+func (s *StorageClassSuite) put(classes string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("PUT", "/"+TestHash, strings.NewReader(string(TestBlock)))
+	if classes != "" {
+		req.Header.Set("X-Keep-Storage-Classes", classes)
+	}
+	resp := httptest.NewRecorder()
+	s.handler.ServeHTTP(resp, req)
+	return resp
+}
+
+func (s *StorageClassSuite) stored() []string {
+	var classes []string
+	for _, class := range []string{"cold", "default", "hot"} {
+		if _, ok := s.mounts[class].Store[TestHash]; ok {
+			classes = append(classes, class)
+		}
+	}
+	return classes
+}
+
+func (s *StorageClassSuite) TestOneClass(c *check.C) {
+	for i := 0; i < 3; i++ {
+		resp := s.put("hot")
+		c.Check(resp.Code, check.Equals, http.StatusOK)
+		c.Check(resp.Body.String(), check.Equals, TestHashPutResp)
+		c.Check(resp.Header().Get("X-Keep-Storage-Classes-Confirmed"), check.Equals, "hot=1")
+		c.Check(resp.Header().Get("X-Keep-Replicas-Stored"), check.Equals, "1")
+		c.Check(s.stored(), check.DeepEquals, []string{"hot"})
+	}
+}
+
+func (s *StorageClassSuite) TestMultipleClasses(c *check.C) {
+	resp := s.put(" cold,hot ")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("X-Keep-Storage-Classes-Confirmed"), check.Equals, "cold=2, hot=1")
+	c.Check(resp.Header().Get("X-Keep-Replicas-Stored"), check.Equals, "3")
+	c.Check(s.stored(), check.DeepEquals, []string{"cold", "hot"})
+}
+
+func (s *StorageClassSuite) TestExistingCopy(c *check.C) {
+	s.put("cold")
+	c.Check(s.stored(), check.DeepEquals, []string{"cold"})
+
+	// The existing copy satisfies "cold", so the block is only
+	// written to the "hot" volume.
+	s.mounts["cold"].called = map[string]int{}
+	resp := s.put("hot, cold")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("X-Keep-Storage-Classes-Confirmed"), check.Equals, "cold=2, hot=1")
+	c.Check(s.stored(), check.DeepEquals, []string{"cold", "hot"})
+	c.Check(s.mounts["cold"].CallCount("Put"), check.Equals, 0)
+	c.Check(s.mounts["cold"].CallCount("Touch"), check.Equals, 1)
+}
+
+func (s *StorageClassSuite) TestUnavailableClass(c *check.C) {
+	resp := s.put("archive")
+	c.Check(resp.Code, check.Equals, StorageClassError.HTTPCode)
+	c.Check(resp.Body.String(), check.Equals, "Requested storage classes not available: archive\n")
+	c.Check(resp.Header().Get("X-Keep-Storage-Classes-Confirmed"), check.Equals, "")
+	c.Check(s.stored(), check.HasLen, 0)
+
+	// If some of the requested classes are available, the block
+	// is stored on those, and only those are confirmed.
+	resp = s.put("archive, hot, tape")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("X-Keep-Storage-Classes-Confirmed"), check.Equals, "hot=1")
+	c.Check(s.stored(), check.DeepEquals, []string{"hot"})
+}
+
+// A client can write a block in several storage classes even if no
+// single server offers all of them.
+func (s *StorageClassSuite) TestClassesOnDifferentServers(c *check.C) {
+	var roots = map[string]string{}
+	var vols []*MockVolume
+	for i, class := range []string{"default", "archive"} {
+		cluster := testCluster(c)
+		cluster.Volumes = map[string]arvados.Volume{
+			fmt.Sprintf("zzzzz-nyw5e-00000000000000%d", i): {Replication: 1, Driver: "mock", StorageClasses: map[string]bool{class: true}},
+		}
+		reg := prometheus.NewRegistry()
+		volmgr, err := makeRRVolumeManager(ctxlog.TestLogger(c), cluster, testServiceURL, newVolumeMetricsVecs(reg))
+		c.Assert(err, check.IsNil)
+		vols = append(vols, volmgr.AllWritable()[0].Volume.(*MockVolume))
+		srv := httptest.NewServer(MakeRESTRouter(context.Background(), cluster, reg, volmgr, NewWorkQueue(), NewWorkQueue(), nil, nil))
+		defer srv.Close()
+		roots[fmt.Sprintf("zzzzz-bi6l4-00000000000000%d", i)] = srv.URL
+	}
+	kc := &keepclient.KeepClient{
+		Arvados:        &arvadosclient.ArvadosClient{ApiToken: arvadostest.ActiveTokenV2},
+		Want_replicas:  2,
+		StorageClasses: []string{"default", "archive"},
+	}
+	kc.SetServiceRoots(roots, roots, nil)
+	_, replicas, err := kc.PutB(TestBlock)
+	c.Check(err, check.IsNil)
+	c.Check(replicas, check.Equals, 2)
+	for _, v := range vols {
+		c.Check(v.Store[TestHash], check.NotNil)
+	}
+}
+
+func (s *StorageClassSuite) TestFailedClass(c *check.C) {
+	s.mounts["cold"].Bad = true
+	s.mounts["cold"].BadVolumeError = FullError
+	resp := s.put("hot, cold")
+	c.Check(resp.Code, check.Equals, FullError.HTTPCode)
+	c.Check(resp.Header().Get("X-Keep-Storage-Classes-Confirmed"), check.Equals, "hot=1")
+	c.Check(s.stored(), check.DeepEquals, []string{"hot"})
+}
+
+func (s *StorageClassSuite) TestNoClassRequested(c *check.C) {
+	resp := s.put("")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("X-Keep-Storage-Classes-Confirmed"), check.Matches, `(cold=2|default=1|hot=1)`)
+	c.Check(s.stored(), check.HasLen, 1)
+}
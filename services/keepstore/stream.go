@@ -0,0 +1,375 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+)
+
+// streamTailSize is the number of bytes a streaming GET holds back
+// from the client until the block's checksum has been verified. If
+// verification fails before any data has been sent, the request can
+// still be retried on a different volume.
+const streamTailSize = bufferPoolMinSize
+
+var errSizeHintMismatch = errors.New("block size does not match size hint")
+
+// sizeHint returns the size hint from the given locator, or -1 if it
+// does not have one.
+func sizeHint(locator string) int {
+	parts := strings.SplitN(locator, "+", 3)
+	if len(parts) < 2 {
+		return -1
+	}
+	size, err := strconv.Atoi(parts[1])
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
+// A serializedVolume is a volume that may only handle one request at
+// a time. Data is not streamed between clients and such a volume,
+// otherwise a slow client would hold up all other requests that use
+// the volume.
+type serializedVolume interface {
+	Serialized() bool
+}
+
+// streamingReader returns vol as a BlockReader if data can be
+// streamed from it to a client, otherwise nil.
+func streamingReader(vol Volume) BlockReader {
+	if sv, ok := vol.(serializedVolume); ok && sv.Serialized() {
+		return nil
+	}
+	br, _ := vol.(BlockReader)
+	return br
+}
+
+// streamingWriter returns vol as a BlockWriter if data can be
+// streamed from a client to it, otherwise nil.
+func streamingWriter(vol Volume) BlockWriter {
+	if sv, ok := vol.(serializedVolume); ok && sv.Serialized() {
+		return nil
+	}
+	bw, _ := vol.(BlockWriter)
+	return bw
+}
+
+// GetBlockStream is like GetBlock, but the caller knows the size of
+// the block in advance, and the data is written to resp instead of
+// a caller-supplied buffer.
+//
+// Volumes that implement BlockReader (and are not serialized) stream
+// data directly to the client, holding back only the last streamTailSize bytes until the
+// checksum has been verified. Other volumes read the block into a
+// buffer just big enough to tell whether its size is correct.
+//
+// If the block is found, but its size does not match the given size
+// (so the size hint in the locator may be wrong) and no volume has a
+// copy of the expected size, GetBlockStream returns
+// errSizeHintMismatch without sending anything, and the caller can
+// retry with a full-size buffer.
+//
+// If a checksum mismatch or read error occurs after some data has
+// already been sent, the rest of the block is sent from a good copy
+// on another volume, provided the data already sent matches it.
+// Otherwise, the response is aborted so the client does not mistake
+// it for a complete block.
+func GetBlockStream(ctx context.Context, volmgr *RRVolumeManager, hash string, size int, resp http.ResponseWriter) error {
+	log := ctxlog.FromContext(ctx)
+
+	var buf, tail []byte
+	defer func() {
+		if buf != nil {
+			bufs.Put(buf)
+		}
+		if tail != nil {
+			bufs.Put(tail)
+		}
+	}()
+
+	errorToCaller := NotFoundError
+	sizeMismatch := false
+	for _, mnt := range volmgr.AllReadable() {
+		var err error
+		var sent bool
+		var w *hashCheckWriter
+		if br := streamingReader(mnt.Volume); br != nil {
+			if tail == nil {
+				tail, err = getBufferWithContext(ctx, bufs, streamTailSize)
+				if err != nil {
+					return err
+				}
+				ctx = withBuffer(ctx)
+			}
+			w = newHashCheckWriter(resp, hash, size, tail[:0])
+			err = br.ReadBlock(ctx, hash, w)
+			if err == nil {
+				err = w.Close()
+			}
+			sent = w.sent > 0
+		} else {
+			if buf == nil {
+				// Leave room for one more byte than
+				// expected, so a block that is longer
+				// than the size hint isn't mistaken
+				// for a truncated one.
+				bufSize := size + 1
+				if bufSize > BlockSize {
+					bufSize = BlockSize
+				}
+				buf, err = getBufferWithContext(ctx, bufs, bufSize)
+				if err != nil {
+					return err
+				}
+				ctx = withBuffer(ctx)
+			}
+			var n int
+			n, err = mnt.Get(ctx, hash, buf)
+			if err == TooLongError || (err == nil && n != size) {
+				err = errSizeHintMismatch
+			} else if err == nil && fmt.Sprintf("%x", md5.Sum(buf[:n])) != hash {
+				err = DiskHashError
+			} else if err == nil {
+				setBlockHeaders(resp, size)
+				resp.Write(buf[:n])
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ErrClientDisconnect
+		default:
+		}
+		if err == nil {
+			if errorToCaller == DiskHashError {
+				log.Warnf("after checksum mismatch for block %s on a different volume, a good copy was found on volume %s and returned", hash, mnt)
+			}
+			return nil
+		}
+		if sent {
+			log.WithError(err).Errorf("Get(%s) failed on %s after sending partial response", hash, mnt)
+			if rerr := resumeBlockStream(ctx, volmgr, mnt, hash, w); rerr != nil {
+				log.WithError(rerr).Errorf("cannot resume response for %s from another volume", hash)
+				panic(http.ErrAbortHandler)
+			}
+			log.Warnf("finished sending %s from another volume after failure on %s", hash, mnt)
+			return nil
+		}
+		switch {
+		case os.IsNotExist(err):
+		case err == errSizeHintMismatch:
+			log.Warnf("size of block %s on %s does not match size hint %d", hash, mnt, size)
+			sizeMismatch = true
+		case err == DiskHashError:
+			log.Errorf("checksum mismatch for block %s on %s", hash, mnt)
+			errorToCaller = DiskHashError
+		case err == VolumeBusyError:
+			log.WithError(err).Errorf("Get(%s) failed on %s", hash, mnt)
+			errorToCaller = VolumeBusyError
+		default:
+			log.WithError(err).Errorf("Get(%s) failed on %s", hash, mnt)
+		}
+	}
+	if sizeMismatch && errorToCaller == NotFoundError {
+		return errSizeHintMismatch
+	}
+	return errorToCaller
+}
+
+// resumeBlockStream finishes a streaming response after the volume
+// it was being read from (failed) returned an error partway through.
+// It reads the block from another volume, checks that the data
+// already sent matches the good copy, and sends the rest.
+func resumeBlockStream(ctx context.Context, volmgr *RRVolumeManager, failed *VolumeMount, hash string, w *hashCheckWriter) error {
+	buf, err := getBufferWithContext(ctx, bufs, w.size)
+	if err != nil {
+		return err
+	}
+	defer bufs.Put(buf)
+	ctx = withBuffer(ctx)
+	for _, mnt := range volmgr.AllReadable() {
+		if mnt == failed {
+			continue
+		}
+		n, err := mnt.Get(ctx, hash, buf)
+		if err != nil || n != w.size || fmt.Sprintf("%x", md5.Sum(buf[:n])) != hash {
+			continue
+		}
+		if fmt.Sprintf("%x", md5.Sum(buf[:w.sent])) != fmt.Sprintf("%x", w.sentHash.Sum(nil)) {
+			return errors.New("data already sent does not match good copy")
+		}
+		_, err = w.resp.Write(buf[w.sent:n])
+		return err
+	}
+	return errors.New("no good copy found on other volumes")
+}
+
+func setBlockHeaders(resp http.ResponseWriter, size int) {
+	resp.Header().Set("Content-Length", strconv.Itoa(size))
+	resp.Header().Set("Content-Type", "application/octet-stream")
+}
+
+// hashCheckWriter passes data through to an http.ResponseWriter
+// while computing its MD5 checksum, holding back the last
+// cap(tail) bytes until Close confirms the size and checksum are
+// correct.
+type hashCheckWriter struct {
+	resp     http.ResponseWriter
+	expect   string
+	size     int
+	hash     hash.Hash
+	sentHash hash.Hash // checksum of the data sent so far
+	tail     []byte
+	n        int // bytes received
+	sent     int // bytes sent to resp
+}
+
+func newHashCheckWriter(resp http.ResponseWriter, expect string, size int, tail []byte) *hashCheckWriter {
+	return &hashCheckWriter{
+		resp:     resp,
+		expect:   expect,
+		size:     size,
+		hash:     md5.New(),
+		sentHash: md5.New(),
+		tail:     tail,
+	}
+}
+
+func (w *hashCheckWriter) Write(p []byte) (int, error) {
+	if w.n+len(p) > w.size {
+		return 0, errSizeHintMismatch
+	}
+	w.hash.Write(p)
+	w.n += len(p)
+	written := len(p)
+	if over := len(w.tail) + len(p) - cap(w.tail); over > 0 {
+		// Send the oldest held-back bytes, then as much of p
+		// as doesn't fit in the tail buffer.
+		k := over
+		if k > len(w.tail) {
+			k = len(w.tail)
+		}
+		if err := w.send(w.tail[:k]); err != nil {
+			return 0, err
+		}
+		w.tail = w.tail[:copy(w.tail, w.tail[k:])]
+		if over > k {
+			if err := w.send(p[:over-k]); err != nil {
+				return 0, err
+			}
+			p = p[over-k:]
+		}
+	}
+	w.tail = append(w.tail, p...)
+	return written, nil
+}
+
+func (w *hashCheckWriter) send(p []byte) error {
+	if w.sent == 0 {
+		setBlockHeaders(w.resp, w.size)
+	}
+	n, err := w.resp.Write(p)
+	w.sentHash.Write(p[:n])
+	w.sent += n
+	return err
+}
+
+// Close verifies the size and checksum of the data received, and if
+// they are correct, sends the held-back data.
+func (w *hashCheckWriter) Close() error {
+	if w.n != w.size {
+		return errSizeHintMismatch
+	}
+	if fmt.Sprintf("%x", w.hash.Sum(nil)) != w.expect {
+		return DiskHashError
+	}
+	if w.sent == 0 && len(w.tail) == 0 {
+		setBlockHeaders(w.resp, w.size)
+		return nil
+	}
+	return w.send(w.tail)
+}
+
+// hashCheckReader passes data through from a request body while
+// computing its MD5 checksum. When the underlying reader reaches
+// EOF, it returns RequestHashError instead if the size or checksum
+// is wrong, so a BlockWriter that is consuming it fails instead of
+// storing bad data.
+type hashCheckReader struct {
+	r      io.Reader
+	expect string
+	size   int64
+	hash   hash.Hash
+	n      int64
+	err    error
+}
+
+func (r *hashCheckReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.r.Read(p)
+	r.hash.Write(p[:n])
+	r.n += int64(n)
+	if err == io.EOF && (r.n != r.size || fmt.Sprintf("%x", r.hash.Sum(nil)) != r.expect) {
+		err = RequestHashError
+	}
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// PutBlockStream stores a block on mnt, reading the data from body
+// as it is being written instead of reading it into a buffer first.
+// The caller is responsible for checking that the block is not
+// already stored.
+//
+// If the volume returns an error without consuming any data
+// (e.g., because it is full), PutBlockStream returns consumed=false
+// and the caller can still read body and try elsewhere. If it fails
+// after consuming some data, the caller can only try elsewhere if it
+// kept a copy of the data that was consumed.
+func PutBlockStream(ctx context.Context, volmgr *RRVolumeManager, mnt *VolumeMount, bw BlockWriter, hash string, body io.Reader, size int64) (replication int, consumed bool, err error) {
+	r := &hashCheckReader{r: body, expect: hash, size: size, hash: md5.New()}
+	t0 := time.Now()
+	err = bw.WriteBlock(ctx, hash, r)
+	if ctx.Err() != nil {
+		return 0, true, ErrClientDisconnect
+	}
+	volmgr.WriteFinished(mnt, int(r.n), time.Since(t0), err)
+	if r.err == RequestHashError {
+		ctxlog.FromContext(ctx).Printf("%s: MD5 checksum %x did not match request", hash, r.hash.Sum(nil))
+		return 0, true, RequestHashError
+	} else if err != nil {
+		ctxlog.FromContext(ctx).WithError(err).Errorf("%s: WriteBlock(%s) failed", mnt.Volume, hash)
+		return 0, r.n > 0 || r.err != nil, err
+	}
+	return mnt.Replication, true, nil
+}
+
+// blockExists returns true if any writable volume has a copy of the
+// given block (correct or not).
+func blockExists(volmgr *RRVolumeManager, hash string) bool {
+	for _, mnt := range volmgr.AllWritable() {
+		if _, err := mnt.Mtime(hash); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,313 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&StreamSuite{})
+
+// StreamSuite tests GET and PUT requests on volumes that support
+// streaming (BlockReader and BlockWriter).
+type StreamSuite struct {
+	cluster *arvados.Cluster
+	handler http.Handler
+	volmgr  *RRVolumeManager
+	dirs    []string
+}
+
+func (s *StreamSuite) SetUpTest(c *check.C) {
+	s.cluster = testCluster(c)
+	s.cluster.Volumes = map[string]arvados.Volume{}
+	s.dirs = nil
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "stream_test")
+		c.Assert(err, check.IsNil)
+		s.dirs = append(s.dirs, dir)
+		s.cluster.Volumes[fmt.Sprintf("zzzzz-nyw5e-%015d", i)] = arvados.Volume{
+			Driver:           "Directory",
+			DriverParameters: []byte(`{"Root":"` + dir + `"}`),
+			Replication:      1,
+		}
+	}
+	reg := prometheus.NewRegistry()
+	volmgr, err := makeRRVolumeManager(ctxlog.TestLogger(c), s.cluster, testServiceURL, newVolumeMetricsVecs(reg))
+	c.Assert(err, check.IsNil)
+	s.volmgr = volmgr
+	s.handler = MakeRESTRouter(ctxlog.Context(context.Background(), ctxlog.TestLogger(c)), s.cluster, reg, volmgr, NewWorkQueue(), NewWorkQueue(), nil, nil)
+}
+
+func (s *StreamSuite) TearDownTest(c *check.C) {
+	for _, dir := range s.dirs {
+		os.RemoveAll(dir)
+	}
+}
+
+// blockPath returns the path where the given block is (or would be)
+// stored on the i'th volume.
+func (s *StreamSuite) blockPath(i int, hash string) string {
+	return filepath.Join(s.dirs[i], hash[:3], hash)
+}
+
+func (s *StreamSuite) findBlock(c *check.C, hash string) (int, []byte) {
+	for i := range s.dirs {
+		data, err := ioutil.ReadFile(s.blockPath(i, hash))
+		if err == nil {
+			return i, data
+		}
+		c.Assert(os.IsNotExist(err), check.Equals, true)
+	}
+	return -1, nil
+}
+
+func (s *StreamSuite) writeBlock(c *check.C, i int, hash string, data []byte) {
+	c.Assert(os.MkdirAll(filepath.Dir(s.blockPath(i, hash)), 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(s.blockPath(i, hash), data, 0644), check.IsNil)
+}
+
+func (s *StreamSuite) TestPutWithoutBuffer(c *check.C) {
+	defer func(orig *bufferPool) {
+		bufs = orig
+	}(bufs)
+	bufs = newBufferPool(ctxlog.TestLogger(c), 1, BlockSize)
+	// Streaming PUT must not wait for a buffer.
+	buf := bufs.Get(BlockSize)
+	defer bufs.Put(buf)
+
+	resp := IssueRequest(s.handler, &RequestTester{
+		method:      "PUT",
+		uri:         "/" + TestHash,
+		requestBody: TestBlock,
+	})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, TestHashPutResp)
+	_, data := s.findBlock(c, TestHash)
+	c.Check(data, check.DeepEquals, TestBlock)
+}
+
+// brokenWriterVolume is a Volume whose WriteBlock fails after
+// consuming part of the data.
+type brokenWriterVolume struct {
+	Volume
+}
+
+func (v *brokenWriterVolume) WriteBlock(ctx context.Context, loc string, r io.Reader) error {
+	io.ReadFull(r, make([]byte, 10))
+	return errors.New("test error")
+}
+
+func (s *StreamSuite) TestPutFailsPartway(c *check.C) {
+	for _, mnt := range s.volmgr.Mounts() {
+		mnt.Volume = &brokenWriterVolume{mnt.Volume}
+	}
+
+	// If a buffer is available, the block is written to a
+	// volume without streaming.
+	resp := IssueRequest(s.handler, &RequestTester{
+		method:      "PUT",
+		uri:         "/" + TestHash,
+		requestBody: TestBlock,
+	})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	_, data := s.findBlock(c, TestHash)
+	c.Check(data, check.DeepEquals, TestBlock)
+	c.Check(bufs.BytesInUse(), check.Equals, 0)
+
+	// Otherwise, the consumed data is gone, so the request fails.
+	defer func(orig *bufferPool) {
+		bufs = orig
+	}(bufs)
+	bufs = newBufferPool(ctxlog.TestLogger(c), 1, BlockSize)
+	buf := bufs.Get(BlockSize)
+	defer bufs.Put(buf)
+	resp = IssueRequest(s.handler, &RequestTester{
+		method:      "PUT",
+		uri:         "/" + TestHash2,
+		requestBody: TestBlock2,
+	})
+	c.Check(resp.Code, check.Equals, http.StatusInternalServerError)
+}
+
+func (s *StreamSuite) TestPutHashMismatch(c *check.C) {
+	resp := IssueRequest(s.handler, &RequestTester{
+		method:      "PUT",
+		uri:         "/" + TestHash,
+		requestBody: TestBlock2,
+	})
+	c.Check(resp.Code, check.Equals, RequestHashError.HTTPCode)
+	i, _ := s.findBlock(c, TestHash)
+	c.Check(i, check.Equals, -1)
+	for _, dir := range s.dirs {
+		matches, err := filepath.Glob(filepath.Join(dir, TestHash[:3], "tmp*"))
+		c.Check(err, check.IsNil)
+		c.Check(matches, check.HasLen, 0)
+	}
+}
+
+func (s *StreamSuite) TestPutExistingBlock(c *check.C) {
+	// A block that is already stored is not written again, just
+	// touched.
+	s.writeBlock(c, 1, TestHash, TestBlock)
+	old := time.Now().Add(-time.Hour)
+	c.Assert(os.Chtimes(s.blockPath(1, TestHash), old, old), check.IsNil)
+	resp := IssueRequest(s.handler, &RequestTester{
+		method:      "PUT",
+		uri:         "/" + TestHash,
+		requestBody: TestBlock,
+	})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	_, err := os.Stat(s.blockPath(0, TestHash))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	fi, err := os.Stat(s.blockPath(1, TestHash))
+	c.Assert(err, check.IsNil)
+	c.Check(fi.ModTime().After(old.Add(time.Minute)), check.Equals, true)
+}
+
+func (s *StreamSuite) TestGetLargeBlock(c *check.C) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), streamTailSize/4+1)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	s.writeBlock(c, 1, hash, data)
+	resp := IssueRequest(s.handler, &RequestTester{
+		method: "GET",
+		uri:    fmt.Sprintf("/%s+%d", hash, len(data)),
+	})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Length"), check.Equals, fmt.Sprintf("%d", len(data)))
+	c.Check(resp.Body.Bytes(), check.DeepEquals, data)
+	c.Check(bufs.BytesInUse(), check.Equals, 0)
+}
+
+func (s *StreamSuite) TestGetEmptyBlock(c *check.C) {
+	hash := fmt.Sprintf("%x", md5.Sum(nil))
+	s.writeBlock(c, 0, hash, nil)
+	resp := IssueRequest(s.handler, &RequestTester{
+		method: "GET",
+		uri:    "/" + hash + "+0",
+	})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Length"), check.Equals, "0")
+	c.Check(resp.Body.Len(), check.Equals, 0)
+}
+
+func (s *StreamSuite) TestGetCorruptBlock(c *check.C) {
+	// Small blocks are verified before anything is sent, so a
+	// good copy on another volume can still be returned.
+	s.writeBlock(c, 0, TestHash, BadBlock)
+	s.writeBlock(c, 1, TestHash, TestBlock)
+	resp := IssueRequest(s.handler, &RequestTester{
+		method: "GET",
+		uri:    fmt.Sprintf("/%s+%d", TestHash, len(TestBlock)),
+	})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.Bytes(), check.DeepEquals, TestBlock)
+
+	os.Remove(s.blockPath(1, TestHash))
+	resp = IssueRequest(s.handler, &RequestTester{
+		method: "GET",
+		uri:    fmt.Sprintf("/%s+%d", TestHash, len(TestBlock)),
+	})
+	c.Check(resp.Code, check.Equals, DiskHashError.HTTPCode)
+}
+
+func (s *StreamSuite) TestGetCorruptLargeBlock(c *check.C) {
+	// If the checksum mismatch is detected after some data has
+	// been sent, the response is aborted.
+	data := bytes.Repeat([]byte("0123456789abcdef"), streamTailSize/4+1)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	s.writeBlock(c, 0, hash, append([]byte("x"), data[1:]...))
+	c.Check(func() {
+		IssueRequest(s.handler, &RequestTester{
+			method: "GET",
+			uri:    fmt.Sprintf("/%s+%d", hash, len(data)),
+		})
+	}, check.Panics, http.ErrAbortHandler)
+}
+
+func (s *StreamSuite) TestGetCorruptLargeBlockWithGoodCopy(c *check.C) {
+	// The corrupt data is at the end, so it is detected after the
+	// beginning of the block has been sent. Depending on which
+	// volume is read first, the rest of the block comes from the
+	// good copy, or the good copy is returned without error.
+	data := bytes.Repeat([]byte("0123456789abcdef"), streamTailSize/4+1)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	for bad := range s.dirs {
+		c.Logf("=== corrupt copy on volume %d", bad)
+		good := 1 - bad
+		s.writeBlock(c, bad, hash, append(append([]byte(nil), data[:len(data)-1]...), 'x'))
+		s.writeBlock(c, good, hash, data)
+		resp := IssueRequest(s.handler, &RequestTester{
+			method: "GET",
+			uri:    fmt.Sprintf("/%s+%d", hash, len(data)),
+		})
+		c.Check(resp.Code, check.Equals, http.StatusOK)
+		c.Check(resp.Body.Bytes(), check.DeepEquals, data)
+	}
+	c.Check(bufs.BytesInUse(), check.Equals, 0)
+}
+
+func (s *StreamSuite) TestGetWrongSizeHint(c *check.C) {
+	s.writeBlock(c, 0, TestHash, TestBlock)
+	for _, size := range []int{len(TestBlock) - 1, len(TestBlock) + 1, BlockSize + 1} {
+		resp := IssueRequest(s.handler, &RequestTester{
+			method: "GET",
+			uri:    fmt.Sprintf("/%s+%d", TestHash, size),
+		})
+		c.Check(resp.Code, check.Equals, SizeHintError.HTTPCode)
+	}
+	c.Check(bufs.BytesInUse(), check.Equals, 0)
+}
+
+func (s *StreamSuite) TestGetWrongSizeHintWithoutStreaming(c *check.C) {
+	// Compressed volumes don't support streaming, so the block
+	// is read into a buffer.
+	for uuid, cfgvol := range s.cluster.Volumes {
+		cfgvol.DriverParameters = []byte(`{"Root":"` + s.dirs[0] + `","Compression":"gzip"}`)
+		s.cluster.Volumes = map[string]arvados.Volume{uuid: cfgvol}
+		break
+	}
+	reg := prometheus.NewRegistry()
+	volmgr, err := makeRRVolumeManager(ctxlog.TestLogger(c), s.cluster, testServiceURL, newVolumeMetricsVecs(reg))
+	c.Assert(err, check.IsNil)
+	handler := MakeRESTRouter(ctxlog.Context(context.Background(), ctxlog.TestLogger(c)), s.cluster, reg, volmgr, NewWorkQueue(), NewWorkQueue(), nil, nil)
+
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(volmgr.Mounts()[0].Put(context.Background(), hash, data), check.IsNil)
+	for _, trial := range []struct {
+		size int
+		code int
+	}{
+		{len(data), http.StatusOK},
+		{len(data) - 1, SizeHintError.HTTPCode},
+		{len(data) + 1, SizeHintError.HTTPCode},
+		{100, SizeHintError.HTTPCode},
+	} {
+		resp := IssueRequest(handler, &RequestTester{
+			method: "GET",
+			uri:    fmt.Sprintf("/%s+%d", hash, trial.size),
+		})
+		c.Check(resp.Code, check.Equals, trial.code)
+		if trial.code == http.StatusOK {
+			c.Check(resp.Body.Bytes(), check.DeepEquals, data)
+		}
+	}
+	c.Check(bufs.BytesInUse(), check.Equals, 0)
+}
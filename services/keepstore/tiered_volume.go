@@ -0,0 +1,637 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	driver["Tiered"] = newTieredVolume
+}
+
+// maxTieredReadEntries is the maximum number of slow-tier blocks
+// whose read counts (and recently promoted blocks whose promotion
+// times) are remembered by a TieredVolume.
+const maxTieredReadEntries = 1 << 16
+
+// TieredVolume pairs a fast volume (e.g., a local SSD) with a slow,
+// cheaper one (e.g., an object storage bucket). New blocks are
+// written to the fast tier. Blocks whose fast-tier timestamps are
+// older than DemoteAge are periodically moved to the slow tier, and
+// blocks that are read from the slow tier PromoteReads times are
+// copied back to the fast tier.
+type TieredVolume struct {
+	Fast           arvados.Volume
+	Slow           arvados.Volume
+	DemoteAge      arvados.Duration
+	DemoteInterval arvados.Duration
+	PromoteReads   int
+
+	cluster   *arvados.Cluster
+	volume    arvados.Volume
+	logger    logrus.FieldLogger
+	metrics   *volumeMetricsVecs
+	fast      Volume
+	slow      Volume
+	reads     *lru.Cache    // block hash => reads from slow tier
+	promoted  *lru.Cache    // block hash => time promoted
+	promoting chan struct{} // limits concurrent promotions
+	stats     tieredVolumeStats
+
+	stopDemotion context.CancelFunc
+	demotionDone chan struct{}
+
+	migrations     *prometheus.CounterVec
+	migrationBytes *prometheus.CounterVec
+}
+
+type tieredVolumeStats struct {
+	statsTicker
+	FastGetOps    uint64
+	SlowGetOps    uint64
+	Demoted       uint64
+	DemotedBytes  uint64
+	Promoted      uint64
+	PromotedBytes uint64
+}
+
+func newTieredVolume(cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) (Volume, error) {
+	v := &TieredVolume{cluster: cluster, volume: volume, logger: logger, metrics: metrics}
+	err := json.Unmarshal(volume.DriverParameters, &v)
+	if err != nil {
+		return nil, err
+	}
+	for _, tier := range []struct {
+		name string
+		cfg  arvados.Volume
+		vol  *Volume
+	}{
+		{"Fast", v.Fast, &v.fast},
+		{"Slow", v.Slow, &v.slow},
+	} {
+		if tier.cfg.Driver == "" {
+			return nil, fmt.Errorf("DriverParameters.%s.Driver was not provided", tier.name)
+		} else if tier.cfg.Driver == "Tiered" {
+			return nil, fmt.Errorf("DriverParameters.%s: nested Tiered volumes are not supported", tier.name)
+		}
+		if err := checkBackingVolume(tier.cfg); err != nil {
+			return nil, fmt.Errorf("DriverParameters.%s: %s", tier.name, err)
+		}
+		tier.cfg.ReadOnly = tier.cfg.ReadOnly || volume.ReadOnly
+		*tier.vol, err = newVolume(cluster, tier.cfg, logger, metrics)
+		if err != nil {
+			return nil, fmt.Errorf("DriverParameters.%s: %s", tier.name, err)
+		}
+	}
+	err = v.check()
+	if err != nil {
+		return nil, err
+	}
+	if !volume.ReadOnly {
+		v.startDemotion()
+	}
+	return v, nil
+}
+
+func (v *TieredVolume) check() error {
+	if v.DemoteAge <= 0 {
+		return errors.New("DriverParameters.DemoteAge must be greater than zero")
+	}
+	if ttl := v.cluster.Collections.BlobSigningTTL; v.DemoteAge < ttl {
+		return fmt.Errorf("DriverParameters.DemoteAge (%s) must not be less than Collections.BlobSigningTTL (%s)", v.DemoteAge, ttl)
+	}
+	if v.DemoteInterval <= 0 {
+		v.DemoteInterval = arvados.Duration(time.Hour)
+	}
+	if v.PromoteReads < 1 {
+		v.PromoteReads = 1
+	}
+	var err error
+	v.reads, err = lru.New(maxTieredReadEntries)
+	if err != nil {
+		return err
+	}
+	v.promoted, err = lru.New(maxTieredReadEntries)
+	if err != nil {
+		return err
+	}
+	v.promoting = make(chan struct{}, 1)
+	v.logger = v.logger.WithField("Volume", v.String())
+
+	// Set up prometheus metrics
+	lbls := prometheus.Labels{"device_id": v.GetDeviceID()}
+	v.stats.opsCounters, v.stats.errCounters, v.stats.ioBytes = v.metrics.getCounterVecsFor(lbls)
+	v.migrations, v.migrationBytes = v.metrics.getTierCounterVecsFor(lbls)
+	return nil
+}
+
+// Replication returns the replication level of the less durable
+// tier.
+func (v *TieredVolume) Replication() int {
+	repl := 0
+	for _, cfg := range []arvados.Volume{v.Fast, v.Slow} {
+		r := cfg.Replication
+		if r < 1 {
+			r = 1
+		}
+		if repl == 0 || r < repl {
+			repl = r
+		}
+	}
+	return repl
+}
+
+// Get implements Volume. If the block is not on the fast tier, it
+// is read from the slow tier, and may be promoted (unless ctx
+// indicates an internal read, like scrubbing).
+func (v *TieredVolume) Get(ctx context.Context, loc string, buf []byte) (int, error) {
+	v.stats.TickOps("get")
+	n, err := v.fast.Get(ctx, loc, buf)
+	if err == nil {
+		v.stats.Tick(&v.stats.FastGetOps)
+		v.stats.TickInBytes(uint64(n))
+		return n, nil
+	}
+	n, slowErr := v.slow.Get(ctx, loc, buf)
+	if slowErr == nil {
+		v.stats.Tick(&v.stats.SlowGetOps)
+		v.stats.TickInBytes(uint64(n))
+		if !isInternalRead(ctx) {
+			v.promoteIfHot(loc, buf[:n])
+		}
+		return n, nil
+	} else if os.IsNotExist(slowErr) {
+		// Report the fast tier's error, which might be more
+		// interesting than "not found".
+		return 0, err
+	}
+	return 0, slowErr
+}
+
+// ReadPrefix implements prefixReader. It reads from the fast tier,
+// or, if the block is not there, from the slow tier. Reading a
+// prefix does not promote the block.
+func (v *TieredVolume) ReadPrefix(ctx context.Context, loc string, n int) ([]byte, error) {
+	buf, err := readBlockPrefix(ctx, v.fast, loc, n)
+	if err == nil {
+		return buf, nil
+	}
+	buf, slowErr := readBlockPrefix(ctx, v.slow, loc, n)
+	if slowErr == nil {
+		return buf, nil
+	} else if os.IsNotExist(slowErr) {
+		return nil, err
+	}
+	return nil, slowErr
+}
+
+// Compare implements Volume.
+func (v *TieredVolume) Compare(ctx context.Context, loc string, expect []byte) error {
+	err := v.fast.Compare(ctx, loc, expect)
+	if os.IsNotExist(err) {
+		err = v.slow.Compare(ctx, loc, expect)
+	}
+	return err
+}
+
+// Put implements Volume. Blocks are written to the fast tier, or, if
+// that fails, to the slow tier.
+func (v *TieredVolume) Put(ctx context.Context, loc string, block []byte) error {
+	if v.volume.ReadOnly {
+		return MethodDisabledError
+	}
+	v.stats.TickOps("put")
+	err := v.fast.Put(ctx, loc, block)
+	if err != nil && ctx.Err() == nil {
+		v.logger.WithError(err).Warnf("%s: write to fast tier failed, writing to slow tier", loc)
+		if v.slow.Put(ctx, loc, block) == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		v.stats.TickErr(err, "put")
+		return err
+	}
+	v.stats.TickOutBytes(uint64(len(block)))
+	return nil
+}
+
+// Touch implements Volume.
+func (v *TieredVolume) Touch(loc string) error {
+	if v.volume.ReadOnly {
+		return MethodDisabledError
+	}
+	err := v.fast.Touch(loc)
+	if os.IsNotExist(err) {
+		err = v.slow.Touch(loc)
+	}
+	return err
+}
+
+// Mtime implements Volume. If the block is stored on both tiers, it
+// returns the more recent timestamp.
+func (v *TieredVolume) Mtime(loc string) (time.Time, error) {
+	fastT, fastErr := v.fast.Mtime(loc)
+	slowT, slowErr := v.slow.Mtime(loc)
+	switch {
+	case fastErr == nil && slowErr == nil:
+		if slowT.After(fastT) {
+			return slowT, nil
+		}
+		return fastT, nil
+	case fastErr == nil:
+		return fastT, nil
+	case slowErr == nil:
+		return slowT, nil
+	case os.IsNotExist(fastErr):
+		return time.Time{}, slowErr
+	default:
+		return time.Time{}, fastErr
+	}
+}
+
+// IndexTo implements Volume. Blocks stored on both tiers are listed
+// once, with the more recent timestamp.
+func (v *TieredVolume) IndexTo(prefix string, w io.Writer) error {
+	// Read the fast tier's index into memory (it is expected to
+	// be much smaller than the slow tier's), then stream the slow
+	// tier's index, merging as we go.
+	fast := map[string]string{}
+	err := scanIndex(v.fast, prefix, func(hash, line string, _ int64) error {
+		fast[hash] = line
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = scanIndex(v.slow, prefix, func(hash, line string, mtime int64) error {
+		if fastLine, ok := fast[hash]; ok {
+			delete(fast, hash)
+			if fastMtime, _ := indexLineMtime(fastLine); fastMtime > mtime {
+				line = fastLine
+			}
+		}
+		_, err := fmt.Fprintln(w, line)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, line := range fast {
+		_, err := fmt.Fprintln(w, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanIndex calls fn for each line of vol's index, without holding
+// the whole index in memory.
+func scanIndex(vol Volume, prefix string, fn func(hash, line string, mtime int64) error) error {
+	rdr, wtr := io.Pipe()
+	go func() {
+		wtr.CloseWithError(vol.IndexTo(prefix, wtr))
+	}()
+	defer rdr.Close()
+	scanner := bufio.NewScanner(rdr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// line is "{hash}+{size} {timestamp}"
+		plus := strings.Index(line, "+")
+		mtime, err := indexLineMtime(line)
+		if plus < 0 || err != nil {
+			return fmt.Errorf("cannot parse index line %q from %s", line, vol)
+		}
+		err = fn(line[:plus], line, mtime)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// indexLineMtime returns the timestamp from the given index line.
+func indexLineMtime(line string) (int64, error) {
+	space := strings.LastIndex(line, " ")
+	if space < 0 {
+		return 0, errors.New("no timestamp")
+	}
+	return strconv.ParseInt(line[space+1:], 10, 64)
+}
+
+// Trash implements Volume. It trashes the block on both tiers.
+func (v *TieredVolume) Trash(loc string) error {
+	if v.volume.ReadOnly || !v.cluster.Collections.BlobTrash {
+		return MethodDisabledError
+	}
+	mtime, err := v.Mtime(loc)
+	if err != nil {
+		return err
+	}
+	if time.Since(mtime) < v.cluster.Collections.BlobSigningTTL.Duration() {
+		return nil
+	}
+	fastErr := v.fast.Trash(loc)
+	slowErr := v.slow.Trash(loc)
+	return tierError(fastErr, slowErr)
+}
+
+// Untrash implements Volume. It succeeds if the block is untrashed
+// on either tier.
+func (v *TieredVolume) Untrash(loc string) error {
+	if v.volume.ReadOnly {
+		return MethodDisabledError
+	}
+	fastErr := v.fast.Untrash(loc)
+	slowErr := v.slow.Untrash(loc)
+	if fastErr == nil || slowErr == nil {
+		return nil
+	}
+	return tierError(fastErr, slowErr)
+}
+
+// tierError returns the first error that isn't "not found", or
+// os.ErrNotExist if the block wasn't found on either tier.
+func tierError(fastErr, slowErr error) error {
+	for _, err := range []error{fastErr, slowErr} {
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if fastErr != nil && slowErr != nil {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// EmptyTrash implements Volume.
+func (v *TieredVolume) EmptyTrash() {
+	v.fast.EmptyTrash()
+	v.slow.EmptyTrash()
+}
+
+// Status implements Volume. BytesFree is the free space on the fast
+// tier, where new blocks are written; BytesUsed includes both tiers.
+func (v *TieredVolume) Status() *VolumeStatus {
+	st := v.fast.Status()
+	if st == nil {
+		return nil
+	}
+	st = &VolumeStatus{
+		MountPoint:  v.String(),
+		DeviceNum:   st.DeviceNum,
+		BytesFree:   st.BytesFree,
+		BytesUsed:   st.BytesUsed,
+		freeUnknown: st.freeUnknown,
+	}
+	if slow := v.slow.Status(); slow != nil {
+		st.BytesUsed += slow.BytesUsed
+	}
+	return st
+}
+
+// String implements Volume.
+func (v *TieredVolume) String() string {
+	return fmt.Sprintf("tiered[%s, %s]", v.fast, v.slow)
+}
+
+// GetDeviceID implements Volume. It returns the device IDs of both
+// tiers, or "" if either is unknown.
+func (v *TieredVolume) GetDeviceID() string {
+	fast, slow := v.fast.GetDeviceID(), v.slow.GetDeviceID()
+	if fast == "" || slow == "" {
+		return ""
+	}
+	return fmt.Sprintf("tiered[%s,%s]", fast, slow)
+}
+
+// InternalStats returns read and migration counters.
+func (v *TieredVolume) InternalStats() interface{} {
+	return &v.stats
+}
+
+// promoteIfHot copies the given block from the slow tier to the
+// fast tier in the background, if it has now been read from the slow
+// tier PromoteReads times. Only one block is promoted at a time;
+// when a promotion is already in progress, the block will be
+// considered again the next time it is read.
+//
+// If the fast tier is an mtimeSetter, the promoted copy keeps the
+// slow-tier timestamp, so promotion does not delay garbage
+// collection. Otherwise, promotion counts as touching the block.
+func (v *TieredVolume) promoteIfHot(loc string, data []byte) {
+	if v.volume.ReadOnly {
+		return
+	}
+	hash := locatorHash(loc)
+	reads := 1
+	if n, ok := v.reads.Get(hash); ok {
+		reads += n.(int)
+	}
+	if reads < v.PromoteReads {
+		v.reads.Add(hash, reads)
+		return
+	}
+	select {
+	case v.promoting <- struct{}{}:
+	default:
+		v.reads.Add(hash, reads)
+		return
+	}
+	v.reads.Remove(hash)
+	data = append([]byte(nil), data...)
+	go func() {
+		defer func() { <-v.promoting }()
+		mtime, mtimeErr := v.slow.Mtime(hash)
+		err := v.fast.Put(context.Background(), hash, data)
+		if err != nil {
+			v.stats.TickErr(err, "promote")
+			v.logger.WithError(err).Warnf("%s: promotion to fast tier failed", hash)
+			return
+		}
+		if ms, ok := v.fast.(mtimeSetter); ok && mtimeErr == nil {
+			err = ms.SetMtime(hash, mtime)
+			if err != nil {
+				v.logger.WithError(err).Warnf("%s: error setting timestamp of promoted block", hash)
+			}
+		}
+		// The promoted copy's timestamp is (probably) older
+		// than DemoteAge. Remember the promotion so the next
+		// demotion pass doesn't undo it.
+		v.promoted.Add(hash, time.Now())
+		v.stats.Tick(&v.stats.Promoted)
+		atomic.AddUint64(&v.stats.PromotedBytes, uint64(len(data)))
+		v.migrations.With(prometheus.Labels{"direction": "promote"}).Inc()
+		v.migrationBytes.With(prometheus.Labels{"direction": "promote"}).Add(float64(len(data)))
+	}()
+}
+
+// startDemotion starts a goroutine that calls demoteOld once per
+// DemoteInterval, until Close is called.
+func (v *TieredVolume) startDemotion() {
+	ctx, cancel := context.WithCancel(context.Background())
+	v.stopDemotion = cancel
+	v.demotionDone = make(chan struct{})
+	go func() {
+		defer close(v.demotionDone)
+		ticker := time.NewTicker(v.DemoteInterval.Duration())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := v.demoteOld(ctx)
+			if err != nil && ctx.Err() == nil {
+				v.logger.WithError(err).Error("demotion pass failed")
+			}
+		}
+	}()
+}
+
+// Close implements volumeCloser. It stops the demotion goroutine,
+// waiting for an interrupted demotion pass to return, and closes
+// the tiers.
+func (v *TieredVolume) Close() {
+	if v.stopDemotion != nil {
+		v.stopDemotion()
+		<-v.demotionDone
+	}
+	closeVolume(v.fast)
+	closeVolume(v.slow)
+}
+
+// demoteOld moves all blocks whose fast-tier timestamps are older
+// than DemoteAge to the slow tier, except blocks promoted within
+// DemoteAge.
+func (v *TieredVolume) demoteOld(ctx context.Context) error {
+	if _, ok := v.fast.(blockDeleter); !ok && !v.cluster.Collections.BlobTrash {
+		// Blocks are removed from the fast tier using Trash.
+		return errors.New("cannot demote blocks because Collections.BlobTrash is disabled")
+	}
+	threshold := time.Now().Add(-v.DemoteAge.Duration()).UnixNano()
+	var old []string
+	err := scanIndex(v.fast, "", func(hash, line string, mtime int64) error {
+		if mtime >= threshold || !IsValidLocator(hash) {
+			return nil
+		}
+		if t, ok := v.promoted.Get(hash); ok && t.(time.Time).UnixNano() >= threshold {
+			return nil
+		}
+		old = append(old, hash)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	demoted, failed := 0, 0
+	for _, hash := range old {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ok, err := v.demote(ctx, hash)
+		if err != nil {
+			failed++
+			v.stats.TickErr(err, "demote")
+			v.logger.WithError(err).Warnf("%s: demotion to slow tier failed", hash)
+		} else if ok {
+			demoted++
+		}
+	}
+	v.logger.Infof("demotion pass finished: %d of %d old blocks demoted, %d failed", demoted, len(old), failed)
+	return nil
+}
+
+// demote copies the given block to the slow tier and removes it from
+// the fast tier. It returns false if the block was touched during
+// the migration, in which case it remains on the fast tier.
+//
+// The block is copied as stored, without checking its hash: when
+// this volume is configured with compression or encryption, the
+// stored data is compressed or encrypted. Instead, the slow-tier
+// copy is compared to the fast-tier copy before the latter is
+// removed.
+//
+// If the fast tier is a blockDeleter, the fast-tier copy is deleted
+// right away, so the space is available for new blocks. Otherwise,
+// it is trashed, and the space is freed when the trash is emptied.
+//
+// If the slow tier is an mtimeSetter, the block keeps its fast-tier
+// timestamp, so demotion does not delay garbage collection.
+// Otherwise, writing the block to the slow tier counts as touching
+// it.
+func (v *TieredVolume) demote(ctx context.Context, hash string) (bool, error) {
+	fastMtime, err := v.fast.Mtime(hash)
+	if err != nil {
+		return false, err
+	}
+	mtime := fastMtime
+	if t, err := v.slow.Mtime(hash); err == nil && t.After(mtime) {
+		// Don't set an older timestamp on an existing copy.
+		mtime = t
+	}
+	buf, ctx, err := getScratch(ctx, maxStoredBlockSize)
+	if err != nil {
+		return false, err
+	}
+	defer bufs.Put(buf)
+	n, err := v.fast.Get(withInternalRead(ctx), hash, buf)
+	if err != nil {
+		return false, err
+	}
+	err = v.slow.Put(ctx, hash, buf[:n])
+	if err != nil {
+		return false, err
+	}
+	err = v.slow.Compare(withInternalRead(ctx), hash, buf[:n])
+	if err != nil {
+		return false, fmt.Errorf("error verifying copy on slow tier: %w", err)
+	}
+	if ms, ok := v.slow.(mtimeSetter); ok {
+		err = ms.SetMtime(hash, mtime)
+		if err != nil {
+			return false, err
+		}
+	}
+	if bd, ok := v.fast.(blockDeleter); ok {
+		// Delete does nothing if the block has been written
+		// or touched since we checked its timestamp.
+		err = bd.Delete(hash, fastMtime)
+	} else {
+		// Trash does nothing if the block has been touched
+		// within BlobSigningTTL, so a concurrent Put or Touch
+		// leaves the block on the fast tier.
+		err = v.fast.Trash(hash)
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := v.fast.Mtime(hash); !os.IsNotExist(err) {
+		return false, err
+	}
+	v.stats.Tick(&v.stats.Demoted)
+	atomic.AddUint64(&v.stats.DemotedBytes, uint64(n))
+	v.migrations.With(prometheus.Labels{"direction": "demote"}).Inc()
+	v.migrationBytes.With(prometheus.Labels{"direction": "demote"}).Add(float64(n))
+	return true, nil
+}
@@ -0,0 +1,366 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	check "gopkg.in/check.v1"
+)
+
+type TestableTieredVolume struct {
+	*TieredVolume
+	fastInner *TestableUnixVolume
+	slowInner *TestableUnixVolume
+}
+
+// PutRaw stores data on the fast tier, bypassing constraints like
+// readonly.
+func (v *TestableTieredVolume) PutRaw(loc string, data []byte) {
+	v.fastInner.PutRaw(loc, data)
+}
+
+// TouchWithDate sets the timestamp of the given block on each tier
+// where it is stored.
+func (v *TestableTieredVolume) TouchWithDate(loc string, t time.Time) {
+	for _, inner := range []*TestableUnixVolume{v.fastInner, v.slowInner} {
+		if _, err := os.Stat(inner.blockPath(loc)); err == nil {
+			inner.TouchWithDate(loc, t)
+		}
+	}
+}
+
+func (v *TestableTieredVolume) Teardown() {
+	v.fastInner.Teardown()
+	v.slowInner.Teardown()
+}
+
+func (v *TestableTieredVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return "get", "put"
+}
+
+// waitForPromotion waits for any background promotion to finish.
+func (v *TestableTieredVolume) waitForPromotion() {
+	v.promoting <- struct{}{}
+	<-v.promoting
+}
+
+func (v *TestableTieredVolume) onTier(inner *TestableUnixVolume, loc string) bool {
+	_, err := os.Stat(inner.blockPath(loc))
+	return err == nil
+}
+
+var _ = check.Suite(&TieredVolumeSuite{})
+
+type TieredVolumeSuite struct{}
+
+func (s *TieredVolumeSuite) newTestableVolume(c *check.C, cluster *arvados.Cluster, volume arvados.Volume, metrics *volumeMetricsVecs, promoteReads int) *TestableTieredVolume {
+	var inner []*TestableUnixVolume
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "tiered_volume_test")
+		c.Assert(err, check.IsNil)
+		tv := &TestableUnixVolume{
+			UnixVolume: UnixVolume{
+				Root:    dir,
+				cluster: cluster,
+				logger:  ctxlog.TestLogger(c),
+				volume:  volume,
+				metrics: metrics,
+			},
+			t: c,
+		}
+		c.Assert(tv.check(), check.IsNil)
+		inner = append(inner, tv)
+	}
+	v := &TestableTieredVolume{
+		TieredVolume: &TieredVolume{
+			Fast:         arvados.Volume{Replication: 1},
+			Slow:         arvados.Volume{Replication: 2},
+			DemoteAge:    arvados.Duration(30 * 24 * time.Hour),
+			PromoteReads: promoteReads,
+			cluster:      cluster,
+			volume:       volume,
+			logger:       ctxlog.TestLogger(c),
+			metrics:      metrics,
+			fast:         inner[0],
+			slow:         inner[1],
+		},
+		fastInner: inner[0],
+		slowInner: inner[1],
+	}
+	c.Assert(v.check(), check.IsNil)
+	return v
+}
+
+func (s *TieredVolumeSuite) TestGenericVolumeTests(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics, 1)
+	})
+}
+
+func (s *TieredVolumeSuite) TestGenericVolumeTestsReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, cluster *arvados.Cluster, volume arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) TestableVolume {
+		return s.newTestableVolume(c, cluster, volume, metrics, 1)
+	})
+}
+
+func (s *TieredVolumeSuite) TestDemoteAndPromote(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	cluster.Collections.BlobTrashLifetime = 0
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), 2)
+	defer v.Teardown()
+
+	c.Assert(v.Put(ctx, TestHash, TestBlock), check.IsNil)
+	c.Assert(v.Put(ctx, TestHash2, TestBlock2), check.IsNil)
+	v.TouchWithDate(TestHash, time.Now().Add(-v.DemoteAge.Duration()-time.Hour))
+
+	// Only the old block is demoted.
+	c.Assert(v.demoteOld(ctx), check.IsNil)
+	c.Check(v.onTier(v.fastInner, TestHash), check.Equals, false)
+	c.Check(v.onTier(v.slowInner, TestHash), check.Equals, true)
+	c.Check(v.onTier(v.fastInner, TestHash2), check.Equals, true)
+	c.Check(v.onTier(v.slowInner, TestHash2), check.Equals, false)
+	c.Check(v.stats.Demoted, check.Equals, uint64(1))
+
+	// The demoted block keeps its old timestamp.
+	t, err := v.Mtime(TestHash)
+	c.Check(err, check.IsNil)
+	c.Check(time.Since(t) > v.DemoteAge.Duration(), check.Equals, true)
+	c.Check(v.stats.DemotedBytes, check.Equals, uint64(len(TestBlock)))
+	c.Check(testutil.ToFloat64(v.migrations.With(prometheus.Labels{"direction": "demote"})), check.Equals, 1.0)
+
+	// Both blocks are still readable and listed.
+	buf := make([]byte, BlockSize)
+	for _, trial := range []struct {
+		hash string
+		data []byte
+	}{{TestHash, TestBlock}, {TestHash2, TestBlock2}} {
+		n, err := v.Get(ctx, trial.hash, buf)
+		c.Check(err, check.IsNil)
+		c.Check(buf[:n], check.DeepEquals, trial.data)
+		c.Check(v.Compare(ctx, trial.hash, trial.data), check.IsNil)
+		_, err = v.Mtime(trial.hash)
+		c.Check(err, check.IsNil)
+	}
+	var idx bytes.Buffer
+	c.Assert(v.IndexTo("", &idx), check.IsNil)
+	c.Check(strings.Count(idx.String(), "\n"), check.Equals, 2)
+
+	// With PromoteReads=2, the demoted block is promoted on its
+	// second read, but remains on the slow tier too.
+	v.waitForPromotion()
+	c.Check(v.onTier(v.fastInner, TestHash), check.Equals, false)
+	_, err = v.Get(ctx, TestHash, buf)
+	c.Check(err, check.IsNil)
+	v.waitForPromotion()
+	c.Check(v.onTier(v.fastInner, TestHash), check.Equals, true)
+	c.Check(v.onTier(v.slowInner, TestHash), check.Equals, true)
+	c.Check(v.stats.Promoted, check.Equals, uint64(1))
+	c.Check(v.stats.SlowGetOps, check.Equals, uint64(2))
+	c.Check(testutil.ToFloat64(v.migrationBytes.With(prometheus.Labels{"direction": "promote"})), check.Equals, float64(len(TestBlock)))
+
+	// The promoted copy keeps the old timestamp, and is not
+	// demoted again right away.
+	t, err = v.Mtime(TestHash)
+	c.Check(err, check.IsNil)
+	c.Check(time.Since(t) > v.DemoteAge.Duration(), check.Equals, true)
+	c.Assert(v.demoteOld(ctx), check.IsNil)
+	c.Check(v.onTier(v.fastInner, TestHash), check.Equals, true)
+
+	// A block stored on both tiers is listed once.
+	idx.Reset()
+	c.Assert(v.IndexTo("", &idx), check.IsNil)
+	c.Check(strings.Count(idx.String(), "\n"), check.Equals, 2)
+
+	// Blocks that were touched recently are not demoted.
+	v.TouchWithDate(TestHash2, time.Now().Add(-v.DemoteAge.Duration()-time.Hour))
+	c.Assert(v.Touch(TestHash2), check.IsNil)
+	c.Assert(v.demoteOld(ctx), check.IsNil)
+	c.Check(v.onTier(v.fastInner, TestHash2), check.Equals, true)
+	c.Check(v.stats.Demoted, check.Equals, uint64(1))
+
+	// Trash removes the block from both tiers.
+	v.TouchWithDate(TestHash, time.Now().Add(-v.DemoteAge.Duration()))
+	c.Assert(v.Trash(TestHash), check.IsNil)
+	_, err = v.Get(ctx, TestHash, buf)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *TieredVolumeSuite) TestInternalReadsDoNotPromote(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), 1)
+	defer v.Teardown()
+	v.slowInner.PutRaw(TestHash, TestBlock)
+
+	// Scrubbing, comparing, and indexing read the block from the
+	// slow tier without promoting it.
+	mnt := &VolumeMount{KeepMount: arvados.KeepMount{UUID: "zzzzz-nyw5e-000000000000000"}, Volume: v}
+	scr := newScrubber(cluster, nil, ctxlog.TestLogger(c), prometheus.NewRegistry())
+	c.Assert(scr.scrubMount(ctx, mnt), check.IsNil)
+	c.Check(scr.Status(mnt.UUID).BlocksChecked, check.Equals, uint64(1))
+	c.Check(v.Compare(withInternalRead(ctx), TestHash, TestBlock), check.IsNil)
+	_, err := readBlockPrefix(ctx, v, TestHash, 4)
+	c.Check(err, check.IsNil)
+	v.waitForPromotion()
+	c.Check(v.onTier(v.fastInner, TestHash), check.Equals, false)
+	c.Check(v.stats.Promoted, check.Equals, uint64(0))
+
+	// A client read promotes it.
+	buf := make([]byte, BlockSize)
+	_, err = v.Get(ctx, TestHash, buf)
+	c.Check(err, check.IsNil)
+	v.waitForPromotion()
+	c.Check(v.onTier(v.fastInner, TestHash), check.Equals, true)
+	c.Check(v.stats.Promoted, check.Equals, uint64(1))
+}
+
+func (s *TieredVolumeSuite) TestDemotionStopsOnClose(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	cluster.Collections.BlobTrashLifetime = 0
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), 1)
+	defer v.Teardown()
+	v.DemoteInterval = arvados.Duration(time.Millisecond)
+	v.startDemotion()
+
+	c.Assert(v.Put(ctx, TestHash, TestBlock), check.IsNil)
+	v.TouchWithDate(TestHash, time.Now().Add(-v.DemoteAge.Duration()-time.Hour))
+	for deadline := time.Now().Add(10 * time.Second); v.onTier(v.fastInner, TestHash); time.Sleep(time.Millisecond) {
+		c.Assert(time.Now().Before(deadline), check.Equals, true)
+	}
+
+	v.Close()
+	c.Assert(v.Put(ctx, TestHash2, TestBlock2), check.IsNil)
+	v.TouchWithDate(TestHash2, time.Now().Add(-v.DemoteAge.Duration()-time.Hour))
+	time.Sleep(20 * time.Millisecond)
+	c.Check(v.onTier(v.fastInner, TestHash2), check.Equals, true)
+}
+
+func (s *TieredVolumeSuite) TestDemoteDeletesFastCopy(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	cluster.Collections.BlobTrashLifetime = arvados.Duration(24 * time.Hour)
+	v := s.newTestableVolume(c, cluster, arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), 1)
+	defer v.Teardown()
+	c.Assert(v.Put(ctx, TestHash, TestBlock), check.IsNil)
+	v.TouchWithDate(TestHash, time.Now().Add(-v.DemoteAge.Duration()-time.Hour))
+	c.Assert(v.demoteOld(ctx), check.IsNil)
+	c.Check(v.onTier(v.slowInner, TestHash), check.Equals, true)
+
+	// The fast-tier copy is deleted, not left in the trash.
+	c.Check(v.onTier(v.fastInner, TestHash), check.Equals, false)
+	c.Check(v.fastInner.Untrash(TestHash), check.NotNil)
+}
+
+func (s *TieredVolumeSuite) TestDemoteCopiesStoredData(c *check.C) {
+	ctx := context.Background()
+	v := s.newTestableVolume(c, testCluster(c), arvados.Volume{}, newVolumeMetricsVecs(prometheus.NewRegistry()), 1)
+	defer v.Teardown()
+
+	// Stored data that doesn't match its hash (as when the
+	// volume is compressed or encrypted) is copied as is.
+	v.PutRaw(TestHash, BadBlock)
+	v.TouchWithDate(TestHash, time.Now().Add(-v.DemoteAge.Duration()-time.Hour))
+	c.Assert(v.demoteOld(ctx), check.IsNil)
+	c.Check(v.onTier(v.fastInner, TestHash), check.Equals, false)
+	stored, err := ioutil.ReadFile(v.slowInner.blockPath(TestHash))
+	c.Assert(err, check.IsNil)
+	c.Check(stored, check.DeepEquals, BadBlock)
+	c.Check(v.stats.Errors, check.Equals, uint64(0))
+}
+
+func (s *TieredVolumeSuite) TestDemoteCompressed(c *check.C) {
+	ctx := context.Background()
+	cluster := testCluster(c)
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "tiered_volume_test")
+		c.Assert(err, check.IsNil)
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+	cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {
+			Driver: "Tiered",
+			DriverParameters: []byte(`{"DemoteAge":"720h","Compression":"zstd",
+				"Fast":{"Driver":"Directory","DriverParameters":{"Root":"` + dirs[0] + `"}},
+				"Slow":{"Driver":"Directory","DriverParameters":{"Root":"` + dirs[1] + `"}}}`),
+		},
+	}
+	vm, err := makeRRVolumeManager(ctxlog.TestLogger(c), cluster, testServiceURL, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Assert(err, check.IsNil)
+	defer vm.Close()
+	mnt := vm.Mounts()[0]
+	tv := mnt.Volume.(*compressedVolume).Volume.(*TieredVolume)
+
+	data := bytes.Repeat([]byte("compressible "), 100000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(mnt.Put(ctx, hash, data), check.IsNil)
+	fastPath := tv.fast.(*UnixVolume).blockPath(hash)
+	old := time.Now().Add(-tv.DemoteAge.Duration() - time.Hour)
+	c.Assert(os.Chtimes(fastPath, old, old), check.IsNil)
+	c.Assert(tv.demoteOld(ctx), check.IsNil)
+	c.Check(tv.stats.Demoted, check.Equals, uint64(1))
+	_, err = os.Stat(fastPath)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	buf := make([]byte, BlockSize)
+	n, err := mnt.Get(ctx, hash, buf)
+	c.Assert(err, check.IsNil)
+	c.Check(bytes.Equal(buf[:n], data), check.Equals, true)
+}
+
+func (s *TieredVolumeSuite) TestConfig(c *check.C) {
+	cluster := testCluster(c)
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "tiered_volume_test")
+		c.Assert(err, check.IsNil)
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+	cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {
+			Driver: "Tiered",
+			DriverParameters: []byte(`{"DemoteAge":"720h",
+				"Fast":{"Driver":"Directory","DriverParameters":{"Root":"` + dirs[0] + `"},"Replication":2},
+				"Slow":{"Driver":"Directory","DriverParameters":{"Root":"` + dirs[1] + `"},"Replication":3}}`),
+		},
+	}
+	vm, err := makeRRVolumeManager(ctxlog.TestLogger(c), cluster, testServiceURL, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Assert(err, check.IsNil)
+	c.Assert(vm.Mounts(), check.HasLen, 1)
+	c.Check(vm.Mounts()[0].Replication, check.Equals, 2)
+	c.Check(vm.Mounts()[0].String(), check.Equals, "tiered[[UnixVolume "+dirs[0]+"], [UnixVolume "+dirs[1]+"]]")
+
+	for _, trial := range []struct {
+		params string
+		err    string
+	}{
+		{`{"DemoteAge":"720h","Slow":{"Driver":"Directory","DriverParameters":{"Root":"/tmp"}}}`, `DriverParameters.Fast.Driver was not provided`},
+		{`{"DemoteAge":"720h","Fast":{"Driver":"Directory","DriverParameters":{"Root":"/tmp"}},"Slow":{"Driver":"Tiered"}}`, `DriverParameters.Slow: nested Tiered volumes are not supported`},
+		{`{"DemoteAge":"720h","Fast":{"Driver":"Directory","DriverParameters":{"Root":"/tmp"},"EncryptionKey":"foo"},"Slow":{"Driver":"Directory","DriverParameters":{"Root":"/tmp"}}}`, `DriverParameters.Fast: EncryptionKey is not supported on a backing volume.*`},
+		{`{"DemoteAge":"720h","Fast":{"Driver":"Directory","DriverParameters":{"Root":"/tmp"}},"Slow":{"Driver":"Directory","DriverParameters":{"Root":"/tmp","Compression":"gzip"}}}`, `DriverParameters.Slow: DriverParameters.Compression is not supported on a backing volume.*`},
+		{`{"Fast":{"Driver":"Directory","DriverParameters":{"Root":"/tmp"}},"Slow":{"Driver":"Directory","DriverParameters":{"Root":"/tmp"}}}`, `DriverParameters.DemoteAge must be greater than zero`},
+		{`{"DemoteAge":"1h","Fast":{"Driver":"Directory","DriverParameters":{"Root":"/tmp"}},"Slow":{"Driver":"Directory","DriverParameters":{"Root":"/tmp"}}}`, `DriverParameters.DemoteAge \(1h\) must not be less than Collections.BlobSigningTTL.*`},
+	} {
+		_, err := newTieredVolume(cluster, arvados.Volume{Driver: "Tiered", DriverParameters: []byte(trial.params)}, ctxlog.TestLogger(c), newVolumeMetricsVecs(prometheus.NewRegistry()))
+		c.Check(err, check.ErrorMatches, trial.err)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Number of tokens remembered by a tokenCache.
+	tokenCacheSize = 10000
+
+	// How long to remember the owner of a token, or that a token
+	// could not be looked up.
+	tokenCacheTTL     = 5 * time.Minute
+	tokenCacheFailTTL = time.Minute
+)
+
+// A tokenCache looks up the user and token UUIDs for API tokens
+// presented by clients, and remembers them for a while.
+//
+// Keepstore does not otherwise need to look up tokens (it only
+// verifies signatures made with them), so this is only used by
+// features like rate limiting and audit logging that need to know
+// who is making a request.
+type tokenCache struct {
+	logger logrus.FieldLogger
+
+	// lookup returns the API client authorization record for
+	// the given token.
+	lookup func(ctx context.Context, token string) (*arvados.APIClientAuthorization, error)
+
+	cache *lru.Cache // token => *tokenInfo
+
+	// Lookups in progress, so concurrent callers asking about the
+	// same token share a single API request.
+	mtx      sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+// tokenInfo describes the owner of a token. If the token could not
+// be looked up, UserUUID is empty, and TokenUUID is empty unless it
+// is part of the token itself (i.e., a v2 token).
+type tokenInfo struct {
+	UserUUID  string
+	TokenUUID string
+	expires   time.Time
+}
+
+func newTokenCache(cluster *arvados.Cluster, logger logrus.FieldLogger) *tokenCache {
+	tc := &tokenCache{logger: logger}
+	tc.cache, _ = lru.New(tokenCacheSize)
+	client, err := arvados.NewClientFromConfig(cluster)
+	if err != nil {
+		tc.lookup = func(context.Context, string) (*arvados.APIClientAuthorization, error) {
+			return nil, err
+		}
+	} else {
+		tc.lookup = func(ctx context.Context, token string) (*arvados.APIClientAuthorization, error) {
+			var aca arvados.APIClientAuthorization
+			ctx = arvados.ContextWithAuthorization(ctx, "Bearer "+token)
+			err := client.RequestAndDecodeContext(ctx, &aca, "GET", "arvados/v1/api_client_authorizations/current", nil, nil)
+			return &aca, err
+		}
+	}
+	return tc
+}
+
+// Get returns the owner of the given token. The returned value
+// must not be modified.
+func (tc *tokenCache) Get(ctx context.Context, token string) *tokenInfo {
+	for {
+		if ent, ok := tc.cache.Get(token); ok && time.Now().Before(ent.(*tokenInfo).expires) {
+			return ent.(*tokenInfo)
+		}
+		tc.mtx.Lock()
+		wait, busy := tc.inflight[token]
+		if !busy {
+			if tc.inflight == nil {
+				tc.inflight = map[string]chan struct{}{}
+			}
+			tc.inflight[token] = make(chan struct{})
+		}
+		tc.mtx.Unlock()
+		if !busy {
+			break
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return tc.unresolved(token, time.Now())
+		}
+	}
+	defer func() {
+		tc.mtx.Lock()
+		close(tc.inflight[token])
+		delete(tc.inflight, token)
+		tc.mtx.Unlock()
+	}()
+	now := time.Now()
+	ti := &tokenInfo{expires: now.Add(tokenCacheTTL)}
+	aca, err := tc.lookup(ctx, token)
+	if err != nil || aca.OwnerUUID == "" {
+		tc.logger.WithError(err).Warn("could not look up owner of token")
+		ti = tc.unresolved(token, now)
+	} else {
+		ti.UserUUID = aca.OwnerUUID
+		ti.TokenUUID = aca.UUID
+	}
+	tc.cache.Add(token, ti)
+	return ti
+}
+
+// unresolved returns a tokenInfo for a token whose owner could not
+// be looked up.
+func (tc *tokenCache) unresolved(token string, now time.Time) *tokenInfo {
+	ti := &tokenInfo{expires: now.Add(tokenCacheFailTTL)}
+	if parts := strings.Split(token, "/"); len(parts) == 3 && parts[0] == "v2" {
+		ti.TokenUUID = parts[1]
+	}
+	return ti
+}
+
+// tokenDigest returns a string that identifies the given token
+// without revealing it.
+func tokenDigest(token string) string {
+	return fmt.Sprintf("token-%x", sha256.Sum256([]byte(token)))[:22]
+}
@@ -180,6 +180,23 @@ func (v *UnixVolume) Touch(loc string) error {
 	return err
 }
 
+// SetMtime implements mtimeSetter.
+func (v *UnixVolume) SetMtime(loc string, t time.Time) error {
+	if v.volume.ReadOnly {
+		return MethodDisabledError
+	}
+	p := v.blockPath(loc)
+	if err := v.lock(context.TODO()); err != nil {
+		return err
+	}
+	defer v.unlock()
+	v.os.stats.TickOps("utimes")
+	v.os.stats.Tick(&v.os.stats.UtimesOps)
+	err := os.Chtimes(p, t, t)
+	v.os.stats.TickErr(err)
+	return err
+}
+
 // Mtime returns the stored timestamp for the given locator.
 func (v *UnixVolume) Mtime(loc string) (time.Time, error) {
 	p := v.blockPath(loc)
@@ -190,6 +207,11 @@ func (v *UnixVolume) Mtime(loc string) (time.Time, error) {
 	return fi.ModTime(), nil
 }
 
+// Serialized implements serializedVolume.
+func (v *UnixVolume) Serialized() bool {
+	return v.locker != nil
+}
+
 // Lock the locker (if one is in use), open the file for reading, and
 // call the given function if and when the file is ready to read.
 func (v *UnixVolume) getFunc(ctx context.Context, path string, fn func(io.Reader) error) error {
@@ -211,7 +233,7 @@ func (v *UnixVolume) stat(path string) (os.FileInfo, error) {
 	if err == nil {
 		if stat.Size() < 0 {
 			err = os.ErrInvalid
-		} else if stat.Size() > BlockSize {
+		} else if stat.Size() > maxStoredBlockSize {
 			err = TooLongError
 		}
 	}
@@ -475,6 +497,34 @@ func (v *UnixVolume) Trash(loc string) error {
 	return v.os.Rename(p, fmt.Sprintf("%v.trash.%d", p, time.Now().Add(v.cluster.Collections.BlobTrashLifetime.Duration()).Unix()))
 }
 
+// Delete implements blockDeleter. Like Trash, it uses lockfile() to
+// avoid racing with a concurrent Touch or Put.
+func (v *UnixVolume) Delete(loc string, notAfter time.Time) error {
+	if v.volume.ReadOnly {
+		return MethodDisabledError
+	}
+	if err := v.lock(context.TODO()); err != nil {
+		return err
+	}
+	defer v.unlock()
+	p := v.blockPath(loc)
+	f, err := v.os.OpenFile(p, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if e := v.lockfile(f); e != nil {
+		return e
+	}
+	defer v.unlockfile(f)
+	if fi, err := v.os.Stat(p); err != nil {
+		return err
+	} else if fi.ModTime().After(notAfter) {
+		return nil
+	}
+	return v.os.Remove(p)
+}
+
 // Untrash moves block from trash back into store
 // Look for path/{loc}.trash.{deadline} in storage,
 // and rename the first such file as path/{loc}
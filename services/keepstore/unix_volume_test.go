@@ -307,6 +307,18 @@ func (s *UnixVolumeSuite) TestUnixVolumeGetFuncWorkerWaitsOnMutex(c *check.C) {
 	}
 }
 
+// Data is not streamed to or from a serialized volume, so a slow
+// client can't hold the lock.
+func (s *UnixVolumeSuite) TestSerializedNotStreamed(c *check.C) {
+	v := s.newTestableUnixVolume(c, s.cluster, arvados.Volume{Replication: 1}, s.metrics, false)
+	c.Check(streamingReader(v), check.NotNil)
+	c.Check(streamingWriter(v), check.NotNil)
+
+	v = s.newTestableUnixVolume(c, s.cluster, arvados.Volume{Replication: 1}, s.metrics, true)
+	c.Check(streamingReader(v), check.IsNil)
+	c.Check(streamingWriter(v), check.IsNil)
+}
+
 func (s *UnixVolumeSuite) TestUnixVolumeCompare(c *check.C) {
 	v := s.newTestableUnixVolume(c, s.cluster, arvados.Volume{Replication: 1}, s.metrics, false)
 	defer v.Teardown()
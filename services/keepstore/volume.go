@@ -7,9 +7,12 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -231,6 +234,61 @@ type VolumeWithExamples interface {
 	Examples() []Volume
 }
 
+// A replicationReporter is a Volume that can determine its own
+// replication level, e.g., because it stores redundant data on
+// several backing volumes. Its Replication method is used when the
+// volume's Replication is not configured explicitly.
+type replicationReporter interface {
+	Replication() int
+}
+
+// A volumeCloser is a Volume that runs background goroutines, which
+// are stopped by calling Close when the volume is no longer in use.
+type volumeCloser interface {
+	Close()
+}
+
+// closeVolume calls vol.Close if vol is a volumeCloser.
+func closeVolume(vol Volume) {
+	if vc, ok := vol.(volumeCloser); ok {
+		vc.Close()
+	}
+}
+
+// An mtimeSetter is a Volume that can set a block's timestamp to an
+// arbitrary time, e.g., to preserve the timestamp of a block that is
+// copied from another volume.
+type mtimeSetter interface {
+	SetMtime(loc string, t time.Time) error
+}
+
+// A blockDeleter is a Volume that can delete a block right away,
+// bypassing the trash, e.g., to free space on a fast tier once the
+// block has been copied to a slow one. Delete does nothing if the
+// block's timestamp is later than notAfter, i.e., if it has been
+// written or touched since the caller checked it.
+type blockDeleter interface {
+	Delete(loc string, notAfter time.Time) error
+}
+
+type internalReadKey struct{}
+
+// withInternalRead returns a context indicating that blocks are
+// being read by keepstore itself (e.g., by the scrubber, or to
+// compare existing data during a write) rather than on behalf of a
+// client. Such reads do not count toward promoting a block to a
+// faster tier.
+func withInternalRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internalReadKey{}, true)
+}
+
+// isInternalRead reports whether ctx was returned by
+// withInternalRead.
+func isInternalRead(ctx context.Context) bool {
+	internal, _ := ctx.Value(internalReadKey{}).(bool)
+	return internal
+}
+
 // A VolumeManager tells callers which volumes can read, which volumes
 // can write, and on which volume the next write should be attempted.
 type VolumeManager interface {
@@ -285,21 +343,27 @@ func (*VolumeMount) generateUUID() string {
 	return fmt.Sprintf("zzzzz-ivpuk-%015s", r.Text(36))
 }
 
-// RRVolumeManager is a round-robin VolumeManager: the Nth call to
-// NextWritable returns the (N % len(writables))th writable Volume
-// (where writables are all Volumes v where v.Writable()==true).
+// RRVolumeManager is a VolumeManager that uses the configured
+// writeStrategy (round-robin by default) to choose the volume
+// returned by NextWritable.
 type RRVolumeManager struct {
 	mounts    []*VolumeMount
 	mountMap  map[string]*VolumeMount
 	readables []*VolumeMount
 	writables []*VolumeMount
-	counter   uint32
+	strategy  writeStrategy
 	iostats   map[Volume]*ioStats
+	closers   []Volume // unwrapped volumes, for Close
 }
 
 func makeRRVolumeManager(logger logrus.FieldLogger, cluster *arvados.Cluster, myURL arvados.URL, metrics *volumeMetricsVecs) (*RRVolumeManager, error) {
+	strategy, err := newWriteStrategy(cluster)
+	if err != nil {
+		return nil, err
+	}
 	vm := &RRVolumeManager{
-		iostats: make(map[Volume]*ioStats),
+		strategy: strategy,
+		iostats:  make(map[Volume]*ioStats),
 	}
 	vm.mountMap = make(map[string]*VolumeMount)
 	for uuid, cfgvol := range cluster.Volumes {
@@ -307,11 +371,22 @@ func makeRRVolumeManager(logger logrus.FieldLogger, cluster *arvados.Cluster, my
 		if !ok && len(cfgvol.AccessViaHosts) > 0 {
 			continue
 		}
-		dri, ok := driver[cfgvol.Driver]
-		if !ok {
-			return nil, fmt.Errorf("volume %s: invalid driver %q", uuid, cfgvol.Driver)
+		vol, err := newVolume(cluster, cfgvol, logger, metrics)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing volume %s: %s", uuid, err)
 		}
-		vol, err := dri(cluster, cfgvol, logger, metrics)
+		vm.closers = append(vm.closers, vol)
+		repl := cfgvol.Replication
+		if rr, ok := vol.(replicationReporter); ok && repl < 1 {
+			repl = rr.Replication()
+		}
+		if cfgvol.EncryptionKey != "" {
+			vol, err = newEncryptedVolume(cluster, cfgvol, vol)
+			if err != nil {
+				return nil, fmt.Errorf("error initializing volume %s: %s", uuid, err)
+			}
+		}
+		vol, err = newCompressedVolume(cfgvol, vol)
 		if err != nil {
 			return nil, fmt.Errorf("error initializing volume %s: %s", uuid, err)
 		}
@@ -321,7 +396,6 @@ func makeRRVolumeManager(logger logrus.FieldLogger, cluster *arvados.Cluster, my
 		if len(sc) == 0 {
 			sc = map[string]bool{"default": true}
 		}
-		repl := cfgvol.Replication
 		if repl < 1 {
 			repl = 1
 		}
@@ -346,6 +420,39 @@ func makeRRVolumeManager(logger logrus.FieldLogger, cluster *arvados.Cluster, my
 	return vm, nil
 }
 
+// checkBackingVolume returns an error if cfgvol, the configuration
+// of a backing volume of a composite volume like ErasureCoded,
+// enables encryption or compression. Those are applied to the
+// top-level volume only, so they would otherwise be silently
+// ignored.
+func checkBackingVolume(cfgvol arvados.Volume) error {
+	if cfgvol.EncryptionKey != "" {
+		return errors.New("EncryptionKey is not supported on a backing volume (configure it on the top-level volume instead)")
+	}
+	var params struct{ Compression string }
+	if len(cfgvol.DriverParameters) > 0 {
+		err := json.Unmarshal(cfgvol.DriverParameters, &params)
+		if err != nil {
+			return err
+		}
+	}
+	if c := strings.ToLower(params.Compression); c != "" && c != "none" {
+		return errors.New("DriverParameters.Compression is not supported on a backing volume (configure it on the top-level volume instead)")
+	}
+	return nil
+}
+
+// newVolume returns a new Volume using the driver specified in
+// cfgvol. Composite drivers, like ErasureCoded, use it to set up
+// their backing volumes.
+func newVolume(cluster *arvados.Cluster, cfgvol arvados.Volume, logger logrus.FieldLogger, metrics *volumeMetricsVecs) (Volume, error) {
+	dri, ok := driver[cfgvol.Driver]
+	if !ok {
+		return nil, fmt.Errorf("invalid driver %q", cfgvol.Driver)
+	}
+	return dri(cluster, cfgvol, logger, metrics)
+}
+
 func (vm *RRVolumeManager) Mounts() []*VolumeMount {
 	return vm.mounts
 }
@@ -369,11 +476,21 @@ func (vm *RRVolumeManager) AllWritable() []*VolumeMount {
 
 // NextWritable returns the next writable
 func (vm *RRVolumeManager) NextWritable() *VolumeMount {
-	if len(vm.writables) == 0 {
-		return nil
+	return vm.strategy.Next(vm.writables)
+}
+
+// WriteFinished records the outcome of a Put on the given mount, so
+// it can be taken into account when choosing future write targets.
+func (vm *RRVolumeManager) WriteFinished(mnt *VolumeMount, size int, elapsed time.Duration, err error) {
+	if st := vm.iostats[mnt.Volume]; st != nil {
+		atomic.AddUint64(&st.PutOps, 1)
+		if err != nil {
+			atomic.AddUint64(&st.Errors, 1)
+		} else {
+			atomic.AddUint64(&st.InBytes, uint64(size))
+		}
 	}
-	i := atomic.AddUint32(&vm.counter, 1)
-	return vm.writables[i%uint32(len(vm.writables))]
+	vm.strategy.Observe(mnt, size, elapsed, err)
 }
 
 // VolumeStats returns an ioStats for the given volume.
@@ -381,8 +498,12 @@ func (vm *RRVolumeManager) VolumeStats(v Volume) *ioStats {
 	return vm.iostats[v]
 }
 
-// Close the RRVolumeManager
+// Close the RRVolumeManager, stopping any background work done by
+// its volumes.
 func (vm *RRVolumeManager) Close() {
+	for _, vol := range vm.closers {
+		closeVolume(vol)
+	}
 }
 
 // VolumeStatus describes the current condition of a volume
@@ -391,6 +512,10 @@ type VolumeStatus struct {
 	DeviceNum  uint64
 	BytesFree  uint64
 	BytesUsed  uint64
+
+	// BytesFree is a placeholder, not the real free space (e.g.,
+	// the volume is backed by cloud storage)
+	freeUnknown bool
 }
 
 // ioStats tracks I/O statistics for a volume or server
@@ -50,6 +50,7 @@ func DoGenericVolumeTests(t TB, readonly bool, factory TestableVolumeFactory) {
 
 	s.testGet(t, factory)
 	s.testGetNoSuchBlock(t, factory)
+	s.testReadBlockPrefix(t, factory)
 
 	s.testCompareNonexistent(t, factory)
 	s.testCompareSameContent(t, factory, TestHash, TestBlock)
@@ -144,6 +145,39 @@ func (s *genericVolumeSuite) testGet(t TB, factory TestableVolumeFactory) {
 	}
 }
 
+// readBlockPrefix should return the beginning of the block, or the
+// whole block if it is shorter than requested.
+func (s *genericVolumeSuite) testReadBlockPrefix(t TB, factory TestableVolumeFactory) {
+	s.setup(t)
+	v := s.newVolume(t, factory)
+	defer v.Teardown()
+
+	v.PutRaw(TestHash, TestBlock)
+	v.PutRaw(EmptyHash, EmptyBlock)
+
+	for _, trial := range []struct {
+		loc    string
+		n      int
+		expect []byte
+	}{
+		{TestHash, 5, TestBlock[:5]},
+		{TestHash, len(TestBlock), TestBlock},
+		{TestHash, len(TestBlock) + 10, TestBlock},
+		{EmptyHash, 5, EmptyBlock},
+	} {
+		buf, err := readBlockPrefix(context.Background(), v, trial.loc, trial.n)
+		if err != nil {
+			t.Errorf("readBlockPrefix(%s, %d): %s", trial.loc, trial.n, err)
+		} else if !bytes.Equal(buf, trial.expect) {
+			t.Errorf("readBlockPrefix(%s, %d): expected %q, got %q", trial.loc, trial.n, trial.expect, buf)
+		}
+	}
+
+	if _, err := readBlockPrefix(context.Background(), v, TestHash2, 5); !os.IsNotExist(err) {
+		t.Errorf("readBlockPrefix(%s): expected ErrNotExist, got %v", TestHash2, err)
+	}
+}
+
 // Invoke get on a block that does not exist in volume; should result in error
 // Test should pass for both writable and read-only volumes
 func (s *genericVolumeSuite) testGetNoSuchBlock(t TB, factory TestableVolumeFactory) {
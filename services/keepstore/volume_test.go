@@ -257,7 +257,12 @@ func (v *MockVolume) Status() *VolumeStatus {
 	for _, block := range v.Store {
 		used = used + uint64(len(block))
 	}
-	return &VolumeStatus{"/bogo", 123, 1000000 - used, used}
+	return &VolumeStatus{
+		MountPoint: "/bogo",
+		DeviceNum:  123,
+		BytesFree:  1000000 - used,
+		BytesUsed:  used,
+	}
 }
 
 func (v *MockVolume) String() string {
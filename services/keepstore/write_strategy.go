@@ -0,0 +1,232 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// A writeStrategy chooses the mount where the next new block should
+// be written.
+type writeStrategy interface {
+	// Next returns one of the given writable mounts, or nil if
+	// the caller should try all of them in order.
+	Next(writables []*VolumeMount) *VolumeMount
+
+	// Observe records the outcome of a write of size bytes to
+	// mnt.
+	Observe(mnt *VolumeMount, size int, elapsed time.Duration, err error)
+}
+
+var writeStrategies = map[string]func(*arvados.Cluster) writeStrategy{
+	"":           func(*arvados.Cluster) writeStrategy { return &roundRobinStrategy{} },
+	"roundrobin": func(*arvados.Cluster) writeStrategy { return &roundRobinStrategy{} },
+	"weighted":   newWeightedStrategy,
+}
+
+func newWriteStrategy(cluster *arvados.Cluster) (writeStrategy, error) {
+	mk, ok := writeStrategies[cluster.Collections.BlobWriteStrategy]
+	if !ok {
+		return nil, fmt.Errorf("invalid Collections.BlobWriteStrategy %q", cluster.Collections.BlobWriteStrategy)
+	}
+	return mk(cluster), nil
+}
+
+// roundRobinStrategy returns the (N % len(writables))th writable
+// mount on the Nth call to Next.
+type roundRobinStrategy struct {
+	counter uint32
+}
+
+func (rr *roundRobinStrategy) Next(writables []*VolumeMount) *VolumeMount {
+	if len(writables) == 0 {
+		return nil
+	}
+	i := atomic.AddUint32(&rr.counter, 1)
+	return writables[i%uint32(len(writables))]
+}
+
+func (rr *roundRobinStrategy) Observe(*VolumeMount, int, time.Duration, error) {}
+
+const (
+	// Weight given to the most recent write when updating a
+	// mount's error rate and latency averages.
+	weightedStrategyDecay = 0.1
+
+	// Minimum fraction of its capacity-based weight given to a
+	// mount with a high error rate, so it still gets an
+	// occasional write and can recover.
+	weightedStrategyMinHealth = 0.01
+
+	// How long to use a mount's Status() before calling it again.
+	weightedStrategyStatusTTL = 10 * time.Second
+)
+
+// weightedStrategy chooses a mount at random, with probability
+// proportional to its free space, adjusted for its recent error rate
+// and write latency (per byte written). Mounts that are more than
+// fillThreshold full are skipped unless all mounts are.
+//
+// Mounts that don't report their real free space (e.g., cloud
+// storage volumes) are given the average free space of the others.
+type weightedStrategy struct {
+	fillThreshold float64
+
+	health map[*VolumeMount]*mountHealth
+	rand   *rand.Rand
+	mtx    sync.Mutex
+}
+
+type mountHealth struct {
+	status     *VolumeStatus
+	statusTime time.Time
+	errorRate  float64 // moving average of write failures (0..1)
+	latency    float64 // moving average of successful write time, in seconds per byte
+}
+
+func newWeightedStrategy(cluster *arvados.Cluster) writeStrategy {
+	return &weightedStrategy{
+		fillThreshold: cluster.Collections.BlobWriteFillThreshold,
+		health:        map[*VolumeMount]*mountHealth{},
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (ws *weightedStrategy) Next(writables []*VolumeMount) *VolumeMount {
+	if len(writables) == 0 {
+		return nil
+	}
+	ws.refreshStatus(writables)
+
+	ws.mtx.Lock()
+	defer ws.mtx.Unlock()
+	var sumLatency float64
+	var nLatency int
+	for _, mnt := range writables {
+		if h := ws.health[mnt]; h.latency > 0 {
+			sumLatency += h.latency
+			nLatency++
+		}
+	}
+	// Mounts that don't report their capacity get the average
+	// weight of the others.
+	var sumFree float64
+	var nFree int
+	for _, mnt := range writables {
+		if st := ws.health[mnt].status; st != nil && !st.freeUnknown {
+			sumFree += float64(st.BytesFree)
+			nFree++
+		}
+	}
+	defaultFree := 1.0
+	if nFree > 0 {
+		defaultFree = sumFree / float64(nFree)
+	}
+
+	weights := make([]float64, len(writables))
+	var total, totalNotFull float64
+	full := make([]bool, len(writables))
+	for i, mnt := range writables {
+		h := ws.health[mnt]
+		w := defaultFree
+		if st := h.status; st != nil && !st.freeUnknown {
+			w = float64(st.BytesFree)
+			if size := st.BytesFree + st.BytesUsed; ws.fillThreshold > 0 && size > 0 && float64(st.BytesUsed)/float64(size) >= ws.fillThreshold {
+				full[i] = true
+			}
+		}
+		if health := 1 - h.errorRate; health > weightedStrategyMinHealth {
+			w *= health
+		} else {
+			w *= weightedStrategyMinHealth
+		}
+		if nLatency > 0 && h.latency > 0 {
+			if avg := sumLatency / float64(nLatency); h.latency > avg {
+				w *= avg / h.latency
+			}
+		}
+		weights[i] = w
+		total += w
+		if !full[i] {
+			totalNotFull += w
+		}
+	}
+	skipFull := totalNotFull > 0
+	if skipFull {
+		total = totalNotFull
+	}
+	if total <= 0 {
+		return nil
+	}
+	x := ws.rand.Float64() * total
+	var chosen *VolumeMount
+	for i, mnt := range writables {
+		if skipFull && full[i] {
+			continue
+		}
+		chosen = mnt
+		if x -= weights[i]; x < 0 {
+			break
+		}
+	}
+	return chosen
+}
+
+// refreshStatus calls Status() on any mounts whose status is more
+// than weightedStrategyStatusTTL old. The mutex is not held while
+// calling Status(), which can be slow on some volume types.
+func (ws *weightedStrategy) refreshStatus(writables []*VolumeMount) {
+	var stale []*VolumeMount
+	ws.mtx.Lock()
+	for _, mnt := range writables {
+		h, ok := ws.health[mnt]
+		if !ok {
+			h = &mountHealth{}
+			ws.health[mnt] = h
+		}
+		if time.Since(h.statusTime) > weightedStrategyStatusTTL {
+			stale = append(stale, mnt)
+			// Prevent other goroutines from refreshing
+			// the same mount concurrently.
+			h.statusTime = time.Now()
+		}
+	}
+	ws.mtx.Unlock()
+	for _, mnt := range stale {
+		st := mnt.Status()
+		ws.mtx.Lock()
+		ws.health[mnt].status = st
+		ws.mtx.Unlock()
+	}
+}
+
+func (ws *weightedStrategy) Observe(mnt *VolumeMount, size int, elapsed time.Duration, err error) {
+	ws.mtx.Lock()
+	defer ws.mtx.Unlock()
+	h, ok := ws.health[mnt]
+	if !ok {
+		h = &mountHealth{}
+		ws.health[mnt] = h
+	}
+	failed := 0.0
+	if err != nil {
+		failed = 1
+	}
+	h.errorRate += weightedStrategyDecay * (failed - h.errorRate)
+	if err == nil && size > 0 {
+		latency := elapsed.Seconds() / float64(size)
+		if h.latency == 0 {
+			h.latency = latency
+		} else {
+			h.latency += weightedStrategyDecay * (latency - h.latency)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&WriteStrategySuite{})
+
+type WriteStrategySuite struct {
+	cluster *arvados.Cluster
+}
+
+func (s *WriteStrategySuite) SetUpTest(c *check.C) {
+	s.cluster = testCluster(c)
+	s.cluster.Collections.BlobWriteStrategy = "weighted"
+	s.cluster.Collections.BlobWriteFillThreshold = 0.9
+}
+
+// statusVolume is a stub Volume that only implements Status.
+type statusVolume struct {
+	Volume
+	status *VolumeStatus
+}
+
+func (v *statusVolume) Status() *VolumeStatus { return v.status }
+
+func (s *WriteStrategySuite) mounts(statuses ...*VolumeStatus) []*VolumeMount {
+	var mnts []*VolumeMount
+	for _, st := range statuses {
+		mnts = append(mnts, &VolumeMount{Volume: &statusVolume{status: st}})
+	}
+	return mnts
+}
+
+// choose calls Next n times and returns the number of times each
+// mount was chosen.
+func (s *WriteStrategySuite) choose(ws writeStrategy, mnts []*VolumeMount, n int) []int {
+	counts := make([]int, len(mnts))
+	for i := 0; i < n; i++ {
+		chosen := ws.Next(mnts)
+		for j, mnt := range mnts {
+			if mnt == chosen {
+				counts[j]++
+			}
+		}
+	}
+	return counts
+}
+
+func (s *WriteStrategySuite) TestRoundRobin(c *check.C) {
+	s.cluster.Collections.BlobWriteStrategy = ""
+	ws, err := newWriteStrategy(s.cluster)
+	c.Assert(err, check.IsNil)
+	mnts := s.mounts(nil, nil, nil)
+	c.Check(s.choose(ws, mnts, 30), check.DeepEquals, []int{10, 10, 10})
+	c.Check(ws.Next(nil), check.IsNil)
+}
+
+func (s *WriteStrategySuite) TestInvalidStrategy(c *check.C) {
+	s.cluster.Collections.BlobWriteStrategy = "bogus"
+	_, err := makeRRVolumeManager(ctxlog.TestLogger(c), s.cluster, testServiceURL, newVolumeMetricsVecs(prometheus.NewRegistry()))
+	c.Check(err, check.ErrorMatches, `invalid Collections.BlobWriteStrategy "bogus"`)
+}
+
+func (s *WriteStrategySuite) TestFreeSpace(c *check.C) {
+	ws := newWeightedStrategy(s.cluster)
+	mnts := s.mounts(
+		&VolumeStatus{BytesFree: 1 << 30, BytesUsed: 1 << 30},
+		&VolumeStatus{BytesFree: 3 << 30, BytesUsed: 1 << 30},
+		nil, // unknown capacity: treated as average (2 GiB)
+	)
+	counts := s.choose(ws, mnts, 6000)
+	c.Logf("counts %v", counts)
+	c.Check(counts[0] > 700 && counts[0] < 1300, check.Equals, true)
+	c.Check(counts[1] > 2700 && counts[1] < 3300, check.Equals, true)
+	c.Check(counts[2] > 1700 && counts[2] < 2300, check.Equals, true)
+}
+
+func (s *WriteStrategySuite) TestPlaceholderFreeSpace(c *check.C) {
+	ws := newWeightedStrategy(s.cluster)
+	mnts := s.mounts(
+		&VolumeStatus{BytesFree: 1 << 30, BytesUsed: 1 << 30},
+		&VolumeStatus{BytesFree: 3 << 30, BytesUsed: 1 << 30},
+		// cloud storage: treated as average (2 GiB)
+		(&S3Volume{}).Status(),
+	)
+	counts := s.choose(ws, mnts, 6000)
+	c.Logf("counts %v", counts)
+	c.Check(counts[0] > 700 && counts[0] < 1300, check.Equals, true)
+	c.Check(counts[1] > 2700 && counts[1] < 3300, check.Equals, true)
+	c.Check(counts[2] > 1700 && counts[2] < 2300, check.Equals, true)
+
+	// If no mount reports its real free space, they are chosen
+	// equally.
+	mnts = s.mounts((&S3Volume{}).Status(), (&GCSVolume{}).Status())
+	counts = s.choose(ws, mnts, 1000)
+	c.Logf("counts %v", counts)
+	c.Check(counts[0] > 400 && counts[0] < 600, check.Equals, true)
+}
+
+func (s *WriteStrategySuite) TestFillThreshold(c *check.C) {
+	ws := newWeightedStrategy(s.cluster)
+	mnts := s.mounts(
+		&VolumeStatus{BytesFree: 5 << 30, BytesUsed: 95 << 30},
+		&VolumeStatus{BytesFree: 1 << 30, BytesUsed: 1 << 30},
+	)
+	c.Check(s.choose(ws, mnts, 100), check.DeepEquals, []int{0, 100})
+
+	// When all mounts are over the threshold, write to them
+	// anyway.
+	mnts = s.mounts(
+		&VolumeStatus{BytesFree: 5 << 30, BytesUsed: 95 << 30},
+		&VolumeStatus{BytesFree: 1 << 30, BytesUsed: 99 << 30},
+	)
+	counts := s.choose(ws, mnts, 600)
+	c.Check(counts[0] > 400, check.Equals, true)
+	c.Check(counts[1] > 50, check.Equals, true)
+
+	// Nothing is chosen if no mount has any free space.
+	mnts = s.mounts(
+		&VolumeStatus{BytesFree: 0, BytesUsed: 1 << 30},
+	)
+	c.Check(ws.Next(mnts), check.IsNil)
+}
+
+func (s *WriteStrategySuite) TestErrorsAndLatency(c *check.C) {
+	ws := newWeightedStrategy(s.cluster)
+	st := &VolumeStatus{BytesFree: 1 << 30, BytesUsed: 1 << 30}
+	mnts := s.mounts(st, st, st)
+	for i := 0; i < 50; i++ {
+		ws.Observe(mnts[0], BlockSize, time.Millisecond, errors.New("failed"))
+		ws.Observe(mnts[1], BlockSize, 10*time.Millisecond, nil)
+		ws.Observe(mnts[2], BlockSize, 30*time.Millisecond, nil)
+	}
+	counts := s.choose(ws, mnts, 1000)
+	c.Logf("counts %v", counts)
+	// mnts[0] has a ~99% error rate.
+	c.Check(counts[0] < 50, check.Equals, true)
+	// mnts[2] is slower than average (20ms), so it gets ~2/3 as
+	// many writes as mnts[1].
+	c.Check(counts[1] > counts[2]*5/4, check.Equals, true)
+	c.Check(counts[2] > 250, check.Equals, true)
+
+	// After the errors stop, mnts[0] recovers.
+	for i := 0; i < 100; i++ {
+		ws.Observe(mnts[0], BlockSize, 10*time.Millisecond, nil)
+	}
+	counts = s.choose(ws, mnts, 1000)
+	c.Logf("counts %v", counts)
+	c.Check(counts[0] > 250, check.Equals, true)
+}
+
+func (s *WriteStrategySuite) TestLatencyPerByte(c *check.C) {
+	ws := newWeightedStrategy(s.cluster)
+	st := &VolumeStatus{BytesFree: 1 << 30, BytesUsed: 1 << 30}
+	mnts := s.mounts(st, st)
+	for i := 0; i < 50; i++ {
+		// mnts[0] takes longer per write, but only because it
+		// is writing larger blocks.
+		ws.Observe(mnts[0], BlockSize, 40*time.Millisecond, nil)
+		ws.Observe(mnts[1], BlockSize/64, 10*time.Millisecond, nil)
+		// Empty blocks don't affect latency.
+		ws.Observe(mnts[0], 0, time.Second, nil)
+	}
+	counts := s.choose(ws, mnts, 1000)
+	c.Logf("counts %v", counts)
+	// mnts[1] is ~16x slower per byte, i.e., ~2x slower than
+	// average, so it gets ~1/2 as many writes as mnts[0].
+	c.Check(counts[0] > counts[1]*3/2, check.Equals, true)
+	c.Check(counts[1] > 200, check.Equals, true)
+}